@@ -0,0 +1,129 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+
+	"github.com/grafana/grafana/pkg/api/response"
+	"github.com/grafana/grafana/pkg/services/annotations"
+	"github.com/grafana/grafana/pkg/services/annotations/accesscontrol"
+	"github.com/grafana/grafana/pkg/services/annotations/annotationsimpl/loki"
+	contextmodel "github.com/grafana/grafana/pkg/services/contexthandler/model"
+	"github.com/grafana/grafana/pkg/web"
+)
+
+// defaultStateHistoryRange is the time range of the state history admin endpoints when the request has none.
+const defaultStateHistoryRange = 24 * time.Hour
+
+// stateHistoryStore is the store of the state history of alerts in Loki, read by the state history admin endpoints.
+type stateHistoryStore interface {
+	GetAnnotationSizeStats(ctx context.Context, orgID int64, from, to time.Time) (loki.SizeStats, error)
+	GetTransitionAnnotationsByThrottleKey(ctx context.Context, orgID int64, throttleKey string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error)
+	OrgAccessResources(ctx context.Context, orgID int64) (*accesscontrol.AccessResources, error)
+	Ping(ctx context.Context) error
+}
+
+// stateHistoryRepository is implemented by annotation repositories that read the state history of alerts from Loki.
+type stateHistoryRepository interface {
+	StateHistoryStore() *loki.LokiHistorianStore
+}
+
+// setStateHistoryStore sets the state history store of the server, if the annotation repository reads the
+// state history from Loki.
+func (hs *HTTPServer) setStateHistoryStore() {
+	repo, ok := hs.annotationsRepo.(stateHistoryRepository)
+	if !ok {
+		return
+	}
+	if store := repo.StateHistoryStore(); store != nil {
+		hs.stateHistoryStore = store
+	}
+}
+
+// GetOrgAnnotationSizeStats returns the size of the state history that an org stored in Loki, between the from and
+// to query parameters, in epoch milliseconds. The time range defaults to the last 24 hours.
+func (hs *HTTPServer) GetOrgAnnotationSizeStats(c *contextmodel.ReqContext) response.Response {
+	orgID, err := strconv.ParseInt(web.Params(c.Req)[":orgId"], 10, 64)
+	if err != nil {
+		return response.Error(http.StatusBadRequest, "orgId is invalid", err)
+	}
+	if hs.stateHistoryStore == nil {
+		return response.Error(http.StatusNotFound, "State history is not stored in Loki", nil)
+	}
+	from, to := stateHistoryTimeRange(c)
+
+	stats, err := hs.stateHistoryStore.GetAnnotationSizeStats(c.Req.Context(), orgID, from, to)
+	if err != nil {
+		return response.ErrOrFallback(http.StatusInternalServerError, "Failed to get annotation size stats", err)
+	}
+
+	return response.JSON(http.StatusOK, stats)
+}
+
+// GetOrgAnnotationsByThrottleKey returns the state history of the alerts of an org whose notifications were throttled
+// by the Alertmanager group key of the throttleKey query parameter, between the from and to query parameters,
+// in epoch milliseconds. The time range defaults to the last 24 hours.
+func (hs *HTTPServer) GetOrgAnnotationsByThrottleKey(c *contextmodel.ReqContext) response.Response {
+	orgID, err := strconv.ParseInt(web.Params(c.Req)[":orgId"], 10, 64)
+	if err != nil {
+		return response.Error(http.StatusBadRequest, "orgId is invalid", err)
+	}
+	throttleKey := c.Query("throttleKey")
+	if throttleKey == "" {
+		return response.Error(http.StatusBadRequest, "throttleKey is required", nil)
+	}
+	if hs.stateHistoryStore == nil {
+		return response.Error(http.StatusNotFound, "State history is not stored in Loki", nil)
+	}
+	from, to := stateHistoryTimeRange(c)
+
+	// Only server admins can call this endpoint, and they can read all annotations of any org.
+	resources, err := hs.stateHistoryStore.OrgAccessResources(c.Req.Context(), orgID)
+	if err != nil {
+		return response.ErrOrFallback(http.StatusInternalServerError, "Failed to get annotations", err)
+	}
+	items, err := hs.stateHistoryStore.GetTransitionAnnotationsByThrottleKey(c.Req.Context(), orgID, throttleKey, from, to, resources)
+	if err != nil {
+		return response.ErrOrFallback(http.StatusInternalServerError, "Failed to get annotations", err)
+	}
+
+	return response.JSON(http.StatusOK, items)
+}
+
+// CheckStateHistoryHealth checks that Loki, which stores the state history of alerts, can be reached. The response
+// has the same format as the health check of data sources.
+func (hs *HTTPServer) CheckStateHistoryHealth(c *contextmodel.ReqContext) response.Response {
+	if hs.stateHistoryStore == nil {
+		return response.Error(http.StatusNotFound, "State history is not stored in Loki", nil)
+	}
+
+	if err := hs.stateHistoryStore.Ping(c.Req.Context()); err != nil {
+		hs.log.Warn("State history health check failed", "error", err)
+		return response.JSON(http.StatusBadRequest, map[string]any{
+			"status":  backend.HealthStatusError.String(),
+			"message": "Failed to connect to Loki: " + err.Error(),
+		})
+	}
+
+	return response.JSON(http.StatusOK, map[string]any{
+		"status":  backend.HealthStatusOk.String(),
+		"message": "Loki is reachable",
+	})
+}
+
+// stateHistoryTimeRange returns the time range of a state history request, from its from and to query parameters.
+func stateHistoryTimeRange(c *contextmodel.ReqContext) (time.Time, time.Time) {
+	to := time.Now()
+	if ms := c.QueryInt64("to"); ms > 0 {
+		to = time.UnixMilli(ms)
+	}
+	from := to.Add(-defaultStateHistoryRange)
+	if ms := c.QueryInt64("from"); ms > 0 {
+		from = time.UnixMilli(ms)
+	}
+	return from, to
+}
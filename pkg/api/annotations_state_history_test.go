@@ -0,0 +1,201 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/annotations"
+	"github.com/grafana/grafana/pkg/services/annotations/accesscontrol"
+	"github.com/grafana/grafana/pkg/services/annotations/annotationsimpl/loki"
+	"github.com/grafana/grafana/pkg/services/org"
+	"github.com/grafana/grafana/pkg/services/user"
+	"github.com/grafana/grafana/pkg/web/webtest"
+)
+
+type fakeStateHistoryStore struct {
+	stats loki.SizeStats
+	items []*annotations.ItemDTO
+	err   error
+
+	orgID       int64
+	throttleKey string
+	from, to    time.Time
+	resources   *accesscontrol.AccessResources
+}
+
+func (f *fakeStateHistoryStore) GetAnnotationSizeStats(_ context.Context, orgID int64, from, to time.Time) (loki.SizeStats, error) {
+	f.orgID, f.from, f.to = orgID, from, to
+	return f.stats, f.err
+}
+
+func (f *fakeStateHistoryStore) Ping(context.Context) error {
+	return f.err
+}
+
+func (f *fakeStateHistoryStore) GetTransitionAnnotationsByThrottleKey(_ context.Context, orgID int64, throttleKey string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	f.orgID, f.throttleKey, f.from, f.to, f.resources = orgID, throttleKey, from, to, resources
+	return f.items, f.err
+}
+
+func (f *fakeStateHistoryStore) OrgAccessResources(_ context.Context, orgID int64) (*accesscontrol.AccessResources, error) {
+	return &accesscontrol.AccessResources{Dashboards: map[string]int64{"dash": orgID}, CanAccessDashAnnotations: true, CanAccessOrgAnnotations: true}, nil
+}
+
+func TestAPI_StateHistory(t *testing.T) {
+	admin := &user.SignedInUser{UserID: 1, OrgID: 1, OrgRole: org.RoleAdmin, IsGrafanaAdmin: true}
+	orgAdmin := &user.SignedInUser{UserID: 2, OrgID: 1, OrgRole: org.RoleAdmin}
+
+	t.Run("GET /api/orgs/:orgId/annotations/stats", func(t *testing.T) {
+		store := &fakeStateHistoryStore{stats: loki.SizeStats{
+			TotalBytes:     300,
+			EntryCount:     3,
+			AvgEntryBytes:  100,
+			TopRulesBySize: []loki.RuleStorageUsage{{RuleUID: "rule-1", Bytes: 200}, {RuleUID: "rule-2", Bytes: 100}},
+		}}
+		server := SetupAPITestServer(t, func(hs *HTTPServer) {
+			hs.stateHistoryStore = store
+		})
+
+		t.Run("should return the stats of the org to server admins", func(t *testing.T) {
+			req := webtest.RequestWithSignedInUser(server.NewGetRequest("/api/orgs/2/annotations/stats?from=1000&to=61000"), admin)
+			res, err := server.Send(req)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, res.Body.Close()) })
+			require.Equal(t, http.StatusOK, res.StatusCode)
+
+			var stats loki.SizeStats
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&stats))
+			assert.Equal(t, store.stats, stats)
+			assert.Equal(t, int64(2), store.orgID)
+			assert.Equal(t, time.UnixMilli(1000), store.from)
+			assert.Equal(t, time.UnixMilli(61000), store.to)
+		})
+
+		t.Run("should default to the last day", func(t *testing.T) {
+			req := webtest.RequestWithSignedInUser(server.NewGetRequest("/api/orgs/1/annotations/stats"), admin)
+			res, err := server.Send(req)
+			require.NoError(t, err)
+			require.NoError(t, res.Body.Close())
+			require.Equal(t, http.StatusOK, res.StatusCode)
+			assert.Equal(t, defaultStateHistoryRange, store.to.Sub(store.from))
+		})
+
+		t.Run("should deny access to other users", func(t *testing.T) {
+			req := webtest.RequestWithSignedInUser(server.NewGetRequest("/api/orgs/1/annotations/stats"), orgAdmin)
+			res, err := server.Send(req)
+			require.NoError(t, err)
+			require.NoError(t, res.Body.Close())
+			require.Equal(t, http.StatusForbidden, res.StatusCode)
+		})
+
+		t.Run("should return the status of store errors", func(t *testing.T) {
+			store.err = loki.ErrLokiStoreBadRequest.Errorf("time range is too short")
+			t.Cleanup(func() { store.err = nil })
+
+			req := webtest.RequestWithSignedInUser(server.NewGetRequest("/api/orgs/1/annotations/stats?from=1000&to=1000"), admin)
+			res, err := server.Send(req)
+			require.NoError(t, err)
+			require.NoError(t, res.Body.Close())
+			require.Equal(t, http.StatusBadRequest, res.StatusCode)
+		})
+	})
+
+	t.Run("GET /api/orgs/:orgId/annotations/throttled", func(t *testing.T) {
+		store := &fakeStateHistoryStore{items: []*annotations.ItemDTO{{ID: 1, AlertID: 1}, {ID: 2, AlertID: 2}}}
+		server := SetupAPITestServer(t, func(hs *HTTPServer) {
+			hs.stateHistoryStore = store
+		})
+
+		t.Run("should return the annotations of the throttle key to server admins", func(t *testing.T) {
+			req := webtest.RequestWithSignedInUser(server.NewGetRequest("/api/orgs/2/annotations/throttled?throttleKey=%7B%7D%3A%7Bteam%3D%22a%22%7D&from=1000&to=61000"), admin)
+			res, err := server.Send(req)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, res.Body.Close()) })
+			require.Equal(t, http.StatusOK, res.StatusCode)
+
+			var items []*annotations.ItemDTO
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&items))
+			require.Len(t, items, 2)
+			assert.Equal(t, int64(1), items[0].ID)
+			assert.Equal(t, int64(2), store.orgID)
+			assert.Equal(t, `{}:{team="a"}`, store.throttleKey)
+			assert.Equal(t, time.UnixMilli(1000), store.from)
+			assert.Equal(t, time.UnixMilli(61000), store.to)
+			assert.Equal(t, map[string]int64{"dash": 2}, store.resources.Dashboards)
+		})
+
+		t.Run("should require a throttle key", func(t *testing.T) {
+			req := webtest.RequestWithSignedInUser(server.NewGetRequest("/api/orgs/1/annotations/throttled"), admin)
+			res, err := server.Send(req)
+			require.NoError(t, err)
+			require.NoError(t, res.Body.Close())
+			require.Equal(t, http.StatusBadRequest, res.StatusCode)
+		})
+
+		t.Run("should deny access to other users", func(t *testing.T) {
+			req := webtest.RequestWithSignedInUser(server.NewGetRequest("/api/orgs/1/annotations/throttled?throttleKey=key"), orgAdmin)
+			res, err := server.Send(req)
+			require.NoError(t, err)
+			require.NoError(t, res.Body.Close())
+			require.Equal(t, http.StatusForbidden, res.StatusCode)
+		})
+	})
+
+	t.Run("GET /api/admin/state-history/health", func(t *testing.T) {
+		store := &fakeStateHistoryStore{}
+		server := SetupAPITestServer(t, func(hs *HTTPServer) {
+			hs.log = log.NewNopLogger()
+			hs.stateHistoryStore = store
+		})
+		check := func(t *testing.T, user *user.SignedInUser) (int, map[string]string) {
+			t.Helper()
+			req := webtest.RequestWithSignedInUser(server.NewGetRequest("/api/admin/state-history/health"), user)
+			res, err := server.Send(req)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, res.Body.Close()) })
+			body := map[string]string{}
+			if res.StatusCode != http.StatusForbidden {
+				require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+			}
+			return res.StatusCode, body
+		}
+
+		t.Run("should report a reachable Loki", func(t *testing.T) {
+			code, body := check(t, admin)
+			require.Equal(t, http.StatusOK, code)
+			assert.Equal(t, "OK", body["status"])
+		})
+
+		t.Run("should report an unavailable Loki", func(t *testing.T) {
+			store.err = loki.ErrLokiUnavailable.Errorf("failed to ping loki: received status 503")
+			t.Cleanup(func() { store.err = nil })
+
+			code, body := check(t, admin)
+			require.Equal(t, http.StatusBadRequest, code)
+			assert.Equal(t, "ERROR", body["status"])
+			assert.Contains(t, body["message"], "503")
+		})
+
+		t.Run("should deny access to other users", func(t *testing.T) {
+			code, _ := check(t, orgAdmin)
+			require.Equal(t, http.StatusForbidden, code)
+		})
+	})
+
+	t.Run("should return not found if the state history is not stored in Loki", func(t *testing.T) {
+		server := SetupAPITestServer(t)
+
+		req := webtest.RequestWithSignedInUser(server.NewGetRequest("/api/orgs/1/annotations/stats"), admin)
+		res, err := server.Send(req)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusNotFound, res.StatusCode)
+	})
+}
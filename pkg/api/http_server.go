@@ -207,6 +207,7 @@ type HTTPServer struct {
 	teamService          team.Service
 	accesscontrolService accesscontrol.Service
 	annotationsRepo      annotations.Repository
+	stateHistoryStore    stateHistoryStore
 	tagService           tag.Service
 	oauthTokenService    oauthtoken.OAuthTokenService
 	statsService         stats.Service
@@ -365,6 +366,7 @@ func ProvideHTTPServer(opts ServerOptions, cfg *setting.Cfg, routeRegister routi
 	if hs.Listener != nil {
 		hs.log.Debug("Using provided listener")
 	}
+	hs.setStateHistoryStore()
 	hs.registerRoutes()
 
 	// Register access control scope resolver for annotations
@@ -15,11 +15,12 @@ import (
 )
 
 type RepositoryImpl struct {
-	db       db.DB
-	authZ    *accesscontrol.AuthService
-	features featuremgmt.FeatureToggles
-	reader   readStore
-	writer   writeStore
+	db        db.DB
+	authZ     *accesscontrol.AuthService
+	features  featuremgmt.FeatureToggles
+	reader    readStore
+	writer    writeStore
+	historian *loki.LokiHistorianStore
 }
 
 func ProvideService(
@@ -45,14 +46,20 @@ func ProvideService(
 	}
 
 	return &RepositoryImpl{
-		db:       db,
-		features: features,
-		authZ:    accesscontrol.NewAuthService(db, features),
-		reader:   read,
-		writer:   write,
+		db:        db,
+		features:  features,
+		authZ:     accesscontrol.NewAuthService(db, features),
+		reader:    read,
+		writer:    write,
+		historian: historianStore,
 	}
 }
 
+// StateHistoryStore returns the store of the state history of alerts in Loki, or nil if it is not stored in Loki.
+func (r *RepositoryImpl) StateHistoryStore() *loki.LokiHistorianStore {
+	return r.historian
+}
+
 func (r *RepositoryImpl) Save(ctx context.Context, item *annotations.Item) error {
 	return r.writer.Add(ctx, item)
 }
@@ -2,6 +2,7 @@ package annotationsimpl
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sort"
 
@@ -10,6 +11,7 @@ import (
 	"github.com/grafana/dskit/concurrency"
 	"github.com/grafana/grafana/pkg/services/annotations"
 	"github.com/grafana/grafana/pkg/services/annotations/accesscontrol"
+	"github.com/grafana/grafana/pkg/services/annotations/annotationsimpl/loki"
 )
 
 // CompositeStore is a read store that combines two or more read stores, and queries all stores in parallel.
@@ -38,6 +40,10 @@ func (c *CompositeStore) Get(ctx context.Context, query *annotations.ItemQuery,
 		defer handleJobPanic(c.logger, c.readers[i].Type(), &err)
 
 		items, err := c.readers[i].Get(ctx, query, accessResources)
+		if errors.Is(err, loki.ErrAnnotationNotFound) {
+			// The annotation looked up by ID can be in another store.
+			items, err = nil, nil
+		}
 		itemCh <- items
 		return err
 	})
@@ -10,6 +10,7 @@ import (
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/services/annotations"
 	"github.com/grafana/grafana/pkg/services/annotations/accesscontrol"
+	"github.com/grafana/grafana/pkg/services/annotations/annotationsimpl/loki"
 	"github.com/stretchr/testify/require"
 )
 
@@ -97,6 +98,23 @@ func TestCompositeStore(t *testing.T) {
 		require.Equal(t, expected, items)
 	})
 
+	t.Run("should ignore annotations that are not found in the state history", func(t *testing.T) {
+		items := []*annotations.ItemDTO{{ID: 1}}
+		r1 := newFakeReader(withItems(items))
+		r2 := newFakeReader(withGetFn(func(context.Context, *annotations.ItemQuery, *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+			return nil, loki.ErrAnnotationNotFound.Errorf("annotation 1 does not exist")
+		}))
+
+		store := &CompositeStore{
+			log.NewNopLogger(),
+			[]readStore{r1, r2},
+		}
+
+		res, err := store.Get(context.Background(), &annotations.ItemQuery{AnnotationID: 1}, nil)
+		require.NoError(t, err)
+		require.Equal(t, items, res)
+	})
+
 	t.Run("should combine and sort results from GetTags", func(t *testing.T) {
 		tags1 := []*annotations.TagsDTO{
 			{Tag: "key1:val1"},
@@ -0,0 +1,233 @@
+package loki
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/memory"
+	"github.com/apache/arrow/go/v15/parquet"
+	"github.com/apache/arrow/go/v15/parquet/pqarrow"
+
+	"github.com/grafana/grafana/pkg/services/ngalert/state/historian"
+)
+
+// ExportFormat is the format that state history is exported in.
+type ExportFormat string
+
+const (
+	// NDJSON writes one JSON object per state transition and line.
+	NDJSON ExportFormat = "ndjson"
+	// CSV writes a header row followed by one row per state transition. Labels are a JSON object.
+	CSV ExportFormat = "csv"
+	// Parquet writes a single Parquet file with one row per state transition. Labels are a JSON object.
+	Parquet ExportFormat = "parquet"
+)
+
+// exportRow is a state transition as it is exported. All formats have the same fields, named after the JSON keys.
+type exportRow struct {
+	Time         time.Time         `json:"time"`
+	RuleUID      string            `json:"ruleUID"`
+	RuleID       int64             `json:"ruleID"`
+	RuleTitle    string            `json:"ruleTitle"`
+	PrevState    string            `json:"prevState"`
+	NewState     string            `json:"newState"`
+	Labels       map[string]string `json:"labels"`
+	DashboardUID string            `json:"dashboardUID"`
+	PanelID      int64             `json:"panelID"`
+	Error        string            `json:"error"`
+}
+
+var exportColumns = []string{"time", "ruleUID", "ruleID", "ruleTitle", "prevState", "newState", "labels", "dashboardUID", "panelID", "error"}
+
+// GetTransitionAnnotationsForExport writes the state transitions of an org in the given time range to w, oldest first.
+// Access control is not enforced, callers must make sure that the user can read the state history of the whole org.
+func (r *LokiHistorianStore) GetTransitionAnnotationsForExport(ctx context.Context, orgID int64, from, to time.Time, format ExportFormat, w io.Writer) error {
+	if !to.After(from) {
+		return ErrLokiStoreBadRequest.Errorf("end of time range must be after its start")
+	}
+	var write func(io.Writer, []exportRow) error
+	switch format {
+	case NDJSON:
+		write = writeNDJSON
+	case CSV:
+		write = writeCSV
+	case Parquet:
+		write = writeParquet
+	default:
+		return ErrLokiStoreBadRequest.Errorf("unknown export format %q", format)
+	}
+
+	logQL, err := historian.BuildStreamSelector(orgID)
+	if err != nil {
+		return ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+	}
+	streams, err := r.rangeQueryAll(ctx, orgID, logQL, from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return queryError(err)
+	}
+
+	entries := r.entriesFromStreams(streams, nil)
+	rows := make([]exportRow, 0, len(entries))
+	for _, e := range entries {
+		rows = append(rows, exportRow{
+			Time:         time.UnixMilli(e.item.Time).UTC(),
+			RuleUID:      e.entry.RuleUID,
+			RuleID:       e.entry.RuleID,
+			RuleTitle:    e.entry.RuleTitle,
+			PrevState:    e.item.PrevState,
+			NewState:     e.item.NewState,
+			Labels:       e.entry.InstanceLabels,
+			DashboardUID: e.entry.DashboardUID,
+			PanelID:      e.entry.PanelID,
+			Error:        e.entry.Error,
+		})
+	}
+
+	if err := write(w, rows); err != nil {
+		return ErrLokiStoreInternal.Errorf("failed to write %s export: %w", format, err)
+	}
+	return nil
+}
+
+// rangeQueryAll runs a range query page by page until all entries in the time range are read.
+func (r *LokiHistorianStore) rangeQueryAll(ctx context.Context, orgID int64, logQL string, from, to int64) ([]historian.Stream, error) {
+	type sampleKey struct {
+		stream string
+		t      int64
+		line   string
+	}
+	seen := make(map[sampleKey]struct{})
+
+	streams := make([]historian.Stream, 0)
+	for {
+		res, err := r.rangeQuery(ctx, orgID, logQL, from, to, backupPageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		count, fresh := 0, 0
+		oldest := to
+		for _, stream := range res.Data.Result {
+			labels := historian.LabelFingerprint(stream.Stream)
+			values := make([]historian.Sample, 0, len(stream.Values))
+			for _, sample := range stream.Values {
+				count++
+				oldest = min(oldest, sample.T.UnixNano())
+				key := sampleKey{stream: labels, t: sample.T.UnixNano(), line: sample.V}
+				if _, ok := seen[key]; ok {
+					continue
+				}
+				seen[key] = struct{}{}
+				values = append(values, sample)
+			}
+			if len(values) > 0 {
+				fresh += len(values)
+				streams = append(streams, historian.Stream{Stream: stream.Stream, Values: values})
+			}
+		}
+
+		if count < backupPageSize || oldest >= to {
+			return streams, nil
+		}
+		// Loki returns the most recent entries first and the end of the time range is exclusive. The next page ends
+		// right after the oldest entry of this one, as this page may not hold all entries with its timestamp, and the
+		// entries read twice are skipped. A page without new entries only holds entries of that timestamp, which
+		// cannot be paged through, so the next page ends before it.
+		to = oldest + 1
+		if fresh == 0 {
+			to = oldest
+		}
+	}
+}
+
+func writeNDJSON(w io.Writer, rows []exportRow) error {
+	enc := json.NewEncoder(w)
+	for _, row := range rows {
+		if err := enc.Encode(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeCSV(w io.Writer, rows []exportRow) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(exportColumns); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		labels, err := json.Marshal(row.Labels)
+		if err != nil {
+			return err
+		}
+		record := []string{
+			row.Time.Format(time.RFC3339Nano),
+			row.RuleUID,
+			strconv.FormatInt(row.RuleID, 10),
+			row.RuleTitle,
+			row.PrevState,
+			row.NewState,
+			string(labels),
+			row.DashboardUID,
+			strconv.FormatInt(row.PanelID, 10),
+			row.Error,
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeParquet(w io.Writer, rows []exportRow) error {
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "time", Type: arrow.FixedWidthTypes.Timestamp_ms},
+		{Name: "ruleUID", Type: arrow.BinaryTypes.String},
+		{Name: "ruleID", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "ruleTitle", Type: arrow.BinaryTypes.String},
+		{Name: "prevState", Type: arrow.BinaryTypes.String},
+		{Name: "newState", Type: arrow.BinaryTypes.String},
+		{Name: "labels", Type: arrow.BinaryTypes.String},
+		{Name: "dashboardUID", Type: arrow.BinaryTypes.String},
+		{Name: "panelID", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "error", Type: arrow.BinaryTypes.String},
+	}, nil)
+
+	b := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer b.Release()
+	for _, row := range rows {
+		labels, err := json.Marshal(row.Labels)
+		if err != nil {
+			return err
+		}
+		b.Field(0).(*array.TimestampBuilder).Append(arrow.Timestamp(row.Time.UnixMilli()))
+		b.Field(1).(*array.StringBuilder).Append(row.RuleUID)
+		b.Field(2).(*array.Int64Builder).Append(row.RuleID)
+		b.Field(3).(*array.StringBuilder).Append(row.RuleTitle)
+		b.Field(4).(*array.StringBuilder).Append(row.PrevState)
+		b.Field(5).(*array.StringBuilder).Append(row.NewState)
+		b.Field(6).(*array.StringBuilder).Append(string(labels))
+		b.Field(7).(*array.StringBuilder).Append(row.DashboardUID)
+		b.Field(8).(*array.Int64Builder).Append(row.PanelID)
+		b.Field(9).(*array.StringBuilder).Append(row.Error)
+	}
+	rec := b.NewRecord()
+	defer rec.Release()
+
+	fw, err := pqarrow.NewFileWriter(schema, w, parquet.NewWriterProperties(), pqarrow.DefaultWriterProps())
+	if err != nil {
+		return err
+	}
+	if err := fw.Write(rec); err != nil {
+		_ = fw.Close()
+		return err
+	}
+	return fw.Close()
+}
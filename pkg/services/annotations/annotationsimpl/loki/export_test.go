@@ -0,0 +1,169 @@
+package loki
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v15/parquet/file"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/ngalert/state/historian"
+)
+
+func TestGetTransitionAnnotationsForExport(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Minute).Truncate(time.Millisecond).UTC()
+	fakeLokiClient.Response = []historian.Stream{
+		{
+			Stream: map[string]string{historian.OrgIDLabel: "1"},
+			Values: []historian.Sample{
+				{
+					T: start,
+					V: `{"schemaVersion":1,"values":{},"previous":"Normal","current":"Alerting","ruleID":1,"ruleUID":"rule-1","ruleTitle":"Rule 1","labels":{"a":"b"},"dashboardUID":"dash-1","panelID":2}`,
+				},
+				{
+					T: start.Add(time.Second),
+					V: `{"schemaVersion":1,"values":{},"previous":"Alerting","current":"Error","ruleID":1,"ruleUID":"rule-1","ruleTitle":"Rule 1","labels":{"a":"b"},"error":"failed, \"badly\""}`,
+				},
+			},
+		},
+	}
+	expected := []exportRow{
+		{
+			Time:         start,
+			RuleUID:      "rule-1",
+			RuleID:       1,
+			RuleTitle:    "Rule 1",
+			PrevState:    "Normal",
+			NewState:     "Alerting",
+			Labels:       map[string]string{"a": "b"},
+			DashboardUID: "dash-1",
+			PanelID:      2,
+		},
+		{
+			Time:      start.Add(time.Second),
+			RuleUID:   "rule-1",
+			RuleID:    1,
+			RuleTitle: "Rule 1",
+			PrevState: "Alerting",
+			NewState:  "Error",
+			Labels:    map[string]string{"a": "b"},
+			Error:     `failed, "badly"`,
+		},
+	}
+
+	t.Run("should export ndjson", func(t *testing.T) {
+		var buf bytes.Buffer
+		err := store.GetTransitionAnnotationsForExport(context.Background(), 1, start, start.Add(time.Minute), NDJSON, &buf)
+		require.NoError(t, err)
+
+		dec := json.NewDecoder(&buf)
+		rows := make([]exportRow, 0)
+		for dec.More() {
+			var row exportRow
+			require.NoError(t, dec.Decode(&row))
+			rows = append(rows, row)
+		}
+		require.Equal(t, expected, rows)
+	})
+
+	t.Run("should export csv", func(t *testing.T) {
+		var buf bytes.Buffer
+		err := store.GetTransitionAnnotationsForExport(context.Background(), 1, start, start.Add(time.Minute), CSV, &buf)
+		require.NoError(t, err)
+
+		records, err := csv.NewReader(&buf).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, records, 3)
+		require.Equal(t, exportColumns, records[0])
+		require.Equal(t, []string{start.Format(time.RFC3339Nano), "rule-1", "1", "Rule 1", "Normal", "Alerting", `{"a":"b"}`, "dash-1", "2", ""}, records[1])
+		require.Equal(t, []string{start.Add(time.Second).Format(time.RFC3339Nano), "rule-1", "1", "Rule 1", "Alerting", "Error", `{"a":"b"}`, "", "0", `failed, "badly"`}, records[2])
+	})
+
+	t.Run("should export parquet", func(t *testing.T) {
+		var buf bytes.Buffer
+		err := store.GetTransitionAnnotationsForExport(context.Background(), 1, start, start.Add(time.Minute), Parquet, &buf)
+		require.NoError(t, err)
+
+		r, err := file.NewParquetReader(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+		defer func() { _ = r.Close() }()
+		require.EqualValues(t, 2, r.NumRows())
+
+		schema := r.MetaData().Schema
+		columns := make([]string, 0, schema.NumColumns())
+		for i := 0; i < schema.NumColumns(); i++ {
+			columns = append(columns, schema.Column(i).Name())
+		}
+		require.Equal(t, exportColumns, columns)
+	})
+
+	t.Run("should reject unknown format", func(t *testing.T) {
+		err := store.GetTransitionAnnotationsForExport(context.Background(), 1, start, start.Add(time.Minute), ExportFormat("xml"), &bytes.Buffer{})
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+
+	t.Run("should reject empty time range", func(t *testing.T) {
+		err := store.GetTransitionAnnotationsForExport(context.Background(), 1, start, start, NDJSON, &bytes.Buffer{})
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestRangeQueryAll(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Millisecond).UTC()
+	line := func(n int) string {
+		return fmt.Sprintf(`{"schemaVersion":1,"values":{},"previous":"Normal","current":"Alerting","ruleID":%d,"ruleUID":"rule-1"}`, n)
+	}
+
+	t.Run("should read all entries with the timestamp at the end of a page", func(t *testing.T) {
+		// The first page ends within the entries at the boundary, which the next page must read as well.
+		boundary := start.Add(time.Second)
+		values := []historian.Sample{{T: start, V: line(0)}}
+		for n := 1; n <= 3; n++ {
+			values = append(values, historian.Sample{T: boundary, V: line(n)})
+		}
+		for n := 1; n < backupPageSize; n++ {
+			values = append(values, historian.Sample{T: boundary.Add(time.Duration(n) * time.Millisecond), V: line(n + 3)})
+		}
+		fakeLokiClient.Response = []historian.Stream{{Stream: map[string]string{historian.OrgIDLabel: "1"}, Values: values}}
+
+		streams, err := store.rangeQueryAll(context.Background(), 1, `{orgID="1"}`, start.UnixNano(), start.Add(time.Hour).UnixNano())
+		require.NoError(t, err)
+
+		read := make(map[string]int)
+		for _, stream := range streams {
+			for _, sample := range stream.Values {
+				read[sample.V]++
+			}
+		}
+		require.Len(t, read, len(values))
+		for _, sample := range values {
+			require.Equal(t, 1, read[sample.V], "entry %s", sample.V)
+		}
+	})
+
+	t.Run("should stop when a page only holds entries with the same timestamp", func(t *testing.T) {
+		values := make([]historian.Sample, 0, backupPageSize+1)
+		for n := 0; n <= backupPageSize; n++ {
+			values = append(values, historian.Sample{T: start, V: line(n)})
+		}
+		fakeLokiClient.Response = []historian.Stream{{Stream: map[string]string{historian.OrgIDLabel: "1"}, Values: values}}
+
+		streams, err := store.rangeQueryAll(context.Background(), 1, `{orgID="1"}`, start.UnixNano(), start.Add(time.Hour).UnixNano())
+		require.NoError(t, err)
+		require.Len(t, streams, 1)
+		require.Len(t, streams[0].Values, backupPageSize)
+	})
+}
@@ -1,12 +1,24 @@
 package loki
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"maps"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/grafana/grafana/pkg/components/simplejson"
 	"github.com/grafana/grafana/pkg/services/annotations/accesscontrol"
@@ -16,6 +28,7 @@ import (
 
 	"github.com/grafana/grafana/pkg/infra/db"
 	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/ngalert/eval"
 	ngmetrics "github.com/grafana/grafana/pkg/services/ngalert/metrics"
 	ngmodels "github.com/grafana/grafana/pkg/services/ngalert/models"
 	"github.com/grafana/grafana/pkg/services/ngalert/state"
@@ -23,6 +36,13 @@ import (
 	historymodel "github.com/grafana/grafana/pkg/services/ngalert/state/historian/model"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gocloud.dev/blob"
 
 	"github.com/grafana/grafana/pkg/services/annotations"
 	"github.com/grafana/grafana/pkg/setting"
@@ -31,109 +51,3040 @@ import (
 
 const (
 	subsystem         = "annotations"
+	tracerName        = "github.com/grafana/grafana/pkg/services/annotations/annotationsimpl/loki"
 	defaultQueryRange = 6 * time.Hour // from grafana/pkg/services/ngalert/state/historian/loki.go
+
+	// backupRange is the time range of each query of a backup, it is bounded by Loki's maximum query length.
+	backupRange    = 30 * 24 * time.Hour
+	backupPageSize = 5000 // from grafana/pkg/services/ngalert/state/historian/loki_http.go
+
+	defaultAnnotationsPageSize = 100
+	maxAnnotationsPageSize     = 1000
+
+	// topRulesBySizeLimit is the number of rules returned in SizeStats.TopRulesBySize.
+	topRulesBySizeLimit = 10
+
+	// severityLabel is the label that holds the severity of alert instances.
+	severityLabel = "severity"
+
+	// environmentLabel is the label that holds the environment of alert instances, such as prod or staging.
+	environmentLabel = "env"
+
+	// deletedLabel is the field of the log lines of the tombstones recorded by Delete.
+	deletedLabel = "deleted"
+
+	// maxAlertIDs bounds the number of rules that can be queried at once, as each of them ends up in the LogQL query.
+	maxAlertIDs = 50
+)
+
+var (
+	ErrLokiStoreInternal   = errutil.Internal("annotations.loki.internal")
+	ErrLokiStoreNotFound   = errutil.NotFound("annotations.loki.notFound")
+	ErrLokiStoreBadRequest = errutil.BadRequest("annotations.loki.badRequest")
+	ErrLokiUnavailable     = errutil.BadGateway("annotations.loki.unavailable")
+	ErrAccessDenied        = errutil.Forbidden("annotations.loki.accessDenied")
+	ErrAnnotationNotFound  = errutil.NotFound("annotations.loki.annotationNotFound")
+
+	// knownSeverities are the values of the severity label that can be queried.
+	knownSeverities = []string{"critical", "high", "medium", "low", "info"}
+
+	errMissingRule   = errors.New("rule not found")
+	errMissingFolder = errors.New("folder not found")
 )
 
-var (
-	ErrLokiStoreInternal = errutil.Internal("annotations.loki.internal")
-	ErrLokiStoreNotFound = errutil.NotFound("annotations.loki.notFound")
+type lokiClient interface {
+	Push(ctx context.Context, s []historian.Stream) error
+	RangeQuery(ctx context.Context, query string, start, end, limit int64) (historian.QueryRes, error)
+	RangeQueryForward(ctx context.Context, query string, start, end, limit int64) (historian.QueryRes, error)
+	MetricsQuery(ctx context.Context, query string, start, end int64, step time.Duration) (historian.MetricQueryRes, error)
+	Ping(ctx context.Context) error
+}
+
+// LokiHistorianStore is a read store that queries Loki for alert state history.
+type LokiHistorianStore struct {
+	client  lokiClient
+	db      db.DB
+	metrics *ngmetrics.Historian
+	tracer  trace.Tracer
+	log     log.Logger
+	// tenantIDMode is the tenant ID mode of the client, orgs have tenants of their own unless it is fixed.
+	tenantIDMode historian.TenantIDMode
+}
+
+// LokiHistorianStoreOption configures optional behavior of a LokiHistorianStore.
+type LokiHistorianStoreOption func(*lokiHistorianStoreOptions)
+
+type lokiHistorianStoreOptions struct {
+	transport      http.RoundTripper
+	tracerProvider trace.TracerProvider
+	tenantResolver historian.TenantResolver
+}
+
+// WithHTTPTransport sets the transport used for requests to Loki, e.g. to route them through a proxy.
+// The transport replaces the one that the TLS files of the configuration are loaded into.
+func WithHTTPTransport(transport http.RoundTripper) LokiHistorianStoreOption {
+	return func(o *lokiHistorianStoreOptions) {
+		o.transport = transport
+	}
+}
+
+// WithTenantResolver sets how the Loki tenant of an org is resolved when the tenant ID mode is org_name.
+// It defaults to the name of the org.
+func WithTenantResolver(resolver historian.TenantResolver) LokiHistorianStoreOption {
+	return func(o *lokiHistorianStoreOptions) {
+		o.tenantResolver = resolver
+	}
+}
+
+// WithTracerProvider sets the provider of the tracer used to trace queries. It defaults to the global provider.
+func WithTracerProvider(tp trace.TracerProvider) LokiHistorianStoreOption {
+	return func(o *lokiHistorianStoreOptions) {
+		o.tracerProvider = tp
+	}
+}
+
+func NewLokiHistorianStore(cfg setting.UnifiedAlertingStateHistorySettings, ft featuremgmt.FeatureToggles, db db.DB, log log.Logger, opts ...LokiHistorianStoreOption) *LokiHistorianStore {
+	if !useStore(cfg, ft) {
+		return nil
+	}
+	lokiCfg, err := historian.NewLokiConfig(cfg)
+	if err != nil {
+		// this config error is already handled elsewhere
+		return nil
+	}
+
+	options := lokiHistorianStoreOptions{
+		tracerProvider: otel.GetTracerProvider(),
+		tenantResolver: historian.OrgNameTenantResolver(db),
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	lokiCfg.TenantResolver = options.tenantResolver
+
+	requester, err := historian.NewLokiRequester(lokiCfg)
+	if err != nil {
+		log.Error("Failed to configure the requests to Loki", "error", err)
+		return nil
+	}
+	if options.transport != nil {
+		requester = &http.Client{Transport: options.transport}
+	}
+
+	metrics := ngmetrics.NewHistorianMetrics(prometheus.DefaultRegisterer, subsystem)
+
+	return &LokiHistorianStore{
+		client:  historian.NewLokiClient(lokiCfg, requester, metrics, log),
+		db:      db,
+		metrics: metrics,
+		tracer:  options.tracerProvider.Tracer(tracerName),
+		log:     log,
+
+		tenantIDMode: lokiCfg.TenantIDMode,
+	}
+}
+
+func (r *LokiHistorianStore) Type() string {
+	return "loki"
+}
+
+// Ping checks that Loki can be reached, without running a query against the state history.
+// If Loki responds that it is unavailable, the error wraps both ErrLokiUnavailable and historian.ErrLokiUnavailable.
+func (r *LokiHistorianStore) Ping(ctx context.Context) error {
+	if err := r.client.Ping(ctx); err != nil {
+		if errors.Is(err, historian.ErrLokiUnavailable) {
+			return ErrLokiUnavailable.Errorf("failed to ping loki: %w", err)
+		}
+		return ErrLokiStoreInternal.Errorf("failed to ping loki: %w", err)
+	}
+	return nil
+}
+
+func (r *LokiHistorianStore) Get(ctx context.Context, query *annotations.ItemQuery, accessResources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	ctx, span := r.tracer.Start(ctx, "annotations.loki.Get", trace.WithAttributes(
+		attribute.Int64("org_id", query.OrgID),
+		attribute.Int64("alert_id", query.AlertID),
+		attribute.String("dashboard_uid", query.DashboardUID),
+	))
+	defer span.End()
+
+	items, err := r.get(ctx, query, accessResources, span)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.SetAttributes(attribute.Int("result_count", len(items)))
+	return items, err
+}
+
+// AnnotationQueryResult is a page of the annotations matching a query, most recent first.
+type AnnotationQueryResult struct {
+	Items []*annotations.ItemDTO
+	// NextPageToken is the PageToken of the query for the next page, it is empty if there are no more annotations.
+	NextPageToken string
+}
+
+// Query returns the page of the annotations matching the query that starts at its PageToken, or the first page if
+// it has none. Pages contain at most Limit annotations, or the default page size if no limit is set.
+func (r *LokiHistorianStore) Query(ctx context.Context, query *annotations.ItemQuery, accessResources *accesscontrol.AccessResources) (AnnotationQueryResult, error) {
+	if query.Offset != 0 {
+		return AnnotationQueryResult{}, ErrLokiStoreBadRequest.Errorf("offset cannot be used with page tokens")
+	}
+	if query.SortField != "" || query.SortOrder != "" {
+		return AnnotationQueryResult{}, ErrLokiStoreBadRequest.Errorf("sorting cannot be used with page tokens")
+	}
+
+	page, err := r.GetAnnotationsPage(ctx, query, accessResources, PageRequest{PageSize: int(query.Limit), Cursor: query.PageToken})
+	if err != nil {
+		return AnnotationQueryResult{}, err
+	}
+	for _, item := range page.Items {
+		item.TimeZone = query.TimeZone
+	}
+
+	return AnnotationQueryResult{Items: page.Items, NextPageToken: page.NextCursor}, nil
+}
+
+// get returns the annotations matching the query, or the page that starts at its page token if it has one.
+// The duration of the queries to Loki is recorded on the span.
+func (r *LokiHistorianStore) get(ctx context.Context, query *annotations.ItemQuery, accessResources *accesscontrol.AccessResources, span trace.Span) ([]*annotations.ItemDTO, error) {
+	if query.PageToken != "" {
+		res, err := r.Query(ctx, query, accessResources)
+		if err != nil {
+			return make([]*annotations.ItemDTO, 0), err
+		}
+		return res.Items, nil
+	}
+	if query.AnnotationID != 0 {
+		return r.getByID(ctx, query, accessResources)
+	}
+
+	var compare func(a, b annotationEntry) int
+	if query.SortField != "" || query.SortOrder != "" {
+		var err error
+		compare, err = entryComparator(query.SortField, query.SortOrder)
+		if err != nil {
+			return make([]*annotations.ItemDTO, 0), err
+		}
+	}
+
+	start := time.Now()
+	entries, err := r.getEntries(ctx, query, accessResources)
+	span.SetAttributes(attribute.Int64("loki_query_duration_ms", time.Since(start).Milliseconds()))
+	if err != nil {
+		return make([]*annotations.ItemDTO, 0), err
+	}
+
+	if compare != nil {
+		slices.SortStableFunc(entries, compare)
+	}
+	items := itemsFromEntries(entries)
+	if compare == nil {
+		sort.Sort(annotations.SortedItems(items))
+	}
+	for _, item := range items {
+		item.TimeZone = query.TimeZone
+	}
+
+	return paginate(items, query.Offset, query.Limit), nil
+}
+
+// getByID returns the state transition annotation with the ID of the query, as computed by ComputeAnnotationID.
+// It is looked up in the second of the transition, which the ID holds, so Loki is not queried for the IDs of
+// annotations stored in the database.
+// The error wraps ErrAnnotationNotFound if there is no such annotation, and ErrAccessDenied if it is not accessible.
+func (r *LokiHistorianStore) getByID(ctx context.Context, query *annotations.ItemQuery, accessResources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	at, ok := annotationIDTime(query.AnnotationID)
+	if !ok || query.Type == "annotation" {
+		return make([]*annotations.ItemDTO, 0), ErrAnnotationNotFound.Errorf("annotation %d does not exist", query.AnnotationID)
+	}
+
+	logQL, err := historian.BuildStreamSelector(query.OrgID)
+	if err != nil {
+		return make([]*annotations.ItemDTO, 0), ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+	}
+	streams, err := r.rangeQueryAll(ctx, query.OrgID, logQL, at.UnixNano(), at.Add(time.Second).UnixNano())
+	if err != nil {
+		return make([]*annotations.ItemDTO, 0), queryError(err)
+	}
+
+	for _, e := range r.entriesFromStreams(streams, nil) {
+		if e.item.ID != query.AnnotationID {
+			continue
+		}
+		if !hasAccess(e.entry, *accessResources) {
+			return make([]*annotations.ItemDTO, 0), ErrAccessDenied.Errorf("no access to annotation %d", query.AnnotationID)
+		}
+		e.item.DashboardID = accessResources.Dashboards[e.entry.DashboardUID]
+		e.item.TimeZone = query.TimeZone
+		return []*annotations.ItemDTO{e.item}, nil
+	}
+
+	return make([]*annotations.ItemDTO, 0), ErrAnnotationNotFound.Errorf("annotation %d does not exist", query.AnnotationID)
+}
+
+// paginate returns the page of items after the first offset ones, with at most limit items. A limit of 0 means
+// that all remaining items are returned.
+func paginate(items []*annotations.ItemDTO, offset, limit int64) []*annotations.ItemDTO {
+	if offset >= int64(len(items)) {
+		return make([]*annotations.ItemDTO, 0)
+	}
+	items = items[offset:]
+	if limit > 0 && limit < int64(len(items)) {
+		items = items[:limit]
+	}
+	return items
+}
+
+// entryComparator returns a function that compares entries by the given field, in the given order. The field
+// defaults to time and the order to descending. Entries with the same value of the field are sorted by time,
+// most recent first.
+func entryComparator(field, order string) (func(a, b annotationEntry) int, error) {
+	var compareField func(a, b annotationEntry) int
+	switch field {
+	case "", "time":
+		compareField = func(a, b annotationEntry) int { return cmp.Compare(a.item.Time, b.item.Time) }
+	case "rule_uid":
+		compareField = func(a, b annotationEntry) int { return strings.Compare(a.entry.RuleUID, b.entry.RuleUID) }
+	case "new_state":
+		compareField = func(a, b annotationEntry) int { return strings.Compare(a.item.NewState, b.item.NewState) }
+	case "prev_state":
+		compareField = func(a, b annotationEntry) int { return strings.Compare(a.item.PrevState, b.item.PrevState) }
+	default:
+		return nil, ErrLokiStoreBadRequest.Errorf("unknown sort field %q, must be one of time, rule_uid, new_state or prev_state", field)
+	}
+
+	var direction int
+	switch order {
+	case "", "desc":
+		direction = -1
+	case "asc":
+		direction = 1
+	default:
+		return nil, ErrLokiStoreBadRequest.Errorf("unknown sort order %q, must be asc or desc", order)
+	}
+
+	return func(a, b annotationEntry) int {
+		if c := compareField(a, b); c != 0 {
+			return direction * c
+		}
+		return cmp.Compare(b.item.Time, a.item.Time)
+	}, nil
+}
+
+// PageRequest selects a page of annotations.
+type PageRequest struct {
+	// PageSize is the maximum number of annotations in the page. Defaults to 100.
+	PageSize int
+	// Cursor is the NextCursor of the previous page, or empty for the first page.
+	Cursor string
+}
+
+// PagedAnnotations is a page of annotations, most recent first.
+type PagedAnnotations struct {
+	Items []*annotations.ItemDTO
+	// NextCursor continues from the end of the page, it is empty if there are no more annotations.
+	NextCursor string
+}
+
+// pageCursor is the decoded form of PagedAnnotations.NextCursor. The next page starts at the Before timestamp,
+// in milliseconds, after skipping the first Skip annotations with that timestamp, which were in previous pages.
+type pageCursor struct {
+	Before int64 `json:"before"`
+	Skip   int   `json:"skip"`
+}
+
+// GetAnnotationsPage returns a page of the annotations matching the query, most recent first.
+// Pages can contain fewer annotations than the page size when some entries are not accessible with the given resources.
+// This is the preferred way to read annotations, Get is kept for backward compatibility.
+func (r *LokiHistorianStore) GetAnnotationsPage(ctx context.Context, query *annotations.ItemQuery, resources *accesscontrol.AccessResources, page PageRequest) (PagedAnnotations, error) {
+	if resources == nil {
+		return PagedAnnotations{}, ErrLokiStoreBadRequest.Errorf("access resources must be provided")
+	}
+	pageSize := page.PageSize
+	if pageSize == 0 {
+		pageSize = defaultAnnotationsPageSize
+	}
+	if pageSize < 0 || pageSize > maxAnnotationsPageSize {
+		return PagedAnnotations{}, ErrLokiStoreBadRequest.Errorf("page size must be between 1 and %d", maxAnnotationsPageSize)
+	}
+	cursor, err := decodePageCursor(page.Cursor)
+	if err != nil {
+		return PagedAnnotations{}, ErrLokiStoreBadRequest.Errorf("invalid cursor: %w", err)
+	}
+
+	result := PagedAnnotations{Items: make([]*annotations.ItemDTO, 0)}
+	if query.Type == "annotation" {
+		return result, nil
+	}
+
+	logQL, from, to, err := r.buildLogQuery(ctx, query, resources.Dashboards)
+	if err != nil {
+		return PagedAnnotations{}, err
+	}
+	if cursor != nil {
+		to = min(to, (cursor.Before+1)*1e6)
+		// The cursor can be older than the time range, such as when the query moved on. Loki rejects empty ranges.
+		if to <= from {
+			return result, nil
+		}
+	}
+
+	// Fetch one more entry than needed, to know whether there is another page.
+	limit := int64(pageSize + 1)
+	if cursor != nil {
+		limit += int64(cursor.Skip)
+	}
+	res, err := r.rangeQuery(ctx, query.OrgID, logQL, from, to, limit)
+	if err != nil {
+		return PagedAnnotations{}, queryError(err)
+	}
+
+	samples := int64(0)
+	oldest := int64(math.MaxInt64)
+	for _, stream := range res.Data.Result {
+		samples += int64(len(stream.Values))
+		for _, sample := range stream.Values {
+			oldest = min(oldest, sample.T.UnixMilli())
+		}
+	}
+
+	entries := r.entriesFromStreams(res.Data.Result, resources)
+	sortPageEntries(entries)
+	if cursor != nil {
+		skipped := 0
+		for skipped < len(entries) && skipped < cursor.Skip && entries[skipped].item.Time == cursor.Before {
+			skipped++
+		}
+		entries = entries[skipped:]
+	}
+
+	more := len(entries) > pageSize || samples >= limit
+	if len(entries) > pageSize {
+		entries = entries[:pageSize]
+	}
+	result.Items = itemsFromEntries(entries)
+	if !more {
+		return result, nil
+	}
+
+	next := pageCursor{}
+	if len(entries) > 0 {
+		next.Before = entries[len(entries)-1].item.Time
+		for _, e := range entries {
+			if e.item.Time == next.Before {
+				next.Skip++
+			}
+		}
+		if cursor != nil && cursor.Before == next.Before {
+			next.Skip += cursor.Skip
+		}
+	} else {
+		// None of the fetched entries are accessible, continue from the oldest one.
+		next.Before = oldest
+		if cursor != nil && cursor.Before == next.Before {
+			next.Before--
+		}
+	}
+	result.NextCursor, err = encodePageCursor(next)
+	if err != nil {
+		return PagedAnnotations{}, ErrLokiStoreInternal.Errorf("failed to encode cursor: %w", err)
+	}
+
+	return result, nil
+}
+
+func decodePageCursor(cursor string) (*pageCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	c := &pageCursor{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	if c.Skip < 0 {
+		return nil, fmt.Errorf("negative skip")
+	}
+	return c, nil
+}
+
+func encodePageCursor(cursor pageCursor) (string, error) {
+	b, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// sortPageEntries sorts entries by time, most recent first. Entries with the same time are sorted by rule and alert
+// instance, so that pages are consistent across queries.
+func sortPageEntries(entries []annotationEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].item.Time != entries[j].item.Time {
+			return entries[i].item.Time > entries[j].item.Time
+		}
+		if entries[i].entry.RuleUID != entries[j].entry.RuleUID {
+			return entries[i].entry.RuleUID < entries[j].entry.RuleUID
+		}
+		return entries[i].entry.Fingerprint < entries[j].entry.Fingerprint
+	})
+}
+
+// annotationEntry is an annotation along with the Loki entry it was built from.
+type annotationEntry struct {
+	item       *annotations.ItemDTO
+	entry      historian.LokiEntry
+	transition *state.StateTransition
+}
+
+// getEntries queries Loki for the annotations matching the query, in chronological order.
+// Consecutive identical transitions of an alert instance are collapsed unless the query includes duplicates.
+func (r *LokiHistorianStore) getEntries(ctx context.Context, query *annotations.ItemQuery, accessResources *accesscontrol.AccessResources) ([]annotationEntry, error) {
+	if query.Type == "annotation" {
+		return make([]annotationEntry, 0), nil
+	}
+
+	logQL, from, to, err := r.buildLogQuery(ctx, query, accessResources.Dashboards)
+	if err != nil {
+		return nil, err
+	}
+
+	// The entries skipped by the offset have to be read as well.
+	limit := query.Limit
+	if limit > 0 {
+		limit += query.Offset
+	}
+	res, err := r.rangeQuery(ctx, query.OrgID, logQL, from, to, limit)
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	entries := r.entriesFromStreams(res.Data.Result, accessResources)
+	if !query.IncludeDuplicates {
+		entries = deduplicateEntries(entries)
+	}
+
+	return entries, nil
+}
+
+// deduplicateEntries drops the entries, in chronological order, that have the same previous and current state as
+// the previous entry of the same alert instance, keeping only the first entry of each run of identical transitions.
+func deduplicateEntries(entries []annotationEntry) []annotationEntry {
+	last := make(map[string]historian.LokiEntry)
+	res := make([]annotationEntry, 0, len(entries))
+	for _, e := range entries {
+		key := e.entry.RuleUID + e.entry.Fingerprint
+		if prev, ok := last[key]; ok && prev.Current == e.entry.Current && prev.Previous == e.entry.Previous {
+			continue
+		}
+		last[key] = e.entry
+		res = append(res, e)
+	}
+	return res
+}
+
+// buildLogQuery builds the LogQL query for an annotation query, along with its time range in nanoseconds.
+// The dashboards are used to resolve the dashboard UID of the query if it only has a dashboard ID.
+func (r *LokiHistorianStore) buildLogQuery(ctx context.Context, query *annotations.ItemQuery, dashboards map[string]int64) (string, int64, int64, error) {
+	rule := &ngmodels.AlertRule{}
+	if query.AlertID != 0 {
+		var err error
+		rule, err = getRule(ctx, r.db, query.OrgID, query.AlertID)
+		if err != nil {
+			if errors.Is(err, errMissingRule) {
+				return "", 0, 0, ErrLokiStoreNotFound.Errorf("rule with ID %d does not exist", query.AlertID)
+			}
+			return "", 0, 0, ErrLokiStoreInternal.Errorf("failed to query rule: %w", err)
+		}
+	}
+
+	var loc *time.Location
+	if query.TimeZone != "" {
+		var err error
+		loc, err = time.LoadLocation(query.TimeZone)
+		if err != nil {
+			return "", 0, 0, ErrLokiStoreBadRequest.Errorf("invalid time zone %q: %w", query.TimeZone, err)
+		}
+	}
+
+	if query.Severity != "" && !slices.Contains(knownSeverities, query.Severity) {
+		return "", 0, 0, ErrLokiStoreBadRequest.Errorf("unknown severity %q, must be one of %v", query.Severity, knownSeverities)
+	}
+
+	if query.RuleNameRegex != "" {
+		if _, err := regexp.Compile(query.RuleNameRegex); err != nil {
+			return "", 0, 0, ErrLokiStoreBadRequest.Errorf("invalid rule name regex: %w", err)
+		}
+	}
+
+	for _, s := range query.States {
+		if _, _, err := state.ParseFormattedState(s); err != nil {
+			return "", 0, 0, ErrLokiStoreBadRequest.Errorf("invalid state %q: %w", s, err)
+		}
+	}
+
+	if query.Limit < 0 || query.Offset < 0 {
+		return "", 0, 0, ErrLokiStoreBadRequest.Errorf("limit and offset must not be negative")
+	}
+
+	if err := validateFieldKeys("label", query.InstanceLabels); err != nil {
+		return "", 0, 0, err
+	}
+
+	if err := validateFieldKeys("annotation", query.AnnotationFilter); err != nil {
+		return "", 0, 0, err
+	}
+
+	if len(query.AlertIDs) > maxAlertIDs {
+		return "", 0, 0, ErrLokiStoreBadRequest.Errorf("at most %d alert IDs can be queried at once, got %d", maxAlertIDs, len(query.AlertIDs))
+	}
+
+	var ruleUIDs []string
+	if len(query.AlertIDs) > 0 {
+		var err error
+		ruleUIDs, err = getRuleUIDs(ctx, r.db, query.OrgID, query.AlertIDs)
+		if err != nil {
+			return "", 0, 0, ErrLokiStoreInternal.Errorf("failed to query rules: %w", err)
+		}
+		if len(ruleUIDs) == 0 {
+			return "", 0, 0, ErrLokiStoreNotFound.Errorf("none of the rules with IDs %v exist", query.AlertIDs)
+		}
+	}
+
+	logQL, err := historian.BuildLogQuery(buildHistoryQuery(query, dashboards, rule.UID))
+	if err != nil {
+		return "", 0, 0, ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+	}
+	if len(ruleUIDs) > 0 {
+		logQL = fmt.Sprintf("%s | ruleUID=~%q", withJSONParser(logQL), uidsRegex(ruleUIDs))
+	}
+
+	fromMs, toMs := query.From, query.To
+	if loc != nil {
+		// Only convert the boundaries given in the query, the defaults are not wall clock times.
+		if fromMs != 0 {
+			fromMs = wallClockIn(fromMs, loc)
+		}
+		if toMs != 0 {
+			toMs = wallClockIn(toMs, loc)
+		}
+	}
+
+	// The defaults are not written back to the query, which belongs to the caller.
+	now := time.Now().UTC()
+	if query.To == 0 {
+		toMs = now.UnixMilli()
+	}
+	if query.From == 0 {
+		fromMs = now.Add(-defaultQueryRange).UnixMilli()
+	}
+
+	// query.From and query.To are always in milliseconds, convert them to nanoseconds for loki
+	from := fromMs * 1e6
+	to := toMs * 1e6
+
+	return logQL, from, to, nil
+}
+
+// wallClockIn reads a time in milliseconds as the wall clock time in UTC, and returns the time in milliseconds
+// with the same wall clock time in loc.
+func wallClockIn(ms int64, loc *time.Location) int64 {
+	t := time.UnixMilli(ms).UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc).UnixMilli()
+}
+
+// StateBucket is the number of transitions into each state within a bucket of time.
+type StateBucket struct {
+	BucketStart time.Time
+	Counts      map[string]int64
+}
+
+// GetAnnotationsGroupedByState counts the state transitions matching the query per state, in buckets of the given size.
+// The counting is done by Loki, so access control is not enforced on individual entries.
+func (r *LokiHistorianStore) GetAnnotationsGroupedByState(ctx context.Context, query *annotations.ItemQuery, bucketSize time.Duration) ([]StateBucket, error) {
+	if bucketSize <= 0 {
+		return nil, ErrLokiStoreBadRequest.Errorf("bucket size must be positive")
+	}
+
+	logQL, from, to, err := r.buildLogQuery(ctx, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	logQL = fmt.Sprintf("sum by (current, %s) (count_over_time(%s [%s]))", deletedLabel, withJSONParser(logQL), model.Duration(bucketSize))
+
+	res, err := r.metricsQuery(ctx, query.OrgID, logQL, from, to, bucketSize)
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	// Every sample counts the entries in the bucket that ends at its timestamp.
+	buckets := make(map[int64]*StateBucket)
+	for _, series := range res.Data.Result {
+		current := series.Metric["current"]
+		sign := countSign(series)
+		for _, sample := range series.Values {
+			start := sample.T.Add(-bucketSize)
+			bucket, ok := buckets[start.UnixNano()]
+			if !ok {
+				bucket = &StateBucket{BucketStart: start, Counts: make(map[string]int64)}
+				buckets[start.UnixNano()] = bucket
+			}
+			bucket.Counts[current] += sign * int64(sample.V)
+		}
+	}
+
+	result := make([]StateBucket, 0, len(buckets))
+	for _, bucket := range buckets {
+		// Drop the states whose transitions in the bucket were all deleted.
+		maps.DeleteFunc(bucket.Counts, func(_ string, count int64) bool { return count == 0 })
+		if len(bucket.Counts) > 0 {
+			result = append(result, *bucket)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].BucketStart.Before(result[j].BucketStart)
+	})
+
+	return result, nil
+}
+
+// TransitionHeatmap is the number of transitions into each state per bucket of time.
+// Values[i][j] is the number of transitions into States[i] in the bucket starting at Timestamps[j].
+type TransitionHeatmap struct {
+	States     []string
+	Timestamps []time.Time
+	Values     [][]int64
+}
+
+// GetTransitionHeatmap counts the state transitions matching the query per state, splitting the queried time range
+// into the given number of buckets. Entries are only counted if they are accessible with the given resources.
+func (r *LokiHistorianStore) GetTransitionHeatmap(ctx context.Context, query *annotations.ItemQuery, resources *accesscontrol.AccessResources, buckets int) (*TransitionHeatmap, error) {
+	if buckets <= 0 {
+		return nil, ErrLokiStoreBadRequest.Errorf("number of buckets must be positive")
+	}
+	if resources == nil {
+		return nil, ErrLokiStoreBadRequest.Errorf("access resources must be provided")
+	}
+
+	logQL, from, to, err := r.buildLogQuery(ctx, query, resources.Dashboards)
+	if err != nil {
+		return nil, err
+	}
+
+	step := time.Duration((to - from) / int64(buckets))
+	if step < time.Millisecond {
+		return nil, ErrLokiStoreBadRequest.Errorf("time range is too short for %d buckets", buckets)
+	}
+
+	heatmap := &TransitionHeatmap{
+		States:     make([]string, 0),
+		Timestamps: make([]time.Time, 0, buckets),
+		Values:     make([][]int64, 0),
+	}
+	start := time.Unix(0, from)
+	for i := 0; i < buckets; i++ {
+		heatmap.Timestamps = append(heatmap.Timestamps, start.Add(time.Duration(i)*step))
+	}
+
+	filter, ok := accessFilter(*resources)
+	if !ok {
+		return heatmap, nil
+	}
+	logQL = fmt.Sprintf("sum by (current, %s) (count_over_time(%s | %s [%s]))", deletedLabel, withJSONParser(logQL), filter, model.Duration(step))
+
+	res, err := r.metricsQuery(ctx, query.OrgID, logQL, from, to, step)
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	rows := make(map[string][]int64)
+	for _, s := range res.Data.Result {
+		current := s.Metric["current"]
+		row, ok := rows[current]
+		if !ok {
+			row = make([]int64, buckets)
+			rows[current] = row
+		}
+		sign := countSign(s)
+		// Every sample counts the entries in the bucket that ends at its timestamp.
+		for _, sample := range s.Values {
+			i := int(sample.T.Add(-step).Sub(start) / step)
+			if i < 0 || i >= buckets {
+				continue
+			}
+			row[i] += sign * int64(sample.V)
+		}
+	}
+	for current, row := range rows {
+		// Skip the states whose transitions were all deleted.
+		if slices.ContainsFunc(row, func(count int64) bool { return count != 0 }) {
+			heatmap.States = append(heatmap.States, current)
+		}
+	}
+	sort.Strings(heatmap.States)
+	for _, current := range heatmap.States {
+		heatmap.Values = append(heatmap.Values, rows[current])
+	}
+
+	return heatmap, nil
+}
+
+// GetCount counts the state transitions matching the query with a single metric query,
+// instead of fetching them. The count is approximate: unlike Get, it ignores the query limit and includes
+// transitions that are not shown as annotations.
+func (r *LokiHistorianStore) GetCount(ctx context.Context, query *annotations.ItemQuery, resources *accesscontrol.AccessResources) (int64, error) {
+	if resources == nil {
+		return 0, ErrLokiStoreBadRequest.Errorf("access resources must be provided")
+	}
+	if query.Type == "annotation" {
+		return 0, nil
+	}
+
+	logQL, from, to, err := r.buildLogQuery(ctx, query, resources.Dashboards)
+	if err != nil {
+		return 0, err
+	}
+	if to <= from {
+		return 0, ErrLokiStoreBadRequest.Errorf("end of time range must be after its start")
+	}
+
+	filter, ok := accessFilter(*resources)
+	if !ok {
+		return 0, nil
+	}
+	rng := time.Duration(to - from)
+	logQL = fmt.Sprintf(`sum by (%s) (count_over_time(%s | type="" | %s [%s]))`, deletedLabel, withJSONParser(logQL), filter, model.Duration(rng))
+
+	series, err := r.queryOverRange(ctx, query.OrgID, logQL, time.Unix(0, to), rng)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	for _, s := range series {
+		count += countSign(s) * lastSampleValue(s)
+	}
+
+	return count, nil
+}
+
+// MetricSnapshot is a time series of the metric that an alert rule was evaluated against.
+type MetricSnapshot struct {
+	Labels     map[string]string `json:"labels"`
+	Timestamps []time.Time       `json:"timestamps"`
+	Values     []float64         `json:"values"`
+}
+
+// ContextualAnnotationDTO is an annotation along with the metric time series around the time it was created.
+type ContextualAnnotationDTO struct {
+	annotations.ItemDTO
+	MetricSnapshots []MetricSnapshot `json:"metricSnapshots"`
+}
+
+// GetAnnotationsWithContext returns the annotations matching the query, each with the metric snapshots
+// returned by datasourceQuery for the rule and time of the annotation.
+func (r *LokiHistorianStore) GetAnnotationsWithContext(
+	ctx context.Context,
+	query *annotations.ItemQuery,
+	resources *accesscontrol.AccessResources,
+	datasourceQuery func(ruleUID string, t time.Time) ([]MetricSnapshot, error),
+) ([]*ContextualAnnotationDTO, error) {
+	if resources == nil {
+		return nil, ErrLokiStoreBadRequest.Errorf("access resources must be provided")
+	}
+
+	entries, err := r.getEntries(ctx, query, resources)
+	if err != nil {
+		return nil, err
+	}
+	sortEntries(entries)
+
+	res := make([]*ContextualAnnotationDTO, 0, len(entries))
+	for _, e := range entries {
+		snapshots, err := datasourceQuery(e.entry.RuleUID, time.UnixMilli(e.item.Time))
+		if err != nil {
+			return nil, ErrLokiStoreInternal.Errorf("failed to query metric snapshots for rule %s: %w", e.entry.RuleUID, err)
+		}
+
+		res = append(res, &ContextualAnnotationDTO{
+			ItemDTO:         *e.item,
+			MetricSnapshots: snapshots,
+		})
+	}
+
+	return res, nil
+}
+
+// TimelineEvent is a period of time during which an alert instance was in a state.
+type TimelineEvent struct {
+	RuleUID string
+	Start   time.Time
+	// End is nil if the alert instance is still in the state.
+	End    *time.Time
+	State  string
+	Labels map[string]string
+}
+
+// GetTransitionTimeline returns the periods of time that the alert instances matching the query spent in each state,
+// in chronological order. A period starts with a transition of an alert instance and ends with its next transition.
+func (r *LokiHistorianStore) GetTransitionTimeline(ctx context.Context, query *annotations.ItemQuery, resources *accesscontrol.AccessResources) ([]TimelineEvent, error) {
+	if resources == nil {
+		return nil, ErrLokiStoreBadRequest.Errorf("access resources must be provided")
+	}
+
+	entries, err := r.getEntries(ctx, query, resources)
+	if err != nil {
+		return nil, err
+	}
+
+	ends := nextTransitionTimes(entries)
+	events := make([]TimelineEvent, 0, len(entries))
+	for i, e := range entries {
+		events = append(events, TimelineEvent{
+			RuleUID: e.entry.RuleUID,
+			Start:   time.UnixMilli(e.item.Time),
+			End:     ends[i],
+			State:   e.entry.Current,
+			Labels:  e.entry.InstanceLabels,
+		})
+	}
+
+	return events, nil
+}
+
+// DuratedAnnotationDTO is an annotation along with how long the alert instance stayed in the new state.
+type DuratedAnnotationDTO struct {
+	annotations.ItemDTO
+	StateDuration time.Duration `json:"stateDuration"`
+}
+
+// GetTransitionsWithDuration returns the annotations matching the query, most recent first, each with the time until
+// the next transition of the same alert instance. If the alert instance has no later transition in the queried
+// time range, the duration lasts until the end of the time range.
+func (r *LokiHistorianStore) GetTransitionsWithDuration(ctx context.Context, query *annotations.ItemQuery, resources *accesscontrol.AccessResources) ([]*DuratedAnnotationDTO, error) {
+	if resources == nil {
+		return nil, ErrLokiStoreBadRequest.Errorf("access resources must be provided")
+	}
+
+	entries, err := r.getEntries(ctx, query, resources)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without an end, the time range of the query ends now.
+	end := time.Now()
+	if query.To != 0 {
+		end = time.UnixMilli(query.To)
+	}
+	next := nextTransitionTimes(entries)
+	res := make([]*DuratedAnnotationDTO, 0, len(entries))
+	for i, e := range entries {
+		until := end
+		if next[i] != nil {
+			until = *next[i]
+		}
+		res = append(res, &DuratedAnnotationDTO{
+			ItemDTO:       *e.item,
+			StateDuration: until.Sub(time.UnixMilli(e.item.Time)),
+		})
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Time > res[j].Time
+	})
+
+	return res, nil
+}
+
+// GetTransitionAnnotationsByResolvedWithin returns the annotations of the transitions of alert instances of an org
+// into firing that were resolved less than maxFiringDuration later, most recent first. Only alert instances that both
+// started firing and were resolved in the given time range are considered.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByResolvedWithin(ctx context.Context, orgID int64, maxFiringDuration time.Duration, from, to time.Time) ([]*annotations.ItemDTO, error) {
+	if maxFiringDuration <= 0 {
+		return nil, ErrLokiStoreBadRequest.Errorf("max firing duration must be positive")
+	}
+
+	logQL, err := historian.BuildStreamSelector(orgID)
+	if err != nil {
+		return nil, ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+	}
+
+	res, err := r.rangeQuery(ctx, orgID, logQL, from.UnixNano(), to.UnixNano(), 0)
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	items := make([]*annotations.ItemDTO, 0)
+	firing := make(map[string]*annotations.ItemDTO)
+	for _, e := range r.entriesFromStreams(res.Data.Result, nil) {
+		key := e.entry.RuleUID + e.entry.Fingerprint
+		if isFiring(e.entry.Current) {
+			if !isFiring(e.entry.Previous) {
+				firing[key] = e.item
+			}
+			continue
+		}
+
+		start, ok := firing[key]
+		if !ok {
+			continue
+		}
+		delete(firing, key)
+		if time.Duration(e.item.Time-start.Time)*time.Millisecond < maxFiringDuration {
+			items = append(items, start)
+		}
+	}
+	sort.Sort(annotations.SortedItems(items))
+
+	return items, nil
+}
+
+// StateAnnotationDTO is an annotation along with the state transition it was built from.
+type StateAnnotationDTO struct {
+	annotations.ItemDTO
+	Transition *state.StateTransition `json:"transition"`
+}
+
+// GetTransitionAnnotationsWithState returns the annotations matching the query, most recent first, each with
+// the state transition it was built from. Only what is recorded in Loki is set on the state of the transition.
+func (r *LokiHistorianStore) GetTransitionAnnotationsWithState(ctx context.Context, query *annotations.ItemQuery, resources *accesscontrol.AccessResources) ([]*StateAnnotationDTO, error) {
+	if resources == nil {
+		return nil, ErrLokiStoreBadRequest.Errorf("access resources must be provided")
+	}
+
+	entries, err := r.getEntries(ctx, query, resources)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*StateAnnotationDTO, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, &StateAnnotationDTO{
+			ItemDTO:    *e.item,
+			Transition: e.transition,
+		})
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Time > res[j].Time
+	})
+
+	return res, nil
+}
+
+// GetTransitionAnnotationsGroupedByRule returns the annotations matching the query keyed by the UID of their rule.
+// The annotations of each rule are sorted most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsGroupedByRule(ctx context.Context, query *annotations.ItemQuery, resources *accesscontrol.AccessResources) (map[string][]*annotations.ItemDTO, error) {
+	if resources == nil {
+		return nil, ErrLokiStoreBadRequest.Errorf("access resources must be provided")
+	}
+
+	entries, err := r.getEntries(ctx, query, resources)
+	if err != nil {
+		return nil, err
+	}
+
+	return groupItems(entries, func(e historian.LokiEntry) string { return e.RuleUID }), nil
+}
+
+// GetTransitionAnnotationsGroupedByDashboard returns the annotations matching the query keyed by the UID of the
+// dashboard of their rule. Annotations of rules without a dashboard are keyed by the empty string.
+// The annotations of each dashboard are sorted most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsGroupedByDashboard(ctx context.Context, query *annotations.ItemQuery, resources *accesscontrol.AccessResources) (map[string][]*annotations.ItemDTO, error) {
+	if resources == nil {
+		return nil, ErrLokiStoreBadRequest.Errorf("access resources must be provided")
+	}
+
+	entries, err := r.getEntries(ctx, query, resources)
+	if err != nil {
+		return nil, err
+	}
+
+	return groupItems(entries, func(e historian.LokiEntry) string { return e.DashboardUID }), nil
+}
+
+// EnrichedAnnotationDTO is an annotation along with the current metadata of its alert rule.
+type EnrichedAnnotationDTO struct {
+	annotations.ItemDTO
+	RuleGroup string `json:"ruleGroup"`
+	FolderUID string `json:"folderUID"`
+	// NotificationPolicies identify the autogenerated notification policies that alerts of the rule are routed by,
+	// if the rule uses simplified routing. They are the fingerprints of the rule's notification settings.
+	NotificationPolicies []string `json:"notificationPolicies"`
+}
+
+// GetTransitionAnnotationsWithRuleMetadata returns the annotations matching the query, most recent first, each with
+// metadata of its rule. The metadata is fetched from the database in a single query, so it is the current one and
+// not necessarily the one at the time of the transition. It is left empty for rules that were deleted.
+func (r *LokiHistorianStore) GetTransitionAnnotationsWithRuleMetadata(ctx context.Context, query *annotations.ItemQuery, resources *accesscontrol.AccessResources) ([]*EnrichedAnnotationDTO, error) {
+	if resources == nil {
+		return nil, ErrLokiStoreBadRequest.Errorf("access resources must be provided")
+	}
+
+	entries, err := r.getEntries(ctx, query, resources)
+	if err != nil {
+		return nil, err
+	}
+
+	uids := make([]string, 0)
+	seen := make(map[string]struct{})
+	for _, e := range entries {
+		if _, ok := seen[e.entry.RuleUID]; !ok {
+			seen[e.entry.RuleUID] = struct{}{}
+			uids = append(uids, e.entry.RuleUID)
+		}
+	}
+	rules, err := getRulesByUID(ctx, r.db, query.OrgID, uids)
+	if err != nil {
+		return nil, ErrLokiStoreInternal.Errorf("failed to query rules: %w", err)
+	}
+
+	res := make([]*EnrichedAnnotationDTO, 0, len(entries))
+	for _, e := range entries {
+		dto := &EnrichedAnnotationDTO{
+			ItemDTO:              *e.item,
+			NotificationPolicies: make([]string, 0),
+		}
+		if rule, ok := rules[e.entry.RuleUID]; ok {
+			dto.RuleGroup = rule.RuleGroup
+			dto.FolderUID = rule.NamespaceUID
+			for _, ns := range rule.NotificationSettings {
+				dto.NotificationPolicies = append(dto.NotificationPolicies, ns.Fingerprint().String())
+			}
+		}
+		res = append(res, dto)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Time > res[j].Time
+	})
+
+	return res, nil
+}
+
+// ExtendedAnnotationDTO is an annotation along with custom fields of its alert rule.
+type ExtendedAnnotationDTO struct {
+	annotations.ItemDTO
+	CustomFields map[string]string `json:"customFields"`
+}
+
+// GetTransitionAnnotationsWithCustomFields returns the annotations matching the query, most recent first, each with
+// the custom fields of its rule that are listed in query.CustomFieldKeys. Fields that the rule did not have when
+// the transition was recorded are left out.
+func (r *LokiHistorianStore) GetTransitionAnnotationsWithCustomFields(ctx context.Context, query *annotations.ItemQuery, resources *accesscontrol.AccessResources) ([]*ExtendedAnnotationDTO, error) {
+	if resources == nil {
+		return nil, ErrLokiStoreBadRequest.Errorf("access resources must be provided")
+	}
+
+	entries, err := r.getEntries(ctx, query, resources)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*ExtendedAnnotationDTO, 0, len(entries))
+	for _, e := range entries {
+		fields := make(map[string]string, len(query.CustomFieldKeys))
+		for _, key := range query.CustomFieldKeys {
+			if v, ok := e.entry.CustomFields[key]; ok {
+				fields[key] = v
+			}
+		}
+		res = append(res, &ExtendedAnnotationDTO{
+			ItemDTO:      *e.item,
+			CustomFields: fields,
+		})
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Time > res[j].Time
+	})
+
+	return res, nil
+}
+
+// ErrorAnnotationDTO is an annotation along with the details of the evaluation error of its transition.
+type ErrorAnnotationDTO struct {
+	annotations.ItemDTO
+	ErrorMessage string `json:"errorMessage,omitempty"`
+	ErrorType    string `json:"errorType,omitempty"`
+}
+
+// GetTransitionAnnotationsWithErrorDetails returns the annotations matching the query, most recent first, each with
+// the message and type of the evaluation error that its transition was caused by. Both are empty for transitions
+// that were not caused by an error.
+func (r *LokiHistorianStore) GetTransitionAnnotationsWithErrorDetails(ctx context.Context, query *annotations.ItemQuery, resources *accesscontrol.AccessResources) ([]*ErrorAnnotationDTO, error) {
+	if resources == nil {
+		return nil, ErrLokiStoreBadRequest.Errorf("access resources must be provided")
+	}
+
+	entries, err := r.getEntries(ctx, query, resources)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*ErrorAnnotationDTO, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, &ErrorAnnotationDTO{
+			ItemDTO:      *e.item,
+			ErrorMessage: e.entry.Error,
+			ErrorType:    e.entry.ErrorType,
+		})
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Time > res[j].Time
+	})
+
+	return res, nil
+}
+
+// GetTransitionAnnotationsByEvalError returns the annotations of the state transitions that were caused by an
+// evaluation error whose type matches the given regular expression, in the given time range, most recent first.
+// The pattern must match the whole error type, such as "sse\\..*" for all errors of server side expressions.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByEvalError(ctx context.Context, orgID int64, from, to time.Time, errorPattern string, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	if errorPattern == "" {
+		return nil, ErrLokiStoreBadRequest.Errorf("error pattern must be provided")
+	}
+	if _, err := regexp.Compile(errorPattern); err != nil {
+		return nil, ErrLokiStoreBadRequest.Errorf("invalid error pattern: %w", err)
+	}
+	return r.queryTransitions(ctx, orgID, from, to, resources, fmt.Sprintf("errorType=~%q", errorPattern))
+}
+
+// rangeQuery runs a range query against Loki on behalf of an org and records how long it took.
+func (r *LokiHistorianStore) rangeQuery(ctx context.Context, orgID int64, logQL string, from, to, limit int64) (historian.QueryRes, error) {
+	start := time.Now()
+	defer func() {
+		r.metrics.QueryDuration.WithLabelValues(fmt.Sprint(orgID)).Observe(time.Since(start).Seconds())
+	}()
+
+	return r.client.RangeQuery(historian.ContextWithOrgID(ctx, orgID), logQL, from, to, limit)
+}
+
+// queryError wraps an error of a Loki query. Errors caused by Loki being unavailable wrap ErrLokiUnavailable
+// and historian.ErrLokiUnavailable, like the errors of Ping. Queries that cannot be run on encrypted state history
+// wrap ErrLokiStoreBadRequest, others wrap ErrLokiStoreInternal.
+func queryError(err error) error {
+	if errors.Is(err, historian.ErrLokiUnavailable) {
+		return ErrLokiUnavailable.Errorf("failed to query loki: %w", err)
+	}
+	if errors.Is(err, historian.ErrEncryptedQuery) {
+		return ErrLokiStoreBadRequest.Errorf("failed to query loki: %w", err)
+	}
+	return ErrLokiStoreInternal.Errorf("failed to query loki: %w", err)
+}
+
+// metricsQuery runs a metric query against Loki on behalf of an org and records how long it took.
+func (r *LokiHistorianStore) metricsQuery(ctx context.Context, orgID int64, logQL string, from, to int64, step time.Duration) (historian.MetricQueryRes, error) {
+	start := time.Now()
+	defer func() {
+		r.metrics.QueryDuration.WithLabelValues(fmt.Sprint(orgID)).Observe(time.Since(start).Seconds())
+	}()
+
+	return r.client.MetricsQuery(historian.ContextWithOrgID(ctx, orgID), logQL, from, to, step)
+}
+
+// queryOverRange evaluates a metric query whose range is rng only once, at the given time.
+// With the time range of interest as rng, the query returns a single sample per series that covers all of it.
+func (r *LokiHistorianStore) queryOverRange(ctx context.Context, orgID int64, logQL string, at time.Time, rng time.Duration) ([]historian.MetricSeries, error) {
+	res, err := r.metricsQuery(ctx, orgID, logQL, at.UnixNano(), at.UnixNano(), rng)
+	if err != nil {
+		return nil, queryError(err)
+	}
+	return res.Data.Result, nil
+}
+
+// GetOldestEntry returns the time of the oldest entry that an org has in Loki, or nil if it has none.
+// Note that Loki might reject the query if it is configured with a maximum query length.
+func (r *LokiHistorianStore) GetOldestEntry(ctx context.Context, orgID int64) (*time.Time, error) {
+	logQL, err := historian.BuildStreamSelector(orgID)
+	if err != nil {
+		return nil, ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+	}
+
+	start := time.Now()
+	res, err := r.client.RangeQueryForward(historian.ContextWithOrgID(ctx, orgID), logQL, time.Unix(0, 0).UnixNano(), start.UnixNano(), 1)
+	r.metrics.QueryDuration.WithLabelValues(fmt.Sprint(orgID)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	var oldest *time.Time
+	for _, stream := range res.Data.Result {
+		for _, sample := range stream.Values {
+			if oldest == nil || sample.T.Before(*oldest) {
+				t := sample.T
+				oldest = &t
+			}
+		}
+	}
+
+	return oldest, nil
+}
+
+// LatencyPercentiles are percentiles of the duration of queries to Loki.
+type LatencyPercentiles struct {
+	P50 time.Duration
+	P95 time.Duration
+	P99 time.Duration
+}
+
+// GetLatencyPercentiles returns the percentiles of the duration of the queries made to Loki for an org,
+// estimated from the query duration histogram. All percentiles are zero if no query was made.
+func (r *LokiHistorianStore) GetLatencyPercentiles(ctx context.Context, orgID int64) (LatencyPercentiles, error) {
+	observer, err := r.metrics.QueryDuration.GetMetricWithLabelValues(fmt.Sprint(orgID))
+	if err != nil {
+		return LatencyPercentiles{}, ErrLokiStoreInternal.Errorf("failed to get query duration histogram: %w", err)
+	}
+	metric, ok := observer.(prometheus.Metric)
+	if !ok {
+		return LatencyPercentiles{}, ErrLokiStoreInternal.Errorf("unexpected query duration histogram type %T", observer)
+	}
+
+	m := &dto.Metric{}
+	if err := metric.Write(m); err != nil {
+		return LatencyPercentiles{}, ErrLokiStoreInternal.Errorf("failed to read query duration histogram: %w", err)
+	}
+
+	toDuration := func(seconds float64) time.Duration {
+		return time.Duration(seconds * float64(time.Second))
+	}
+
+	return LatencyPercentiles{
+		P50: toDuration(histogramQuantile(0.50, m.GetHistogram())),
+		P95: toDuration(histogramQuantile(0.95, m.GetHistogram())),
+		P99: toDuration(histogramQuantile(0.99, m.GetHistogram())),
+	}, nil
+}
+
+// RecordEvaluationGroup writes an entry to Loki for a single evaluation of a rule group.
+// This leaves a trace of the evaluation even when it does not produce any state transitions.
+func (r *LokiHistorianStore) RecordEvaluationGroup(ctx context.Context, orgID int64, group string, folderUID string, ruleCount int, duration time.Duration) error {
+	entry := historian.LokiEntry{
+		SchemaVersion: 1,
+		Type:          historian.EntryTypeEvaluationGroup,
+		Group:         group,
+		FolderUID:     folderUID,
+		RuleCount:     ruleCount,
+		DurationMs:    duration.Milliseconds(),
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return ErrLokiStoreInternal.Errorf("failed to marshal evaluation group entry: %w", err)
+	}
+
+	stream := historian.Stream{
+		Stream: map[string]string{
+			historian.StateHistoryLabelKey: historian.StateHistoryLabelValue,
+			historian.OrgIDLabel:           fmt.Sprint(orgID),
+			historian.GroupLabel:           group,
+			historian.FolderUIDLabel:       folderUID,
+		},
+		Values: []historian.Sample{
+			{T: time.Now(), V: string(line)},
+		},
+	}
+
+	if err := r.client.Push(historian.ContextWithOrgID(ctx, orgID), []historian.Stream{stream}); err != nil {
+		return ErrLokiStoreInternal.Errorf("failed to push evaluation group entry to loki: %w", err)
+	}
+
+	return nil
+}
+
+// CurrentAlertState is the most recent state of an alert instance, as recorded in Loki.
+type CurrentAlertState struct {
+	RuleID    int64
+	RuleUID   string
+	RuleTitle string
+	State     string
+	Labels    map[string]string
+	Since     time.Time
+	// ContactPoint is the contact point that the latest recorded notification about the alert instance was sent to,
+	// empty if there is none.
+	ContactPoint string
+}
+
+// GetFiringAlertsByFolder returns the alert instances of rules in the given folder that are currently firing.
+func (r *LokiHistorianStore) GetFiringAlertsByFolder(ctx context.Context, orgID int64, folderUID string) ([]*CurrentAlertState, error) {
+	ruleUIDs, err := getRuleUIDsByFolder(ctx, r.db, orgID, folderUID)
+	if err != nil {
+		return nil, ErrLokiStoreInternal.Errorf("failed to query rules in folder: %w", err)
+	}
+
+	return r.getCurrentlyFiringAlerts(ctx, orgID, ruleUIDs)
+}
+
+// GetTransitionAnnotationsByFolderPath returns the annotations of the state transitions of the rules in a folder in
+// the given time range, most recent first. The folder is designated by the titles of its ancestors and its own,
+// separated by slashes, such as "Parent/Child". If recursive is true, the rules in all subfolders are included.
+// Access control is not enforced, callers must make sure that the user can read the state history of the whole org.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByFolderPath(ctx context.Context, orgID int64, folderPath string, from, to time.Time, recursive bool, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	folderUID, err := getFolderUIDByPath(ctx, r.db, orgID, folderPath)
+	if err != nil {
+		if errors.Is(err, errMissingFolder) {
+			return nil, ErrLokiStoreNotFound.Errorf("folder %q does not exist", folderPath)
+		}
+		return nil, ErrLokiStoreInternal.Errorf("failed to query folder: %w", err)
+	}
+
+	folderUIDs := []string{folderUID}
+	if recursive {
+		folderUIDs, err = getDescendantFolderUIDs(ctx, r.db, orgID, folderUID)
+		if err != nil {
+			return nil, ErrLokiStoreInternal.Errorf("failed to query subfolders: %w", err)
+		}
+	}
+
+	ruleUIDs, err := getRuleUIDsByFolders(ctx, r.db, orgID, folderUIDs)
+	if err != nil {
+		return nil, ErrLokiStoreInternal.Errorf("failed to query rules in folder: %w", err)
+	}
+	if len(ruleUIDs) == 0 {
+		return make([]*annotations.ItemDTO, 0), nil
+	}
+
+	return r.queryTransitions(ctx, orgID, from, to, resources, fmt.Sprintf("ruleUID=~%q", uidsRegex(ruleUIDs)))
+}
+
+// GetTransitionAnnotationsByAlertRuleName returns the annotations of the state transitions of the rules with the
+// given title in the given time range, most recent first. Rules in different folders can share a title, the
+// transitions of all of them are returned.
+// Access control is not enforced, callers must make sure that the user can read the state history of the whole org.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByAlertRuleName(ctx context.Context, orgID int64, ruleName string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	if ruleName == "" {
+		return nil, ErrLokiStoreBadRequest.Errorf("rule name must be provided")
+	}
+
+	ruleUIDs, err := getRuleUIDsByTitle(ctx, r.db, orgID, ruleName)
+	if err != nil {
+		return nil, ErrLokiStoreInternal.Errorf("failed to query rules: %w", err)
+	}
+	if len(ruleUIDs) == 0 {
+		return make([]*annotations.ItemDTO, 0), nil
+	}
+
+	return r.queryTransitions(ctx, orgID, from, to, resources, fmt.Sprintf("ruleUID=~%q", uidsRegex(ruleUIDs)))
+}
+
+// getCurrentlyFiringAlerts returns the alert instances of the given rules whose latest recorded state is Alerting.
+// All rules are fetched with a single Loki query.
+func (r *LokiHistorianStore) getCurrentlyFiringAlerts(ctx context.Context, orgID int64, ruleUIDs []string) ([]*CurrentAlertState, error) {
+	if len(ruleUIDs) == 0 {
+		return make([]*CurrentAlertState, 0), nil
+	}
+
+	logQL, err := historian.BuildLogQuery(ngmodels.HistoryQuery{OrgID: orgID})
+	if err != nil {
+		return nil, ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+	}
+	logQL = fmt.Sprintf("%s | json | ruleUID=~%q", logQL, uidsRegex(ruleUIDs))
+
+	now := time.Now().UTC()
+	res, err := r.rangeQuery(ctx, orgID, logQL, now.Add(-defaultQueryRange).UnixNano(), now.UnixNano(), 0)
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	latest := r.latestAlertStates(res.Data.Result)
+	firing := make([]*CurrentAlertState, 0, len(latest))
+	for _, s := range latest {
+		if isFiring(s.State) {
+			firing = append(firing, s)
+		}
+	}
+	sort.Slice(firing, func(i, j int) bool {
+		if firing[i].RuleUID != firing[j].RuleUID {
+			return firing[i].RuleUID < firing[j].RuleUID
+		}
+		return firing[i].Since.Before(firing[j].Since)
+	})
+
+	return firing, nil
+}
+
+// latestAlertStates returns the most recent state of every alert instance found in the streams, keyed by rule UID and fingerprint.
+func (r *LokiHistorianStore) latestAlertStates(streams []historian.Stream) map[string]*CurrentAlertState {
+	latest := make(map[string]*CurrentAlertState)
+	type notification struct {
+		contactPoint string
+		time         time.Time
+	}
+	notified := make(map[string]notification)
+	for _, stream := range withoutDeleted(streams) {
+		for _, sample := range stream.Values {
+			entry := historian.LokiEntry{}
+			if err := json.Unmarshal([]byte(sample.V), &entry); err != nil {
+				r.log.Debug("failed to unmarshal loki entry", "error", err, "entry", sample.V)
+				continue
+			}
+
+			key := entry.RuleUID + entry.Fingerprint
+			if entry.Type == historian.EntryTypeNotification {
+				if cur, ok := notified[key]; !ok || !cur.time.After(sample.T) {
+					notified[key] = notification{contactPoint: entry.ContactPoint, time: sample.T}
+				}
+				continue
+			}
+			if entry.Type != "" {
+				continue
+			}
+
+			if cur, ok := latest[key]; ok && cur.Since.After(sample.T) {
+				continue
+			}
+			latest[key] = &CurrentAlertState{
+				RuleID:    entry.RuleID,
+				RuleUID:   entry.RuleUID,
+				RuleTitle: entry.RuleTitle,
+				State:     entry.Current,
+				Labels:    entry.InstanceLabels,
+				Since:     sample.T,
+			}
+		}
+	}
+	for key, s := range latest {
+		s.ContactPoint = notified[key].contactPoint
+	}
+
+	return latest
+}
+
+// StateDelta compares the rules that were firing at two points in time, by rule UID.
+type StateDelta struct {
+	NewlyFiring []string
+	Resolved    []string
+	StillFiring []string
+}
+
+// GetTransitionDelta compares the rules of an org that were firing before and after a point in time.
+// A rule is firing if any of its alert instances is firing.
+func (r *LokiHistorianStore) GetTransitionDelta(ctx context.Context, orgID int64, beforeTime, afterTime time.Time) (*StateDelta, error) {
+	if afterTime.Before(beforeTime) {
+		return nil, ErrLokiStoreBadRequest.Errorf("after time cannot be before before time")
+	}
+
+	before, err := r.getFiringRulesAt(ctx, orgID, beforeTime)
+	if err != nil {
+		return nil, err
+	}
+	after, err := r.getFiringRulesAt(ctx, orgID, afterTime)
+	if err != nil {
+		return nil, err
+	}
+
+	delta := &StateDelta{
+		NewlyFiring: make([]string, 0),
+		Resolved:    make([]string, 0),
+		StillFiring: make([]string, 0),
+	}
+	for uid := range after {
+		if _, ok := before[uid]; ok {
+			delta.StillFiring = append(delta.StillFiring, uid)
+		} else {
+			delta.NewlyFiring = append(delta.NewlyFiring, uid)
+		}
+	}
+	for uid := range before {
+		if _, ok := after[uid]; !ok {
+			delta.Resolved = append(delta.Resolved, uid)
+		}
+	}
+	sort.Strings(delta.NewlyFiring)
+	sort.Strings(delta.Resolved)
+	sort.Strings(delta.StillFiring)
+
+	return delta, nil
+}
+
+// getFiringRulesAt returns the UIDs of the rules that had at least one firing alert instance at the given time,
+// according to the state transitions recorded in the preceding defaultQueryRange.
+func (r *LokiHistorianStore) getFiringRulesAt(ctx context.Context, orgID int64, at time.Time) (map[string]struct{}, error) {
+	logQL, err := historian.BuildStreamSelector(orgID)
+	if err != nil {
+		return nil, ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+	}
+
+	res, err := r.rangeQuery(ctx, orgID, logQL, at.Add(-defaultQueryRange).UnixNano(), at.UnixNano(), 0)
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	firing := make(map[string]struct{})
+	for _, s := range r.latestAlertStates(res.Data.Result) {
+		if isFiring(s.State) {
+			firing[s.RuleUID] = struct{}{}
+		}
+	}
+
+	return firing, nil
+}
+
+// ReplayEntry is an alert instance whose notifications might have to be sent again.
+type ReplayEntry struct {
+	RuleUID     string
+	FiringStart time.Time
+	Labels      map[string]string
+	// ContactPoint is the contact point that the latest recorded notification about the alert instance was sent to,
+	// empty if there is none.
+	ContactPoint string
+}
+
+// GetAnnotationsForReplay returns the alert instances of an org that started firing in the given time range
+// and were still firing at its end, oldest first. If the Alertmanager was not running during the time range,
+// their notifications might not have been sent.
+func (r *LokiHistorianStore) GetAnnotationsForReplay(ctx context.Context, orgID int64, from, to time.Time) ([]ReplayEntry, error) {
+	logQL, err := historian.BuildStreamSelector(orgID)
+	if err != nil {
+		return nil, ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+	}
+
+	res, err := r.rangeQuery(ctx, orgID, logQL, from.UnixNano(), to.UnixNano(), 0)
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	replay := make([]ReplayEntry, 0)
+	for _, s := range r.latestAlertStates(res.Data.Result) {
+		if !isFiring(s.State) {
+			continue
+		}
+		replay = append(replay, ReplayEntry{
+			RuleUID:      s.RuleUID,
+			FiringStart:  s.Since,
+			Labels:       s.Labels,
+			ContactPoint: s.ContactPoint,
+		})
+	}
+	sort.Slice(replay, func(i, j int) bool {
+		if !replay[i].FiringStart.Equal(replay[j].FiringStart) {
+			return replay[i].FiringStart.Before(replay[j].FiringStart)
+		}
+		return replay[i].RuleUID < replay[j].RuleUID
+	})
+
+	return replay, nil
+}
+
+// ChaosTestRunIDLabel is the label that ties alert rules and alert instances to a chaos engineering test run.
+// Rules that carry it are expected to fire during the run, and failures injected by the run carry it in the
+// series they produce, so that it ends up in the labels of the alert instances that they cause to fire.
+const ChaosTestRunIDLabel = "chaos_test_run_id"
+
+// ChaosTestResult compares the rules that were expected to fire during a chaos engineering test run with the ones
+// that did. All lists are sorted rule UIDs.
+type ChaosTestResult struct {
+	ExpectedFiringRules []string
+	ActualFiringRules   []string
+	// MissingFires are the rules that were expected to fire but did not.
+	MissingFires []string
+	// UnexpectedFires are the rules that fired but were not expected to.
+	UnexpectedFires []string
+}
+
+// GetTransitionAnnotationsForChaosEngineering compares the rules of an org that are labeled with the test run ID
+// with the rules that had alert instances of the test run start firing in the given time range.
+func (r *LokiHistorianStore) GetTransitionAnnotationsForChaosEngineering(ctx context.Context, orgID int64, testRunID string, from, to time.Time) (ChaosTestResult, error) {
+	if testRunID == "" {
+		return ChaosTestResult{}, ErrLokiStoreBadRequest.Errorf("test run ID must be provided")
+	}
+
+	expected, err := getRuleUIDsByLabel(ctx, r.db, orgID, ChaosTestRunIDLabel, testRunID)
+	if err != nil {
+		return ChaosTestResult{}, ErrLokiStoreInternal.Errorf("failed to query rules: %w", err)
+	}
+
+	logQL, err := historian.BuildStreamSelector(orgID)
+	if err != nil {
+		return ChaosTestResult{}, ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+	}
+	logQL += fmt.Sprintf(" | json | labels_%s=%q", ChaosTestRunIDLabel, testRunID)
+
+	res, err := r.rangeQuery(ctx, orgID, logQL, from.UnixNano(), to.UnixNano(), 0)
+	if err != nil {
+		return ChaosTestResult{}, queryError(err)
+	}
+
+	fired := make(map[string]struct{})
+	for _, e := range r.entriesFromStreams(res.Data.Result, nil) {
+		if isFiring(e.entry.Current) {
+			fired[e.entry.RuleUID] = struct{}{}
+		}
+	}
+
+	result := ChaosTestResult{
+		ExpectedFiringRules: expected,
+		ActualFiringRules:   make([]string, 0, len(fired)),
+		MissingFires:        make([]string, 0),
+		UnexpectedFires:     make([]string, 0),
+	}
+	for uid := range fired {
+		result.ActualFiringRules = append(result.ActualFiringRules, uid)
+		if !slices.Contains(expected, uid) {
+			result.UnexpectedFires = append(result.UnexpectedFires, uid)
+		}
+	}
+	for _, uid := range expected {
+		if _, ok := fired[uid]; !ok {
+			result.MissingFires = append(result.MissingFires, uid)
+		}
+	}
+	sort.Strings(result.ExpectedFiringRules)
+	sort.Strings(result.ActualFiringRules)
+	sort.Strings(result.MissingFires)
+	sort.Strings(result.UnexpectedFires)
+
+	return result, nil
+}
+
+// MultiInstanceAlert is an alert rule with state transitions for several of its alert instances.
+type MultiInstanceAlert struct {
+	RuleUID string
+	// InstanceCount is the number of distinct alert instances of the rule with state transitions.
+	InstanceCount int64
+	// FiringInstances are the labels of the alert instances whose latest state is Alerting.
+	FiringInstances []map[string]string
+}
+
+// GetTransitionsByInstanceCount returns the rules of an org with state transitions for at least minInstances
+// distinct alert instances in the given time range, the rules with most instances first.
+func (r *LokiHistorianStore) GetTransitionsByInstanceCount(ctx context.Context, orgID int64, from, to time.Time, minInstances int) ([]MultiInstanceAlert, error) {
+	if minInstances < 1 {
+		return nil, ErrLokiStoreBadRequest.Errorf("minimum number of instances must be positive")
+	}
+
+	instances, err := r.getInstancesByRule(ctx, orgID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]MultiInstanceAlert, 0)
+	for ruleUID, states := range instances {
+		if len(states) < minInstances {
+			continue
+		}
+		alert := MultiInstanceAlert{
+			RuleUID:         ruleUID,
+			InstanceCount:   int64(len(states)),
+			FiringInstances: make([]map[string]string, 0),
+		}
+		for _, s := range states {
+			if isFiring(s.State) {
+				alert.FiringInstances = append(alert.FiringInstances, s.Labels)
+			}
+		}
+		result = append(result, alert)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].InstanceCount != result[j].InstanceCount {
+			return result[i].InstanceCount > result[j].InstanceCount
+		}
+		return result[i].RuleUID < result[j].RuleUID
+	})
+
+	return result, nil
+}
+
+// CardinalityReport is the number of distinct alert instances of a rule.
+type CardinalityReport struct {
+	RuleUID             string
+	UniqueInstanceCount int64
+}
+
+// GetTransitionsByLabelCardinality returns the rules of an org with state transitions for more than maxCardinality
+// distinct alert instances in the given time range, the rules with most instances first.
+func (r *LokiHistorianStore) GetTransitionsByLabelCardinality(ctx context.Context, orgID int64, from, to time.Time, maxCardinality int) ([]CardinalityReport, error) {
+	if maxCardinality < 0 {
+		return nil, ErrLokiStoreBadRequest.Errorf("maximum cardinality cannot be negative")
+	}
+
+	instances, err := r.getInstancesByRule(ctx, orgID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]CardinalityReport, 0)
+	for ruleUID, states := range instances {
+		if len(states) > maxCardinality {
+			result = append(result, CardinalityReport{RuleUID: ruleUID, UniqueInstanceCount: int64(len(states))})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].UniqueInstanceCount != result[j].UniqueInstanceCount {
+			return result[i].UniqueInstanceCount > result[j].UniqueInstanceCount
+		}
+		return result[i].RuleUID < result[j].RuleUID
+	})
+
+	return result, nil
+}
+
+// getInstancesByRule returns the latest state of the alert instances of an org with state transitions in the given
+// time range, grouped by rule UID. Alert instances are told apart by the fingerprint of their labels.
+func (r *LokiHistorianStore) getInstancesByRule(ctx context.Context, orgID int64, from, to time.Time) (map[string][]*CurrentAlertState, error) {
+	logQL, err := historian.BuildStreamSelector(orgID)
+	if err != nil {
+		return nil, ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+	}
+
+	res, err := r.rangeQuery(ctx, orgID, logQL, from.UnixNano(), to.UnixNano(), 0)
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	byRule := make(map[string][]*CurrentAlertState)
+	for _, s := range r.latestAlertStates(res.Data.Result) {
+		byRule[s.RuleUID] = append(byRule[s.RuleUID], s)
+	}
+
+	return byRule, nil
+}
+
+// GroupSummary summarizes the state history of a rule group.
+type GroupSummary struct {
+	// RuleCount is the number of rules of the group that have state history in the time range.
+	RuleCount int
+	// FiringCount is the number of rules with at least one alert instance whose latest state is Alerting.
+	FiringCount int
+	// LastEvaluation is the time of the most recent entry recorded for the group.
+	LastEvaluation time.Time
+	// TotalTransitions is the number of state transitions recorded for the group.
+	TotalTransitions int64
+}
+
+// GetAlertGroupSummary returns a summary of the state history of a rule group in the given time range.
+func (r *LokiHistorianStore) GetAlertGroupSummary(ctx context.Context, orgID int64, groupName string, from, to time.Time) (GroupSummary, error) {
+	logQL, err := historian.BuildStreamSelector(orgID, historian.Selector{Label: historian.GroupLabel, Op: historian.Eq, Value: groupName})
+	if err != nil {
+		return GroupSummary{}, ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+	}
+
+	res, err := r.rangeQuery(ctx, orgID, logQL, from.UnixNano(), to.UnixNano(), 0)
+	if err != nil {
+		return GroupSummary{}, queryError(err)
+	}
+
+	streams := withoutDeleted(res.Data.Result)
+	summary := GroupSummary{}
+	rules := make(map[string]struct{})
+	for _, stream := range streams {
+		for _, sample := range stream.Values {
+			if sample.T.After(summary.LastEvaluation) {
+				summary.LastEvaluation = sample.T
+			}
+
+			entry := historian.LokiEntry{}
+			if err := json.Unmarshal([]byte(sample.V), &entry); err != nil {
+				r.log.Debug("failed to unmarshal loki entry", "error", err, "entry", sample.V)
+				continue
+			}
+			if entry.Type != "" {
+				continue
+			}
+
+			rules[entry.RuleUID] = struct{}{}
+			summary.TotalTransitions++
+		}
+	}
+	summary.RuleCount = len(rules)
+
+	firing := make(map[string]struct{})
+	for _, s := range r.latestAlertStates(streams) {
+		if isFiring(s.State) {
+			firing[s.RuleUID] = struct{}{}
+		}
+	}
+	summary.FiringCount = len(firing)
+
+	return summary, nil
+}
+
+// GetTransitionsByNote returns the annotations of state transitions whose rule note contains the given substring.
+func (r *LokiHistorianStore) GetTransitionsByNote(ctx context.Context, orgID int64, noteSubstring string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	return r.queryTransitions(ctx, orgID, from, to, resources,
+		`note!=""`,
+		fmt.Sprintf("note=~%q", ".*"+regexp.QuoteMeta(noteSubstring)+".*"),
+	)
+}
+
+// RuleStorageUsage is the size of the state history of an alert rule.
+type RuleStorageUsage struct {
+	RuleUID string `json:"ruleUID"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// SizeStats describes the size of the state history of an org.
+type SizeStats struct {
+	TotalBytes    int64   `json:"totalBytes"`
+	EntryCount    int64   `json:"entryCount"`
+	AvgEntryBytes float64 `json:"avgEntryBytes"`
+	// TopRulesBySize are the rules with the largest state history, largest first.
+	TopRulesBySize []RuleStorageUsage `json:"topRulesBySize"`
+}
+
+// GetAnnotationSizeStats returns the size of the state history that an org stored in Loki in the given time range.
+func (r *LokiHistorianStore) GetAnnotationSizeStats(ctx context.Context, orgID int64, from, to time.Time) (SizeStats, error) {
+	rng := to.Sub(from).Truncate(time.Millisecond)
+	if rng <= 0 {
+		return SizeStats{}, ErrLokiStoreBadRequest.Errorf("time range is too short")
+	}
+
+	selector, err := historian.BuildStreamSelector(orgID)
+	if err != nil {
+		return SizeStats{}, ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+	}
+
+	stats := SizeStats{TopRulesBySize: make([]RuleStorageUsage, 0)}
+
+	bytes, err := r.queryOverRange(ctx, orgID, fmt.Sprintf("sum(bytes_over_time(%s [%s]))", selector, model.Duration(rng)), to, rng)
+	if err != nil {
+		return SizeStats{}, err
+	}
+	for _, series := range bytes {
+		stats.TotalBytes += lastSampleValue(series)
+	}
+
+	counts, err := r.queryOverRange(ctx, orgID, fmt.Sprintf("sum(count_over_time(%s [%s]))", selector, model.Duration(rng)), to, rng)
+	if err != nil {
+		return SizeStats{}, err
+	}
+	for _, series := range counts {
+		stats.EntryCount += lastSampleValue(series)
+	}
+	if stats.EntryCount > 0 {
+		stats.AvgEntryBytes = float64(stats.TotalBytes) / float64(stats.EntryCount)
+	}
+
+	rules, err := r.queryOverRange(ctx, orgID, fmt.Sprintf("topk(%d, sum by (ruleUID) (bytes_over_time(%s | json [%s])))", topRulesBySizeLimit, selector, model.Duration(rng)), to, rng)
+	if err != nil {
+		return SizeStats{}, err
+	}
+	for _, series := range rules {
+		uid := series.Metric["ruleUID"]
+		if uid == "" {
+			continue
+		}
+		stats.TopRulesBySize = append(stats.TopRulesBySize, RuleStorageUsage{RuleUID: uid, Bytes: lastSampleValue(series)})
+	}
+	sort.SliceStable(stats.TopRulesBySize, func(i, j int) bool {
+		return stats.TopRulesBySize[i].Bytes > stats.TopRulesBySize[j].Bytes
+	})
+
+	return stats, nil
+}
+
+// AnnotationStats is an overview of the state history of an org.
+type AnnotationStats struct {
+	TotalCount           int64
+	UniqueRuleCount      int64
+	UniqueDashboardCount int64
+	// StateDistribution is the number of transitions into each state.
+	StateDistribution map[string]int64
+}
+
+// GetAnnotationStats returns an overview of the state transitions that an org recorded in the given time range.
+func (r *LokiHistorianStore) GetAnnotationStats(ctx context.Context, orgID int64, from, to time.Time) (AnnotationStats, error) {
+	rng := to.Sub(from).Truncate(time.Millisecond)
+	if rng <= 0 {
+		return AnnotationStats{}, ErrLokiStoreBadRequest.Errorf("time range is too short")
+	}
+
+	selector, err := historian.BuildStreamSelector(orgID)
+	if err != nil {
+		return AnnotationStats{}, ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+	}
+	// Only count state transitions, which have no type.
+	transitions := fmt.Sprintf(`count_over_time(%s | json | type="" [%s])`, selector, model.Duration(rng))
+
+	stats := AnnotationStats{StateDistribution: make(map[string]int64)}
+
+	states, err := r.queryOverRange(ctx, orgID, fmt.Sprintf("sum by (current, %s) (%s)", deletedLabel, transitions), to, rng)
+	if err != nil {
+		return AnnotationStats{}, err
+	}
+	for _, series := range states {
+		count := countSign(series) * lastSampleValue(series)
+		stats.StateDistribution[series.Metric["current"]] += count
+		stats.TotalCount += count
+	}
+	maps.DeleteFunc(stats.StateDistribution, func(_ string, count int64) bool { return count == 0 })
+
+	// The number of distinct values of a label is the number of series when grouping by it. Tombstones are left
+	// out, but a rule or dashboard whose transitions were all deleted is still counted.
+	liveTransitions := fmt.Sprintf(`count_over_time(%s | json | type="" | %s!="true" [%s])`, selector, deletedLabel, model.Duration(rng))
+	rules, err := r.queryOverRange(ctx, orgID, fmt.Sprintf("count(sum by (ruleUID) (%s))", liveTransitions), to, rng)
+	if err != nil {
+		return AnnotationStats{}, err
+	}
+	for _, series := range rules {
+		stats.UniqueRuleCount += lastSampleValue(series)
+	}
+
+	dashboardTransitions := fmt.Sprintf(`count_over_time(%s | json | type="" | %s!="true" | dashboardUID!="" [%s])`, selector, deletedLabel, model.Duration(rng))
+	dashboards, err := r.queryOverRange(ctx, orgID, fmt.Sprintf("count(sum by (dashboardUID) (%s))", dashboardTransitions), to, rng)
+	if err != nil {
+		return AnnotationStats{}, err
+	}
+	for _, series := range dashboards {
+		stats.UniqueDashboardCount += lastSampleValue(series)
+	}
+
+	return stats, nil
+}
+
+// notificationLookahead is how long after the end of a time range the notifications about the state transitions in
+// the range are looked up. Notifications are only sent once the group wait of the notification policy has elapsed.
+const notificationLookahead = time.Hour
+
+// GetTransitionsByContactPoint returns the annotations of the state transitions in the given time range that the
+// given contact point was notified about, most recent first. A transition was notified if a notification about its
+// alert instance was sent to the contact point after it, and before the next transition of the instance.
+func (r *LokiHistorianStore) GetTransitionsByContactPoint(ctx context.Context, orgID int64, contactPointName string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	if contactPointName == "" {
+		return nil, ErrLokiStoreBadRequest.Errorf("contact point name must be provided")
+	}
+	return r.queryNotifiedTransitions(ctx, orgID, from, to, resources, fmt.Sprintf("contactPoint=%q", contactPointName), func(entry historian.LokiEntry) bool {
+		return entry.ContactPoint == contactPointName
+	})
+}
+
+// queryNotifiedTransitions returns the annotations of the state transitions in the given time range that were
+// followed by a notification about their alert instance before the next transition of the instance, most recent
+// first. Only the notifications that match both the LogQL label filter and the match function are considered.
+func (r *LokiHistorianStore) queryNotifiedTransitions(ctx context.Context, orgID int64, from, to time.Time, resources *accesscontrol.AccessResources, notificationFilter string, match func(historian.LokiEntry) bool) ([]*annotations.ItemDTO, error) {
+	if resources == nil {
+		return nil, ErrLokiStoreBadRequest.Errorf("access resources must be provided")
+	}
+	filter, ok := accessFilter(*resources)
+	if !ok {
+		return make([]*annotations.ItemDTO, 0), nil
+	}
+
+	selector, err := historian.BuildStreamSelector(orgID)
+	if err != nil {
+		return nil, ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+	}
+	logQL := fmt.Sprintf("%s | json | type=%q | %s | %s", selector, historian.EntryTypeNotification, notificationFilter, filter)
+	res, err := r.rangeQuery(ctx, orgID, logQL, from.UnixNano(), to.Add(notificationLookahead).UnixNano(), 0)
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	// The times at which each alert instance was notified, in chronological order.
+	notified := make(map[string][]time.Time)
+	ruleUIDs := make([]string, 0)
+	for _, stream := range res.Data.Result {
+		for _, sample := range stream.Values {
+			entry := historian.LokiEntry{}
+			if err := json.Unmarshal([]byte(sample.V), &entry); err != nil {
+				// bad data, skip
+				r.log.Debug("failed to unmarshal loki entry", "error", err, "entry", sample.V)
+				continue
+			}
+			if entry.Type != historian.EntryTypeNotification || !match(entry) {
+				continue
+			}
+			key := entry.RuleUID + entry.Fingerprint
+			if _, ok := notified[key]; !ok && !slices.Contains(ruleUIDs, entry.RuleUID) {
+				ruleUIDs = append(ruleUIDs, entry.RuleUID)
+			}
+			notified[key] = append(notified[key], sample.T)
+		}
+	}
+	if len(notified) == 0 {
+		return make([]*annotations.ItemDTO, 0), nil
+	}
+	for _, times := range notified {
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	}
+	sort.Strings(ruleUIDs)
+
+	logQL = fmt.Sprintf("%s | json | ruleUID=~%q | %s", selector, uidsRegex(ruleUIDs), filter)
+	res, err = r.rangeQuery(ctx, orgID, logQL, from.UnixNano(), to.UnixNano(), 0)
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	entries := r.entriesFromStreams(res.Data.Result, resources)
+	next := nextTransitionTimes(entries)
+	items := make([]*annotations.ItemDTO, 0)
+	for i, e := range entries {
+		times := notified[e.entry.RuleUID+e.entry.Fingerprint]
+		t := time.UnixMilli(e.item.Time)
+		j := sort.Search(len(times), func(j int) bool { return !times[j].Before(t) })
+		if j < len(times) && (next[i] == nil || times[j].Before(*next[i])) {
+			items = append(items, e.item)
+		}
+	}
+	sort.Sort(annotations.SortedItems(items))
+
+	return items, nil
+}
+
+// GetTransitionsByRecordingRule returns the annotations of state transitions of rules that are evaluated against
+// the output of the given recording rule.
+func (r *LokiHistorianStore) GetTransitionsByRecordingRule(ctx context.Context, recordingRuleUID string, orgID int64, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	return r.queryTransitions(ctx, orgID, from, to, resources, fmt.Sprintf("recordingRuleUID=%q", recordingRuleUID))
+}
+
+// GetTransitionsByNotificationPolicy returns the annotations of state transitions of rules whose alerts are routed
+// by the given autogenerated notification policy, identified by the fingerprint of the rules' notification settings.
+func (r *LokiHistorianStore) GetTransitionsByNotificationPolicy(ctx context.Context, orgID int64, policyUID string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	return r.queryTransitions(ctx, orgID, from, to, resources, fmt.Sprintf("policyRoute=%q", policyUID))
+}
+
+// GetTransitionAnnotationsInBulk returns the latest annotation of each of the given dashboards within the lookback
+// period, keyed by dashboard UID. Dashboards without annotations in the period are not in the result.
+func (r *LokiHistorianStore) GetTransitionAnnotationsInBulk(ctx context.Context, orgID int64, dashboardUIDs []string, lookback time.Duration, resources *accesscontrol.AccessResources) (map[string]*annotations.ItemDTO, error) {
+	if lookback <= 0 {
+		return nil, ErrLokiStoreBadRequest.Errorf("lookback must be positive")
+	}
+
+	latest := make(map[string]*annotations.ItemDTO, len(dashboardUIDs))
+	if len(dashboardUIDs) == 0 {
+		return latest, nil
+	}
+
+	now := time.Now()
+	items, err := r.queryTransitions(ctx, orgID, now.Add(-lookback), now, resources, fmt.Sprintf("dashboardUID=~%q", uidsRegex(dashboardUIDs)))
+	if err != nil {
+		return nil, err
+	}
+
+	// Items are sorted most recent first.
+	for _, item := range items {
+		if item.DashboardUID == nil {
+			continue
+		}
+		if _, ok := latest[*item.DashboardUID]; !ok {
+			latest[*item.DashboardUID] = item
+		}
+	}
+
+	return latest, nil
+}
+
+// GetTransitionAnnotationsByAlertRuleVersion returns the annotations of the state transitions of a rule that were
+// recorded while it was at the given version, over the default query range, most recent first.
+// Entries written before the rule version was recorded are never returned.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByAlertRuleVersion(ctx context.Context, ruleUID string, orgID int64, version int64, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	if ruleUID == "" {
+		return nil, ErrLokiStoreBadRequest.Errorf("rule UID must be provided")
+	}
+
+	now := time.Now().UTC()
+	return r.queryTransitions(ctx, orgID, now.Add(-defaultQueryRange), now, resources,
+		fmt.Sprintf("ruleUID=%q", ruleUID),
+		fmt.Sprintf("ruleVersion=%d", version),
+	)
+}
+
+// GetTransitionAnnotationsByEvaluationNode returns the annotations of the state transitions recorded by the Grafana
+// instance with the given node ID in the given time range, most recent first. The node ID is the instance name.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByEvaluationNode(ctx context.Context, orgID int64, nodeID string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	if nodeID == "" {
+		return nil, ErrLokiStoreBadRequest.Errorf("node ID must be provided")
+	}
+	return r.queryTransitions(ctx, orgID, from, to, resources, fmt.Sprintf("nodeID=%q", nodeID))
+}
+
+// GetTransitionAnnotationsByRuleCondition returns the annotations of the state transitions of rules whose condition
+// is the query or expression with the given ref ID, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByRuleCondition(ctx context.Context, orgID int64, condition string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	if condition == "" {
+		return nil, ErrLokiStoreBadRequest.Errorf("condition must be provided")
+	}
+	return r.queryTransitions(ctx, orgID, from, to, resources, fmt.Sprintf("condition=%q", condition))
+}
+
+// GetTransitionAnnotationsByAlertGroup returns the annotations of the state transitions of alert instances in the
+// Alertmanager group with the given label set, such as {alertname="a", grafana_folder="b"}, in the given time range,
+// most recent first. Groups are only known for rules that set the labels to group by.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByAlertGroup(ctx context.Context, orgID int64, groupKey string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	if groupKey == "" {
+		return nil, ErrLokiStoreBadRequest.Errorf("group key must be provided")
+	}
+	return r.queryTransitions(ctx, orgID, from, to, resources, fmt.Sprintf("groupKey=%q", groupKey))
+}
+
+// GetTransitionAnnotationsByResolutionSource returns the annotations of the resolutions of firing alerts that had
+// the given source, either historian.ResolutionSourceAuto or historian.ResolutionSourceManual, in the given time
+// range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByResolutionSource(ctx context.Context, orgID int64, source string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	if source != historian.ResolutionSourceAuto && source != historian.ResolutionSourceManual {
+		return nil, ErrLokiStoreBadRequest.Errorf("unknown resolution source %q, must be %q or %q", source, historian.ResolutionSourceAuto, historian.ResolutionSourceManual)
+	}
+	return r.queryTransitions(ctx, orgID, from, to, resources, fmt.Sprintf("resolutionSource=%q", source))
+}
+
+// GetTransitionAnnotationsBySeverity returns the annotations of the state transitions of alert instances with
+// the given severity label, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsBySeverity(ctx context.Context, orgID int64, severity string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	if !slices.Contains(knownSeverities, severity) {
+		return nil, ErrLokiStoreBadRequest.Errorf("unknown severity %q, must be one of %v", severity, knownSeverities)
+	}
+	return r.queryTransitions(ctx, orgID, from, to, resources, fmt.Sprintf("labels_%s=%q", severityLabel, severity))
+}
+
+// GetTransitionAnnotationsByLabelSet returns the annotations of the state transitions of alert instances with
+// exactly the given labels, in the given time range, most recent first. Unlike the instance label filter of Get,
+// alert instances with any labels besides the given ones do not match.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByLabelSet(ctx context.Context, orgID int64, labels map[string]string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	if len(labels) == 0 {
+		return nil, ErrLokiStoreBadRequest.Errorf("labels must be provided")
+	}
+	if err := validateFieldKeys("label", labels); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	filters := make([]string, 0, len(labels)+1)
+	for _, k := range keys {
+		filters = append(filters, fmt.Sprintf("labels_%s=%q", k, labels[k]))
+	}
+	// The fingerprint is computed over all labels of the alert instance, so it rules out any other labels.
+	filters = append(filters, fmt.Sprintf("fingerprint=%q", historian.LabelFingerprint(labels)))
+
+	return r.queryTransitions(ctx, orgID, from, to, resources, filters...)
+}
+
+// GetTransitionAnnotationsByAlertRuleTag returns the annotations of the state transitions of the alert rules that
+// have the given tag, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByAlertRuleTag(ctx context.Context, orgID int64, tag string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	if tag == "" {
+		return nil, ErrLokiStoreBadRequest.Errorf("tag must be provided")
+	}
+	if strings.ContainsFunc(tag, unicode.IsSpace) {
+		return nil, ErrLokiStoreBadRequest.Errorf("tag must not contain whitespace")
+	}
+	// Tags are recorded as a space-separated list, the tag must match one of them as a whole.
+	return r.queryTransitions(ctx, orgID, from, to, resources, fmt.Sprintf("tags=~%q", "(.* )?"+regexp.QuoteMeta(tag)+"( .*)?"))
+}
+
+// GetTransitionAnnotationsByCustomAnnotation returns the annotations of the state transitions of the alert rules
+// that have all of the given free-form annotations, such as summary or description, in the given time range,
+// most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByCustomAnnotation(ctx context.Context, orgID int64, filter map[string]string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	if len(filter) == 0 {
+		return nil, ErrLokiStoreBadRequest.Errorf("annotations must be provided")
+	}
+	if err := validateFieldKeys("annotation", filter); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(filter))
+	for k := range filter {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	filters := make([]string, 0, len(filter))
+	for _, k := range keys {
+		filters = append(filters, fmt.Sprintf("customFields_%s=%q", k, filter[k]))
+	}
+
+	return r.queryTransitions(ctx, orgID, from, to, resources, filters...)
+}
+
+// fieldKeyRegexp matches the keys of maps in state history entries, such as labels or custom fields, that can be
+// filtered by. The json parser of Loki joins them to the name of the map, and other keys would not make valid
+// label names in a LogQL label filter.
+var fieldKeyRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// validateFieldKeys returns an ErrLokiStoreBadRequest error if any of the keys of the filter cannot be filtered by.
+func validateFieldKeys(kind string, filter map[string]string) error {
+	for k := range filter {
+		if !fieldKeyRegexp.MatchString(k) {
+			return ErrLokiStoreBadRequest.Errorf("invalid %s name %q, must match %s", kind, k, fieldKeyRegexp)
+		}
+	}
+	return nil
+}
+
+// transitionFieldFilters has the label filter of each field that queryTransitionsByField can query
+// state transitions by. The fields are those of the state history entries, except environment, which is a label.
+var transitionFieldFilters = map[string]func(value string) string{
+	"application":         equalFieldFilter("application"),
+	"clusterID":           equalFieldFilter("clusterID"),
+	"deploymentID":        equalFieldFilter("deploymentID"),
+	"environment":         equalFieldFilter("labels_" + environmentLabel),
+	"featureFlag":         equalFieldFilter("featureFlag"),
+	"incidentID":          equalFieldFilter("incidentID"),
+	"maintenanceWindowID": equalFieldFilter("maintenanceWindowID"),
+	"namespace":           equalFieldFilter("namespace"),
+	"onCallPolicy":        equalFieldFilter("onCallPolicy"),
+	"priority":            equalFieldFilter("priority"),
+	"reconciliationID":    equalFieldFilter("reconciliationID"),
+	"region":              equalFieldFilter("region"),
+	"serviceName":         equalFieldFilter("serviceName"),
+	"team":                equalFieldFilter("team"),
+	"tenantID":            equalFieldFilter("tenantID"),
+	// A trailing slash is ignored when matching runbook URLs.
+	"runbookURL": func(url string) string {
+		return fmt.Sprintf("runbookURL=~%q", regexp.QuoteMeta(strings.TrimSuffix(url, "/"))+"/?")
+	},
+}
+
+func equalFieldFilter(field string) func(value string) string {
+	return func(value string) string {
+		return fmt.Sprintf("%s=%q", field, value)
+	}
+}
+
+// queryTransitionsByField returns the annotations of the state transitions whose field has the given value,
+// in the given time range, most recent first. The field is one of the keys of transitionFieldFilters.
+func (r *LokiHistorianStore) queryTransitionsByField(ctx context.Context, orgID int64, field, value string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	filter, ok := transitionFieldFilters[field]
+	if !ok {
+		return nil, ErrLokiStoreInternal.Errorf("transitions cannot be queried by field %q", field)
+	}
+	if value == "" {
+		return nil, ErrLokiStoreBadRequest.Errorf("%s must be provided", field)
+	}
+	return r.queryTransitions(ctx, orgID, from, to, resources, filter(value))
+}
+
+// GetTransitionAnnotationsByClusterID returns the annotations of the state transitions recorded by the given
+// cluster of Grafana instances, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByClusterID(ctx context.Context, orgID int64, clusterID string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	return r.queryTransitionsByField(ctx, orgID, "clusterID", clusterID, from, to, resources)
+}
+
+// GetTransitionAnnotationsByEnvironment returns the annotations of the state transitions of alert instances with
+// the given environment label, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByEnvironment(ctx context.Context, orgID int64, environment string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	return r.queryTransitionsByField(ctx, orgID, "environment", environment, from, to, resources)
+}
+
+// GetTransitionAnnotationsByTeam returns the annotations of the state transitions of the alert rules owned by the
+// given team, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByTeam(ctx context.Context, orgID int64, teamName string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	return r.queryTransitionsByField(ctx, orgID, "team", teamName, from, to, resources)
+}
+
+// GetTransitionAnnotationsByApplication returns the annotations of the state transitions of the alert rules of the
+// given application, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByApplication(ctx context.Context, orgID int64, application string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	return r.queryTransitionsByField(ctx, orgID, "application", application, from, to, resources)
+}
+
+// GetTransitionAnnotationsByRegion returns the annotations of the state transitions recorded by Grafana instances
+// in the given region, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByRegion(ctx context.Context, orgID int64, region string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	return r.queryTransitionsByField(ctx, orgID, "region", region, from, to, resources)
+}
+
+// GetTransitionAnnotationsByTenant returns the annotations of the state transitions of the alert rules owned by the
+// given tenant of the org, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByTenant(ctx context.Context, orgID int64, tenantID string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	return r.queryTransitionsByField(ctx, orgID, "tenantID", tenantID, from, to, resources)
+}
+
+// GetTransitionAnnotationsByReconciliationID returns the annotations of the state transitions of the alert rules
+// last applied by the given infrastructure-as-code reconciliation run, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByReconciliationID(ctx context.Context, orgID int64, reconciliationID string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	return r.queryTransitionsByField(ctx, orgID, "reconciliationID", reconciliationID, from, to, resources)
+}
+
+// GetTransitionAnnotationsByIncidentID returns the annotations of the state transitions of the alert rules attached
+// to the given external incident, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByIncidentID(ctx context.Context, orgID int64, incidentID string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	return r.queryTransitionsByField(ctx, orgID, "incidentID", incidentID, from, to, resources)
+}
+
+// GetTransitionAnnotationsByServiceName returns the annotations of the state transitions of the alert instances of
+// the given service, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByServiceName(ctx context.Context, orgID int64, serviceName string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	return r.queryTransitionsByField(ctx, orgID, "serviceName", serviceName, from, to, resources)
+}
+
+// GetTransitionAnnotationsByPriority returns the annotations of the state transitions of the alert rules with the
+// given priority, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByPriority(ctx context.Context, orgID int64, priority string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	return r.queryTransitionsByField(ctx, orgID, "priority", priority, from, to, resources)
+}
+
+// GetTransitionAnnotationsByNamespace returns the annotations of the state transitions of the alert instances in
+// the given Kubernetes namespace, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByNamespace(ctx context.Context, orgID int64, namespace string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	return r.queryTransitionsByField(ctx, orgID, "namespace", namespace, from, to, resources)
+}
+
+// GetTransitionAnnotationsByDeploymentID returns the annotations of the state transitions of the alert instances
+// tied to the given deployment, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByDeploymentID(ctx context.Context, orgID int64, deploymentID string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	return r.queryTransitionsByField(ctx, orgID, "deploymentID", deploymentID, from, to, resources)
+}
+
+// GetTransitionAnnotationsByFeatureFlag returns the annotations of the state transitions of the alert rules tied to
+// the given feature flag, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByFeatureFlag(ctx context.Context, orgID int64, featureFlag string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	return r.queryTransitionsByField(ctx, orgID, "featureFlag", featureFlag, from, to, resources)
+}
+
+// GetTransitionAnnotationsByRunbook returns the annotations of the state transitions of the alert rules that link to
+// the given runbook URL, in the given time range, most recent first. A trailing slash is ignored when matching URLs.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByRunbook(ctx context.Context, orgID int64, runbookURL string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	return r.queryTransitionsByField(ctx, orgID, "runbookURL", runbookURL, from, to, resources)
+}
+
+// GetTransitionAnnotationsByOnCallPolicy returns the annotations of the state transitions of the alert rules that are
+// escalated to the given on-call policy, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByOnCallPolicy(ctx context.Context, orgID int64, policy string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	return r.queryTransitionsByField(ctx, orgID, "onCallPolicy", policy, from, to, resources)
+}
+
+// GetTransitionAnnotationsByMaintenanceWindow returns the annotations of the state transitions that happened during
+// the given maintenance window, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByMaintenanceWindow(ctx context.Context, orgID int64, windowID string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	return r.queryTransitionsByField(ctx, orgID, "maintenanceWindowID", windowID, from, to, resources)
+}
+
+// GetTransitionAnnotationsByDatasource returns the annotations of the state transitions of rules that query the
+// given data source, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByDatasource(ctx context.Context, orgID int64, datasourceUID string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	if datasourceUID == "" {
+		return nil, ErrLokiStoreBadRequest.Errorf("data source UID must be provided")
+	}
+	// Data source UIDs are recorded as a comma-separated list.
+	return r.queryTransitions(ctx, orgID, from, to, resources, fmt.Sprintf("datasourceUIDs=~%q", "(.*,)?"+regexp.QuoteMeta(datasourceUID)+"(,.*)?"))
+}
+
+// GetTransitionAnnotationsByGrafanaVersion returns the annotations of the state transitions that were recorded by
+// Grafana instances running the given version, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByGrafanaVersion(ctx context.Context, orgID int64, version string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	if version == "" {
+		return nil, ErrLokiStoreBadRequest.Errorf("version must be provided")
+	}
+	return r.queryTransitions(ctx, orgID, from, to, resources, fmt.Sprintf("grafanaVersion=%q", version))
+}
+
+// GetTransitionAnnotationsByThrottleKey returns the annotations of the state transitions in the given time range that
+// were notified through the Alertmanager aggregation group with the given key, whose notifications are throttled by
+// the group interval and repeat interval of its notification policy, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByThrottleKey(ctx context.Context, orgID int64, throttleKey string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	if throttleKey == "" {
+		return nil, ErrLokiStoreBadRequest.Errorf("throttle key must be provided")
+	}
+	return r.queryNotifiedTransitions(ctx, orgID, from, to, resources, fmt.Sprintf("throttleKey=%q", throttleKey), func(entry historian.LokiEntry) bool {
+		return entry.ThrottleKey == throttleKey
+	})
+}
+
+// GetTransitionAnnotationsByNoDataBehavior returns the annotations of the state transitions of alert rules that
+// treat evaluations without data as the given state, Alerting, NoData or OK, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByNoDataBehavior(ctx context.Context, orgID int64, behavior string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	if _, err := ngmodels.NoDataStateFromString(behavior); err != nil {
+		return nil, ErrLokiStoreBadRequest.Errorf("invalid no data behavior: %w", err)
+	}
+	return r.queryTransitions(ctx, orgID, from, to, resources, fmt.Sprintf("noDataBehavior=%q", behavior))
+}
+
+// GetTransitionAnnotationsByMutedStatus returns the annotations of the state transitions that happened while
+// notifications of the alert were muted, or not muted, in the given time range, most recent first.
+// Entries that do not record whether the alert was muted are considered not muted.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByMutedStatus(ctx context.Context, orgID int64, from, to time.Time, muted bool, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	filter := `muted="true"`
+	if !muted {
+		filter = `muted!="true"`
+	}
+	return r.queryTransitions(ctx, orgID, from, to, resources, filter)
+}
+
+// GetAlertingAnnotations returns the annotations of the transitions into the Alerting state of the alerts of a
+// dashboard in the given time range, most recent first. It answers the most common annotation query with a
+// pre-built LogQL query rather than the general one built by buildLogQuery, so that Loki drops the lines of other
+// dashboards before parsing them and only returns the transitions into Alerting.
+func (r *LokiHistorianStore) GetAlertingAnnotations(ctx context.Context, dashboardUID string, orgID int64, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	if resources == nil {
+		return nil, ErrLokiStoreBadRequest.Errorf("access resources must be provided")
+	}
+	if dashboardUID == "" {
+		return nil, ErrLokiStoreBadRequest.Errorf("dashboard UID must be provided")
+	}
+
+	logQL, err := alertingAnnotationsQuery(orgID, dashboardUID)
+	if err != nil {
+		return nil, ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+	}
+
+	res, err := r.rangeQuery(ctx, orgID, logQL, from.UnixNano(), to.UnixNano(), 0)
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	entries := r.entriesFromStreams(res.Data.Result, resources)
+	for _, e := range entries {
+		// Only transitions into Alerting are returned, so the previous entry of the rule is not necessarily the
+		// one before this transition. Rely on what was recorded instead.
+		e.item.PrevState = e.entry.Previous
+	}
+	items := itemsFromEntries(entries)
+	sort.Sort(annotations.SortedItems(items))
+
+	return items, nil
+}
+
+// alertingAnnotationsQuery builds the LogQL query for the transitions into the Alerting state of the alerts of a
+// dashboard. The line filter matches the dashboard UID as it is encoded in the log line, so that Loki does not
+// need to parse the lines of other dashboards.
+func alertingAnnotationsQuery(orgID int64, dashboardUID string) (string, error) {
+	selector, err := historian.BuildStreamSelector(orgID)
+	if err != nil {
+		return "", err
+	}
+	encodedUID, err := json.Marshal(dashboardUID)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`%s |= %q | json | dashboardUID=%q | current=~%q`, selector, `"dashboardUID":`+string(encodedUID), dashboardUID, eval.Alerting.String()+".*"), nil
+}
+
+// GetTransitionAnnotationsForDashboardSnapshot returns the annotations of a dashboard to embed in a snapshot of it
+// taken at snapshotTime, that is the state transitions within lookback before snapshotTime, most recent first.
+// Unlike the time range of other queries, the window includes its end, so that a transition at snapshotTime is kept.
+func (r *LokiHistorianStore) GetTransitionAnnotationsForDashboardSnapshot(ctx context.Context, orgID int64, dashboardUID string, snapshotTime time.Time, lookback time.Duration, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	if resources == nil {
+		return nil, ErrLokiStoreBadRequest.Errorf("access resources must be provided")
+	}
+	if dashboardUID == "" {
+		return nil, ErrLokiStoreBadRequest.Errorf("dashboard UID must be provided")
+	}
+	if lookback <= 0 {
+		return nil, ErrLokiStoreBadRequest.Errorf("lookback must be positive")
+	}
+
+	return r.Get(ctx, &annotations.ItemQuery{
+		OrgID:        orgID,
+		DashboardUID: dashboardUID,
+		From:         snapshotTime.Add(-lookback).UnixMilli(),
+		To:           snapshotTime.UnixMilli() + 1,
+	}, resources)
+}
+
+// GetTransitionAnnotationsByPendingPeriod returns the annotations of state transitions of rules whose alerts are
+// pending for at least the given period before they fire, in the given time range, most recent first.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByPendingPeriod(ctx context.Context, orgID int64, minPending time.Duration, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	if minPending < 0 {
+		return nil, ErrLokiStoreBadRequest.Errorf("minimum pending period must not be negative")
+	}
+	return r.queryTransitions(ctx, orgID, from, to, resources, fmt.Sprintf("pendingDurationMs>=%d", minPending.Milliseconds()))
+}
+
+// GetTransitionAnnotationsByEvaluationInterval returns the annotations of state transitions of rules whose
+// evaluation interval exceeds minInterval. Entries written before the interval was recorded are never returned.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByEvaluationInterval(ctx context.Context, orgID int64, from, to time.Time, minInterval time.Duration, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	if minInterval < 0 {
+		return nil, ErrLokiStoreBadRequest.Errorf("minimum evaluation interval must not be negative")
+	}
+	return r.queryTransitions(ctx, orgID, from, to, resources, fmt.Sprintf("evaluationIntervalMs>%d", minInterval.Milliseconds()))
+}
+
+// GetTransitionsByCustomExpr returns the annotations of the state transitions matching a LogQL log query.
+// The query must start with the stream selector of the org, so that only its state history can be queried.
+// Entries are only returned if they are accessible with the given resources.
+func (r *LokiHistorianStore) GetTransitionsByCustomExpr(ctx context.Context, orgID int64, logqlExpr string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	if resources == nil {
+		return nil, ErrLokiStoreBadRequest.Errorf("access resources must be provided")
+	}
+
+	selector, err := historian.BuildStreamSelector(orgID)
+	if err != nil {
+		return nil, ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+	}
+	logQL := strings.TrimSpace(logqlExpr)
+	pipeline, ok := strings.CutPrefix(logQL, selector)
+	if !ok {
+		return nil, ErrLokiStoreBadRequest.Errorf("query must start with the stream selector %s", selector)
+	}
+	if err := parseLogPipeline(pipeline); err != nil {
+		return nil, ErrLokiStoreBadRequest.Errorf("invalid query: %w", err)
+	}
+
+	return r.queryItems(ctx, orgID, logQL, from, to, resources)
+}
+
+// GetTransitionAnnotationsByOrg returns the annotations of the state transitions of several orgs in the given time range,
+// most recent first, keyed by org ID. If no org is given, the state history of all orgs is returned.
+// Access control is not enforced, it is meant for server admins only.
+func (r *LokiHistorianStore) GetTransitionAnnotationsByOrg(ctx context.Context, orgIDs []int64, from, to time.Time) (map[int64][]*annotations.ItemDTO, error) {
+	var streams []historian.Stream
+	if r.tenantIDMode == "" || r.tenantIDMode == historian.TenantIDModeFixed {
+		logQL := historian.BuildMultiOrgStreamSelector(orgIDs)
+		res, err := r.client.RangeQuery(ctx, logQL, from.UnixNano(), to.UnixNano(), 0)
+		if err != nil {
+			return nil, queryError(err)
+		}
+		streams = res.Data.Result
+	} else {
+		// Each org has a tenant of its own, so they are queried one at a time.
+		if len(orgIDs) == 0 {
+			var err error
+			orgIDs, err = getOrgIDs(ctx, r.db)
+			if err != nil {
+				return nil, ErrLokiStoreInternal.Errorf("failed to query orgs: %w", err)
+			}
+		}
+		for _, orgID := range orgIDs {
+			logQL := historian.BuildMultiOrgStreamSelector([]int64{orgID})
+			res, err := r.rangeQuery(ctx, orgID, logQL, from.UnixNano(), to.UnixNano(), 0)
+			if err != nil {
+				return nil, queryError(err)
+			}
+			streams = append(streams, res.Data.Result...)
+		}
+	}
+
+	streamsByOrg := make(map[int64][]historian.Stream)
+	for _, orgID := range orgIDs {
+		streamsByOrg[orgID] = nil
+	}
+	for _, stream := range streams {
+		orgID, err := strconv.ParseInt(stream.Stream[historian.OrgIDLabel], 10, 64)
+		if err != nil {
+			// bad data, skip
+			r.log.Debug("failed to parse org ID of loki stream", "error", err, "stream", stream.Stream)
+			continue
+		}
+		streamsByOrg[orgID] = append(streamsByOrg[orgID], stream)
+	}
+
+	result := make(map[int64][]*annotations.ItemDTO, len(streamsByOrg))
+	for orgID, streams := range streamsByOrg {
+		items := itemsFromEntries(r.entriesFromStreams(streams, nil))
+		sort.Sort(annotations.SortedItems(items))
+		result[orgID] = items
+	}
+
+	return result, nil
+}
+
+// queryTransitions returns the annotations of the state transitions of an org in the given time range that are
+// accessible with the given resources, most recent first. The filters are LogQL label filter expressions applied to
+// the fields of the parsed log line.
+func (r *LokiHistorianStore) queryTransitions(ctx context.Context, orgID int64, from, to time.Time, resources *accesscontrol.AccessResources, filters ...string) ([]*annotations.ItemDTO, error) {
+	if resources == nil {
+		return nil, ErrLokiStoreBadRequest.Errorf("access resources must be provided")
+	}
+	filter, ok := accessFilter(*resources)
+	if !ok {
+		return make([]*annotations.ItemDTO, 0), nil
+	}
+
+	logQL, err := historian.BuildStreamSelector(orgID)
+	if err != nil {
+		return nil, ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+	}
+	logQL += " | json | " + strings.Join(append(filters, filter), " | ")
+
+	return r.queryItems(ctx, orgID, logQL, from, to, resources)
+}
+
+// queryItems runs a LogQL log query for an org and returns the annotations of the state transitions it matches,
+// most recent first. If resources are given, only the entries that are accessible with them are returned.
+func (r *LokiHistorianStore) queryItems(ctx context.Context, orgID int64, logQL string, from, to time.Time, resources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
+	res, err := r.rangeQuery(ctx, orgID, logQL, from.UnixNano(), to.UnixNano(), 0)
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	items := itemsFromEntries(r.entriesFromStreams(res.Data.Result, resources))
+	sort.Sort(annotations.SortedItems(items))
+
+	return items, nil
+}
+
+// GetTransitionAnnotationsForReconciliation returns the IDs of the state transition annotations that an org has
+// in Loki in the given time range, as computed by ComputeAnnotationID. Comparing them with the IDs computed for
+// annotations stored in the database tells which of these are missing from Loki.
+func (r *LokiHistorianStore) GetTransitionAnnotationsForReconciliation(ctx context.Context, orgID int64, from, to time.Time) (map[int64]bool, error) {
+	logQL, err := historian.BuildStreamSelector(orgID)
+	if err != nil {
+		return nil, ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+	}
+	// Reconciliation compares all annotations of the org, regardless of who can read them.
+	items, err := r.queryItems(ctx, orgID, logQL, from, to, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[int64]bool, len(items))
+	for _, item := range items {
+		ids[item.ID] = true
+	}
+
+	return ids, nil
+}
 
-	errMissingRule = errors.New("rule not found")
+// The IDs of state transition annotations have stateHistoryIDFlag set, which keeps them apart from the IDs of
+// annotations stored in the database. The next bits hold the time of the transition in seconds, so that it can be
+// looked up without scanning the state history, and the lowest idHashBits hold a hash of the transition.
+const (
+	stateHistoryIDFlag = int64(1) << 62
+	idHashBits         = 29
 )
 
-type lokiQueryClient interface {
-	RangeQuery(ctx context.Context, query string, start, end, limit int64) (historian.QueryRes, error)
+// ComputeAnnotationID computes an ID for a state transition annotation that only depends on its content,
+// so that it is the same for an annotation stored in the database and in Loki.
+// The time is in milliseconds and the fingerprint is historian.LabelFingerprint of the labels of the alert instance,
+// so that instances of a rule that transition to the same state at the same time get different IDs.
+// The ID is always positive.
+func ComputeAnnotationID(orgID, alertID, epoch int64, newState, fingerprint string) int64 {
+	h := fnv.New64a()
+	_, _ = fmt.Fprintf(h, "%d:%d:%d:%s:%s", orgID, alertID, epoch, newState, fingerprint)
+	hash := int64(h.Sum64() & (1<<idHashBits - 1))
+	seconds := (epoch / 1000) & (stateHistoryIDFlag>>idHashBits - 1)
+	return stateHistoryIDFlag | seconds<<idHashBits | hash
 }
 
-// LokiHistorianStore is a read store that queries Loki for alert state history.
-type LokiHistorianStore struct {
-	client lokiQueryClient
-	db     db.DB
-	log    log.Logger
+// annotationIDTime returns the time of the state transition of an annotation ID computed by ComputeAnnotationID,
+// to the second. It returns false if the ID is not such an ID.
+func annotationIDTime(id int64) (time.Time, bool) {
+	if id&stateHistoryIDFlag == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix((id&^stateHistoryIDFlag)>>idHashBits, 0), true
 }
 
-func NewLokiHistorianStore(cfg setting.UnifiedAlertingStateHistorySettings, ft featuremgmt.FeatureToggles, db db.DB, log log.Logger) *LokiHistorianStore {
-	if !useStore(cfg, ft) {
-		return nil
+// Delete deletes a state transition annotation of an org by its ID, as computed by ComputeAnnotationID.
+// Loki is append-only, so this records a tombstone for the transition, which hides it from all reads.
+// The transition is looked up in the second that the ID holds.
+func (r *LokiHistorianStore) Delete(ctx context.Context, orgID int64, id int64, resources *accesscontrol.AccessResources) error {
+	if resources == nil {
+		return ErrLokiStoreBadRequest.Errorf("access resources must be provided")
 	}
-	lokiCfg, err := historian.NewLokiConfig(cfg)
+	at, ok := annotationIDTime(id)
+	if !ok {
+		return ErrAnnotationNotFound.Errorf("annotation %d does not exist", id)
+	}
+
+	logQL, err := historian.BuildStreamSelector(orgID)
 	if err != nil {
-		// this config error is already handled elsewhere
-		return nil
+		return ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+	}
+	streams, err := r.rangeQueryAll(ctx, orgID, logQL, at.UnixNano(), at.Add(time.Second).UnixNano())
+	if err != nil {
+		return queryError(err)
 	}
 
-	return &LokiHistorianStore{
-		client: historian.NewLokiClient(lokiCfg, historian.NewRequester(), ngmetrics.NewHistorianMetrics(prometheus.DefaultRegisterer, subsystem), log),
-		db:     db,
-		log:    log,
+	// A transition that already has a tombstone is not found again.
+	for _, stream := range withoutDeleted(streams) {
+		for _, sample := range stream.Values {
+			entry := historian.LokiEntry{}
+			if err := json.Unmarshal([]byte(sample.V), &entry); err != nil || entry.Type != "" {
+				continue
+			}
+			if ComputeAnnotationID(orgID, entry.RuleID, sample.T.UnixMilli(), entry.Current, entry.Fingerprint) != id {
+				continue
+			}
+			if !hasAccess(entry, *resources) {
+				return ErrAccessDenied.Errorf("no access to annotation %d", id)
+			}
+
+			entry.Deleted = true
+			line, err := json.Marshal(entry)
+			if err != nil {
+				return ErrLokiStoreInternal.Errorf("failed to marshal tombstone: %w", err)
+			}
+			tombstone := historian.Stream{Stream: stream.Stream, Values: []historian.Sample{{T: sample.T, V: string(line)}}}
+			if err := r.client.Push(historian.ContextWithOrgID(ctx, orgID), []historian.Stream{tombstone}); err != nil {
+				return ErrLokiStoreInternal.Errorf("failed to push tombstone to loki: %w", err)
+			}
+			return nil
+		}
 	}
+
+	return ErrAnnotationNotFound.Errorf("annotation %d does not exist", id)
 }
 
-func (r *LokiHistorianStore) Type() string {
-	return "loki"
+// tombstoneKey identifies the state transition that a tombstone deletes.
+func tombstoneKey(entry historian.LokiEntry, t time.Time) string {
+	return fmt.Sprintf("%s:%s:%s:%d", entry.RuleUID, entry.Fingerprint, entry.Current, t.UnixNano())
 }
 
-func (r *LokiHistorianStore) Get(ctx context.Context, query *annotations.ItemQuery, accessResources *accesscontrol.AccessResources) ([]*annotations.ItemDTO, error) {
-	if query.Type == "annotation" {
-		return make([]*annotations.ItemDTO, 0), nil
+// withoutDeleted removes the tombstones recorded by Delete from the streams, along with the state transitions that
+// they delete. Lines that cannot be parsed are kept, for the caller to skip.
+func withoutDeleted(streams []historian.Stream) []historian.Stream {
+	tombstones := make(map[string]struct{})
+	for _, stream := range streams {
+		for _, sample := range stream.Values {
+			// Only tombstones have to be parsed to find out what they delete.
+			if !strings.Contains(sample.V, `"deleted":true`) {
+				continue
+			}
+			entry := historian.LokiEntry{}
+			if err := json.Unmarshal([]byte(sample.V), &entry); err == nil && entry.Deleted {
+				tombstones[tombstoneKey(entry, sample.T)] = struct{}{}
+			}
+		}
+	}
+	if len(tombstones) == 0 {
+		return streams
 	}
 
-	rule := &ngmodels.AlertRule{}
-	if query.AlertID != 0 {
-		var err error
-		rule, err = getRule(ctx, r.db, query.OrgID, query.AlertID)
-		if err != nil {
-			if errors.Is(err, errMissingRule) {
-				return make([]*annotations.ItemDTO, 0), ErrLokiStoreNotFound.Errorf("rule with ID %d does not exist", query.AlertID)
+	res := make([]historian.Stream, 0, len(streams))
+	for _, stream := range streams {
+		values := make([]historian.Sample, 0, len(stream.Values))
+		for _, sample := range stream.Values {
+			entry := historian.LokiEntry{}
+			if err := json.Unmarshal([]byte(sample.V), &entry); err == nil {
+				if entry.Deleted {
+					continue
+				}
+				if _, ok := tombstones[tombstoneKey(entry, sample.T)]; ok && entry.Type == "" {
+					continue
+				}
 			}
-			return make([]*annotations.ItemDTO, 0), ErrLokiStoreInternal.Errorf("failed to query rule: %w", err)
+			values = append(values, sample)
 		}
+		res = append(res, historian.Stream{Stream: stream.Stream, Values: values})
+	}
+
+	return res
+}
+
+// countSign is the sign of the counts of a metric series that is grouped by the deleted label: -1 for tombstones and
+// 1 for all other entries. A tombstone has the fields of the state transition that it deletes, so it is counted along
+// with it, and subtracting the count of tombstones leaves the deleted transitions out.
+func countSign(series historian.MetricSeries) int64 {
+	if series.Metric[deletedLabel] == "true" {
+		return -1
 	}
+	return 1
+}
+
+// RuleChangeEvent is a change to an alert rule, as recorded in Loki.
+type RuleChangeEvent struct {
+	Timestamp   time.Time
+	ChangedBy   string
+	OldTitle    string
+	NewTitle    string
+	DiffSummary string
+}
 
-	logQL, err := historian.BuildLogQuery(buildHistoryQuery(query, accessResources.Dashboards, rule.UID))
+// ruleChangeEntry is the log line of an entry of type historian.EntryTypeRuleChange.
+type ruleChangeEntry struct {
+	Type      string `json:"type"`
+	RuleUID   string `json:"ruleUID"`
+	RuleID    int64  `json:"ruleID,omitempty"`
+	ChangedBy string `json:"changedBy"`
+	Diff      struct {
+		OldTitle string `json:"oldTitle"`
+		NewTitle string `json:"newTitle"`
+		Summary  string `json:"summary"`
+	} `json:"diff"`
+}
+
+// GetAlertRuleChangeLog returns the changes recorded for an alert rule in the given time range, most recent first.
+func (r *LokiHistorianStore) GetAlertRuleChangeLog(ctx context.Context, ruleUID string, orgID int64, from, to time.Time) ([]RuleChangeEvent, error) {
+	logQL, err := historian.BuildStreamSelector(orgID)
 	if err != nil {
-		return make([]*annotations.ItemDTO, 0), ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+		return nil, ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
 	}
+	logQL = fmt.Sprintf("%s | json | type=%q | ruleUID=%q", logQL, historian.EntryTypeRuleChange, ruleUID)
 
-	now := time.Now().UTC()
-	if query.To == 0 {
-		query.To = now.UnixMilli()
+	res, err := r.rangeQuery(ctx, orgID, logQL, from.UnixNano(), to.UnixNano(), 0)
+	if err != nil {
+		return nil, queryError(err)
 	}
-	if query.From == 0 {
-		query.From = now.Add(-defaultQueryRange).UnixMilli()
+
+	events := make([]RuleChangeEvent, 0)
+	for _, stream := range res.Data.Result {
+		for _, sample := range stream.Values {
+			entry := ruleChangeEntry{}
+			if err := json.Unmarshal([]byte(sample.V), &entry); err != nil {
+				// bad data, skip
+				r.log.Debug("failed to unmarshal rule change entry", "error", err, "entry", sample.V)
+				continue
+			}
+			if entry.Type != historian.EntryTypeRuleChange || entry.RuleUID != ruleUID {
+				continue
+			}
+
+			events = append(events, RuleChangeEvent{
+				Timestamp:   sample.T,
+				ChangedBy:   entry.ChangedBy,
+				OldTitle:    entry.Diff.OldTitle,
+				NewTitle:    entry.Diff.NewTitle,
+				DiffSummary: entry.Diff.Summary,
+			})
+		}
 	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Timestamp.After(events[j].Timestamp)
+	})
 
-	// query.From and query.To are always in milliseconds, convert them to nanoseconds for loki
-	from := query.From * 1e6
-	to := query.To * 1e6
+	return events, nil
+}
 
-	res, err := r.client.RangeQuery(ctx, logQL, from, to, query.Limit)
+// GetAnnotationsByUser returns annotations for the changes to alert rules that the given user made in the given
+// time range, most recent first.
+func (r *LokiHistorianStore) GetAnnotationsByUser(ctx context.Context, orgID int64, userLogin string, from, to time.Time) ([]*annotations.ItemDTO, error) {
+	logQL, err := historian.BuildStreamSelector(orgID)
 	if err != nil {
-		return make([]*annotations.ItemDTO, 0), ErrLokiStoreInternal.Errorf("failed to query loki: %w", err)
+		return nil, ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+	}
+	logQL = fmt.Sprintf("%s | json | type=%q | changedBy=%q", logQL, historian.EntryTypeRuleChange, userLogin)
+
+	res, err := r.rangeQuery(ctx, orgID, logQL, from.UnixNano(), to.UnixNano(), 0)
+	if err != nil {
+		return nil, queryError(err)
 	}
 
 	items := make([]*annotations.ItemDTO, 0)
 	for _, stream := range res.Data.Result {
-		items = append(items, r.annotationsFromStream(stream, *accessResources)...)
+		for _, sample := range stream.Values {
+			entry := ruleChangeEntry{}
+			if err := json.Unmarshal([]byte(sample.V), &entry); err != nil {
+				// bad data, skip
+				r.log.Debug("failed to unmarshal rule change entry", "error", err, "entry", sample.V)
+				continue
+			}
+			if entry.Type != historian.EntryTypeRuleChange || entry.ChangedBy != userLogin {
+				continue
+			}
+
+			items = append(items, &annotations.ItemDTO{
+				AlertID:   entry.RuleID,
+				AlertName: entry.Diff.NewTitle,
+				Time:      sample.T.UnixMilli(),
+				TimeEnd:   sample.T.UnixMilli(),
+				Text:      entry.Diff.Summary,
+				Login:     entry.ChangedBy,
+			})
+		}
 	}
 	sort.Sort(annotations.SortedItems(items))
 
-	return items, err
+	return items, nil
 }
 
-func (r *LokiHistorianStore) annotationsFromStream(stream historian.Stream, ac accesscontrol.AccessResources) []*annotations.ItemDTO {
-	items := make([]*annotations.ItemDTO, 0, len(stream.Values))
-	for _, sample := range stream.Values {
-		entry := historian.LokiEntry{}
-		err := json.Unmarshal([]byte(sample.V), &entry)
+// BackupResult summarizes a backup of state history to object storage.
+type BackupResult struct {
+	FilesWritten    int
+	EntriesBackedUp int64
+	BytesWritten    int64
+}
+
+// backupEntry is a line of a backup file.
+type backupEntry struct {
+	Time   time.Time         `json:"time"`
+	Labels map[string]string `json:"labels"`
+	Line   json.RawMessage   `json:"line"`
+}
+
+// BackupToObjectStorage copies the state history of an org that is older than the given age to an object storage bucket,
+// so that it is kept after Loki's retention period. Entries are written as NDJSON, one file per day, under <orgID>/<date>.ndjson.
+// A single query cannot cover more than backupRange, so the history is read one backupRange at a time, going back from
+// the cutoff until a range has no entries, which happens at the end of Loki's retention period.
+func (r *LokiHistorianStore) BackupToObjectStorage(ctx context.Context, orgID int64, olderThan time.Duration, target *blob.Bucket) (BackupResult, error) {
+	logQL, err := historian.BuildStreamSelector(orgID)
+	if err != nil {
+		return BackupResult{}, ErrLokiStoreInternal.Errorf("failed to build loki query: %w", err)
+	}
+
+	days := make(map[string][]backupEntry)
+	to := time.Now().UTC().Add(-olderThan)
+	for {
+		from := to.Add(-backupRange)
+		streams, err := r.rangeQueryAll(ctx, orgID, logQL, from.UnixNano(), to.UnixNano())
 		if err != nil {
-			// bad data, skip
-			r.log.Debug("failed to unmarshal loki entry", "error", err, "entry", sample.V)
-			continue
+			return BackupResult{}, queryError(err)
 		}
 
-		if !hasAccess(entry, ac) {
-			// no access to this annotation, skip
+		count := 0
+		for _, stream := range streams {
+			for _, sample := range stream.Values {
+				count++
+				if !json.Valid([]byte(sample.V)) {
+					// bad data, skip
+					r.log.Debug("skipping invalid loki entry in backup", "entry", sample.V)
+					continue
+				}
+
+				day := sample.T.UTC().Format(time.DateOnly)
+				days[day] = append(days[day], backupEntry{
+					Time:   sample.T,
+					Labels: stream.Stream,
+					Line:   json.RawMessage(sample.V),
+				})
+			}
+		}
+		if count == 0 {
+			break
+		}
+		to = from
+	}
+
+	result := BackupResult{}
+	for day, entries := range days {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Time.Before(entries[j].Time)
+		})
+
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, e := range entries {
+			if err := enc.Encode(e); err != nil {
+				return result, ErrLokiStoreInternal.Errorf("failed to encode backup entry: %w", err)
+			}
+		}
+
+		key := fmt.Sprintf("%d/%s.ndjson", orgID, day)
+		if err := target.WriteAll(ctx, key, buf.Bytes(), nil); err != nil {
+			return result, ErrLokiStoreInternal.Errorf("failed to write backup file %s: %w", key, err)
+		}
+
+		result.FilesWritten++
+		result.EntriesBackedUp += int64(len(entries))
+		result.BytesWritten += int64(buf.Len())
+	}
+
+	return result, nil
+}
+
+func (r *LokiHistorianStore) annotationsFromStream(stream historian.Stream, ac accesscontrol.AccessResources) []*annotations.ItemDTO {
+	return itemsFromEntries(r.entriesFromStreams([]historian.Stream{stream}, &ac))
+}
+
+// entriesFromStreams builds annotations from the samples of all streams, in chronological order.
+// The previous state of each annotation is the state of the last annotation of the same alert instance,
+// so that it is correct even when the entries of an instance are spread across interleaved streams.
+// If ac is nil, access control is not enforced.
+func (r *LokiHistorianStore) entriesFromStreams(streams []historian.Stream, ac *accesscontrol.AccessResources) []annotationEntry {
+	type orgSample struct {
+		historian.Sample
+		orgID int64
+		entry historian.LokiEntry
+	}
+	samples := make([]orgSample, 0)
+	for _, stream := range withoutDeleted(streams) {
+		orgID, _ := strconv.ParseInt(stream.Stream[historian.OrgIDLabel], 10, 64)
+		for _, sample := range stream.Values {
+			entry := historian.LokiEntry{}
+			err := json.Unmarshal([]byte(sample.V), &entry)
+			if err != nil {
+				// bad data, skip
+				r.log.Debug("failed to unmarshal loki entry", "error", err, "entry", sample.V)
+				continue
+			}
+			samples = append(samples, orgSample{Sample: sample, orgID: orgID, entry: entry})
+		}
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].T.Before(samples[j].T)
+	})
+
+	lastState := make(map[string]string)
+	entries := make([]annotationEntry, 0, len(samples))
+	for _, sample := range samples {
+		entry := sample.entry
+
+		if entry.Type != "" {
+			// not a state transition, skip
 			continue
 		}
 
@@ -144,11 +3095,24 @@ func (r *LokiHistorianStore) annotationsFromStream(stream historian.Stream, ac a
 			continue
 		}
 
+		if ac != nil && !hasAccess(entry, *ac) {
+			// no access to this annotation, skip
+			continue
+		}
+
 		if !historian.ShouldRecordAnnotation(*transition) {
 			// skip non-annotation transition
 			continue
 		}
 
+		instance := entry.RuleUID + entry.Fingerprint
+		prevState, ok := lastState[instance]
+		if !ok {
+			// first entry of the instance in the result set, rely on what was recorded
+			prevState = entry.Previous
+		}
+		lastState[instance] = entry.Current
+
 		annotationText, annotationData := historian.BuildAnnotationTextAndData(
 			historymodel.RuleMeta{
 				Title: entry.RuleTitle,
@@ -156,22 +3120,76 @@ func (r *LokiHistorianStore) annotationsFromStream(stream historian.Stream, ac a
 			transition.State,
 		)
 
-		items = append(items, &annotations.ItemDTO{
-			AlertID:      entry.RuleID,
-			DashboardID:  ac.Dashboards[entry.DashboardUID],
-			DashboardUID: &entry.DashboardUID,
-			PanelID:      entry.PanelID,
-			NewState:     entry.Current,
-			PrevState:    entry.Previous,
-			Time:         sample.T.UnixMilli(),
-			Text:         annotationText,
-			Data:         annotationData,
+		var dashboardID int64
+		if ac != nil {
+			dashboardID = ac.Dashboards[entry.DashboardUID]
+		}
+
+		entries = append(entries, annotationEntry{
+			item: &annotations.ItemDTO{
+				ID:           ComputeAnnotationID(sample.orgID, entry.RuleID, sample.T.UnixMilli(), entry.Current, entry.Fingerprint),
+				AlertID:      entry.RuleID,
+				DashboardID:  dashboardID,
+				DashboardUID: &entry.DashboardUID,
+				PanelID:      entry.PanelID,
+				NewState:     entry.Current,
+				PrevState:    prevState,
+				Time:         sample.T.UnixMilli(),
+				Text:         annotationText,
+				Data:         annotationData,
+			},
+			entry:      entry,
+			transition: transition,
 		})
 	}
 
+	return entries
+}
+
+func itemsFromEntries(entries []annotationEntry) []*annotations.ItemDTO {
+	items := make([]*annotations.ItemDTO, 0, len(entries))
+	for _, e := range entries {
+		items = append(items, e.item)
+	}
 	return items
 }
 
+// groupItems groups the annotations of the entries by the given key, each group sorted most recent first.
+func groupItems(entries []annotationEntry, key func(historian.LokiEntry) string) map[string][]*annotations.ItemDTO {
+	res := make(map[string][]*annotations.ItemDTO)
+	for _, e := range entries {
+		k := key(e.entry)
+		res[k] = append(res[k], e.item)
+	}
+	for _, items := range res {
+		sort.Sort(annotations.SortedItems(items))
+	}
+	return res
+}
+
+// nextTransitionTimes returns, for each of the entries in chronological order, the time of the next entry
+// of the same alert instance, or nil if there is none.
+func nextTransitionTimes(entries []annotationEntry) []*time.Time {
+	res := make([]*time.Time, len(entries))
+	last := make(map[string]int)
+	for i, e := range entries {
+		key := e.entry.RuleUID + e.entry.Fingerprint
+		if prev, ok := last[key]; ok {
+			t := time.UnixMilli(e.item.Time)
+			res[prev] = &t
+		}
+		last[key] = i
+	}
+	return res
+}
+
+// sortEntries sorts entries in the same order as annotations.SortedItems, most recent first.
+func sortEntries(entries []annotationEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].item.Time > entries[j].item.Time
+	})
+}
+
 func (r *LokiHistorianStore) GetTags(ctx context.Context, query *annotations.TagsQuery) (annotations.FindTagsResult, error) {
 	return annotations.FindTagsResult{}, nil
 }
@@ -194,6 +3212,234 @@ func getRule(ctx context.Context, sql db.DB, orgID int64, ruleID int64) (*ngmode
 	return rule, err
 }
 
+// OrgAccessResources returns access resources that grant access to all state history annotations of an org,
+// for callers that may read all of them, such as server admins.
+func (r *LokiHistorianStore) OrgAccessResources(ctx context.Context, orgID int64) (*accesscontrol.AccessResources, error) {
+	dashboards, err := getDashboards(ctx, r.db, orgID)
+	if err != nil {
+		return nil, ErrLokiStoreInternal.Errorf("failed to get dashboards: %w", err)
+	}
+
+	return &accesscontrol.AccessResources{
+		Dashboards:               dashboards,
+		CanAccessDashAnnotations: true,
+		CanAccessOrgAnnotations:  true,
+	}, nil
+}
+
+// getDashboards returns the IDs of the dashboards of an org, keyed by UID.
+func getDashboards(ctx context.Context, sql db.DB, orgID int64) (map[string]int64, error) {
+	type dashboard struct {
+		ID  int64
+		UID string
+	}
+	rows := make([]dashboard, 0)
+	err := sql.WithDbSession(ctx, func(sess *db.Session) error {
+		return sess.Table("dashboard").Where("org_id = ? AND is_folder = ?", orgID, false).Cols("id", "uid").Find(&rows)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dashboards := make(map[string]int64, len(rows))
+	for _, d := range rows {
+		dashboards[d.UID] = d.ID
+	}
+
+	return dashboards, nil
+}
+
+// getOrgIDs returns the IDs of all orgs.
+func getOrgIDs(ctx context.Context, sql db.DB) ([]int64, error) {
+	ids := make([]int64, 0)
+	err := sql.WithDbSession(ctx, func(sess *db.Session) error {
+		return sess.Table("org").Cols("id").Find(&ids)
+	})
+
+	return ids, err
+}
+
+func getRuleUIDs(ctx context.Context, sql db.DB, orgID int64, ruleIDs []int64) ([]string, error) {
+	uids := make([]string, 0, len(ruleIDs))
+	err := sql.WithDbSession(ctx, func(sess *db.Session) error {
+		return sess.Table(ngmodels.AlertRule{}).Where("org_id = ?", orgID).In("id", ruleIDs).Cols("uid").Find(&uids)
+	})
+
+	return uids, err
+}
+
+func getRuleUIDsByFolder(ctx context.Context, sql db.DB, orgID int64, folderUID string) ([]string, error) {
+	uids := make([]string, 0)
+	err := sql.WithDbSession(ctx, func(sess *db.Session) error {
+		return sess.Table(ngmodels.AlertRule{}).Where("org_id = ? AND namespace_uid = ?", orgID, folderUID).Cols("uid").Find(&uids)
+	})
+
+	return uids, err
+}
+
+// getRulesByUID returns the rules with the given UIDs, keyed by UID.
+func getRulesByUID(ctx context.Context, sql db.DB, orgID int64, uids []string) (map[string]*ngmodels.AlertRule, error) {
+	res := make(map[string]*ngmodels.AlertRule, len(uids))
+	if len(uids) == 0 {
+		return res, nil
+	}
+
+	rules := make([]*ngmodels.AlertRule, 0, len(uids))
+	err := sql.WithDbSession(ctx, func(sess *db.Session) error {
+		return sess.Table(ngmodels.AlertRule{}).Where("org_id = ?", orgID).In("uid", uids).Find(&rules)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		res[rule.UID] = rule
+	}
+
+	return res, nil
+}
+
+func getRuleUIDsByTitle(ctx context.Context, sql db.DB, orgID int64, title string) ([]string, error) {
+	uids := make([]string, 0)
+	err := sql.WithDbSession(ctx, func(sess *db.Session) error {
+		return sess.Table(ngmodels.AlertRule{}).Where("org_id = ? AND title = ?", orgID, title).Cols("uid").Find(&uids)
+	})
+
+	return uids, err
+}
+
+// getRuleUIDsByLabel returns the UIDs of the rules of an org that have a label with the given value.
+// Labels are stored as JSON, so they are matched after loading the rules.
+func getRuleUIDsByLabel(ctx context.Context, sql db.DB, orgID int64, key, value string) ([]string, error) {
+	rules := make([]*ngmodels.AlertRule, 0)
+	err := sql.WithDbSession(ctx, func(sess *db.Session) error {
+		return sess.Table(ngmodels.AlertRule{}).Where("org_id = ?", orgID).Cols("uid", "labels").Find(&rules)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	uids := make([]string, 0)
+	for _, rule := range rules {
+		if v, ok := rule.Labels[key]; ok && v == value {
+			uids = append(uids, rule.UID)
+		}
+	}
+
+	return uids, nil
+}
+
+func getRuleUIDsByFolders(ctx context.Context, sql db.DB, orgID int64, folderUIDs []string) ([]string, error) {
+	uids := make([]string, 0)
+	err := sql.WithDbSession(ctx, func(sess *db.Session) error {
+		return sess.Table(ngmodels.AlertRule{}).Where("org_id = ?", orgID).In("namespace_uid", folderUIDs).Cols("uid").Find(&uids)
+	})
+
+	return uids, err
+}
+
+// getFolderUIDByPath resolves a path of folder titles separated by slashes to the UID of the last folder.
+// Folders whose title contains a slash cannot be resolved.
+func getFolderUIDByPath(ctx context.Context, sql db.DB, orgID int64, path string) (string, error) {
+	titles := strings.Split(strings.Trim(path, "/"), "/")
+	var uid string
+	err := sql.WithDbSession(ctx, func(sess *db.Session) error {
+		for i, title := range titles {
+			q := sess.Table("folder").Where("org_id = ? AND title = ?", orgID, title)
+			if i == 0 {
+				q = q.And("parent_uid IS NULL")
+			} else {
+				q = q.And("parent_uid = ?", uid)
+			}
+
+			uids := make([]string, 0, 1)
+			if err := q.Cols("uid").Find(&uids); err != nil {
+				return err
+			}
+			if len(uids) == 0 {
+				return errMissingFolder
+			}
+			uid = uids[0]
+		}
+		return nil
+	})
+
+	return uid, err
+}
+
+// getDescendantFolderUIDs returns the UID of a folder along with the UIDs of all of its subfolders, at any depth.
+func getDescendantFolderUIDs(ctx context.Context, sql db.DB, orgID int64, folderUID string) ([]string, error) {
+	res := []string{folderUID}
+	err := sql.WithDbSession(ctx, func(sess *db.Session) error {
+		parents := []string{folderUID}
+		for len(parents) > 0 {
+			children := make([]string, 0)
+			if err := sess.Table("folder").Where("org_id = ?", orgID).In("parent_uid", parents).Cols("uid").Find(&children); err != nil {
+				return err
+			}
+			res = append(res, children...)
+			parents = children
+		}
+		return nil
+	})
+
+	return res, err
+}
+
+// lastSampleValue returns the value of the most recent sample of a series, or zero if it has no samples.
+func lastSampleValue(series historian.MetricSeries) int64 {
+	if len(series.Values) == 0 {
+		return 0
+	}
+	return int64(series.Values[len(series.Values)-1].V)
+}
+
+// withJSONParser makes sure that the log line of a LogQL query is parsed as JSON, so that its fields can be used as labels.
+func withJSONParser(logQL string) string {
+	if strings.Contains(logQL, " | json") {
+		return logQL
+	}
+	return logQL + " | json"
+}
+
+// uidsRegex builds a regular expression that matches any of the given rule UIDs exactly.
+func uidsRegex(uids []string) string {
+	quoted := make([]string, 0, len(uids))
+	for _, uid := range uids {
+		quoted = append(quoted, regexp.QuoteMeta(uid))
+	}
+	return strings.Join(quoted, "|")
+}
+
+// histogramQuantile estimates the q-quantile of a histogram by linear interpolation within buckets,
+// the same way as the PromQL function of the same name.
+func histogramQuantile(q float64, h *dto.Histogram) float64 {
+	total := float64(h.GetSampleCount())
+	if total == 0 {
+		return 0
+	}
+
+	rank := q * total
+	lowerBound, lowerCount := 0.0, 0.0
+	for _, b := range h.GetBucket() {
+		count := float64(b.GetCumulativeCount())
+		if count >= rank {
+			if count == lowerCount {
+				return b.GetUpperBound()
+			}
+			return lowerBound + (b.GetUpperBound()-lowerBound)*(rank-lowerCount)/(count-lowerCount)
+		}
+		lowerBound, lowerCount = b.GetUpperBound(), count
+	}
+
+	// The quantile falls in the implicit +Inf bucket, return the highest known bound.
+	return lowerBound
+}
+
+func isFiring(formatted string) bool {
+	cur, _, err := state.ParseFormattedState(formatted)
+	return err == nil && cur == eval.Alerting
+}
+
 func hasAccess(entry historian.LokiEntry, resources accesscontrol.AccessResources) bool {
 	orgFilter := resources.CanAccessOrgAnnotations && entry.DashboardUID == ""
 	dashFilter := func() bool {
@@ -207,6 +3453,27 @@ func hasAccess(entry historian.LokiEntry, resources accesscontrol.AccessResource
 	return orgFilter || dashFilter()
 }
 
+// accessFilter builds a LogQL label filter that only matches entries accessible with the given resources,
+// the same way as hasAccess. It returns false if no entry can be accessed.
+func accessFilter(resources accesscontrol.AccessResources) (string, bool) {
+	uids := make([]string, 0, len(resources.Dashboards)+1)
+	if resources.CanAccessOrgAnnotations {
+		uids = append(uids, "")
+	}
+	if resources.CanAccessDashAnnotations {
+		for uid := range resources.Dashboards {
+			uids = append(uids, uid)
+		}
+	}
+	if len(uids) == 0 {
+		return "", false
+	}
+	// Ensure that all queries we build are deterministic.
+	sort.Strings(uids)
+
+	return fmt.Sprintf("dashboardUID=~%q", uidsRegex(uids)), true
+}
+
 type number interface {
 	constraints.Integer | constraints.Float
 }
@@ -276,6 +3543,22 @@ func buildHistoryQuery(query *annotations.ItemQuery, dashboards map[string]int64
 		RuleUID:      ruleUID,
 	}
 
+	if len(query.InstanceLabels) > 0 || query.Severity != "" || query.Environment != "" {
+		historyQuery.Labels = make(map[string]string, len(query.InstanceLabels)+2)
+		for k, v := range query.InstanceLabels {
+			historyQuery.Labels[k] = v
+		}
+		if query.Severity != "" {
+			historyQuery.Labels[severityLabel] = query.Severity
+		}
+		if query.Environment != "" {
+			historyQuery.Labels[environmentLabel] = query.Environment
+		}
+	}
+	historyQuery.Annotations = query.AnnotationFilter
+	historyQuery.States = query.States
+	historyQuery.TitleRegex = query.RuleNameRegex
+
 	if historyQuery.DashboardUID == "" && query.DashboardID != 0 {
 		for uid, id := range dashboards {
 			if query.DashboardID == id {
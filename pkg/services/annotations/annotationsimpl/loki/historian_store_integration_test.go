@@ -0,0 +1,172 @@
+//go:build integration
+
+package loki
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ory/dockertest/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/grafana/grafana/pkg/infra/db"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/annotations"
+	annotation_ac "github.com/grafana/grafana/pkg/services/annotations/accesscontrol"
+	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+	"github.com/grafana/grafana/pkg/services/ngalert/metrics"
+	ngmodels "github.com/grafana/grafana/pkg/services/ngalert/models"
+	"github.com/grafana/grafana/pkg/services/ngalert/state"
+	"github.com/grafana/grafana/pkg/services/ngalert/state/historian"
+)
+
+// lokiRepository and lokiTag are the Loki image that TestIntegrationRealLoki runs the store against.
+const (
+	lokiRepository = "grafana/loki"
+	lokiTag        = "2.9.4"
+)
+
+// TestIntegrationRealLoki runs the store against a real Loki, which it starts in a Docker container. It needs a
+// Docker daemon, so it only builds with the integration tag:
+//
+//	go test -tags integration -run TestIntegrationRealLoki ./pkg/services/annotations/annotationsimpl/loki/
+func TestIntegrationRealLoki(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	u := startLoki(t)
+
+	sql := db.InitTestDB(t)
+	met := metrics.NewHistorianMetrics(prometheus.NewRegistry(), subsystem)
+	client := historian.NewLokiClient(historian.LokiConfig{
+		ReadPathURL:  u,
+		WritePathURL: u,
+		Encoder:      historian.SnappyProtoEncoder{},
+	}, historian.NewRequester(), met, log.NewNopLogger())
+	store := &LokiHistorianStore{
+		client:  client,
+		db:      sql,
+		metrics: met,
+		tracer:  noop.NewTracerProvider().Tracer(tracerName),
+		log:     log.NewNopLogger(),
+	}
+
+	orgID := int64(1)
+	generator := ngmodels.AlertRuleGen(
+		ngmodels.WithUniqueUID(&sync.Map{}),
+		ngmodels.WithUniqueID(),
+		ngmodels.WithOrgID(orgID),
+	)
+	rule1 := createAlertRule(t, sql, "Test Rule 1", generator)
+	rule2 := createAlertRule(t, sql, "Test Rule 2", generator)
+
+	start := time.Now().Add(-time.Minute).Truncate(time.Second)
+	push := func(rule *ngmodels.AlertRule, transitions ...state.StateTransition) {
+		stream := historian.StatesToStream(ruleMetaFromRule(t, rule), transitions, map[string]string{}, log.NewNopLogger())
+		require.NoError(t, client.Push(context.Background(), []historian.Stream{stream}))
+	}
+	push(rule1,
+		genTransition(eval.Normal, eval.Pending, start),
+		genTransition(eval.Pending, eval.Alerting, start.Add(2*time.Second)),
+		genTransition(eval.Alerting, eval.Normal, start.Add(4*time.Second)),
+	)
+	push(rule2,
+		genTransition(eval.Normal, eval.Alerting, start.Add(time.Second)),
+		genTransition(eval.Alerting, eval.Normal, start.Add(3*time.Second)),
+	)
+
+	resources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+	get := func(query annotations.ItemQuery, expected int) []*annotations.ItemDTO {
+		t.Helper()
+		query.OrgID = orgID
+
+		var res []*annotations.ItemDTO
+		// Entries might not be queryable right after they are pushed.
+		require.EventuallyWithT(t, func(c *assert.CollectT) {
+			var err error
+			res, err = store.Get(context.Background(), &query, resources)
+			if assert.NoError(c, err) {
+				assert.Len(c, res, expected)
+			}
+		}, 10*time.Second, 200*time.Millisecond)
+		return res
+	}
+
+	t.Run("should include start and exclude end of time range", func(t *testing.T) {
+		res := get(annotations.ItemQuery{
+			AlertID: rule1.ID,
+			From:    start.UnixMilli(),
+			To:      start.Add(4 * time.Second).UnixMilli(),
+		}, 2)
+		require.Equal(t, start.Add(2*time.Second).UnixMilli(), res[0].Time)
+		require.Equal(t, start.UnixMilli(), res[1].Time)
+	})
+
+	t.Run("should query multiple rules", func(t *testing.T) {
+		res := get(annotations.ItemQuery{
+			AlertIDs: []int64{rule1.ID, rule2.ID},
+			From:     start.UnixMilli(),
+			To:       start.Add(5 * time.Second).UnixMilli(),
+		}, 5)
+		ids := make(map[int64]int)
+		for _, item := range res {
+			ids[item.AlertID]++
+		}
+		require.Equal(t, map[int64]int{rule1.ID: 3, rule2.ID: 2}, ids)
+	})
+
+	t.Run("should sort history by time, most recent first", func(t *testing.T) {
+		res := get(annotations.ItemQuery{
+			From: start.UnixMilli(),
+			To:   start.Add(5 * time.Second).UnixMilli(),
+		}, 5)
+		for i := 1; i < len(res); i++ {
+			require.Greater(t, res[i-1].Time, res[i].Time)
+		}
+	})
+}
+
+// startLoki starts a Loki container that is removed at the end of the test, and returns its URL once it is ready.
+func startLoki(t *testing.T) *url.URL {
+	t.Helper()
+
+	pool, err := dockertest.NewPool("")
+	require.NoError(t, err)
+	pool.MaxWait = time.Minute
+	require.NoError(t, pool.Client.Ping(), "could not connect to Docker")
+
+	resource, err := pool.RunWithOptions(&dockertest.RunOptions{
+		Repository: lokiRepository,
+		Tag:        lokiTag,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if err := pool.Purge(resource); err != nil {
+			t.Logf("failed to remove Loki container: %s", err)
+		}
+	})
+
+	u, err := url.Parse(fmt.Sprintf("http://%s", resource.GetHostPort("3100/tcp")))
+	require.NoError(t, err)
+	require.NoError(t, pool.Retry(func() error {
+		resp, err := http.Get(u.JoinPath("ready").String())
+		if err != nil {
+			return err
+		}
+		defer func() { _ = resp.Body.Close() }()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("loki is not ready: %s", resp.Status)
+		}
+		return nil
+	}), "loki did not become ready")
+	return u
+}
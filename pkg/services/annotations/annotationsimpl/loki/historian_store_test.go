@@ -2,11 +2,30 @@ package loki
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"io"
+	"math/big"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -29,7 +48,15 @@ import (
 	"github.com/grafana/grafana/pkg/setting"
 	"github.com/grafana/grafana/pkg/tests/testsuite"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/memblob"
 
+	"github.com/grafana/grafana/pkg/util/errutil"
 	"github.com/stretchr/testify/require"
 )
 
@@ -37,6 +64,9 @@ func TestMain(m *testing.M) {
 	testsuite.Run(m)
 }
 
+// orgAccess grants access to the org annotations, which is all that the test entries without a dashboard need.
+var orgAccess = &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+
 func TestIntegrationAlertStateHistoryStore(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping integration test")
@@ -66,6 +96,13 @@ func TestIntegrationAlertStateHistoryStore(t *testing.T) {
 		ngmodels.WithUniqueID(),
 		ngmodels.WithOrgID(1),
 	)
+	inFolder := func(folderUID string) func() *ngmodels.AlertRule {
+		return func() *ngmodels.AlertRule {
+			rule := generator()
+			rule.NamespaceUID = folderUID
+			return rule
+		}
+	}
 
 	dashboardRules := map[string][]*ngmodels.AlertRule{
 		dashboard1.UID: {
@@ -112,6 +149,74 @@ func TestIntegrationAlertStateHistoryStore(t *testing.T) {
 			require.Len(t, res, numTransitions)
 		})
 
+		t.Run("can query history by multiple alert ids", func(t *testing.T) {
+			rule1 := dashboardRules[dashboard1.UID][0]
+			rule3 := dashboardRules[dashboard2.UID][0]
+
+			fakeLokiClient.Response = []historian.Stream{
+				historian.StatesToStream(ruleMetaFromRule(t, rule1), transitions, map[string]string{}, log.NewNopLogger()),
+				historian.StatesToStream(ruleMetaFromRule(t, dashboardRules[dashboard1.UID][1]), transitions, map[string]string{}, log.NewNopLogger()),
+				historian.StatesToStream(ruleMetaFromRule(t, rule3), transitions, map[string]string{}, log.NewNopLogger()),
+			}
+
+			query := annotations.ItemQuery{
+				OrgID:    1,
+				AlertIDs: []int64{rule1.ID, rule3.ID},
+				From:     start.UnixMilli(),
+				To:       start.Add(time.Second * time.Duration(numTransitions+1)).UnixMilli(),
+			}
+			res, err := store.Get(
+				context.Background(),
+				&query,
+				&annotation_ac.AccessResources{
+					Dashboards: map[string]int64{
+						dashboard1.UID: dashboard1.ID,
+						dashboard2.UID: dashboard2.ID,
+					},
+					CanAccessDashAnnotations: true,
+				},
+			)
+			require.NoError(t, err)
+			require.Len(t, res, 2*numTransitions)
+			// Both rules are read with a single query.
+			require.Contains(t, fakeLokiClient.LastQuery, `ruleUID=~`)
+			require.Contains(t, fakeLokiClient.LastQuery, rule1.UID)
+			require.Contains(t, fakeLokiClient.LastQuery, rule3.UID)
+			counts := make(map[int64]int)
+			for _, item := range res {
+				counts[item.AlertID]++
+			}
+			require.Equal(t, map[int64]int{rule1.ID: numTransitions, rule3.ID: numTransitions}, counts)
+		})
+
+		t.Run("should fail when querying too many alert ids", func(t *testing.T) {
+			ids := make([]int64, maxAlertIDs+1)
+			for i := range ids {
+				ids[i] = int64(i + 1)
+			}
+
+			query := annotations.ItemQuery{
+				OrgID:    1,
+				AlertIDs: ids,
+			}
+			_, err := store.Get(context.Background(), &query, &annotation_ac.AccessResources{CanAccessDashAnnotations: true})
+			require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+
+			_, err = store.GetCount(context.Background(), &query, &annotation_ac.AccessResources{CanAccessDashAnnotations: true})
+			require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+
+			_, err = store.GetAnnotationsPage(context.Background(), &query, &annotation_ac.AccessResources{CanAccessDashAnnotations: true}, PageRequest{})
+			require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+		})
+
+		t.Run("should not set the default time range on the query", func(t *testing.T) {
+			query := annotations.ItemQuery{OrgID: 1}
+			_, err := store.Get(context.Background(), &query, &annotation_ac.AccessResources{CanAccessDashAnnotations: true})
+			require.NoError(t, err)
+			require.Zero(t, query.From)
+			require.Zero(t, query.To)
+		})
+
 		t.Run("can query history by dashboard id", func(t *testing.T) {
 			fakeLokiClient.Response = []historian.Stream{
 				historian.StatesToStream(ruleMetaFromRule(t, dashboardRules[dashboard1.UID][0]), transitions, map[string]string{}, log.NewNopLogger()),
@@ -138,6 +243,55 @@ func TestIntegrationAlertStateHistoryStore(t *testing.T) {
 			require.Len(t, res, 2*numTransitions)
 		})
 
+		t.Run("can attach metric snapshots to history", func(t *testing.T) {
+			rule := dashboardRules[dashboard1.UID][0]
+
+			fakeLokiClient.Response = []historian.Stream{
+				historian.StatesToStream(ruleMetaFromRule(t, rule), transitions, map[string]string{}, log.NewNopLogger()),
+			}
+
+			query := annotations.ItemQuery{
+				OrgID:   1,
+				AlertID: rule.ID,
+				From:    start.UnixMilli(),
+				To:      start.Add(time.Second * time.Duration(numTransitions+1)).UnixMilli(),
+			}
+			calls := 0
+			res, err := store.GetAnnotationsWithContext(
+				context.Background(),
+				&query,
+				&annotation_ac.AccessResources{
+					Dashboards: map[string]int64{
+						dashboard1.UID: dashboard1.ID,
+					},
+					CanAccessDashAnnotations: true,
+				},
+				func(ruleUID string, ts time.Time) ([]MetricSnapshot, error) {
+					calls++
+					require.Equal(t, rule.UID, ruleUID)
+					return []MetricSnapshot{
+						{Timestamps: []time.Time{ts}, Values: []float64{float64(ts.UnixMilli())}},
+					}, nil
+				},
+			)
+			require.NoError(t, err)
+			require.Len(t, res, numTransitions)
+			require.Equal(t, numTransitions, calls)
+
+			for _, item := range res {
+				require.Len(t, item.MetricSnapshots, 1)
+				require.Equal(t, float64(item.Time), item.MetricSnapshots[0].Values[0])
+			}
+		})
+
+		t.Run("should require access resources when attaching metric snapshots", func(t *testing.T) {
+			query := annotations.ItemQuery{OrgID: 1}
+			_, err := store.GetAnnotationsWithContext(context.Background(), &query, nil, func(string, time.Time) ([]MetricSnapshot, error) {
+				return nil, nil
+			})
+			require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+		})
+
 		t.Run("should return empty results when type is annotation", func(t *testing.T) {
 			fakeLokiClient.Response = []historian.Stream{
 				historian.StatesToStream(ruleMetaFromRule(t, dashboardRules[dashboard1.UID][0]), transitions, map[string]string{}, log.NewNopLogger()),
@@ -223,118 +377,4330 @@ func TestIntegrationAlertStateHistoryStore(t *testing.T) {
 		})
 	})
 
-	t.Run("Testing items from Loki stream", func(t *testing.T) {
-		fakeLokiClient := NewFakeLokiClient()
-		store := createTestLokiStore(t, sql, fakeLokiClient)
+	t.Run("Testing firing alerts by folder", func(t *testing.T) {
+		fakeLokiClient := NewFakeLokiClient()
+		store := createTestLokiStore(t, sql, fakeLokiClient)
+
+		folderUID := "test-folder-uid"
+		folderGenerator := func() *ngmodels.AlertRule {
+			rule := generator()
+			rule.NamespaceUID = folderUID
+			return rule
+		}
+		firingRule := createAlertRule(t, sql, "Firing Rule", folderGenerator)
+		resolvedRule := createAlertRule(t, sql, "Resolved Rule", folderGenerator)
+
+		start := time.Now().Add(-time.Minute)
+		fakeLokiClient.Response = []historian.Stream{
+			historian.StatesToStream(ruleMetaFromRule(t, firingRule), []state.StateTransition{
+				genTransition(eval.Normal, eval.Alerting, start),
+			}, map[string]string{}, log.NewNopLogger()),
+			historian.StatesToStream(ruleMetaFromRule(t, resolvedRule), []state.StateTransition{
+				genTransition(eval.Normal, eval.Alerting, start),
+				genTransition(eval.Alerting, eval.Normal, start.Add(time.Second)),
+			}, map[string]string{}, log.NewNopLogger()),
+		}
+
+		res, err := store.GetFiringAlertsByFolder(context.Background(), 1, folderUID)
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		require.Equal(t, firingRule.UID, res[0].RuleUID)
+		require.Equal(t, eval.Alerting.String(), res[0].State)
+
+		t.Run("should return empty list when folder has no rules", func(t *testing.T) {
+			res, err := store.GetFiringAlertsByFolder(context.Background(), 1, "empty-folder-uid")
+			require.NoError(t, err)
+			require.Empty(t, res)
+		})
+	})
+
+	t.Run("Testing transitions by folder path", func(t *testing.T) {
+		fakeLokiClient := NewFakeLokiClient()
+		store := createTestLokiStore(t, sql, fakeLokiClient)
+
+		createFolder := func(uid, parentUID, title string) {
+			t.Helper()
+			err := sql.WithDbSession(context.Background(), func(sess *db.Session) error {
+				if parentUID == "" {
+					_, err := sess.Exec("INSERT INTO folder(org_id, uid, title, description, created, updated) VALUES(?, ?, ?, ?, ?, ?)",
+						1, uid, title, "", time.Now(), time.Now())
+					return err
+				}
+				_, err := sess.Exec("INSERT INTO folder(org_id, uid, parent_uid, title, description, created, updated) VALUES(?, ?, ?, ?, ?, ?, ?)",
+					1, uid, parentUID, title, "", time.Now(), time.Now())
+				return err
+			})
+			require.NoError(t, err)
+		}
+		createFolder("path-parent-uid", "", "Parent")
+		createFolder("path-child-uid", "path-parent-uid", "Child")
+		createFolder("path-grandchild-uid", "path-child-uid", "Grandchild")
+
+		parentRule := createAlertRule(t, sql, "Parent Rule", inFolder("path-parent-uid"))
+		childRule := createAlertRule(t, sql, "Child Rule", inFolder("path-child-uid"))
+		grandchildRule := createAlertRule(t, sql, "Grandchild Rule", inFolder("path-grandchild-uid"))
+
+		start := time.Now().Add(-time.Minute)
+		fakeLokiClient.KeepResponse = true
+		fakeLokiClient.Response = []historian.Stream{
+			alertingStream(ruleMetaFromRule(t, parentRule), start),
+			alertingStream(ruleMetaFromRule(t, childRule), start.Add(time.Second)),
+			alertingStream(ruleMetaFromRule(t, grandchildRule), start.Add(2*time.Second)),
+		}
+		alertIDs := func(items []*annotations.ItemDTO) []int64 {
+			ids := make([]int64, 0, len(items))
+			for _, item := range items {
+				ids = append(ids, item.AlertID)
+			}
+			return ids
+		}
+
+		t.Run("should only include rules of the folder if not recursive", func(t *testing.T) {
+			res, err := store.GetTransitionAnnotationsByFolderPath(context.Background(), 1, "Parent/Child", start, start.Add(time.Minute), false, orgAccess)
+			require.NoError(t, err)
+			require.Equal(t, []int64{childRule.ID}, alertIDs(res))
+		})
+
+		t.Run("should include rules of subfolders if recursive", func(t *testing.T) {
+			res, err := store.GetTransitionAnnotationsByFolderPath(context.Background(), 1, "Parent", start, start.Add(time.Minute), true, orgAccess)
+			require.NoError(t, err)
+			require.Equal(t, []int64{grandchildRule.ID, childRule.ID, parentRule.ID}, alertIDs(res))
+
+			res, err = store.GetTransitionAnnotationsByFolderPath(context.Background(), 1, "Parent/Child", start, start.Add(time.Minute), true, orgAccess)
+			require.NoError(t, err)
+			require.Equal(t, []int64{grandchildRule.ID, childRule.ID}, alertIDs(res))
+		})
+
+		t.Run("should return not found for unknown paths", func(t *testing.T) {
+			_, err := store.GetTransitionAnnotationsByFolderPath(context.Background(), 1, "Child", start, start.Add(time.Minute), true, orgAccess)
+			require.ErrorIs(t, err, ErrLokiStoreNotFound)
+		})
+	})
+
+	t.Run("Testing transitions with rule metadata", func(t *testing.T) {
+		fakeLokiClient := NewFakeLokiClient()
+		store := createTestLokiStore(t, sql, fakeLokiClient)
+
+		notificationSettings := ngmodels.NotificationSettings{Receiver: "email"}
+		rule := createAlertRule(t, sql, "Rule With Metadata", func() *ngmodels.AlertRule {
+			rule := inFolder("metadata-folder-uid")()
+			rule.RuleGroup = "metadata-group"
+			rule.NotificationSettings = []ngmodels.NotificationSettings{notificationSettings}
+			return rule
+		})
+		deleted := historymodel.RuleMeta{OrgID: 1, ID: 1_000_000, UID: "deleted-rule-uid"}
+
+		start := time.Now().Add(-time.Minute)
+		fakeLokiClient.Response = []historian.Stream{
+			alertingStream(ruleMetaFromRule(t, rule), start),
+			alertingStream(deleted, start.Add(time.Second)),
+		}
+
+		query := &annotations.ItemQuery{
+			OrgID: 1,
+			From:  start.UnixMilli(),
+			To:    start.Add(time.Minute).UnixMilli(),
+		}
+		res, err := store.GetTransitionAnnotationsWithRuleMetadata(context.Background(), query, &annotation_ac.AccessResources{CanAccessOrgAnnotations: true})
+		require.NoError(t, err)
+		require.Len(t, res, 2)
+
+		require.Equal(t, deleted.ID, res[0].AlertID)
+		require.Empty(t, res[0].RuleGroup)
+		require.Empty(t, res[0].FolderUID)
+		require.Empty(t, res[0].NotificationPolicies)
+
+		require.Equal(t, rule.ID, res[1].AlertID)
+		require.Equal(t, "metadata-group", res[1].RuleGroup)
+		require.Equal(t, "metadata-folder-uid", res[1].FolderUID)
+		require.Equal(t, []string{notificationSettings.Fingerprint().String()}, res[1].NotificationPolicies)
+	})
+
+	t.Run("Testing transitions by rule name", func(t *testing.T) {
+		fakeLokiClient := NewFakeLokiClient()
+		store := createTestLokiStore(t, sql, fakeLokiClient)
+
+		uniqueRule := createAlertRule(t, sql, "Unique Name", nil)
+		sharedRule1 := createAlertRule(t, sql, "Shared Name", inFolder("name-folder-1"))
+		sharedRule2 := createAlertRule(t, sql, "Shared Name", inFolder("name-folder-2"))
+		otherRule := createAlertRule(t, sql, "Other Name", nil)
+
+		start := time.Now().Add(-time.Minute)
+		fakeLokiClient.KeepResponse = true
+		fakeLokiClient.Response = []historian.Stream{
+			alertingStream(ruleMetaFromRule(t, uniqueRule), start),
+			alertingStream(ruleMetaFromRule(t, sharedRule1), start.Add(time.Second)),
+			alertingStream(ruleMetaFromRule(t, sharedRule2), start.Add(2*time.Second)),
+			alertingStream(ruleMetaFromRule(t, otherRule), start.Add(3*time.Second)),
+		}
+		alertIDs := func(items []*annotations.ItemDTO) []int64 {
+			ids := make([]int64, 0, len(items))
+			for _, item := range items {
+				ids = append(ids, item.AlertID)
+			}
+			return ids
+		}
+
+		t.Run("should return transitions of a single rule", func(t *testing.T) {
+			res, err := store.GetTransitionAnnotationsByAlertRuleName(context.Background(), 1, "Unique Name", start, start.Add(time.Minute), orgAccess)
+			require.NoError(t, err)
+			require.Equal(t, []int64{uniqueRule.ID}, alertIDs(res))
+		})
+
+		t.Run("should return transitions of all rules with the name", func(t *testing.T) {
+			res, err := store.GetTransitionAnnotationsByAlertRuleName(context.Background(), 1, "Shared Name", start, start.Add(time.Minute), orgAccess)
+			require.NoError(t, err)
+			require.Equal(t, []int64{sharedRule2.ID, sharedRule1.ID}, alertIDs(res))
+		})
+
+		t.Run("should return empty list when no rule has the name", func(t *testing.T) {
+			res, err := store.GetTransitionAnnotationsByAlertRuleName(context.Background(), 1, "Unknown Name", start, start.Add(time.Minute), orgAccess)
+			require.NoError(t, err)
+			require.Empty(t, res)
+		})
+	})
+
+	t.Run("Testing chaos engineering test runs", func(t *testing.T) {
+		fakeLokiClient := NewFakeLokiClient()
+		store := createTestLokiStore(t, sql, fakeLokiClient)
+
+		withRunID := func(runID string) func() *ngmodels.AlertRule {
+			return func() *ngmodels.AlertRule {
+				rule := generator()
+				rule.Labels = map[string]string{ChaosTestRunIDLabel: runID}
+				return rule
+			}
+		}
+		firedRule := createAlertRule(t, sql, "Chaos Fired", withRunID("run-1"))
+		missedRule := createAlertRule(t, sql, "Chaos Missed", withRunID("run-1"))
+		unexpectedRule := createAlertRule(t, sql, "Chaos Unexpected", nil)
+		otherRunRule := createAlertRule(t, sql, "Chaos Other Run", withRunID("run-2"))
+
+		start := time.Now().Add(-time.Minute)
+		transition := func(rule *ngmodels.AlertRule, runID string, prev, cur eval.State, at time.Time) historian.Stream {
+			tr := genTransition(prev, cur, at)
+			tr.Labels = map[string]string{ChaosTestRunIDLabel: runID}
+			return historian.StatesToStream(ruleMetaFromRule(t, rule), []state.StateTransition{tr}, map[string]string{}, log.NewNopLogger())
+		}
+		fakeLokiClient.KeepResponse = true
+		fakeLokiClient.Response = []historian.Stream{
+			transition(firedRule, "run-1", eval.Normal, eval.Alerting, start),
+			transition(missedRule, "run-1", eval.Normal, eval.Pending, start.Add(time.Second)),
+			transition(unexpectedRule, "run-1", eval.Normal, eval.Alerting, start.Add(2*time.Second)),
+			transition(otherRunRule, "run-2", eval.Normal, eval.Alerting, start.Add(3*time.Second)),
+		}
+
+		t.Run("should compare expected and actual firing rules", func(t *testing.T) {
+			res, err := store.GetTransitionAnnotationsForChaosEngineering(context.Background(), 1, "run-1", start, start.Add(time.Minute))
+			require.NoError(t, err)
+			require.Contains(t, fakeLokiClient.LastQuery, `labels_chaos_test_run_id="run-1"`)
+
+			expected := []string{firedRule.UID, missedRule.UID}
+			sort.Strings(expected)
+			actual := []string{firedRule.UID, unexpectedRule.UID}
+			sort.Strings(actual)
+			require.Equal(t, ChaosTestResult{
+				ExpectedFiringRules: expected,
+				ActualFiringRules:   actual,
+				MissingFires:        []string{missedRule.UID},
+				UnexpectedFires:     []string{unexpectedRule.UID},
+			}, res)
+		})
+
+		t.Run("should report all expected rules as missing when nothing fired", func(t *testing.T) {
+			res, err := store.GetTransitionAnnotationsForChaosEngineering(context.Background(), 1, "run-2", start, start.Add(time.Second))
+			require.NoError(t, err)
+			require.Equal(t, []string{otherRunRule.UID}, res.ExpectedFiringRules)
+			require.Empty(t, res.ActualFiringRules)
+			require.Equal(t, []string{otherRunRule.UID}, res.MissingFires)
+			require.Empty(t, res.UnexpectedFires)
+		})
+
+		t.Run("should require a test run ID", func(t *testing.T) {
+			_, err := store.GetTransitionAnnotationsForChaosEngineering(context.Background(), 1, "", start, start.Add(time.Minute))
+			require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+		})
+	})
+
+	t.Run("Testing items from Loki stream", func(t *testing.T) {
+		fakeLokiClient := NewFakeLokiClient()
+		store := createTestLokiStore(t, sql, fakeLokiClient)
+
+		t.Run("should return empty list when no streams", func(t *testing.T) {
+			items := store.annotationsFromStream(historian.Stream{}, annotation_ac.AccessResources{})
+			require.Empty(t, items)
+		})
+
+		t.Run("should return empty list when no entries", func(t *testing.T) {
+			items := store.annotationsFromStream(historian.Stream{
+				Values: []historian.Sample{},
+			}, annotation_ac.AccessResources{})
+			require.Empty(t, items)
+		})
+
+		t.Run("should return one annotation per sample", func(t *testing.T) {
+			rule := dashboardRules[dashboard1.UID][0]
+			start := time.Now()
+			numTransitions := 2
+			transitions := genStateTransitions(t, numTransitions, start)
+
+			stream := historian.StatesToStream(ruleMetaFromRule(t, rule), transitions, map[string]string{}, log.NewNopLogger())
+
+			items := store.annotationsFromStream(stream, annotation_ac.AccessResources{
+				Dashboards: map[string]int64{
+					dashboard1.UID: dashboard1.ID,
+				},
+				CanAccessDashAnnotations: true,
+			})
+			require.Len(t, items, numTransitions)
+
+			for i := 0; i < numTransitions; i++ {
+				item := items[i]
+				transition := transitions[i]
+
+				expected := &annotations.ItemDTO{
+					AlertID:      rule.ID,
+					DashboardID:  dashboard1.ID,
+					DashboardUID: &dashboard1.UID,
+					PanelID:      *rule.PanelID,
+					Time:         transition.State.LastEvaluationTime.UnixMilli(),
+					NewState:     transition.Formatted(),
+				}
+				if i > 0 {
+					prevTransition := transitions[i-1]
+					expected.PrevState = prevTransition.Formatted()
+				}
+
+				compareAnnotationItem(t, expected, item)
+			}
+		})
+
+		t.Run("should set previous state from interleaved streams", func(t *testing.T) {
+			rule := createAlertRule(t, sql, "Interleaved Rule", generator)
+			start := time.Now()
+
+			stream1 := historian.StatesToStream(ruleMetaFromRule(t, rule), []state.StateTransition{
+				genTransition(eval.Normal, eval.Alerting, start),
+				genTransition(eval.Normal, eval.NoData, start.Add(2*time.Second)),
+			}, map[string]string{"stream": "1"}, log.NewNopLogger())
+			stream2 := historian.StatesToStream(ruleMetaFromRule(t, rule), []state.StateTransition{
+				genTransition(eval.Normal, eval.Pending, start.Add(time.Second)),
+				genTransition(eval.Normal, eval.Error, start.Add(3*time.Second)),
+			}, map[string]string{"stream": "2"}, log.NewNopLogger())
+
+			items := itemsFromEntries(store.entriesFromStreams([]historian.Stream{stream1, stream2}, &annotation_ac.AccessResources{
+				CanAccessOrgAnnotations: true,
+			}))
+			require.Len(t, items, 4)
+
+			expected := []struct{ prev, cur eval.State }{
+				{eval.Normal, eval.Alerting},
+				{eval.Alerting, eval.Pending},
+				{eval.Pending, eval.NoData},
+				{eval.NoData, eval.Error},
+			}
+			for i, e := range expected {
+				require.Equal(t, e.prev.String(), items[i].PrevState)
+				require.Equal(t, e.cur.String(), items[i].NewState)
+			}
+		})
+
+		t.Run("should filter out annotations from dashboards not in scope", func(t *testing.T) {
+			start := time.Now()
+			numTransitions := 2
+			transitions := genStateTransitions(t, numTransitions, start)
+
+			rule := dashboardRules[dashboard1.UID][0]
+			stream1 := historian.StatesToStream(ruleMetaFromRule(t, rule), transitions, map[string]string{}, log.NewNopLogger())
+
+			rule = createAlertRule(t, sql, "Test rule", generator)
+			stream2 := historian.StatesToStream(ruleMetaFromRule(t, rule), transitions, map[string]string{}, log.NewNopLogger())
+
+			stream := historian.Stream{
+				Values: append(stream1.Values, stream2.Values...),
+				Stream: stream1.Stream,
+			}
+
+			items := store.annotationsFromStream(stream, annotation_ac.AccessResources{
+				Dashboards: map[string]int64{
+					dashboard1.UID: dashboard1.ID,
+				},
+				CanAccessDashAnnotations: true,
+			})
+			require.Len(t, items, numTransitions)
+
+			for _, item := range items {
+				require.Equal(t, dashboard1.ID, item.DashboardID)
+				require.Equal(t, dashboard1.UID, *item.DashboardUID)
+			}
+		})
+
+		t.Run("should include only annotations without linked dashboard on org scope", func(t *testing.T) {
+			start := time.Now()
+			numTransitions := 2
+			transitions := genStateTransitions(t, numTransitions, start)
+
+			rule := dashboardRules[dashboard1.UID][0]
+			stream1 := historian.StatesToStream(ruleMetaFromRule(t, rule), transitions, map[string]string{}, log.NewNopLogger())
+
+			rule.DashboardUID = nil
+			stream2 := historian.StatesToStream(ruleMetaFromRule(t, rule), transitions, map[string]string{}, log.NewNopLogger())
+
+			stream := historian.Stream{
+				Values: append(stream1.Values, stream2.Values...),
+				Stream: stream1.Stream,
+			}
+
+			items := store.annotationsFromStream(stream, annotation_ac.AccessResources{
+				Dashboards: map[string]int64{
+					dashboard1.UID: dashboard1.ID,
+				},
+				CanAccessOrgAnnotations: true,
+			})
+			require.Len(t, items, numTransitions)
+
+			for _, item := range items {
+				require.Zero(t, *item.DashboardUID)
+				require.Zero(t, item.DashboardID)
+			}
+		})
+	})
+}
+
+func TestRecordEvaluationGroup(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	err := store.RecordEvaluationGroup(context.Background(), 1, "test-group", "folder-uid", 3, 1500*time.Millisecond)
+	require.NoError(t, err)
+
+	require.Len(t, fakeLokiClient.Pushed, 1)
+	stream := fakeLokiClient.Pushed[0]
+	require.Equal(t, "1", stream.Stream[historian.OrgIDLabel])
+	require.Equal(t, "test-group", stream.Stream[historian.GroupLabel])
+	require.Equal(t, "folder-uid", stream.Stream[historian.FolderUIDLabel])
+	require.Equal(t, historian.StateHistoryLabelValue, stream.Stream[historian.StateHistoryLabelKey])
+	require.Len(t, stream.Values, 1)
+
+	entry := historian.LokiEntry{}
+	require.NoError(t, json.Unmarshal([]byte(stream.Values[0].V), &entry))
+	require.Equal(t, historian.EntryTypeEvaluationGroup, entry.Type)
+	require.Equal(t, "test-group", entry.Group)
+	require.Equal(t, "folder-uid", entry.FolderUID)
+	require.Equal(t, 3, entry.RuleCount)
+	require.Equal(t, int64(1500), entry.DurationMs)
+
+	t.Run("should not be returned as an annotation", func(t *testing.T) {
+		items := store.annotationsFromStream(stream, annotation_ac.AccessResources{
+			CanAccessOrgAnnotations: true,
+		})
+		require.Empty(t, items)
+	})
+}
+
+func TestGetAlertGroupSummary(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Minute)
+	firingRule := historymodel.RuleMeta{OrgID: 1, UID: "firing-rule", Group: "test-group"}
+	resolvedRule := historymodel.RuleMeta{OrgID: 1, UID: "resolved-rule", Group: "test-group"}
+
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(firingRule, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, start),
+		}, map[string]string{}, log.NewNopLogger()),
+		historian.StatesToStream(resolvedRule, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, start),
+			genTransition(eval.Alerting, eval.Normal, start.Add(time.Second)),
+		}, map[string]string{}, log.NewNopLogger()),
+	}
+
+	summary, err := store.GetAlertGroupSummary(context.Background(), 1, "test-group", start, start.Add(time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 2, summary.RuleCount)
+	require.Equal(t, 1, summary.FiringCount)
+	require.Equal(t, int64(3), summary.TotalTransitions)
+	require.Equal(t, start.Add(time.Second).UnixNano(), summary.LastEvaluation.UnixNano())
+}
+
+func TestGetTransitionsByNote(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Minute)
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, UID: "rule-1", Note: "Database is down, page the DBA"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, start),
+		}, map[string]string{}, log.NewNopLogger()),
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, UID: "rule-2", Note: "Disk is full"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, start),
+		}, map[string]string{}, log.NewNopLogger()),
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, UID: "rule-3"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, start),
+		}, map[string]string{}, log.NewNopLogger()),
+	}
+
+	res, err := store.GetTransitionsByNote(context.Background(), 1, "page the DBA", start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.Contains(t, fakeLokiClient.LastQuery, `note=~".*page the DBA.*"`)
+
+	t.Run("should exclude entries without notes", func(t *testing.T) {
+		fakeLokiClient.Response = []historian.Stream{
+			historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, UID: "rule-1", Note: "some note"}, []state.StateTransition{
+				genTransition(eval.Normal, eval.Alerting, start),
+			}, map[string]string{}, log.NewNopLogger()),
+			historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, UID: "rule-2"}, []state.StateTransition{
+				genTransition(eval.Normal, eval.Alerting, start),
+			}, map[string]string{}, log.NewNopLogger()),
+		}
+
+		res, err := store.GetTransitionsByNote(context.Background(), 1, "", start, start.Add(time.Minute), orgAccess)
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+	})
+}
+
+func TestGetTransitionAnnotationsForReconciliation(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, start),
+			genTransition(eval.Alerting, eval.Normal, start.Add(time.Minute)),
+		}, map[string]string{}, log.NewNopLogger()),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2"}, start),
+	}
+
+	res, err := store.GetTransitionAnnotationsForReconciliation(context.Background(), 1, start, start.Add(time.Hour))
+	require.NoError(t, err)
+	fp := historian.LabelFingerprint(map[string]string{"key1": "value1"})
+	require.Equal(t, map[int64]bool{
+		ComputeAnnotationID(1, 1, start.UnixMilli(), "Alerting", fp):                true,
+		ComputeAnnotationID(1, 1, start.Add(time.Minute).UnixMilli(), "Normal", fp): true,
+		ComputeAnnotationID(1, 2, start.UnixMilli(), "Alerting", fp):                true,
+	}, res)
+	require.NotContains(t, res, ComputeAnnotationID(1, 2, start.Add(time.Minute).UnixMilli(), "Normal", fp))
+}
+
+func TestComputeAnnotationID(t *testing.T) {
+	id := ComputeAnnotationID(1, 2, 1700000000000, "Alerting", "fp-1")
+	require.Positive(t, id)
+	require.Equal(t, id, ComputeAnnotationID(1, 2, 1700000000000, "Alerting", "fp-1"))
+	require.NotEqual(t, id, ComputeAnnotationID(2, 2, 1700000000000, "Alerting", "fp-1"))
+	require.NotEqual(t, id, ComputeAnnotationID(1, 3, 1700000000000, "Alerting", "fp-1"))
+	require.NotEqual(t, id, ComputeAnnotationID(1, 2, 1700000000001, "Alerting", "fp-1"))
+	require.NotEqual(t, id, ComputeAnnotationID(1, 2, 1700000000000, "Normal", "fp-1"))
+	require.NotEqual(t, id, ComputeAnnotationID(1, 2, 1700000000000, "Alerting", "fp-2"))
+
+	at, ok := annotationIDTime(id)
+	require.True(t, ok)
+	require.Equal(t, time.UnixMilli(1700000000000), at)
+	at, ok = annotationIDTime(ComputeAnnotationID(1, 2, 1700000000999, "Alerting", "fp-1"))
+	require.True(t, ok)
+	require.Equal(t, time.UnixMilli(1700000000000), at)
+
+	// IDs of annotations stored in the database.
+	_, ok = annotationIDTime(1)
+	require.False(t, ok)
+	_, ok = annotationIDTime(1 << 40)
+	require.False(t, ok)
+}
+
+func TestGetAlertRuleChangeLog(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Minute)
+	fakeLokiClient.Response = []historian.Stream{
+		{
+			Stream: map[string]string{historian.OrgIDLabel: "1"},
+			Values: []historian.Sample{
+				{
+					T: start,
+					V: `{"schemaVersion":1,"type":"rule_change","ruleUID":"rule-uid","changedBy":"admin","diff":{"oldTitle":"Old title","newTitle":"New title","summary":"title changed"}}`,
+				},
+				{
+					T: start.Add(time.Second),
+					V: `{"schemaVersion":1,"type":"rule_change","ruleUID":"rule-uid","changedBy":"editor","diff":{"oldTitle":"New title","newTitle":"New title","summary":"condition changed"}}`,
+				},
+				{
+					T: start.Add(2 * time.Second),
+					V: `{"schemaVersion":1,"type":"rule_change","ruleUID":"other-rule-uid","changedBy":"admin","diff":{"summary":"labels changed"}}`,
+				},
+				{
+					T: start.Add(3 * time.Second),
+					V: `{"schemaVersion":1,"previous":"Normal","current":"Alerting","ruleUID":"rule-uid"}`,
+				},
+			},
+		},
+	}
+
+	events, err := store.GetAlertRuleChangeLog(context.Background(), "rule-uid", 1, start, start.Add(time.Minute))
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+
+	require.Equal(t, start.Add(time.Second).UnixNano(), events[0].Timestamp.UnixNano())
+	require.Equal(t, "editor", events[0].ChangedBy)
+	require.Equal(t, "condition changed", events[0].DiffSummary)
+
+	require.Equal(t, start.UnixNano(), events[1].Timestamp.UnixNano())
+	require.Equal(t, "admin", events[1].ChangedBy)
+	require.Equal(t, "Old title", events[1].OldTitle)
+	require.Equal(t, "New title", events[1].NewTitle)
+	require.Equal(t, "title changed", events[1].DiffSummary)
+}
+
+func TestGetAnnotationsByUser(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Minute)
+	fakeLokiClient.Response = []historian.Stream{
+		{
+			Stream: map[string]string{historian.OrgIDLabel: "1"},
+			Values: []historian.Sample{
+				{
+					T: start,
+					V: `{"schemaVersion":1,"type":"rule_change","ruleUID":"rule-1","ruleID":1,"changedBy":"admin","diff":{"newTitle":"Rule 1","summary":"title changed"}}`,
+				},
+				{
+					T: start.Add(time.Second),
+					V: `{"schemaVersion":1,"type":"rule_change","ruleUID":"rule-2","ruleID":2,"changedBy":"editor","diff":{"newTitle":"Rule 2","summary":"condition changed"}}`,
+				},
+				{
+					T: start.Add(2 * time.Second),
+					V: `{"schemaVersion":1,"type":"rule_change","ruleUID":"rule-2","ruleID":2,"changedBy":"admin","diff":{"newTitle":"Rule 2","summary":"labels changed"}}`,
+				},
+			},
+		},
+	}
+
+	res, err := store.GetAnnotationsByUser(context.Background(), 1, "admin", start, start.Add(time.Minute))
+	require.NoError(t, err)
+	require.Contains(t, fakeLokiClient.LastQuery, `changedBy="admin"`)
+	require.Len(t, res, 2)
+
+	require.Equal(t, int64(2), res[0].AlertID)
+	require.Equal(t, "Rule 2", res[0].AlertName)
+	require.Equal(t, "labels changed", res[0].Text)
+	require.Equal(t, "admin", res[0].Login)
+	require.Equal(t, start.Add(2*time.Second).UnixMilli(), res[0].Time)
+
+	require.Equal(t, int64(1), res[1].AlertID)
+	require.Equal(t, "title changed", res[1].Text)
+	require.Equal(t, "admin", res[1].Login)
+}
+
+func TestBackupToObjectStorage(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	bucket := memblob.OpenBucket(nil)
+	t.Cleanup(func() {
+		require.NoError(t, bucket.Close())
+	})
+
+	now := time.Now().UTC()
+	today := now.Truncate(24 * time.Hour)
+	rule := historymodel.RuleMeta{OrgID: 1, UID: "rule-uid"}
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(rule, []state.StateTransition{
+			// Older than the range of a single query.
+			genTransition(eval.Alerting, eval.Normal, today.Add(-40*24*time.Hour)),
+			genTransition(eval.Normal, eval.Alerting, today.Add(-71*time.Hour)),
+			genTransition(eval.Alerting, eval.Normal, today.Add(-70*time.Hour)),
+			genTransition(eval.Normal, eval.Alerting, today.Add(-47*time.Hour)),
+			genTransition(eval.Alerting, eval.Normal, now.Add(-time.Hour)),
+		}, map[string]string{}, log.NewNopLogger()),
+	}
+
+	res, err := store.BackupToObjectStorage(context.Background(), 1, 24*time.Hour, bucket)
+	require.NoError(t, err)
+	require.Equal(t, 3, res.FilesWritten)
+	require.Equal(t, int64(4), res.EntriesBackedUp)
+
+	var totalBytes int64
+	var totalLines int
+	iter := bucket.List(&blob.ListOptions{Prefix: "1/"})
+	for {
+		obj, err := iter.Next(context.Background())
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		require.True(t, strings.HasSuffix(obj.Key, ".ndjson"))
+
+		content, err := bucket.ReadAll(context.Background(), obj.Key)
+		require.NoError(t, err)
+		totalBytes += int64(len(content))
+
+		for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+			entry := backupEntry{}
+			require.NoError(t, json.Unmarshal([]byte(line), &entry))
+			require.Equal(t, obj.Key, fmt.Sprintf("1/%s.ndjson", entry.Time.UTC().Format(time.DateOnly)))
+			require.Equal(t, "1", entry.Labels[historian.OrgIDLabel])
+			totalLines++
+		}
+	}
+	require.Equal(t, res.BytesWritten, totalBytes)
+	require.Equal(t, 4, totalLines)
+}
+
+type recordingTransport struct {
+	next     http.RoundTripper
+	requests []*http.Request
+}
+
+func (r *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.requests = append(r.requests, req)
+	return r.next.RoundTrip(req)
+}
+
+func TestWithHTTPTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{"result":[]}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	cfg := setting.UnifiedAlertingStateHistorySettings{
+		Enabled:       true,
+		Backend:       "loki",
+		LokiRemoteURL: server.URL,
+	}
+	features := featuremgmt.WithFeatures(
+		featuremgmt.FlagAlertStateHistoryLokiOnly,
+		featuremgmt.FlagAlertStateHistoryLokiPrimary,
+		featuremgmt.FlagAlertStateHistoryLokiSecondary,
+	)
+	transport := &recordingTransport{next: http.DefaultTransport}
+
+	store := NewLokiHistorianStore(cfg, features, nil, log.NewNopLogger(), WithHTTPTransport(transport))
+	require.NotNil(t, store)
+
+	_, err := store.Get(context.Background(), &annotations.ItemQuery{OrgID: 1}, &annotation_ac.AccessResources{CanAccessOrgAnnotations: true})
+	require.NoError(t, err)
+	require.Len(t, transport.requests, 1)
+	require.Equal(t, "/loki/api/v1/query_range", transport.requests[0].URL.Path)
+}
+
+// createTenantTestStore creates a store that queries a Loki server with the given handler, in the given tenant ID mode.
+// The fixed tenant is "fixed-tenant" and the name of an org is "org-name-<org ID>".
+func createTenantTestStore(t *testing.T, mode historian.TenantIDMode, handler http.HandlerFunc) *LokiHistorianStore {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	client := historian.NewLokiClient(historian.LokiConfig{
+		ReadPathURL:  u,
+		WritePathURL: u,
+		TenantID:     "fixed-tenant",
+		TenantIDMode: mode,
+		TenantResolver: func(_ context.Context, orgID int64) (string, error) {
+			return fmt.Sprintf("org-name-%d", orgID), nil
+		},
+		Encoder: historian.JsonEncoder{},
+	}, historian.NewRequester(), metrics.NewHistorianMetrics(prometheus.NewRegistry(), subsystem), log.NewNopLogger())
+	store := createTestLokiStore(t, nil, client)
+	store.tenantIDMode = mode
+	return store
+}
+
+func TestTenantIDMode(t *testing.T) {
+	resources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+
+	cases := []struct {
+		mode     historian.TenantIDMode
+		expected string
+	}{
+		{mode: historian.TenantIDModeFixed, expected: "fixed-tenant"},
+		{mode: historian.TenantIDModeOrgID, expected: "2"},
+		{mode: historian.TenantIDModeOrgName, expected: "org-name-2"},
+	}
+	for _, tc := range cases {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			var tenants []string
+			store := createTenantTestStore(t, tc.mode, func(w http.ResponseWriter, r *http.Request) {
+				tenants = append(tenants, r.Header.Get("X-Scope-OrgID"))
+				_, _ = w.Write([]byte(`{"data":{"result":[]}}`))
+			})
+
+			_, err := store.Get(context.Background(), &annotations.ItemQuery{OrgID: 2}, resources)
+			require.NoError(t, err)
+			_, err = store.GetCount(context.Background(), &annotations.ItemQuery{OrgID: 2}, resources)
+			require.NoError(t, err)
+
+			require.Equal(t, []string{tc.expected, tc.expected}, tenants)
+		})
+	}
+
+	t.Run("pings use the fixed tenant", func(t *testing.T) {
+		var tenant string
+		store := createTenantTestStore(t, historian.TenantIDModeOrgID, func(w http.ResponseWriter, r *http.Request) {
+			tenant = r.Header.Get("X-Scope-OrgID")
+			_, _ = w.Write([]byte(`{"status":"success","data":[]}`))
+		})
+
+		require.NoError(t, store.Ping(context.Background()))
+		require.Equal(t, "fixed-tenant", tenant)
+	})
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := createTestCA(t)
+	writePEM(t, filepath.Join(dir, "ca.crt"), "CERTIFICATE", ca.Raw)
+	serverCert := createTestCertificate(t, ca, caKey, x509.ExtKeyUsageServerAuth)
+	clientCert := createTestCertificate(t, ca, caKey, x509.ExtKeyUsageClientAuth)
+	writePEM(t, filepath.Join(dir, "client.crt"), "CERTIFICATE", clientCert.Certificate[0])
+	key, err := x509.MarshalPKCS8PrivateKey(clientCert.PrivateKey)
+	require.NoError(t, err)
+	writePEM(t, filepath.Join(dir, "client.key"), "PRIVATE KEY", key)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{"result":[]}}`))
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	createStore := func(t *testing.T, cfg historian.LokiConfig) *LokiHistorianStore {
+		t.Helper()
+		cfg.ReadPathURL, cfg.WritePathURL, cfg.Encoder = u, u, historian.JsonEncoder{}
+		req, err := historian.NewLokiRequester(cfg)
+		require.NoError(t, err)
+		client := historian.NewLokiClient(cfg, req, metrics.NewHistorianMetrics(prometheus.NewRegistry(), subsystem), log.NewNopLogger())
+		return createTestLokiStore(t, nil, client)
+	}
+	query := &annotations.ItemQuery{OrgID: 1}
+	resources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+
+	t.Run("should query loki with a client certificate", func(t *testing.T) {
+		store := createStore(t, historian.LokiConfig{
+			TLSCertFile: filepath.Join(dir, "client.crt"),
+			TLSKeyFile:  filepath.Join(dir, "client.key"),
+			TLSCAFile:   filepath.Join(dir, "ca.crt"),
+		})
+
+		_, err := store.Get(context.Background(), query, resources)
+		require.NoError(t, err)
+	})
+
+	t.Run("should fail without a client certificate", func(t *testing.T) {
+		store := createStore(t, historian.LokiConfig{TLSCAFile: filepath.Join(dir, "ca.crt")})
+
+		_, err := store.Get(context.Background(), query, resources)
+		require.ErrorIs(t, err, ErrLokiStoreInternal)
+	})
+}
+
+func TestEncryptedStateHistory(t *testing.T) {
+	// The server stores the lines pushed to it and returns all of them for any log query without a pipeline,
+	// like Loki does for encrypted lines, which cannot match the filters of a pipeline.
+	var mtx sync.Mutex
+	var pushed []historian.Stream
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		switch r.URL.Path {
+		case "/loki/api/v1/push":
+			body := struct {
+				Streams []historian.Stream `json:"streams"`
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			pushed = append(pushed, body.Streams...)
+			w.WriteHeader(http.StatusNoContent)
+		case "/loki/api/v1/query_range":
+			if strings.Contains(r.URL.Query().Get("query"), "|") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			res := historian.QueryRes{Data: historian.QueryData{Result: pushed}}
+			_ = json.NewEncoder(w).Encode(res)
+		}
+	}))
+	t.Cleanup(server.Close)
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	set := setting.UnifiedAlertingStateHistorySettings{
+		LokiRemoteURL:     server.URL,
+		LokiEncryptionKey: "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=",
+	}
+	cfg, err := historian.NewLokiConfig(set)
+	require.NoError(t, err)
+	cfg.ReadPathURL, cfg.WritePathURL, cfg.Encoder = u, u, historian.JsonEncoder{}
+	client := historian.NewLokiClient(cfg, historian.NewRequester(), metrics.NewHistorianMetrics(prometheus.NewRegistry(), subsystem), log.NewNopLogger())
+	store := createTestLokiStore(t, nil, client)
+
+	start := time.Now()
+	transitions := genStateTransitions(t, 2, start)
+	orgRule := historymodel.RuleMeta{OrgID: 1, UID: "org-rule"}
+	dashboardRule := historymodel.RuleMeta{OrgID: 1, UID: "dashboard-rule", DashboardUID: "dash-1", PanelID: 1}
+	err = client.Push(context.Background(), []historian.Stream{
+		historian.StatesToStream(orgRule, transitions, map[string]string{}, log.NewNopLogger()),
+		historian.StatesToStream(dashboardRule, transitions, map[string]string{}, log.NewNopLogger()),
+	})
+	require.NoError(t, err)
+	for _, stream := range pushed {
+		for _, sample := range stream.Values {
+			require.NotContains(t, sample.V, "org-rule", "lines should be encrypted at rest")
+			require.NotContains(t, sample.V, "dashboard-rule", "lines should be encrypted at rest")
+		}
+	}
+
+	query := &annotations.ItemQuery{
+		OrgID: 1,
+		From:  start.UnixMilli(),
+		To:    start.Add(time.Second * 3).UnixMilli(),
+	}
+
+	t.Run("should filter decrypted lines", func(t *testing.T) {
+		res, err := store.Get(context.Background(), query, orgAccess)
+
+		require.NoError(t, err)
+		require.Len(t, res, len(transitions))
+		for _, item := range res {
+			require.Empty(t, item.DashboardUID)
+		}
+	})
+
+	t.Run("should read back all accessible lines", func(t *testing.T) {
+		resources := &annotation_ac.AccessResources{
+			CanAccessOrgAnnotations:  true,
+			CanAccessDashAnnotations: true,
+			Dashboards:               map[string]int64{"dash-1": 1},
+		}
+
+		res, err := store.Get(context.Background(), query, resources)
+
+		require.NoError(t, err)
+		require.Len(t, res, 2*len(transitions))
+	})
+
+	t.Run("should reject metric queries", func(t *testing.T) {
+		_, err := store.GetCount(context.Background(), query, orgAccess)
+
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+// createTestCA creates a self-signed CA certificate.
+func createTestCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return ca, key
+}
+
+// createTestCertificate creates a certificate for localhost, signed by the given CA.
+func createTestCertificate(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+}
+
+func TestGetTransitionsByContactPoint(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	t.Run("returns the transitions that the contact point was notified about", func(t *testing.T) {
+		fakeLokiClient := NewFakeLokiClient()
+		fakeLokiClient.KeepResponse = true
+		store := createTestLokiStore(t, nil, fakeLokiClient)
+
+		fakeLokiClient.Response = []historian.Stream{
+			// Notified to another contact point.
+			alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, start),
+			notificationStream("rule-1", "email", start.Add(30*time.Second)),
+			// Both the firing and the resolved transitions were notified.
+			historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2"}, []state.StateTransition{
+				genTransition(eval.Normal, eval.Alerting, start),
+				genTransition(eval.Alerting, eval.Normal, start.Add(2*time.Minute)),
+			}, map[string]string{}, log.NewNopLogger()),
+			notificationStream("rule-2", "slack", start.Add(30*time.Second)),
+			notificationStream("rule-2", "slack", start.Add(150*time.Second)),
+			// Resolved before the notification about the firing transition was sent.
+			historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3"}, []state.StateTransition{
+				genTransition(eval.Normal, eval.Alerting, start),
+				genTransition(eval.Alerting, eval.Normal, start.Add(time.Minute)),
+			}, map[string]string{}, log.NewNopLogger()),
+			notificationStream("rule-3", "slack", start.Add(90*time.Second)),
+			// The notification was sent before the transition.
+			alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 4, UID: "rule-4"}, start.Add(time.Minute)),
+			notificationStream("rule-4", "slack", start.Add(30*time.Second)),
+		}
+
+		res, err := store.GetTransitionsByContactPoint(context.Background(), 1, "slack", start, start.Add(10*time.Minute), orgAccess)
+		require.NoError(t, err)
+		require.Len(t, res, 3)
+		require.Equal(t, int64(2), res[0].AlertID)
+		require.Equal(t, "Normal", res[0].NewState)
+		require.Equal(t, int64(3), res[1].AlertID)
+		require.Equal(t, "Normal", res[1].NewState)
+		require.Equal(t, int64(2), res[2].AlertID)
+		require.Equal(t, "Alerting", res[2].NewState)
+		require.Contains(t, fakeLokiClient.LastQuery, `ruleUID=~"rule-2|rule-3|rule-4"`)
+	})
+
+	t.Run("does not query transitions if the contact point was not notified", func(t *testing.T) {
+		fakeLokiClient := NewFakeLokiClient()
+		store := createTestLokiStore(t, nil, fakeLokiClient)
+
+		res, err := store.GetTransitionsByContactPoint(context.Background(), 1, "slack", start, start.Add(10*time.Minute), orgAccess)
+		require.NoError(t, err)
+		require.Empty(t, res)
+		require.Contains(t, fakeLokiClient.LastQuery, `type="notification" | contactPoint="slack"`)
+	})
+
+	t.Run("should fail without a contact point", func(t *testing.T) {
+		store := createTestLokiStore(t, nil, NewFakeLokiClient())
+
+		_, err := store.GetTransitionsByContactPoint(context.Background(), 1, "", start, start.Add(10*time.Minute), orgAccess)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetTransitionsByRecordingRule(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Minute)
+	fakeLokiClient.Response = []historian.Stream{
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1", RecordingRuleUID: "recording-1"}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2", RecordingRuleUID: "recording-2"}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3"}, start),
+	}
+
+	res, err := store.GetTransitionsByRecordingRule(context.Background(), "recording-1", 1, start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.Equal(t, int64(1), res[0].AlertID)
+	require.Contains(t, fakeLokiClient.LastQuery, `recordingRuleUID="recording-1"`)
+}
+
+func TestGetTransitionsByNotificationPolicy(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Minute)
+	fakeLokiClient.Response = []historian.Stream{
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1", PolicyRoute: "policy-1"}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2", PolicyRoute: "policy-2"}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3"}, start),
+	}
+
+	res, err := store.GetTransitionsByNotificationPolicy(context.Background(), 1, "policy-2", start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.Equal(t, int64(2), res[0].AlertID)
+	require.Contains(t, fakeLokiClient.LastQuery, `policyRoute="policy-2"`)
+}
+
+func TestGetTransitionAnnotationsInBulk(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Hour)
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1", DashboardUID: "dashboard-1"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, start),
+			genTransition(eval.Alerting, eval.Normal, start.Add(time.Minute)),
+		}, map[string]string{}, log.NewNopLogger()),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2", DashboardUID: "dashboard-1"}, start.Add(2*time.Minute)),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3", DashboardUID: "dashboard-2"}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 4, UID: "rule-4", DashboardUID: "dashboard-3"}, start.Add(3*time.Minute)),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 5, UID: "rule-5"}, start.Add(3*time.Minute)),
+	}
+
+	resources := &annotation_ac.AccessResources{
+		Dashboards:               map[string]int64{"dashboard-1": 1, "dashboard-2": 2, "dashboard-3": 3},
+		CanAccessDashAnnotations: true,
+	}
+	res, err := store.GetTransitionAnnotationsInBulk(context.Background(), 1, []string{"dashboard-1", "dashboard-2", "dashboard-4"}, 2*time.Hour, resources)
+	require.NoError(t, err)
+	require.Contains(t, fakeLokiClient.LastQuery, `dashboardUID=~"dashboard-1|dashboard-2|dashboard-4"`)
+	require.Len(t, res, 2)
+	require.Equal(t, int64(2), res["dashboard-1"].AlertID)
+	require.Equal(t, start.Add(2*time.Minute).UnixMilli(), res["dashboard-1"].Time)
+	require.Equal(t, int64(3), res["dashboard-2"].AlertID)
+
+	t.Run("should not query loki without dashboards", func(t *testing.T) {
+		fakeLokiClient.LastQuery = ""
+		res, err := store.GetTransitionAnnotationsInBulk(context.Background(), 1, nil, time.Hour, orgAccess)
+		require.NoError(t, err)
+		require.Empty(t, res)
+		require.Empty(t, fakeLokiClient.LastQuery)
+	})
+}
+
+func TestErrorTypes(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	fakeLokiClient.Response = []historian.Stream{
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1", DashboardUID: "dashboard-1", PanelID: 1}, start),
+	}
+	query := &annotations.ItemQuery{
+		OrgID: 1,
+		From:  start.UnixMilli(),
+		To:    start.Add(time.Hour).UnixMilli(),
+	}
+	messageID := func(err error) string {
+		t.Helper()
+		var e errutil.Error
+		require.True(t, errors.As(err, &e), "expected an errutil.Error, got %v", err)
+		return e.MessageID
+	}
+
+	t.Run("should return ErrLokiUnavailable if loki is unavailable", func(t *testing.T) {
+		fakeLokiClient.QueryErr = fmt.Errorf("%w: received status 503", historian.ErrLokiUnavailable)
+		t.Cleanup(func() { fakeLokiClient.QueryErr = nil })
+
+		_, err := store.Get(context.Background(), query, &annotation_ac.AccessResources{CanAccessOrgAnnotations: true})
+		require.Equal(t, "annotations.loki.unavailable", messageID(err))
+		require.ErrorIs(t, err, ErrLokiUnavailable)
+		require.ErrorIs(t, err, historian.ErrLokiUnavailable)
+	})
+
+	t.Run("should return ErrLokiStoreInternal for other query errors", func(t *testing.T) {
+		fakeLokiClient.QueryErr = errors.New("received a non-200 response from loki, status: 400")
+		t.Cleanup(func() { fakeLokiClient.QueryErr = nil })
+
+		_, err := store.Get(context.Background(), query, &annotation_ac.AccessResources{CanAccessOrgAnnotations: true})
+		require.Equal(t, "annotations.loki.internal", messageID(err))
+	})
+
+	t.Run("should return ErrAnnotationNotFound for unknown annotations", func(t *testing.T) {
+		err := store.Delete(context.Background(), 1, 42, &annotation_ac.AccessResources{CanAccessOrgAnnotations: true})
+		require.Equal(t, "annotations.loki.annotationNotFound", messageID(err))
+		require.ErrorIs(t, err, ErrAnnotationNotFound)
+
+		_, err = store.Get(context.Background(), &annotations.ItemQuery{OrgID: 1, AnnotationID: 42}, &annotation_ac.AccessResources{CanAccessOrgAnnotations: true})
+		require.Equal(t, "annotations.loki.annotationNotFound", messageID(err))
+		require.ErrorIs(t, err, ErrAnnotationNotFound)
+	})
+
+	t.Run("should return ErrAccessDenied without access", func(t *testing.T) {
+		items, err := store.Get(context.Background(), query, &annotation_ac.AccessResources{
+			CanAccessDashAnnotations: true,
+			Dashboards:               map[string]int64{"dashboard-1": 1},
+		})
+		require.NoError(t, err)
+		require.Len(t, items, 1)
+
+		orgResources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+		err = store.Delete(context.Background(), 1, items[0].ID, orgResources)
+		require.Equal(t, "annotations.loki.accessDenied", messageID(err))
+		require.ErrorIs(t, err, ErrAccessDenied)
+
+		_, err = store.Get(context.Background(), &annotations.ItemQuery{OrgID: 1, AnnotationID: items[0].ID}, orgResources)
+		require.Equal(t, "annotations.loki.accessDenied", messageID(err))
+		require.ErrorIs(t, err, ErrAccessDenied)
+	})
+}
+
+func TestPing(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	t.Run("should succeed if loki can be reached", func(t *testing.T) {
+		fakeLokiClient.PingErr = nil
+
+		require.NoError(t, store.Ping(context.Background()))
+	})
+
+	t.Run("should return a typed error if loki is unavailable", func(t *testing.T) {
+		fakeLokiClient.PingErr = fmt.Errorf("%w: status code 503", historian.ErrLokiUnavailable)
+
+		err := store.Ping(context.Background())
+		require.ErrorIs(t, err, ErrLokiUnavailable)
+		require.ErrorIs(t, err, historian.ErrLokiUnavailable)
+	})
+
+	t.Run("should return an internal error otherwise", func(t *testing.T) {
+		fakeLokiClient.PingErr = errors.New("connection refused")
+
+		err := store.Ping(context.Background())
+		require.ErrorIs(t, err, ErrLokiStoreInternal)
+	})
+}
+
+func TestGetTransitionAnnotationsByOrg(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Minute)
+	response := []historian.Stream{
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2"}, start.Add(time.Second)),
+		alertingStream(historymodel.RuleMeta{OrgID: 2, ID: 3, UID: "rule-3"}, start),
+	}
+
+	t.Run("should key annotations by org", func(t *testing.T) {
+		fakeLokiClient.Response = response
+
+		res, err := store.GetTransitionAnnotationsByOrg(context.Background(), []int64{1, 2, 3}, start, start.Add(time.Minute))
+		require.NoError(t, err)
+		require.Equal(t, `{orgID=~"1|2|3",from="state-history"}`, fakeLokiClient.LastQuery)
+
+		require.Len(t, res, 3)
+		require.Len(t, res[1], 2)
+		require.Equal(t, int64(2), res[1][0].AlertID)
+		require.Equal(t, int64(1), res[1][1].AlertID)
+		require.Len(t, res[2], 1)
+		require.Equal(t, int64(3), res[2][0].AlertID)
+		require.Empty(t, res[3])
+	})
+
+	t.Run("should query all orgs when none is given", func(t *testing.T) {
+		fakeLokiClient.Response = response
+
+		res, err := store.GetTransitionAnnotationsByOrg(context.Background(), nil, start, start.Add(time.Minute))
+		require.NoError(t, err)
+		require.Equal(t, `{orgID=~".+",from="state-history"}`, fakeLokiClient.LastQuery)
+
+		require.Len(t, res, 2)
+		require.Len(t, res[1], 2)
+		require.Len(t, res[2], 1)
+	})
+
+	tenants := []struct {
+		mode     historian.TenantIDMode
+		tenants  map[string]int64
+		expected []string
+	}{
+		{mode: historian.TenantIDModeOrgID, tenants: map[string]int64{"1": 1, "2": 2}, expected: []string{"1", "2"}},
+		{mode: historian.TenantIDModeOrgName, tenants: map[string]int64{"org-name-1": 1, "org-name-2": 2}, expected: []string{"org-name-1", "org-name-2"}},
+	}
+	for _, tc := range tenants {
+		t.Run(fmt.Sprintf("should query each org in its tenant in %s mode", tc.mode), func(t *testing.T) {
+			var queried []string
+			store := createTenantTestStore(t, tc.mode, func(w http.ResponseWriter, r *http.Request) {
+				tenant := r.Header.Get("X-Scope-OrgID")
+				queried = append(queried, tenant)
+				streams := make([]historian.Stream, 0)
+				for _, stream := range response {
+					if orgID, ok := tc.tenants[tenant]; ok && stream.Stream[historian.OrgIDLabel] == fmt.Sprint(orgID) {
+						streams = append(streams, stream)
+					}
+				}
+				_ = json.NewEncoder(w).Encode(historian.QueryRes{Data: historian.QueryData{Result: streams}})
+			})
+
+			res, err := store.GetTransitionAnnotationsByOrg(context.Background(), []int64{1, 2}, start, start.Add(time.Minute))
+			require.NoError(t, err)
+
+			require.Equal(t, tc.expected, queried)
+			require.Len(t, res, 2)
+			require.Len(t, res[1], 2)
+			require.Len(t, res[2], 1)
+		})
+	}
+
+	t.Run("should query all orgs in the fixed tenant in fixed mode", func(t *testing.T) {
+		var queried []string
+		store := createTenantTestStore(t, historian.TenantIDModeFixed, func(w http.ResponseWriter, r *http.Request) {
+			queried = append(queried, r.Header.Get("X-Scope-OrgID"))
+			_ = json.NewEncoder(w).Encode(historian.QueryRes{Data: historian.QueryData{Result: response}})
+		})
+
+		res, err := store.GetTransitionAnnotationsByOrg(context.Background(), []int64{1, 2}, start, start.Add(time.Minute))
+		require.NoError(t, err)
+
+		require.Equal(t, []string{"fixed-tenant"}, queried)
+		require.Len(t, res, 2)
+		require.Len(t, res[1], 2)
+		require.Len(t, res[2], 1)
+	})
+}
+
+func TestIntegrationGetTransitionAnnotationsByOrgAllTenants(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	sql := db.InitTestDB(t)
+	err := sql.WithDbSession(context.Background(), func(sess *db.Session) error {
+		for _, id := range []int64{1, 2} {
+			if _, err := sess.Exec("INSERT INTO org (id, version, name, created, updated) VALUES (?, 0, ?, ?, ?)", id, fmt.Sprintf("org-%d", id), time.Now(), time.Now()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	var queried []string
+	store := createTenantTestStore(t, historian.TenantIDModeOrgID, func(w http.ResponseWriter, r *http.Request) {
+		queried = append(queried, r.Header.Get("X-Scope-OrgID"))
+		_, _ = w.Write([]byte(`{"data":{"result":[]}}`))
+	})
+	store.db = sql
+
+	start := time.Now().Add(-time.Minute)
+	res, err := store.GetTransitionAnnotationsByOrg(context.Background(), nil, start, start.Add(time.Minute))
+	require.NoError(t, err)
+
+	require.ElementsMatch(t, []string{"1", "2"}, queried)
+	require.Len(t, res, 2)
+}
+
+func TestGetTransitionAnnotationsByAlertRuleVersion(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Hour)
+	v1 := historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1", Version: 1}
+	v2 := historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1", Version: 2}
+	response := []historian.Stream{
+		historian.StatesToStream(v1, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, start),
+			genTransition(eval.Alerting, eval.Normal, start.Add(time.Minute)),
+		}, map[string]string{}, log.NewNopLogger()),
+		historian.StatesToStream(v2, []state.StateTransition{
+			genTransition(eval.Normal, eval.Pending, start.Add(2*time.Minute)),
+		}, map[string]string{}, log.NewNopLogger()),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2", Version: 2}, start),
+	}
+
+	t.Run("should only return entries of the version", func(t *testing.T) {
+		fakeLokiClient.Response = response
+
+		res, err := store.GetTransitionAnnotationsByAlertRuleVersion(context.Background(), "rule-1", 1, 1, orgAccess)
+		require.NoError(t, err)
+		require.Contains(t, fakeLokiClient.LastQuery, `ruleUID="rule-1" | ruleVersion=1`)
+		require.Len(t, res, 2)
+		require.Equal(t, "Normal", res[0].NewState)
+		require.Equal(t, "Alerting", res[1].NewState)
+
+		fakeLokiClient.Response = response
+
+		res, err = store.GetTransitionAnnotationsByAlertRuleVersion(context.Background(), "rule-1", 1, 2, orgAccess)
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		require.Equal(t, int64(1), res[0].AlertID)
+		require.Equal(t, "Pending", res[0].NewState)
+	})
+
+	t.Run("should require a rule UID", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsByAlertRuleVersion(context.Background(), "", 1, 1, orgAccess)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetTransitionAnnotationsByEvaluationNode(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Hour)
+	fromNode := func(nodeID string, rule historymodel.RuleMeta, at time.Time) historian.Stream {
+		return historian.StatesToStreamWithNodeID(rule, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, at),
+		}, map[string]string{}, nodeID, log.NewNopLogger())
+	}
+	fakeLokiClient.Response = []historian.Stream{
+		fromNode("node-1", historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, start),
+		fromNode("node-2", historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2"}, start),
+		fromNode("node-1", historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3"}, start.Add(time.Minute)),
+	}
+
+	res, err := store.GetTransitionAnnotationsByEvaluationNode(context.Background(), 1, "node-1", start, start.Add(time.Hour), orgAccess)
+	require.NoError(t, err)
+	require.Contains(t, fakeLokiClient.LastQuery, `nodeID="node-1"`)
+	require.Len(t, res, 2)
+	require.Equal(t, int64(3), res[0].AlertID)
+	require.Equal(t, int64(1), res[1].AlertID)
+
+	t.Run("should require a node ID", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsByEvaluationNode(context.Background(), 1, "", start, start.Add(time.Hour), orgAccess)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetTransitionAnnotationsByRuleCondition(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Minute)
+	fakeLokiClient.Response = []historian.Stream{
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1", Condition: "A"}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2", Condition: "B"}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3", Condition: "A"}, start.Add(time.Second)),
+	}
+	alertIDs := func(items []*annotations.ItemDTO) []int64 {
+		ids := make([]int64, 0, len(items))
+		for _, item := range items {
+			ids = append(ids, item.AlertID)
+		}
+		return ids
+	}
+
+	res, err := store.GetTransitionAnnotationsByRuleCondition(context.Background(), 1, "A", start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Contains(t, fakeLokiClient.LastQuery, `condition="A"`)
+	require.Equal(t, []int64{3, 1}, alertIDs(res))
+
+	res, err = store.GetTransitionAnnotationsByRuleCondition(context.Background(), 1, "B", start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Equal(t, []int64{2}, alertIDs(res))
+
+	t.Run("should require a condition", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsByRuleCondition(context.Background(), 1, "", start, start.Add(time.Minute), orgAccess)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetTransitionAnnotationsByDatasource(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	fakeLokiClient.Response = []historian.Stream{
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1", DatasourceUIDs: []string{"prometheus"}}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2", DatasourceUIDs: []string{"loki"}}, start.Add(time.Minute)),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3", DatasourceUIDs: []string{"loki", "prometheus"}}, start.Add(2*time.Minute)),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 4, UID: "rule-4", DatasourceUIDs: []string{"prometheus-2"}}, start.Add(3*time.Minute)),
+	}
+	alertIDs := func(items []*annotations.ItemDTO) []int64 {
+		ids := make([]int64, 0, len(items))
+		for _, item := range items {
+			ids = append(ids, item.AlertID)
+		}
+		return ids
+	}
+
+	res, err := store.GetTransitionAnnotationsByDatasource(context.Background(), 1, "prometheus", start, start.Add(time.Hour), orgAccess)
+	require.NoError(t, err)
+	require.Equal(t, []int64{3, 1}, alertIDs(res))
+
+	res, err = store.GetTransitionAnnotationsByDatasource(context.Background(), 1, "loki", start, start.Add(time.Hour), orgAccess)
+	require.NoError(t, err)
+	require.Equal(t, []int64{3, 2}, alertIDs(res))
+
+	t.Run("should require a data source UID", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsByDatasource(context.Background(), 1, "", start, start.Add(time.Hour), orgAccess)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetTransitionAnnotationsByGrafanaVersion(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Minute)
+	fakeLokiClient.Response = []historian.Stream{
+		{
+			Stream: map[string]string{historian.OrgIDLabel: "1"},
+			Values: []historian.Sample{
+				{
+					T: start,
+					V: `{"schemaVersion":1,"values":{},"previous":"Normal","current":"Alerting","ruleID":1,"ruleUID":"rule-1","grafanaVersion":"10.0.0"}`,
+				},
+				{
+					T: start.Add(time.Second),
+					V: `{"schemaVersion":1,"values":{},"previous":"Alerting","current":"Normal","ruleID":1,"ruleUID":"rule-1","grafanaVersion":"10.0.0"}`,
+				},
+				{
+					T: start.Add(2 * time.Second),
+					V: `{"schemaVersion":1,"values":{},"previous":"Normal","current":"Alerting","ruleID":1,"ruleUID":"rule-1","grafanaVersion":"10.1.0"}`,
+				},
+				{
+					T: start.Add(3 * time.Second),
+					V: `{"schemaVersion":1,"values":{},"previous":"Normal","current":"Alerting","ruleID":2,"ruleUID":"rule-2"}`,
+				},
+			},
+		},
+	}
+	times := func(items []*annotations.ItemDTO) []int64 {
+		res := make([]int64, 0, len(items))
+		for _, item := range items {
+			res = append(res, item.Time)
+		}
+		return res
+	}
+
+	res, err := store.GetTransitionAnnotationsByGrafanaVersion(context.Background(), 1, "10.0.0", start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Contains(t, fakeLokiClient.LastQuery, `grafanaVersion="10.0.0"`)
+	require.Equal(t, []int64{start.Add(time.Second).UnixMilli(), start.UnixMilli()}, times(res))
+
+	res, err = store.GetTransitionAnnotationsByGrafanaVersion(context.Background(), 1, "10.1.0", start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Equal(t, []int64{start.Add(2 * time.Second).UnixMilli()}, times(res))
+
+	t.Run("should require a version", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsByGrafanaVersion(context.Background(), 1, "", start, start.Add(time.Minute), orgAccess)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetTransitionAnnotationsByThrottleKey(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Minute)
+	fakeLokiClient.Response = []historian.Stream{
+		{
+			Stream: map[string]string{historian.OrgIDLabel: "1"},
+			Values: []historian.Sample{
+				{
+					T: start,
+					V: `{"schemaVersion":1,"values":{},"previous":"Normal","current":"Alerting","ruleID":1,"ruleUID":"rule-1"}`,
+				},
+				{
+					T: start.Add(time.Second),
+					V: `{"schemaVersion":1,"values":{},"previous":"Normal","current":"Alerting","ruleID":2,"ruleUID":"rule-2"}`,
+				},
+				{
+					T: start.Add(2 * time.Second),
+					V: `{"schemaVersion":1,"values":{},"previous":"Normal","current":"Alerting","ruleID":3,"ruleUID":"rule-3"}`,
+				},
+				{
+					T: start.Add(3 * time.Second),
+					V: `{"schemaVersion":1,"values":{},"previous":"Alerting","current":"Normal","ruleID":1,"ruleUID":"rule-1"}`,
+				},
+			},
+		},
+		{
+			Stream: map[string]string{historian.OrgIDLabel: "1"},
+			Values: []historian.Sample{
+				{
+					T: start.Add(2 * time.Second),
+					V: `{"schemaVersion":1,"type":"notification","current":"Alerting","ruleUID":"rule-1","throttleKey":"{}:{alertname=\"a\"}"}`,
+				},
+				{
+					T: start.Add(2 * time.Second),
+					V: `{"schemaVersion":1,"type":"notification","current":"Alerting","ruleUID":"rule-2","throttleKey":"{}:{alertname=\"b\"}"}`,
+				},
+				{
+					T: start.Add(4 * time.Second),
+					V: `{"schemaVersion":1,"type":"notification","current":"Normal","ruleUID":"rule-1","throttleKey":"{}:{alertname=\"a\"}"}`,
+				},
+			},
+		},
+	}
+	alertIDs := func(items []*annotations.ItemDTO) []int64 {
+		ids := make([]int64, 0, len(items))
+		for _, item := range items {
+			ids = append(ids, item.AlertID)
+		}
+		return ids
+	}
+
+	res, err := store.GetTransitionAnnotationsByThrottleKey(context.Background(), 1, `{}:{alertname="a"}`, start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Equal(t, []int64{1, 1}, alertIDs(res))
+
+	res, err = store.GetTransitionAnnotationsByThrottleKey(context.Background(), 1, `{}:{alertname="b"}`, start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Equal(t, []int64{2}, alertIDs(res))
+
+	t.Run("queries the notifications of the group", func(t *testing.T) {
+		fakeLokiClient := NewFakeLokiClient()
+		store := createTestLokiStore(t, nil, fakeLokiClient)
+
+		_, err := store.GetTransitionAnnotationsByThrottleKey(context.Background(), 1, `{}:{alertname="a"}`, start, start.Add(time.Minute), orgAccess)
+		require.NoError(t, err)
+		require.Contains(t, fakeLokiClient.LastQuery, `type="notification" | throttleKey="{}:{alertname=\"a\"}"`)
+	})
+
+	t.Run("should require a throttle key", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsByThrottleKey(context.Background(), 1, "", start, start.Add(time.Minute), orgAccess)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetTransitionAnnotationsByAlertGroup(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Minute)
+	rule := historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1", GroupBy: []string{"alertname", "team"}}
+	transition := func(team string, at time.Time) state.StateTransition {
+		tr := genTransition(eval.Normal, eval.Alerting, at)
+		tr.Labels = map[string]string{"alertname": "rule-1", "team": team, "instance": fmt.Sprint(at.Unix())}
+		return tr
+	}
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(rule, []state.StateTransition{
+			transition("a", start),
+			transition("b", start.Add(time.Second)),
+			transition("a", start.Add(2*time.Second)),
+		}, map[string]string{}, log.NewNopLogger()),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2"}, start),
+	}
+	times := func(items []*annotations.ItemDTO) []int64 {
+		res := make([]int64, 0, len(items))
+		for _, item := range items {
+			res = append(res, item.Time)
+		}
+		return res
+	}
+
+	res, err := store.GetTransitionAnnotationsByAlertGroup(context.Background(), 1, `{alertname="rule-1", team="a"}`, start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Equal(t, []int64{start.Add(2 * time.Second).UnixMilli(), start.UnixMilli()}, times(res))
+
+	res, err = store.GetTransitionAnnotationsByAlertGroup(context.Background(), 1, `{alertname="rule-1", team="b"}`, start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Equal(t, []int64{start.Add(time.Second).UnixMilli()}, times(res))
+
+	t.Run("should require a group key", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsByAlertGroup(context.Background(), 1, "", start, start.Add(time.Minute), orgAccess)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetTransitionAnnotationsByResolutionSource(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	paused := genTransition(eval.Alerting, eval.Normal, start.Add(3*time.Minute))
+	paused.StateReason = ngmodels.StateReasonPaused
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, start),
+			genTransition(eval.Alerting, eval.Normal, start.Add(time.Minute)),
+			genTransition(eval.Normal, eval.Alerting, start.Add(2*time.Minute)),
+			paused,
+		}, map[string]string{}, log.NewNopLogger()),
+	}
+	times := func(items []*annotations.ItemDTO) []int64 {
+		res := make([]int64, 0, len(items))
+		for _, item := range items {
+			res = append(res, item.Time)
+		}
+		return res
+	}
+
+	res, err := store.GetTransitionAnnotationsByResolutionSource(context.Background(), 1, historian.ResolutionSourceAuto, start, start.Add(time.Hour), orgAccess)
+	require.NoError(t, err)
+	require.Contains(t, fakeLokiClient.LastQuery, `resolutionSource="auto"`)
+	require.Equal(t, []int64{start.Add(time.Minute).UnixMilli()}, times(res))
+
+	res, err = store.GetTransitionAnnotationsByResolutionSource(context.Background(), 1, historian.ResolutionSourceManual, start, start.Add(time.Hour), orgAccess)
+	require.NoError(t, err)
+	require.Equal(t, []int64{start.Add(3 * time.Minute).UnixMilli()}, times(res))
+
+	t.Run("should reject unknown sources", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsByResolutionSource(context.Background(), 1, "button", start, start.Add(time.Hour), orgAccess)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetTransitionAnnotationsBySeverity(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Minute).Truncate(time.Second)
+	transition := func(severity string, at time.Time) state.StateTransition {
+		tr := genTransition(eval.Normal, eval.Alerting, at)
+		tr.Labels = map[string]string{"severity": severity, "instance": fmt.Sprint(at.Unix())}
+		return tr
+	}
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, []state.StateTransition{
+			transition("critical", start),
+			transition("low", start.Add(time.Second)),
+			transition("critical", start.Add(2*time.Second)),
+		}, map[string]string{}, log.NewNopLogger()),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2"}, start),
+	}
+	times := func(items []*annotations.ItemDTO) []int64 {
+		res := make([]int64, 0, len(items))
+		for _, item := range items {
+			res = append(res, item.Time)
+		}
+		return res
+	}
+
+	t.Run("should return transitions with the severity", func(t *testing.T) {
+		res, err := store.GetTransitionAnnotationsBySeverity(context.Background(), 1, "critical", start, start.Add(time.Minute), orgAccess)
+		require.NoError(t, err)
+		require.Contains(t, fakeLokiClient.LastQuery, `labels_severity="critical"`)
+		require.Equal(t, []int64{start.Add(2 * time.Second).UnixMilli(), start.UnixMilli()}, times(res))
+
+		res, err = store.GetTransitionAnnotationsBySeverity(context.Background(), 1, "low", start, start.Add(time.Minute), orgAccess)
+		require.NoError(t, err)
+		require.Equal(t, []int64{start.Add(time.Second).UnixMilli()}, times(res))
+	})
+
+	t.Run("should filter annotation queries by severity", func(t *testing.T) {
+		res, err := store.Get(context.Background(), &annotations.ItemQuery{
+			OrgID:    1,
+			From:     start.UnixMilli(),
+			To:       start.Add(time.Minute).UnixMilli(),
+			Severity: "low",
+		}, &annotation_ac.AccessResources{CanAccessOrgAnnotations: true})
+		require.NoError(t, err)
+		require.Contains(t, fakeLokiClient.LastQuery, `labels_severity="low"`)
+		require.Equal(t, []int64{start.Add(time.Second).UnixMilli()}, times(res))
+	})
+
+	t.Run("should reject unknown severities", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsBySeverity(context.Background(), 1, "urgent", start, start.Add(time.Minute), orgAccess)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+
+		_, err = store.Get(context.Background(), &annotations.ItemQuery{OrgID: 1, Severity: "urgent"}, &annotation_ac.AccessResources{CanAccessOrgAnnotations: true})
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetTransitionAnnotationsByLabelSet(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Minute)
+	withLabels := func(labels map[string]string, at time.Time) state.StateTransition {
+		transition := genTransition(eval.Normal, eval.Alerting, at)
+		transition.Labels = labels
+		return transition
+	}
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, []state.StateTransition{
+			withLabels(map[string]string{"team": "a", "env": "prod"}, start),
+			withLabels(map[string]string{"team": "a", "env": "prod", "instance": "host-1"}, start.Add(time.Second)),
+			withLabels(map[string]string{"team": "a"}, start.Add(2*time.Second)),
+			withLabels(map[string]string{"team": "a", "env": "prod", "__private__": "x"}, start.Add(3*time.Second)),
+		}, map[string]string{}, log.NewNopLogger()),
+	}
+	times := func(items []*annotations.ItemDTO) []int64 {
+		res := make([]int64, 0, len(items))
+		for _, item := range items {
+			res = append(res, item.Time)
+		}
+		return res
+	}
+
+	res, err := store.GetTransitionAnnotationsByLabelSet(context.Background(), 1, map[string]string{"team": "a", "env": "prod"}, start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Contains(t, fakeLokiClient.LastQuery, `labels_env="prod" | labels_team="a" | fingerprint=`)
+	require.Equal(t, []int64{start.Add(3 * time.Second).UnixMilli(), start.UnixMilli()}, times(res))
+
+	res, err = store.GetTransitionAnnotationsByLabelSet(context.Background(), 1, map[string]string{"team": "a", "env": "prod", "instance": "host-1"}, start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Equal(t, []int64{start.Add(time.Second).UnixMilli()}, times(res))
+
+	res, err = store.GetTransitionAnnotationsByLabelSet(context.Background(), 1, map[string]string{"team": "a"}, start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Equal(t, []int64{start.Add(2 * time.Second).UnixMilli()}, times(res))
+
+	t.Run("should require labels", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsByLabelSet(context.Background(), 1, nil, start, start.Add(time.Minute), orgAccess)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+
+	t.Run("should reject label names that cannot be filtered by", func(t *testing.T) {
+		for _, name := range []string{"", "1team", "app.kubernetes.io/name", `team="a" | json | orgID`} {
+			fakeLokiClient.LastQuery = ""
+
+			_, err := store.GetTransitionAnnotationsByLabelSet(context.Background(), 1, map[string]string{"team": "a", name: "b"}, start, start.Add(time.Minute), orgAccess)
+			require.ErrorIs(t, err, ErrLokiStoreBadRequest, name)
+			require.Empty(t, fakeLokiClient.LastQuery)
+		}
+	})
+}
+
+func TestGetByEnvironment(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Minute).Truncate(time.Second)
+	transition := func(env string, at time.Time) state.StateTransition {
+		tr := genTransition(eval.Normal, eval.Alerting, at)
+		tr.Labels = map[string]string{"env": env, "instance": fmt.Sprint(at.Unix())}
+		return tr
+	}
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, []state.StateTransition{
+			transition("prod", start),
+			transition("staging", start.Add(time.Second)),
+			transition("prod", start.Add(2*time.Second)),
+		}, map[string]string{}, log.NewNopLogger()),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2"}, start),
+	}
+	times := func(items []*annotations.ItemDTO) []int64 {
+		res := make([]int64, 0, len(items))
+		for _, item := range items {
+			res = append(res, item.Time)
+		}
+		return res
+	}
+
+	t.Run("should filter annotation queries by environment", func(t *testing.T) {
+		res, err := store.Get(context.Background(), &annotations.ItemQuery{
+			OrgID:       1,
+			From:        start.UnixMilli(),
+			To:          start.Add(time.Minute).UnixMilli(),
+			Environment: "staging",
+		}, &annotation_ac.AccessResources{CanAccessOrgAnnotations: true})
+		require.NoError(t, err)
+		require.Contains(t, fakeLokiClient.LastQuery, `labels_env="staging"`)
+		require.Equal(t, []int64{start.Add(time.Second).UnixMilli()}, times(res))
+	})
+}
+
+func TestGetTransitionAnnotationsByNoDataBehavior(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Minute)
+	fakeLokiClient.Response = []historian.Stream{
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1", NoDataBehavior: "OK"}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2", NoDataBehavior: "Alerting"}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3", NoDataBehavior: "NoData"}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 4, UID: "rule-4", NoDataBehavior: "OK"}, start.Add(time.Second)),
+	}
+	alertIDs := func(items []*annotations.ItemDTO) []int64 {
+		ids := make([]int64, 0, len(items))
+		for _, item := range items {
+			ids = append(ids, item.AlertID)
+		}
+		return ids
+	}
+
+	res, err := store.GetTransitionAnnotationsByNoDataBehavior(context.Background(), 1, "OK", start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Contains(t, fakeLokiClient.LastQuery, `noDataBehavior="OK"`)
+	require.Equal(t, []int64{4, 1}, alertIDs(res))
+
+	res, err = store.GetTransitionAnnotationsByNoDataBehavior(context.Background(), 1, "Alerting", start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Equal(t, []int64{2}, alertIDs(res))
+
+	res, err = store.GetTransitionAnnotationsByNoDataBehavior(context.Background(), 1, "NoData", start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Equal(t, []int64{3}, alertIDs(res))
+
+	t.Run("should reject unknown behavior", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsByNoDataBehavior(context.Background(), 1, "Pending", start, start.Add(time.Minute), orgAccess)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetTransitionAnnotationsByAlertRuleTag(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Minute)
+	fakeLokiClient.Response = []historian.Stream{
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1", Tags: []string{"db"}}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2", Tags: []string{"backend"}}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3", Tags: []string{"backend", "db", "critical"}}, start.Add(time.Second)),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 4, UID: "rule-4", Tags: []string{"dbx"}}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 5, UID: "rule-5"}, start),
+	}
+	alertIDs := func(items []*annotations.ItemDTO) []int64 {
+		ids := make([]int64, 0, len(items))
+		for _, item := range items {
+			ids = append(ids, item.AlertID)
+		}
+		return ids
+	}
+
+	res, err := store.GetTransitionAnnotationsByAlertRuleTag(context.Background(), 1, "db", start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Contains(t, fakeLokiClient.LastQuery, `tags=~"(.* )?db( .*)?"`)
+	require.Equal(t, []int64{3, 1}, alertIDs(res))
+
+	res, err = store.GetTransitionAnnotationsByAlertRuleTag(context.Background(), 1, "backend", start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Equal(t, []int64{3, 2}, alertIDs(res))
+
+	res, err = store.GetTransitionAnnotationsByAlertRuleTag(context.Background(), 1, "critical", start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Equal(t, []int64{3}, alertIDs(res))
+
+	t.Run("should require a tag", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsByAlertRuleTag(context.Background(), 1, "", start, start.Add(time.Minute), orgAccess)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+
+	t.Run("should reject tags with whitespace", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsByAlertRuleTag(context.Background(), 1, "db critical", start, start.Add(time.Minute), orgAccess)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetTransitionAnnotationsByCustomAnnotation(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Minute).Truncate(time.Second)
+	fakeLokiClient.Response = []historian.Stream{
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1", CustomFields: map[string]string{"summary": "disk full", "team": "platform"}}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2", CustomFields: map[string]string{"summary": "disk full", "team": "storage"}}, start.Add(time.Second)),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3", CustomFields: map[string]string{"summary": "disk full"}}, start.Add(2*time.Second)),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 4, UID: "rule-4"}, start),
+	}
+	alertIDs := func(items []*annotations.ItemDTO) []int64 {
+		ids := make([]int64, 0, len(items))
+		for _, item := range items {
+			ids = append(ids, item.AlertID)
+		}
+		return ids
+	}
+
+	t.Run("should return transitions of rules with all annotations", func(t *testing.T) {
+		res, err := store.GetTransitionAnnotationsByCustomAnnotation(context.Background(), 1, map[string]string{"summary": "disk full"}, start, start.Add(time.Minute), orgAccess)
+		require.NoError(t, err)
+		require.Contains(t, fakeLokiClient.LastQuery, `customFields_summary="disk full"`)
+		require.Equal(t, []int64{3, 2, 1}, alertIDs(res))
+
+		res, err = store.GetTransitionAnnotationsByCustomAnnotation(context.Background(), 1, map[string]string{"summary": "disk full", "team": "platform"}, start, start.Add(time.Minute), orgAccess)
+		require.NoError(t, err)
+		require.Contains(t, fakeLokiClient.LastQuery, `customFields_summary="disk full" | customFields_team="platform"`)
+		require.Equal(t, []int64{1}, alertIDs(res))
+	})
+
+	t.Run("should filter annotation queries by rule annotations", func(t *testing.T) {
+		res, err := store.Get(context.Background(), &annotations.ItemQuery{
+			OrgID:            1,
+			From:             start.UnixMilli(),
+			To:               start.Add(time.Minute).UnixMilli(),
+			AnnotationFilter: map[string]string{"summary": "disk full", "team": "storage"},
+		}, &annotation_ac.AccessResources{CanAccessOrgAnnotations: true})
+		require.NoError(t, err)
+		require.Contains(t, fakeLokiClient.LastQuery, `customFields_summary="disk full" | customFields_team="storage"`)
+		require.Equal(t, []int64{2}, alertIDs(res))
+	})
+
+	t.Run("should require annotations", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsByCustomAnnotation(context.Background(), 1, nil, start, start.Add(time.Minute), orgAccess)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+
+	t.Run("should reject annotation names that cannot be filtered by", func(t *testing.T) {
+		for _, name := range []string{"", "1summary", "run-book", `summary="" | json | orgID`} {
+			fakeLokiClient.LastQuery = ""
+
+			_, err := store.GetTransitionAnnotationsByCustomAnnotation(context.Background(), 1, map[string]string{name: "disk full"}, start, start.Add(time.Minute), orgAccess)
+			require.ErrorIs(t, err, ErrLokiStoreBadRequest, name)
+
+			_, err = store.Get(context.Background(), &annotations.ItemQuery{
+				OrgID:            1,
+				From:             start.UnixMilli(),
+				To:               start.Add(time.Minute).UnixMilli(),
+				AnnotationFilter: map[string]string{name: "disk full"},
+			}, &annotation_ac.AccessResources{CanAccessOrgAnnotations: true})
+			require.ErrorIs(t, err, ErrLokiStoreBadRequest, name)
+			require.Empty(t, fakeLokiClient.LastQuery)
+		}
+	})
+}
+
+func TestQueryTransitionsByField(t *testing.T) {
+	// withRuleMeta returns streams of rules with the given rule metadata.
+	withRuleMeta := func(set func(meta *historymodel.RuleMeta, value string)) func(historymodel.RuleMeta, string, time.Time) historian.Stream {
+		return func(meta historymodel.RuleMeta, value string, at time.Time) historian.Stream {
+			set(&meta, value)
+			return alertingStream(meta, at)
+		}
+	}
+	// withLabel returns streams of alert instances with the given label.
+	withLabel := func(label string) func(historymodel.RuleMeta, string, time.Time) historian.Stream {
+		return func(meta historymodel.RuleMeta, value string, at time.Time) historian.Stream {
+			transition := genTransition(eval.Normal, eval.Alerting, at)
+			transition.Labels = map[string]string{label: value}
+			return historian.StatesToStream(meta, []state.StateTransition{transition}, map[string]string{}, log.NewNopLogger())
+		}
+	}
+
+	testCases := []struct {
+		name  string
+		query func(r *LokiHistorianStore, ctx context.Context, orgID int64, value string, from, to time.Time, resources *annotation_ac.AccessResources) ([]*annotations.ItemDTO, error)
+		// values are the values of the field of rules 1, 2 and 3. Rules 1 and 3 must match the first value.
+		values []string
+		stream func(meta historymodel.RuleMeta, value string, at time.Time) historian.Stream
+		filter string
+	}{
+		{
+			name:   "application",
+			query:  (*LokiHistorianStore).GetTransitionAnnotationsByApplication,
+			values: []string{"checkout", "search", "checkout"},
+			stream: withRuleMeta(func(meta *historymodel.RuleMeta, v string) { meta.Application = v }),
+			filter: `application="checkout"`,
+		},
+		{
+			name:   "clusterID",
+			query:  (*LokiHistorianStore).GetTransitionAnnotationsByClusterID,
+			values: []string{"eu-west", "us-east", "eu-west"},
+			stream: withRuleMeta(func(meta *historymodel.RuleMeta, v string) { meta.ClusterID = v }),
+			filter: `clusterID="eu-west"`,
+		},
+		{
+			name:   "deploymentID",
+			query:  (*LokiHistorianStore).GetTransitionAnnotationsByDeploymentID,
+			values: []string{"deploy-1", "deploy-2", "deploy-1"},
+			stream: withLabel(historian.DeploymentIDLabel),
+			filter: `deploymentID="deploy-1"`,
+		},
+		{
+			name:   "environment",
+			query:  (*LokiHistorianStore).GetTransitionAnnotationsByEnvironment,
+			values: []string{"prod", "staging", "prod"},
+			stream: withLabel(environmentLabel),
+			filter: `labels_env="prod"`,
+		},
+		{
+			name:   "featureFlag",
+			query:  (*LokiHistorianStore).GetTransitionAnnotationsByFeatureFlag,
+			values: []string{"newCheckout", "newSearch", "newCheckout"},
+			stream: withRuleMeta(func(meta *historymodel.RuleMeta, v string) { meta.FeatureFlag = v }),
+			filter: `featureFlag="newCheckout"`,
+		},
+		{
+			name:   "incidentID",
+			query:  (*LokiHistorianStore).GetTransitionAnnotationsByIncidentID,
+			values: []string{"INC-1", "INC-2", "INC-1"},
+			stream: withRuleMeta(func(meta *historymodel.RuleMeta, v string) { meta.IncidentID = v }),
+			filter: `incidentID="INC-1"`,
+		},
+		{
+			name:   "maintenanceWindowID",
+			query:  (*LokiHistorianStore).GetTransitionAnnotationsByMaintenanceWindow,
+			values: []string{"window-1", "window-2", "window-1"},
+			stream: withLabel(historian.MaintenanceWindowLabel),
+			filter: `maintenanceWindowID="window-1"`,
+		},
+		{
+			name:   "namespace",
+			query:  (*LokiHistorianStore).GetTransitionAnnotationsByNamespace,
+			values: []string{"monitoring", "default", "monitoring"},
+			stream: withRuleMeta(func(meta *historymodel.RuleMeta, v string) { meta.K8sNamespace = v }),
+			filter: `namespace="monitoring"`,
+		},
+		{
+			name:   "namespace from labels",
+			query:  (*LokiHistorianStore).GetTransitionAnnotationsByNamespace,
+			values: []string{"monitoring", "default", "monitoring"},
+			stream: withLabel("namespace"),
+			filter: `namespace="monitoring"`,
+		},
+		{
+			name:   "onCallPolicy",
+			query:  (*LokiHistorianStore).GetTransitionAnnotationsByOnCallPolicy,
+			values: []string{"primary-sre", "secondary-sre", "primary-sre"},
+			stream: withRuleMeta(func(meta *historymodel.RuleMeta, v string) { meta.OnCallPolicy = v }),
+			filter: `onCallPolicy="primary-sre"`,
+		},
+		{
+			name:   "priority",
+			query:  (*LokiHistorianStore).GetTransitionAnnotationsByPriority,
+			values: []string{"P0", "P1", "P0"},
+			stream: withRuleMeta(func(meta *historymodel.RuleMeta, v string) { meta.Priority = v }),
+			filter: `priority="P0"`,
+		},
+		{
+			name:   "reconciliationID",
+			query:  (*LokiHistorianStore).GetTransitionAnnotationsByReconciliationID,
+			values: []string{"run-1", "run-2", "run-1"},
+			stream: withRuleMeta(func(meta *historymodel.RuleMeta, v string) { meta.ReconciliationID = v }),
+			filter: `reconciliationID="run-1"`,
+		},
+		{
+			name:   "region",
+			query:  (*LokiHistorianStore).GetTransitionAnnotationsByRegion,
+			values: []string{"eu-west-1", "us-east-1", "eu-west-1"},
+			stream: withRuleMeta(func(meta *historymodel.RuleMeta, v string) { meta.Region = v }),
+			filter: `region="eu-west-1"`,
+		},
+		{
+			name:   "runbookURL",
+			query:  (*LokiHistorianStore).GetTransitionAnnotationsByRunbook,
+			values: []string{"https://runbooks.example.com/db", "https://runbooks.example.com/dbx", "https://runbooks.example.com/db/"},
+			stream: withRuleMeta(func(meta *historymodel.RuleMeta, v string) { meta.RunbookURL = v }),
+			filter: `runbookURL=~"https://runbooks\\.example\\.com/db/?"`,
+		},
+		{
+			name:   "serviceName",
+			query:  (*LokiHistorianStore).GetTransitionAnnotationsByServiceName,
+			values: []string{"checkout", "search", "checkout"},
+			stream: withRuleMeta(func(meta *historymodel.RuleMeta, v string) { meta.ServiceName = v }),
+			filter: `serviceName="checkout"`,
+		},
+		{
+			name:   "serviceName from labels",
+			query:  (*LokiHistorianStore).GetTransitionAnnotationsByServiceName,
+			values: []string{"checkout", "search", "checkout"},
+			stream: withLabel("service"),
+			filter: `serviceName="checkout"`,
+		},
+		{
+			name:   "team",
+			query:  (*LokiHistorianStore).GetTransitionAnnotationsByTeam,
+			values: []string{"platform", "payments", "platform"},
+			stream: withRuleMeta(func(meta *historymodel.RuleMeta, v string) { meta.Team = v }),
+			filter: `team="platform"`,
+		},
+		{
+			name:   "tenantID",
+			query:  (*LokiHistorianStore).GetTransitionAnnotationsByTenant,
+			values: []string{"tenant-a", "tenant-b", "tenant-a"},
+			stream: withRuleMeta(func(meta *historymodel.RuleMeta, v string) { meta.TenantID = v }),
+			filter: `tenantID="tenant-a"`,
+		},
+	}
+	alertIDs := func(items []*annotations.ItemDTO) []int64 {
+		ids := make([]int64, 0, len(items))
+		for _, item := range items {
+			ids = append(ids, item.AlertID)
+		}
+		return ids
+	}
+
+	start := time.Now().Add(-time.Minute)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeLokiClient := NewFakeLokiClient()
+			fakeLokiClient.KeepResponse = true
+			store := createTestLokiStore(t, nil, fakeLokiClient)
+			fakeLokiClient.Response = []historian.Stream{
+				tc.stream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, tc.values[0], start),
+				tc.stream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2"}, tc.values[1], start),
+				tc.stream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3"}, tc.values[2], start.Add(time.Second)),
+				alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 4, UID: "rule-4"}, start),
+			}
+
+			res, err := tc.query(store, context.Background(), 1, tc.values[0], start, start.Add(time.Minute), orgAccess)
+			require.NoError(t, err)
+			require.Contains(t, fakeLokiClient.LastQuery, tc.filter)
+			require.Equal(t, []int64{3, 1}, alertIDs(res))
+
+			res, err = tc.query(store, context.Background(), 1, tc.values[1], start, start.Add(time.Minute), orgAccess)
+			require.NoError(t, err)
+			require.Equal(t, []int64{2}, alertIDs(res))
+
+			_, err = tc.query(store, context.Background(), 1, "", start, start.Add(time.Minute), orgAccess)
+			require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+		})
+	}
+
+	t.Run("should only return accessible annotations", func(t *testing.T) {
+		fakeLokiClient := NewFakeLokiClient()
+		fakeLokiClient.KeepResponse = true
+		store := createTestLokiStore(t, nil, fakeLokiClient)
+		fakeLokiClient.Response = []historian.Stream{
+			alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1", Team: "a"}, start),
+			alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2", Team: "a", DashboardUID: "dashboard-1"}, start),
+			alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3", Team: "a", DashboardUID: "dashboard-2"}, start),
+		}
+
+		res, err := store.GetTransitionAnnotationsByTeam(context.Background(), 1, "a", start, start.Add(time.Minute), orgAccess)
+		require.NoError(t, err)
+		require.Equal(t, []int64{1}, alertIDs(res))
+
+		res, err = store.GetTransitionAnnotationsByTeam(context.Background(), 1, "a", start, start.Add(time.Minute), &annotation_ac.AccessResources{
+			Dashboards:               map[string]int64{"dashboard-1": 1},
+			CanAccessDashAnnotations: true,
+		})
+		require.NoError(t, err)
+		require.Contains(t, fakeLokiClient.LastQuery, `dashboardUID=~"dashboard-1"`)
+		require.Equal(t, []int64{2}, alertIDs(res))
+
+		fakeLokiClient.LastQuery = ""
+		res, err = store.GetTransitionAnnotationsByTeam(context.Background(), 1, "a", start, start.Add(time.Minute), &annotation_ac.AccessResources{})
+		require.NoError(t, err)
+		require.Empty(t, res)
+		require.Empty(t, fakeLokiClient.LastQuery)
+
+		_, err = store.GetTransitionAnnotationsByTeam(context.Background(), 1, "a", start, start.Add(time.Minute), nil)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetTransitionAnnotationsByMutedStatus(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Minute)
+	fakeLokiClient.KeepResponse = true
+	fakeLokiClient.Response = []historian.Stream{
+		{
+			Stream: map[string]string{historian.OrgIDLabel: "1"},
+			Values: []historian.Sample{
+				{
+					T: start,
+					V: `{"schemaVersion":1,"values":{},"previous":"Normal","current":"Alerting","ruleID":1,"ruleUID":"rule-1","muted":true}`,
+				},
+				{
+					T: start.Add(time.Second),
+					V: `{"schemaVersion":1,"values":{},"previous":"Normal","current":"Alerting","ruleID":2,"ruleUID":"rule-2","muted":false}`,
+				},
+				{
+					T: start.Add(2 * time.Second),
+					V: `{"schemaVersion":1,"values":{},"previous":"Normal","current":"Alerting","ruleID":3,"ruleUID":"rule-3"}`,
+				},
+				{
+					T: start.Add(3 * time.Second),
+					V: `{"schemaVersion":1,"values":{},"previous":"Alerting","current":"Normal","ruleID":1,"ruleUID":"rule-1","muted":true}`,
+				},
+			},
+		},
+	}
+	alertIDs := func(items []*annotations.ItemDTO) []int64 {
+		ids := make([]int64, 0, len(items))
+		for _, item := range items {
+			ids = append(ids, item.AlertID)
+		}
+		return ids
+	}
+
+	t.Run("should return muted transitions", func(t *testing.T) {
+		res, err := store.GetTransitionAnnotationsByMutedStatus(context.Background(), 1, start, start.Add(time.Minute), true, orgAccess)
+		require.NoError(t, err)
+		require.Contains(t, fakeLokiClient.LastQuery, `muted="true"`)
+		require.Equal(t, []int64{1, 1}, alertIDs(res))
+	})
+
+	t.Run("should return transitions that are not muted", func(t *testing.T) {
+		res, err := store.GetTransitionAnnotationsByMutedStatus(context.Background(), 1, start, start.Add(time.Minute), false, orgAccess)
+		require.NoError(t, err)
+		require.Contains(t, fakeLokiClient.LastQuery, `muted!="true"`)
+		require.Equal(t, []int64{3, 2}, alertIDs(res))
+	})
+}
+
+func TestEntriesFromStreamsPreviousState(t *testing.T) {
+	store := createTestLokiStore(t, nil, NewFakeLokiClient())
+	start := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	rule := historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}
+
+	// Both instances are in the same stream, so that their entries interleave.
+	stream := historian.StatesToStream(rule, []state.StateTransition{
+		withInstance(genTransition(eval.Normal, eval.Alerting, start), "a"),
+		withInstance(genTransition(eval.Normal, eval.Pending, start.Add(time.Second)), "b"),
+		withInstance(genTransition(eval.Alerting, eval.Normal, start.Add(2*time.Second)), "a"),
+		withInstance(genTransition(eval.Pending, eval.Alerting, start.Add(3*time.Second)), "b"),
+	}, map[string]string{}, log.NewNopLogger())
+
+	entries := store.entriesFromStreams([]historian.Stream{stream}, &annotation_ac.AccessResources{CanAccessOrgAnnotations: true})
+	require.Len(t, entries, 4)
+
+	expected := []struct{ prev, cur eval.State }{
+		{eval.Normal, eval.Alerting},
+		{eval.Normal, eval.Pending},
+		{eval.Alerting, eval.Normal},
+		{eval.Pending, eval.Alerting},
+	}
+	for i, e := range expected {
+		require.Equal(t, e.prev.String(), entries[i].item.PrevState, "entry %d", i)
+		require.Equal(t, e.cur.String(), entries[i].item.NewState, "entry %d", i)
+	}
+}
+
+func TestGetAlertingAnnotations(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{
+		Dashboards:               map[string]int64{"dashboard-1": 1, "dashboard-2": 2},
+		CanAccessDashAnnotations: true,
+	}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1", DashboardUID: "dashboard-1"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Pending, start),
+			genTransition(eval.Pending, eval.Alerting, start.Add(time.Minute)),
+			genTransition(eval.Alerting, eval.Normal, start.Add(2*time.Minute)),
+			genTransition(eval.Normal, eval.Alerting, start.Add(3*time.Minute)),
+		}, map[string]string{}, log.NewNopLogger()),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2", DashboardUID: "dashboard-2"}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3"}, start),
+	}
+
+	res, err := store.GetAlertingAnnotations(context.Background(), "dashboard-1", 1, start, start.Add(time.Hour), resources)
+	require.NoError(t, err)
+	require.Equal(t, `{orgID="1",from="state-history"} |= "\"dashboardUID\":\"dashboard-1\"" | json | dashboardUID="dashboard-1" | current=~"Alerting.*"`, fakeLokiClient.LastQuery)
+
+	require.Len(t, res, 2)
+	require.Equal(t, int64(1), res[0].AlertID)
+	require.Equal(t, start.Add(3*time.Minute).UnixMilli(), res[0].Time)
+	require.Equal(t, "Normal", res[0].PrevState)
+	require.Equal(t, "Alerting", res[0].NewState)
+	require.Equal(t, int64(1), res[0].DashboardID)
+	require.Equal(t, start.Add(time.Minute).UnixMilli(), res[1].Time)
+	require.Equal(t, "Pending", res[1].PrevState)
+
+	t.Run("should enforce access control", func(t *testing.T) {
+		res, err := store.GetAlertingAnnotations(context.Background(), "dashboard-2", 1, start, start.Add(time.Hour), &annotation_ac.AccessResources{
+			Dashboards:               map[string]int64{"dashboard-1": 1},
+			CanAccessDashAnnotations: true,
+		})
+		require.NoError(t, err)
+		require.Empty(t, res)
+	})
+
+	t.Run("should require a dashboard UID", func(t *testing.T) {
+		_, err := store.GetAlertingAnnotations(context.Background(), "", 1, start, start.Add(time.Hour), resources)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+
+	t.Run("should require access resources", func(t *testing.T) {
+		_, err := store.GetAlertingAnnotations(context.Background(), "dashboard-1", 1, start, start.Add(time.Hour), nil)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func BenchmarkGetAlertingAnnotations(b *testing.B) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(b, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{
+		Dashboards:               map[string]int64{"dashboard-0": 1},
+		CanAccessDashAnnotations: true,
+	}
+
+	// 100 rules on 10 dashboards, each flapping between Normal and Alerting 100 times.
+	start := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	for i := 0; i < 100; i++ {
+		transitions := make([]state.StateTransition, 0, 100)
+		for j := 0; j < 100; j += 2 {
+			at := start.Add(time.Duration(j) * time.Second)
+			transitions = append(transitions,
+				genTransition(eval.Normal, eval.Alerting, at),
+				genTransition(eval.Alerting, eval.Normal, at.Add(time.Second)),
+			)
+		}
+		fakeLokiClient.Response = append(fakeLokiClient.Response, historian.StatesToStream(historymodel.RuleMeta{
+			OrgID:        1,
+			ID:           int64(i),
+			UID:          fmt.Sprintf("rule-%d", i),
+			DashboardUID: fmt.Sprintf("dashboard-%d", i%10),
+		}, transitions, map[string]string{}, log.NewNopLogger()))
+	}
+
+	b.Run("general path", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			items, err := store.Get(context.Background(), &annotations.ItemQuery{
+				OrgID:        1,
+				DashboardUID: "dashboard-0",
+				From:         start.UnixMilli(),
+				To:           start.Add(time.Hour).UnixMilli(),
+			}, resources)
+			require.NoError(b, err)
+			alerting := make([]*annotations.ItemDTO, 0, len(items))
+			for _, item := range items {
+				if item.NewState == eval.Alerting.String() {
+					alerting = append(alerting, item)
+				}
+			}
+			require.Len(b, alerting, 500)
+		}
+	})
+
+	b.Run("alerting path", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			items, err := store.GetAlertingAnnotations(context.Background(), "dashboard-0", 1, start, start.Add(time.Hour), resources)
+			require.NoError(b, err)
+			require.Len(b, items, 500)
+		}
+	})
+}
+
+func TestGetTransitionAnnotationsForDashboardSnapshot(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{
+		Dashboards:               map[string]int64{"dashboard-1": 1, "dashboard-2": 2},
+		CanAccessDashAnnotations: true,
+	}
+
+	snapshotTime := time.Now().Truncate(time.Millisecond)
+	lookback := time.Hour
+
+	t.Run("should exclude annotations outside of the lookback", func(t *testing.T) {
+		fakeLokiClient.Response = []historian.Stream{
+			alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1", DashboardUID: "dashboard-1"}, snapshotTime.Add(-2*lookback)),
+			alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2", DashboardUID: "dashboard-1"}, snapshotTime.Add(-lookback)),
+			alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3", DashboardUID: "dashboard-1"}, snapshotTime),
+			alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 4, UID: "rule-4", DashboardUID: "dashboard-1"}, snapshotTime.Add(time.Minute)),
+			alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 5, UID: "rule-5", DashboardUID: "dashboard-2"}, snapshotTime.Add(-time.Minute)),
+		}
+
+		res, err := store.GetTransitionAnnotationsForDashboardSnapshot(context.Background(), 1, "dashboard-1", snapshotTime, lookback, resources)
+		require.NoError(t, err)
+		require.Contains(t, fakeLokiClient.LastQuery, `dashboardUID="dashboard-1"`)
+
+		require.Len(t, res, 2)
+		require.Equal(t, int64(3), res[0].AlertID)
+		require.Equal(t, int64(2), res[1].AlertID)
+	})
+
+	t.Run("should reject invalid lookback", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsForDashboardSnapshot(context.Background(), 1, "dashboard-1", snapshotTime, 0, resources)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+
+	t.Run("should require access resources", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsForDashboardSnapshot(context.Background(), 1, "dashboard-1", snapshotTime, lookback, nil)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetTransitionAnnotationsByPendingPeriod(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Minute)
+	fakeLokiClient.Response = []historian.Stream{
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1", PendingPeriod: 30 * time.Second}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2", PendingPeriod: time.Minute}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3", PendingPeriod: 5 * time.Minute}, start.Add(time.Second)),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 4, UID: "rule-4"}, start),
+	}
+	alertIDs := func(items []*annotations.ItemDTO) []int64 {
+		ids := make([]int64, 0, len(items))
+		for _, item := range items {
+			ids = append(ids, item.AlertID)
+		}
+		return ids
+	}
+
+	res, err := store.GetTransitionAnnotationsByPendingPeriod(context.Background(), 1, time.Minute, start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Contains(t, fakeLokiClient.LastQuery, `pendingDurationMs>=60000`)
+	require.Equal(t, []int64{3, 2}, alertIDs(res))
+
+	res, err = store.GetTransitionAnnotationsByPendingPeriod(context.Background(), 1, 2*time.Minute, start, start.Add(time.Minute), orgAccess)
+	require.NoError(t, err)
+	require.Equal(t, []int64{3}, alertIDs(res))
+
+	t.Run("should reject negative periods", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsByPendingPeriod(context.Background(), 1, -time.Second, start, start.Add(time.Minute), orgAccess)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetTransitionAnnotationsByEvaluationInterval(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Minute)
+	fakeLokiClient.Response = []historian.Stream{
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1", EvaluationInterval: 10 * time.Second}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2", EvaluationInterval: time.Minute}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3", EvaluationInterval: 5 * time.Minute}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 4, UID: "rule-4"}, start),
+	}
+
+	res, err := store.GetTransitionAnnotationsByEvaluationInterval(context.Background(), 1, start, start.Add(time.Minute), 30*time.Second, orgAccess)
+	require.NoError(t, err)
+	require.Contains(t, fakeLokiClient.LastQuery, `evaluationIntervalMs>30000`)
+	require.Len(t, res, 2)
+	require.ElementsMatch(t, []int64{2, 3}, []int64{res[0].AlertID, res[1].AlertID})
+
+	t.Run("should reject negative intervals", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsByEvaluationInterval(context.Background(), 1, start, start.Add(time.Minute), -time.Second, orgAccess)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetTransitionsByCustomExpr(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+
+	start := time.Now().Add(-time.Minute)
+	streams := []historian.Stream{
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2"}, start),
+	}
+
+	t.Run("should query valid expressions", func(t *testing.T) {
+		fakeLokiClient.Response = streams
+		expr := `{orgID="1",from="state-history"} | json | ruleUID=~"rule-2|other"`
+
+		res, err := store.GetTransitionsByCustomExpr(context.Background(), 1, expr, start, start.Add(time.Minute), resources)
+		require.NoError(t, err)
+		require.Equal(t, expr, fakeLokiClient.LastQuery)
+		require.Len(t, res, 1)
+		require.Equal(t, int64(2), res[0].AlertID)
+	})
+
+	t.Run("should enforce access control", func(t *testing.T) {
+		fakeLokiClient.Response = streams
+		expr := `{orgID="1",from="state-history"}`
+
+		res, err := store.GetTransitionsByCustomExpr(context.Background(), 1, expr, start, start.Add(time.Minute), &annotation_ac.AccessResources{})
+		require.NoError(t, err)
+		require.Empty(t, res)
+	})
+
+	t.Run("should only return entries of accessible dashboards", func(t *testing.T) {
+		fakeLokiClient.Response = []historian.Stream{
+			alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1", DashboardUID: "dash-1"}, start),
+			alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2", DashboardUID: "dash-2"}, start),
+			alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3"}, start),
+		}
+		expr := `{orgID="1",from="state-history"}`
+		dashResources := &annotation_ac.AccessResources{
+			Dashboards:               map[string]int64{"dash-1": 1},
+			CanAccessDashAnnotations: true,
+		}
+
+		res, err := store.GetTransitionsByCustomExpr(context.Background(), 1, expr, start, start.Add(time.Minute), dashResources)
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		require.Equal(t, int64(1), res[0].AlertID)
+	})
+
+	t.Run("should reject invalid expressions", func(t *testing.T) {
+		exprs := []string{
+			`{orgID="1",from="state-history"} | json | ruleUID="rule-2`,
+			`{orgID="1",from="state-history"} json`,
+			`{orgID="1",from="state-history"} | json [5m]`,
+			`{orgID="1",from="state-history"} | json or {orgID="2"}`,
+		}
+		for _, expr := range exprs {
+			fakeLokiClient.LastQuery = ""
+			_, err := store.GetTransitionsByCustomExpr(context.Background(), 1, expr, start, start.Add(time.Minute), resources)
+			require.ErrorIs(t, err, ErrLokiStoreBadRequest, expr)
+			require.Empty(t, fakeLokiClient.LastQuery)
+		}
+	})
+
+	t.Run("should reject expressions of other orgs", func(t *testing.T) {
+		exprs := []string{
+			`{orgID="2",from="state-history"} | json`,
+			`{from="state-history"} | json`,
+			`count_over_time({orgID="1",from="state-history"} [5m])`,
+		}
+		for _, expr := range exprs {
+			fakeLokiClient.LastQuery = ""
+			_, err := store.GetTransitionsByCustomExpr(context.Background(), 1, expr, start, start.Add(time.Minute), resources)
+			require.ErrorIs(t, err, ErrLokiStoreBadRequest, expr)
+			require.Empty(t, fakeLokiClient.LastQuery)
+		}
+	})
+}
+
+func TestGetAnnotationSizeStats(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	to := time.Now().Truncate(time.Minute)
+	from := to.Add(-time.Hour)
+	fakeLokiClient.MetricResponses = map[string][]historian.MetricSeries{
+		"sum(bytes_over_time(": {
+			{Metric: map[string]string{}, Values: []historian.MetricSample{{T: to, V: 3000}}},
+		},
+		"sum(count_over_time(": {
+			{Metric: map[string]string{}, Values: []historian.MetricSample{{T: to, V: 12}}},
+		},
+		"topk(10, sum by (ruleUID) (bytes_over_time(": {
+			{Metric: map[string]string{"ruleUID": "rule-2"}, Values: []historian.MetricSample{{T: to, V: 1000}}},
+			{Metric: map[string]string{"ruleUID": "rule-1"}, Values: []historian.MetricSample{{T: to, V: 2000}}},
+		},
+	}
+
+	res, err := store.GetAnnotationSizeStats(context.Background(), 1, from, to)
+	require.NoError(t, err)
+	require.Equal(t, SizeStats{
+		TotalBytes:    3000,
+		EntryCount:    12,
+		AvgEntryBytes: 250,
+		TopRulesBySize: []RuleStorageUsage{
+			{RuleUID: "rule-1", Bytes: 2000},
+			{RuleUID: "rule-2", Bytes: 1000},
+		},
+	}, res)
+	require.Contains(t, fakeLokiClient.LastQuery, "| json [1h])))")
+
+	t.Run("should return zero without entries", func(t *testing.T) {
+		fakeLokiClient.MetricResponses = nil
+		fakeLokiClient.MetricResponse = nil
+
+		res, err := store.GetAnnotationSizeStats(context.Background(), 1, from, to)
+		require.NoError(t, err)
+		require.Equal(t, SizeStats{TopRulesBySize: []RuleStorageUsage{}}, res)
+	})
+
+	t.Run("should fail with invalid time range", func(t *testing.T) {
+		_, err := store.GetAnnotationSizeStats(context.Background(), 1, to, from)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetAnnotationsForReplay(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	withLabels := func(transition state.StateTransition, labels map[string]string) state.StateTransition {
+		transition.State.Labels = labels
+		return transition
+	}
+	fakeLokiClient.Response = []historian.Stream{
+		// Started firing and was still firing at the end, needs replay.
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Pending, start),
+			genTransition(eval.Pending, eval.Alerting, start.Add(time.Minute)),
+		}, map[string]string{}, log.NewNopLogger()),
+		notificationStream("rule-1", "email", start.Add(90*time.Second)),
+		// Fired and resolved, does not need replay.
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, start),
+			genTransition(eval.Alerting, eval.Normal, start.Add(2*time.Minute)),
+		}, map[string]string{}, log.NewNopLogger()),
+		// One instance still firing, the other resolved.
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3"}, []state.StateTransition{
+			withLabels(genTransition(eval.Normal, eval.Alerting, start), map[string]string{"instance": "a"}),
+			withLabels(genTransition(eval.Normal, eval.Alerting, start.Add(time.Minute)), map[string]string{"instance": "b"}),
+			withLabels(genTransition(eval.Alerting, eval.Normal, start.Add(3*time.Minute)), map[string]string{"instance": "b"}),
+		}, map[string]string{}, log.NewNopLogger()),
+		// Started firing after the time range, does not need replay.
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 4, UID: "rule-4"}, start.Add(2*time.Hour)),
+	}
+
+	res, err := store.GetAnnotationsForReplay(context.Background(), 1, start, start.Add(10*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, []ReplayEntry{
+		{
+			RuleUID:     "rule-3",
+			FiringStart: start,
+			Labels:      map[string]string{"instance": "a"},
+		},
+		{
+			RuleUID:      "rule-1",
+			FiringStart:  start.Add(time.Minute),
+			Labels:       map[string]string{"key1": "value1"},
+			ContactPoint: "email",
+		},
+	}, res)
+}
+
+func TestGetTransitionDelta(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Hour)
+	before := start.Add(10 * time.Minute)
+	after := start.Add(30 * time.Minute)
+	fakeLokiClient.Response = []historian.Stream{
+		// Firing before and after.
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, start),
+		// Firing before, resolved in between.
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, start),
+			genTransition(eval.Alerting, eval.Normal, start.Add(20*time.Minute)),
+		}, map[string]string{}, log.NewNopLogger()),
+		// Firing in between.
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3"}, start.Add(20*time.Minute)),
+		// Firing after.
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 4, UID: "rule-4"}, start.Add(40*time.Minute)),
+	}
+
+	res, err := store.GetTransitionDelta(context.Background(), 1, before, after)
+	require.NoError(t, err)
+	require.Equal(t, &StateDelta{
+		NewlyFiring: []string{"rule-3"},
+		Resolved:    []string{"rule-2"},
+		StillFiring: []string{"rule-1"},
+	}, res)
+
+	t.Run("should fail when after time is before before time", func(t *testing.T) {
+		_, err := store.GetTransitionDelta(context.Background(), 1, after, before)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetAnnotationsPage(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	transitions := func(n int) []state.StateTransition {
+		res := make([]state.StateTransition, 0, n)
+		for i := 0; i < n; i++ {
+			res = append(res, genTransition(eval.Normal, eval.Alerting, start.Add(time.Duration(i)*time.Second)))
+		}
+		return res
+	}
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, transitions(5), map[string]string{}, log.NewNopLogger()),
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2"}, transitions(5), map[string]string{}, log.NewNopLogger()),
+		// Not accessible.
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3", DashboardUID: "dashboard-uid"}, transitions(5), map[string]string{}, log.NewNopLogger()),
+	}
+	query := &annotations.ItemQuery{
+		OrgID: 1,
+		From:  start.UnixMilli(),
+		To:    start.Add(time.Minute).UnixMilli(),
+	}
+
+	type key struct {
+		alertID int64
+		time    int64
+	}
+	expected := make([]key, 0)
+	for i := 4; i >= 0; i-- {
+		expected = append(expected, key{1, start.Add(time.Duration(i) * time.Second).UnixMilli()})
+		expected = append(expected, key{2, start.Add(time.Duration(i) * time.Second).UnixMilli()})
+	}
+
+	for _, pageSize := range []int{1, 3, 4, 10, 100} {
+		t.Run(fmt.Sprintf("should return all annotations in pages of %d", pageSize), func(t *testing.T) {
+			actual := make([]key, 0)
+			page := PageRequest{PageSize: pageSize}
+			for i := 0; ; i++ {
+				require.Less(t, i, 100, "too many pages")
+
+				res, err := store.GetAnnotationsPage(context.Background(), query, resources, page)
+				require.NoError(t, err)
+				require.LessOrEqual(t, len(res.Items), pageSize)
+				for _, item := range res.Items {
+					actual = append(actual, key{item.AlertID, item.Time})
+				}
+				if res.NextCursor == "" {
+					break
+				}
+				page.Cursor = res.NextCursor
+			}
+			require.Equal(t, expected, actual)
+		})
+	}
+
+	t.Run("should fail with invalid page size", func(t *testing.T) {
+		_, err := store.GetAnnotationsPage(context.Background(), query, resources, PageRequest{PageSize: maxAnnotationsPageSize + 1})
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+
+	t.Run("should fail with invalid cursor", func(t *testing.T) {
+		_, err := store.GetAnnotationsPage(context.Background(), query, resources, PageRequest{Cursor: "not a cursor"})
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+
+	t.Run("should return an empty final page when the entries of the cursor expired", func(t *testing.T) {
+		res, err := store.GetAnnotationsPage(context.Background(), query, resources, PageRequest{PageSize: 4})
+		require.NoError(t, err)
+		require.NotEmpty(t, res.NextCursor)
+
+		// Retention deleted the remaining entries before the next page was read.
+		response := fakeLokiClient.Response
+		fakeLokiClient.Response = []historian.Stream{}
+		t.Cleanup(func() { fakeLokiClient.Response = response })
+
+		res, err = store.GetAnnotationsPage(context.Background(), query, resources, PageRequest{PageSize: 4, Cursor: res.NextCursor})
+		require.NoError(t, err)
+		require.Empty(t, res.Items)
+		require.Empty(t, res.NextCursor)
+	})
+
+	t.Run("should return an empty final page when the cursor is older than the time range", func(t *testing.T) {
+		cursor, err := encodePageCursor(pageCursor{Before: start.Add(-time.Hour).UnixMilli()})
+		require.NoError(t, err)
+
+		fakeLokiClient.LastQuery = ""
+		res, err := store.GetAnnotationsPage(context.Background(), query, resources, PageRequest{Cursor: cursor})
+		require.NoError(t, err)
+		require.Empty(t, res.Items)
+		require.Empty(t, res.NextCursor)
+		require.Empty(t, fakeLokiClient.LastQuery)
+	})
+}
+
+func TestQuery(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	transitions := make([]state.StateTransition, 0, 5)
+	for i := 0; i < 5; i++ {
+		transitions = append(transitions, genTransition(eval.Normal, eval.Alerting, start.Add(time.Duration(i)*time.Second)))
+	}
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, transitions, map[string]string{}, log.NewNopLogger()),
+	}
+	newQuery := func() *annotations.ItemQuery {
+		return &annotations.ItemQuery{
+			OrgID: 1,
+			From:  start.UnixMilli(),
+			To:    start.Add(time.Minute).UnixMilli(),
+			Limit: 2,
+		}
+	}
+
+	expected := make([]int64, 0, 5)
+	for i := 4; i >= 0; i-- {
+		expected = append(expected, start.Add(time.Duration(i)*time.Second).UnixMilli())
+	}
+
+	t.Run("should return all annotations in pages", func(t *testing.T) {
+		query := newQuery()
+		actual := make([]int64, 0)
+		pages := 0
+		for {
+			require.Less(t, pages, 10, "too many pages")
+			pages++
+
+			res, err := store.Query(context.Background(), query, resources)
+			require.NoError(t, err)
+			require.LessOrEqual(t, len(res.Items), 2)
+			for _, item := range res.Items {
+				actual = append(actual, item.Time)
+			}
+			if res.NextPageToken == "" {
+				break
+			}
+			query.PageToken = res.NextPageToken
+		}
+		require.Equal(t, expected, actual)
+		require.Equal(t, 3, pages)
+	})
+
+	t.Run("should continue from the page token with Get", func(t *testing.T) {
+		query := newQuery()
+		res, err := store.Query(context.Background(), query, resources)
+		require.NoError(t, err)
+		require.NotEmpty(t, res.NextPageToken)
+
+		query.PageToken = res.NextPageToken
+		items, err := store.Get(context.Background(), query, resources)
+		require.NoError(t, err)
+		require.Len(t, items, 2)
+		require.Equal(t, expected[2:4], []int64{items[0].Time, items[1].Time})
+	})
+
+	t.Run("should not skip annotations added between pages", func(t *testing.T) {
+		query := newQuery()
+		res, err := store.Query(context.Background(), query, resources)
+		require.NoError(t, err)
+
+		response := fakeLokiClient.Response
+		t.Cleanup(func() { fakeLokiClient.Response = response })
+		fakeLokiClient.Response = append([]historian.Stream{
+			alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2"}, start.Add(30*time.Second)),
+		}, response...)
+
+		query.PageToken = res.NextPageToken
+		res, err = store.Query(context.Background(), query, resources)
+		require.NoError(t, err)
+		require.Len(t, res.Items, 2)
+		require.Equal(t, expected[2:4], []int64{res.Items[0].Time, res.Items[1].Time})
+	})
+
+	t.Run("should return an empty final page when the entries of the page token expired", func(t *testing.T) {
+		query := newQuery()
+		res, err := store.Query(context.Background(), query, resources)
+		require.NoError(t, err)
+		require.NotEmpty(t, res.NextPageToken)
+
+		// Retention deleted the remaining entries before the next page was read.
+		response := fakeLokiClient.Response
+		fakeLokiClient.Response = []historian.Stream{}
+		t.Cleanup(func() { fakeLokiClient.Response = response })
+
+		query.PageToken = res.NextPageToken
+		res, err = store.Query(context.Background(), query, resources)
+		require.NoError(t, err)
+		require.Empty(t, res.Items)
+		require.Empty(t, res.NextPageToken)
+	})
+
+	t.Run("should fail with invalid page token", func(t *testing.T) {
+		query := newQuery()
+		query.PageToken = "not a token"
+		_, err := store.Query(context.Background(), query, resources)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+		_, err = store.Get(context.Background(), query, resources)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+
+	t.Run("should fail with offset", func(t *testing.T) {
+		query := newQuery()
+		query.Offset = 2
+		_, err := store.Query(context.Background(), query, resources)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetCount(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, start),
+			genTransition(eval.Alerting, eval.Normal, start.Add(time.Minute)),
+			genTransition(eval.Normal, eval.Alerting, start.Add(2*time.Minute)),
+		}, map[string]string{}, log.NewNopLogger()),
+	}
+	query := &annotations.ItemQuery{
+		OrgID: 1,
+		From:  start.UnixMilli(),
+		To:    start.Add(time.Hour).UnixMilli(),
+	}
+
+	items, err := store.Get(context.Background(), query, resources)
+	require.NoError(t, err)
+	require.Len(t, items, 3)
+	logQuery := fakeLokiClient.LastQuery
+
+	fakeLokiClient.MetricResponse = []historian.MetricSeries{
+		{Metric: map[string]string{}, Values: []historian.MetricSample{{T: start.Add(time.Hour), V: float64(len(items))}}},
+	}
+	count, err := store.GetCount(context.Background(), query, resources)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(items)), count)
+
+	filter, ok := accessFilter(*resources)
+	require.True(t, ok)
+	require.Equal(t, fmt.Sprintf(`sum by (deleted) (count_over_time(%s | type="" | %s [1h]))`, withJSONParser(logQuery), filter), fakeLokiClient.LastQuery)
+
+	t.Run("should not query loki if nothing is accessible", func(t *testing.T) {
+		fakeLokiClient.LastQuery = ""
+		count, err := store.GetCount(context.Background(), query, &annotation_ac.AccessResources{})
+		require.NoError(t, err)
+		require.Zero(t, count)
+		require.Empty(t, fakeLokiClient.LastQuery)
+	})
+
+	t.Run("should require access resources", func(t *testing.T) {
+		_, err := store.GetCount(context.Background(), query, nil)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+
+	t.Run("should not count regular annotations", func(t *testing.T) {
+		fakeLokiClient.LastQuery = ""
+		count, err := store.GetCount(context.Background(), &annotations.ItemQuery{OrgID: 1, Type: "annotation"}, resources)
+		require.NoError(t, err)
+		require.Zero(t, count)
+		require.Empty(t, fakeLokiClient.LastQuery)
+	})
+
+	t.Run("should fail with an empty time range", func(t *testing.T) {
+		_, err := store.GetCount(context.Background(), &annotations.ItemQuery{OrgID: 1, From: query.To, To: query.From}, resources)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+
+	t.Run("should only count accessible transitions", func(t *testing.T) {
+		fakeLokiClient.MetricResponse = nil
+		fakeLokiClient.KeepResponse = true
+		fakeLokiClient.Response = []historian.Stream{
+			alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, start),
+			alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2"}, start.Add(time.Minute)),
+			alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3", DashboardUID: "dashboard-1", PanelID: 1}, start),
+			alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 4, UID: "rule-4", DashboardUID: "dashboard-1", PanelID: 2}, start.Add(time.Minute)),
+		}
+
+		count, err := store.GetCount(context.Background(), query, &annotation_ac.AccessResources{CanAccessOrgAnnotations: true})
+		require.NoError(t, err)
+		require.Equal(t, int64(2), count)
+
+		count, err = store.GetCount(context.Background(), query, &annotation_ac.AccessResources{
+			CanAccessOrgAnnotations:  true,
+			CanAccessDashAnnotations: true,
+			Dashboards:               map[string]int64{"dashboard-1": 1},
+		})
+		require.NoError(t, err)
+		require.Equal(t, int64(4), count)
+	})
+}
+
+func TestGetAnnotationStats(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	to := time.Now().Truncate(time.Minute)
+	from := to.Add(-30 * 24 * time.Hour)
+	fakeLokiClient.MetricResponses = map[string][]historian.MetricSeries{
+		"sum by (current, deleted) (": {
+			{Metric: map[string]string{"current": "Alerting"}, Values: []historian.MetricSample{{T: to, V: 8}}},
+			{Metric: map[string]string{"current": "Alerting", "deleted": "true"}, Values: []historian.MetricSample{{T: to, V: 1}}},
+			{Metric: map[string]string{"current": "Normal"}, Values: []historian.MetricSample{{T: to, V: 5}}},
+			{Metric: map[string]string{"current": "Pending"}, Values: []historian.MetricSample{{T: to, V: 2}}},
+			{Metric: map[string]string{"current": "Pending", "deleted": "true"}, Values: []historian.MetricSample{{T: to, V: 2}}},
+		},
+		"count(sum by (ruleUID) (": {
+			{Metric: map[string]string{}, Values: []historian.MetricSample{{T: to, V: 4}}},
+		},
+		"count(sum by (dashboardUID) (": {
+			{Metric: map[string]string{}, Values: []historian.MetricSample{{T: to, V: 2}}},
+		},
+	}
+
+	res, err := store.GetAnnotationStats(context.Background(), 1, from, to)
+	require.NoError(t, err)
+	require.Equal(t, AnnotationStats{
+		TotalCount:           12,
+		UniqueRuleCount:      4,
+		UniqueDashboardCount: 2,
+		StateDistribution:    map[string]int64{"Alerting": 7, "Normal": 5},
+	}, res)
+	require.Contains(t, fakeLokiClient.LastQuery, `| json | type="" | deleted!="true" | dashboardUID!="" [30d]))`)
+
+	t.Run("should fail with invalid time range", func(t *testing.T) {
+		_, err := store.GetAnnotationStats(context.Background(), 1, to, from)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetTransitionsByInstanceCount(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Hour)
+	instance := func(name string, prev, cur eval.State, at time.Time) state.StateTransition {
+		transition := genTransition(prev, cur, at)
+		transition.State.Labels = map[string]string{"instance": name}
+		return transition
+	}
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, []state.StateTransition{
+			instance("a", eval.Normal, eval.Alerting, start),
+			instance("b", eval.Normal, eval.Alerting, start),
+			instance("c", eval.Normal, eval.Alerting, start),
+			instance("c", eval.Alerting, eval.Normal, start.Add(time.Minute)),
+		}, map[string]string{}, log.NewNopLogger()),
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2"}, []state.StateTransition{
+			instance("a", eval.Normal, eval.Alerting, start),
+			instance("b", eval.Normal, eval.Pending, start),
+		}, map[string]string{}, log.NewNopLogger()),
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3"}, []state.StateTransition{
+			instance("a", eval.Normal, eval.Alerting, start),
+			instance("a", eval.Alerting, eval.Normal, start.Add(time.Minute)),
+		}, map[string]string{}, log.NewNopLogger()),
+	}
+
+	res, err := store.GetTransitionsByInstanceCount(context.Background(), 1, start, start.Add(time.Hour), 2)
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	require.Equal(t, "rule-1", res[0].RuleUID)
+	require.Equal(t, int64(3), res[0].InstanceCount)
+	require.ElementsMatch(t, []map[string]string{{"instance": "a"}, {"instance": "b"}}, res[0].FiringInstances)
+	require.Equal(t, "rule-2", res[1].RuleUID)
+	require.Equal(t, int64(2), res[1].InstanceCount)
+	require.Equal(t, []map[string]string{{"instance": "a"}}, res[1].FiringInstances)
+
+	t.Run("should apply minimum number of instances", func(t *testing.T) {
+		res, err := store.GetTransitionsByInstanceCount(context.Background(), 1, start, start.Add(time.Hour), 3)
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		require.Equal(t, "rule-1", res[0].RuleUID)
+
+		res, err = store.GetTransitionsByInstanceCount(context.Background(), 1, start, start.Add(time.Hour), 1)
+		require.NoError(t, err)
+		require.Len(t, res, 3)
+	})
+
+	t.Run("should fail with invalid minimum number of instances", func(t *testing.T) {
+		_, err := store.GetTransitionsByInstanceCount(context.Background(), 1, start, start.Add(time.Hour), 0)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetTransitionTimeline(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	instance := func(name string, prev, cur eval.State, at time.Time) state.StateTransition {
+		transition := genTransition(prev, cur, at)
+		transition.State.Labels = map[string]string{"instance": name}
+		return transition
+	}
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, []state.StateTransition{
+			instance("a", eval.Normal, eval.Alerting, start),
+			instance("b", eval.Normal, eval.Alerting, start.Add(time.Minute)),
+			instance("a", eval.Alerting, eval.Normal, start.Add(2*time.Minute)),
+		}, map[string]string{}, log.NewNopLogger()),
+	}
+
+	query := &annotations.ItemQuery{
+		OrgID: 1,
+		From:  start.UnixMilli(),
+		To:    start.Add(time.Hour).UnixMilli(),
+	}
+	res, err := store.GetTransitionTimeline(context.Background(), query, resources)
+	require.NoError(t, err)
+
+	end := start.Add(2 * time.Minute)
+	require.Equal(t, []TimelineEvent{
+		{RuleUID: "rule-1", Start: start, End: &end, State: "Alerting", Labels: map[string]string{"instance": "a"}},
+		{RuleUID: "rule-1", Start: start.Add(time.Minute), State: "Alerting", Labels: map[string]string{"instance": "b"}},
+		{RuleUID: "rule-1", Start: start.Add(2 * time.Minute), State: "Normal", Labels: map[string]string{"instance": "a"}},
+	}, res)
+}
+
+func TestGetTransitionsWithDuration(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Pending, start),
+			genTransition(eval.Pending, eval.Alerting, start.Add(time.Minute)),
+			genTransition(eval.Alerting, eval.Normal, start.Add(6*time.Minute)),
+		}, map[string]string{}, log.NewNopLogger()),
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, start.Add(2*time.Minute)),
+		}, map[string]string{}, log.NewNopLogger()),
+	}
+
+	query := &annotations.ItemQuery{
+		OrgID: 1,
+		From:  start.UnixMilli(),
+		To:    start.Add(10 * time.Minute).UnixMilli(),
+	}
+	res, err := store.GetTransitionsWithDuration(context.Background(), query, resources)
+	require.NoError(t, err)
+	require.Len(t, res, 4)
+
+	type durated struct {
+		alertID  int64
+		state    string
+		duration time.Duration
+	}
+	actual := make([]durated, 0, len(res))
+	for _, item := range res {
+		actual = append(actual, durated{item.AlertID, item.NewState, item.StateDuration})
+	}
+	require.Equal(t, []durated{
+		{1, "Normal", 4 * time.Minute},
+		{2, "Alerting", 8 * time.Minute},
+		{1, "Alerting", 5 * time.Minute},
+		{1, "Pending", time.Minute},
+	}, actual)
+}
+
+func TestGetTransitionAnnotationsGroupedByRule(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Pending, start),
+			genTransition(eval.Pending, eval.Alerting, start.Add(2*time.Minute)),
+			genTransition(eval.Alerting, eval.Normal, start.Add(4*time.Minute)),
+		}, map[string]string{}, log.NewNopLogger()),
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, start.Add(time.Minute)),
+			genTransition(eval.Alerting, eval.Normal, start.Add(3*time.Minute)),
+		}, map[string]string{}, log.NewNopLogger()),
+	}
+
+	query := &annotations.ItemQuery{
+		OrgID: 1,
+		From:  start.UnixMilli(),
+		To:    start.Add(10 * time.Minute).UnixMilli(),
+	}
+	res, err := store.GetTransitionAnnotationsGroupedByRule(context.Background(), query, resources)
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+
+	times := func(items []*annotations.ItemDTO) []int64 {
+		res := make([]int64, 0, len(items))
+		for _, item := range items {
+			res = append(res, item.Time)
+		}
+		return res
+	}
+	require.Len(t, res["rule-1"], 3)
+	for _, item := range res["rule-1"] {
+		require.Equal(t, int64(1), item.AlertID)
+	}
+	require.Equal(t, []int64{
+		start.Add(4 * time.Minute).UnixMilli(),
+		start.Add(2 * time.Minute).UnixMilli(),
+		start.UnixMilli(),
+	}, times(res["rule-1"]))
+
+	require.Len(t, res["rule-2"], 2)
+	for _, item := range res["rule-2"] {
+		require.Equal(t, int64(2), item.AlertID)
+	}
+	require.Equal(t, []int64{
+		start.Add(3 * time.Minute).UnixMilli(),
+		start.Add(time.Minute).UnixMilli(),
+	}, times(res["rule-2"]))
+}
+
+func TestGetTransitionAnnotationsGroupedByDashboard(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{
+		Dashboards:               map[string]int64{"dashboard-1": 1, "dashboard-2": 2},
+		CanAccessDashAnnotations: true,
+		CanAccessOrgAnnotations:  true,
+	}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1", DashboardUID: "dashboard-1"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, start),
+			genTransition(eval.Alerting, eval.Normal, start.Add(3*time.Minute)),
+		}, map[string]string{}, log.NewNopLogger()),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2", DashboardUID: "dashboard-1"}, start.Add(time.Minute)),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3", DashboardUID: "dashboard-2"}, start.Add(2*time.Minute)),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 4, UID: "rule-4"}, start.Add(4*time.Minute)),
+	}
+
+	query := &annotations.ItemQuery{
+		OrgID: 1,
+		From:  start.UnixMilli(),
+		To:    start.Add(10 * time.Minute).UnixMilli(),
+	}
+	res, err := store.GetTransitionAnnotationsGroupedByDashboard(context.Background(), query, resources)
+	require.NoError(t, err)
+	require.Len(t, res, 3)
+
+	type item struct {
+		alertID int64
+		time    int64
+	}
+	items := func(dashboardUID string) []item {
+		items := make([]item, 0, len(res[dashboardUID]))
+		for _, i := range res[dashboardUID] {
+			items = append(items, item{i.AlertID, i.Time})
+		}
+		return items
+	}
+	require.Equal(t, []item{
+		{1, start.Add(3 * time.Minute).UnixMilli()},
+		{2, start.Add(time.Minute).UnixMilli()},
+		{1, start.UnixMilli()},
+	}, items("dashboard-1"))
+	require.Equal(t, []item{{3, start.Add(2 * time.Minute).UnixMilli()}}, items("dashboard-2"))
+	require.Equal(t, []item{{4, start.Add(4 * time.Minute).UnixMilli()}}, items(""))
+}
+
+func TestGetTransitionAnnotationsWithCustomFields(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	fakeLokiClient.Response = []historian.Stream{
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1", CustomFields: map[string]string{
+			"team":     "platform",
+			"severity": "critical",
+			"service":  "api",
+		}}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2", CustomFields: map[string]string{
+			"team": "storage",
+		}}, start.Add(time.Minute)),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3"}, start.Add(2*time.Minute)),
+	}
+
+	query := &annotations.ItemQuery{
+		OrgID:           1,
+		From:            start.UnixMilli(),
+		To:              start.Add(10 * time.Minute).UnixMilli(),
+		CustomFieldKeys: []string{"team", "severity"},
+	}
+	res, err := store.GetTransitionAnnotationsWithCustomFields(context.Background(), query, resources)
+	require.NoError(t, err)
+	require.Len(t, res, 3)
+
+	require.Equal(t, int64(3), res[0].AlertID)
+	require.Empty(t, res[0].CustomFields)
+	require.Equal(t, int64(2), res[1].AlertID)
+	require.Equal(t, map[string]string{"team": "storage"}, res[1].CustomFields)
+	require.Equal(t, int64(1), res[2].AlertID)
+	require.Equal(t, map[string]string{"team": "platform", "severity": "critical"}, res[2].CustomFields)
+}
+
+func TestGetTransitionAnnotationsByResolvedWithin(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	instance := func(name string, transitions ...state.StateTransition) []state.StateTransition {
+		for i := range transitions {
+			transitions[i].Labels = map[string]string{"instance": name}
+		}
+		return transitions
+	}
+	var transitions []state.StateTransition
+	// Fires for 30 seconds.
+	transitions = append(transitions, instance("short",
+		genTransition(eval.Normal, eval.Alerting, start),
+		genTransition(eval.Alerting, eval.Normal, start.Add(30*time.Second)),
+	)...)
+	// Fires for 5 minutes.
+	transitions = append(transitions, instance("long",
+		genTransition(eval.Normal, eval.Alerting, start.Add(time.Second)),
+		genTransition(eval.Alerting, eval.Normal, start.Add(5*time.Minute+time.Second)),
+	)...)
+	// Fires for 10 seconds, then for 2 minutes.
+	transitions = append(transitions, instance("flapping",
+		genTransition(eval.Normal, eval.Alerting, start.Add(2*time.Second)),
+		genTransition(eval.Alerting, eval.Normal, start.Add(12*time.Second)),
+		genTransition(eval.Normal, eval.Alerting, start.Add(20*time.Second)),
+		genTransition(eval.Alerting, eval.Normal, start.Add(2*time.Minute+20*time.Second)),
+	)...)
+	// Starts firing, but is not resolved.
+	transitions = append(transitions, instance("unresolved",
+		genTransition(eval.Normal, eval.Alerting, start.Add(3*time.Second)),
+	)...)
+	sort.SliceStable(transitions, func(i, j int) bool {
+		return transitions[i].LastEvaluationTime.Before(transitions[j].LastEvaluationTime)
+	})
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, transitions, map[string]string{}, log.NewNopLogger()),
+	}
+	times := func(items []*annotations.ItemDTO) []int64 {
+		res := make([]int64, 0, len(items))
+		for _, item := range items {
+			res = append(res, item.Time)
+		}
+		return res
+	}
+
+	t.Run("should return transitions into firing that resolved within the duration", func(t *testing.T) {
+		res, err := store.GetTransitionAnnotationsByResolvedWithin(context.Background(), 1, time.Minute, start, start.Add(time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, []int64{start.Add(2 * time.Second).UnixMilli(), start.UnixMilli()}, times(res))
+	})
+
+	t.Run("should exclude firing periods as long as the duration", func(t *testing.T) {
+		res, err := store.GetTransitionAnnotationsByResolvedWithin(context.Background(), 1, 30*time.Second, start, start.Add(time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, []int64{start.Add(2 * time.Second).UnixMilli()}, times(res))
+	})
+
+	t.Run("should include longer firing periods with a longer duration", func(t *testing.T) {
+		res, err := store.GetTransitionAnnotationsByResolvedWithin(context.Background(), 1, 10*time.Minute, start, start.Add(time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, []int64{
+			start.Add(20 * time.Second).UnixMilli(),
+			start.Add(2 * time.Second).UnixMilli(),
+			start.Add(time.Second).UnixMilli(),
+			start.UnixMilli(),
+		}, times(res))
+	})
+
+	t.Run("should require a positive duration", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsByResolvedWithin(context.Background(), 1, 0, start, start.Add(time.Hour))
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetInTimeZone(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+
+	at := func(value string) time.Time {
+		t.Helper()
+		ts, err := time.Parse(time.RFC3339, value)
+		require.NoError(t, err)
+		return ts
+	}
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, []state.StateTransition{
+			// 2024-01-14 22:00 in New York.
+			genTransition(eval.Normal, eval.Alerting, at("2024-01-15T03:00:00Z")),
+			// 2024-01-15 01:00 in New York.
+			genTransition(eval.Alerting, eval.Normal, at("2024-01-15T06:00:00Z")),
+			// 2024-01-15 23:00 in New York.
+			genTransition(eval.Normal, eval.Alerting, at("2024-01-16T04:00:00Z")),
+			// 2024-01-16 01:00 in New York.
+			genTransition(eval.Alerting, eval.Normal, at("2024-01-16T06:00:00Z")),
+		}, map[string]string{}, log.NewNopLogger()),
+	}
+	// The whole day of 2024-01-15, as wall clock time.
+	query := func(timeZone string) *annotations.ItemQuery {
+		return &annotations.ItemQuery{
+			OrgID:    1,
+			From:     at("2024-01-15T00:00:00Z").UnixMilli(),
+			To:       at("2024-01-16T00:00:00Z").UnixMilli(),
+			TimeZone: timeZone,
+		}
+	}
+	times := func(items []*annotations.ItemDTO) []int64 {
+		res := make([]int64, 0, len(items))
+		for _, item := range items {
+			res = append(res, item.Time)
+		}
+		return res
+	}
+
+	t.Run("should query local date boundaries", func(t *testing.T) {
+		res, err := store.Get(context.Background(), query("America/New_York"), resources)
+		require.NoError(t, err)
+		require.Equal(t, []int64{at("2024-01-16T04:00:00Z").UnixMilli(), at("2024-01-15T06:00:00Z").UnixMilli()}, times(res))
+		for _, item := range res {
+			require.Equal(t, "America/New_York", item.TimeZone)
+		}
+	})
+
+	t.Run("should query UTC date boundaries without a time zone", func(t *testing.T) {
+		res, err := store.Get(context.Background(), query(""), resources)
+		require.NoError(t, err)
+		require.Equal(t, []int64{at("2024-01-15T06:00:00Z").UnixMilli(), at("2024-01-15T03:00:00Z").UnixMilli()}, times(res))
+		require.Empty(t, res[0].TimeZone)
+	})
+
+	t.Run("should reject unknown time zones", func(t *testing.T) {
+		_, err := store.Get(context.Background(), query("Mars/Olympus_Mons"), resources)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetWithCustomSort(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-b"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, start),
+			genTransition(eval.Alerting, eval.Normal, start.Add(3*time.Second)),
+		}, map[string]string{}, log.NewNopLogger()),
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-a"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Pending, start.Add(time.Second)),
+			genTransition(eval.Pending, eval.Alerting, start.Add(2*time.Second)),
+		}, map[string]string{}, log.NewNopLogger()),
+	}
+	get := func(field, order string) ([]*annotations.ItemDTO, error) {
+		return store.Get(context.Background(), &annotations.ItemQuery{
+			OrgID:     1,
+			From:      start.UnixMilli(),
+			To:        start.Add(time.Hour).UnixMilli(),
+			SortField: field,
+			SortOrder: order,
+		}, resources)
+	}
+	times := func(items []*annotations.ItemDTO) []time.Duration {
+		res := make([]time.Duration, 0, len(items))
+		for _, item := range items {
+			res = append(res, time.UnixMilli(item.Time).Sub(start))
+		}
+		return res
+	}
+
+	t.Run("should sort by time ascending", func(t *testing.T) {
+		res, err := get("time", "asc")
+		require.NoError(t, err)
+		require.Equal(t, []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second}, times(res))
+	})
+
+	t.Run("should sort by time descending", func(t *testing.T) {
+		res, err := get("time", "desc")
+		require.NoError(t, err)
+		require.Equal(t, []time.Duration{3 * time.Second, 2 * time.Second, time.Second, 0}, times(res))
+	})
+
+	t.Run("should sort by rule UID, then most recent first", func(t *testing.T) {
+		res, err := get("rule_uid", "asc")
+		require.NoError(t, err)
+		require.Equal(t, []int64{1, 1, 2, 2}, []int64{res[0].AlertID, res[1].AlertID, res[2].AlertID, res[3].AlertID})
+		require.Equal(t, []time.Duration{2 * time.Second, time.Second, 3 * time.Second, 0}, times(res))
+	})
+
+	t.Run("should sort by new state descending", func(t *testing.T) {
+		res, err := get("new_state", "")
+		require.NoError(t, err)
+		states := make([]string, 0, len(res))
+		for _, item := range res {
+			states = append(states, item.NewState)
+		}
+		require.Equal(t, []string{"Pending", "Normal", "Alerting", "Alerting"}, states)
+	})
+
+	t.Run("should reject unknown sort fields and orders", func(t *testing.T) {
+		_, err := get("title", "asc")
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+
+		_, err = get("time", "up")
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetWithPagination(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, start),
+			genTransition(eval.Alerting, eval.Normal, start.Add(2*time.Second)),
+		}, map[string]string{}, log.NewNopLogger()),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2"}, start.Add(time.Second)),
+	}
+	get := func(limit, offset int64) ([]*annotations.ItemDTO, error) {
+		return store.Get(context.Background(), &annotations.ItemQuery{
+			OrgID:  1,
+			From:   start.UnixMilli(),
+			To:     start.Add(time.Hour).UnixMilli(),
+			Limit:  limit,
+			Offset: offset,
+		}, resources)
+	}
+	times := func(items []*annotations.ItemDTO) []time.Duration {
+		res := make([]time.Duration, 0, len(items))
+		for _, item := range items {
+			res = append(res, time.UnixMilli(item.Time).Sub(start))
+		}
+		return res
+	}
+
+	t.Run("should return all items without limit", func(t *testing.T) {
+		res, err := get(0, 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(0), fakeLokiClient.LastLimit)
+		require.Equal(t, []time.Duration{2 * time.Second, time.Second, 0}, times(res))
+	})
+
+	t.Run("should return at most limit items", func(t *testing.T) {
+		res, err := get(1, 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), fakeLokiClient.LastLimit)
+		require.Equal(t, []time.Duration{2 * time.Second}, times(res))
+	})
+
+	t.Run("should skip offset items", func(t *testing.T) {
+		res, err := get(1, 1)
+		require.NoError(t, err)
+		require.Equal(t, int64(2), fakeLokiClient.LastLimit)
+		require.Equal(t, []time.Duration{time.Second}, times(res))
+
+		res, err = get(0, 1)
+		require.NoError(t, err)
+		require.Equal(t, []time.Duration{time.Second, 0}, times(res))
+	})
+
+	t.Run("should return no items past the end", func(t *testing.T) {
+		res, err := get(1, 3)
+		require.NoError(t, err)
+		require.Empty(t, res)
+	})
+
+	t.Run("should reject negative limit and offset", func(t *testing.T) {
+		_, err := get(-1, 0)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+
+		_, err = get(1, -1)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestIntegrationGetTracing(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	sql := db.InitTestDB(t)
+	rule := createAlertRule(t, sql, "Traced Rule", ngmodels.AlertRuleGen(ngmodels.WithUniqueID(), ngmodels.WithOrgID(1)))
+
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, sql, fakeLokiClient)
+	recorder := tracetest.NewSpanRecorder()
+	store.tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(tracerName)
+	resources := &annotation_ac.AccessResources{
+		Dashboards:               map[string]int64{"dash-1": 1},
+		CanAccessDashAnnotations: true,
+	}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	fakeLokiClient.Response = []historian.Stream{
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: rule.ID, UID: rule.UID, DashboardUID: "dash-1"}, start),
+	}
+	query := &annotations.ItemQuery{
+		OrgID:        1,
+		AlertID:      rule.ID,
+		DashboardUID: "dash-1",
+		From:         start.UnixMilli(),
+		To:           start.Add(time.Hour).UnixMilli(),
+	}
+	lastSpan := func(t *testing.T) (sdktrace.ReadOnlySpan, map[attribute.Key]attribute.Value) {
+		t.Helper()
+		spans := recorder.Ended()
+		require.NotEmpty(t, spans)
+		span := spans[len(spans)-1]
+		attrs := make(map[attribute.Key]attribute.Value, len(span.Attributes()))
+		for _, attr := range span.Attributes() {
+			attrs[attr.Key] = attr.Value
+		}
+		return span, attrs
+	}
+
+	t.Run("should record a span for a successful query", func(t *testing.T) {
+		res, err := store.Get(context.Background(), query, resources)
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+
+		span, attrs := lastSpan(t)
+		require.Equal(t, "annotations.loki.Get", span.Name())
+		require.Equal(t, codes.Unset, span.Status().Code)
+		require.Equal(t, int64(1), attrs["org_id"].AsInt64())
+		require.Equal(t, rule.ID, attrs["alert_id"].AsInt64())
+		require.Equal(t, "dash-1", attrs["dashboard_uid"].AsString())
+		require.Equal(t, int64(1), attrs["result_count"].AsInt64())
+		require.Contains(t, attrs, attribute.Key("loki_query_duration_ms"))
+	})
+
+	t.Run("should record the error of a failed query", func(t *testing.T) {
+		fakeLokiClient.QueryErr = errors.New("boom")
+		t.Cleanup(func() { fakeLokiClient.QueryErr = nil })
+
+		_, err := store.Get(context.Background(), query, resources)
+		require.Error(t, err)
+
+		span, attrs := lastSpan(t)
+		require.Equal(t, "annotations.loki.Get", span.Name())
+		require.Equal(t, codes.Error, span.Status().Code)
+		require.Equal(t, int64(1), attrs["org_id"].AsInt64())
+		require.Equal(t, rule.ID, attrs["alert_id"].AsInt64())
+		require.Equal(t, "dash-1", attrs["dashboard_uid"].AsString())
+		require.Equal(t, int64(0), attrs["result_count"].AsInt64())
+		require.Contains(t, attrs, attribute.Key("loki_query_duration_ms"))
+		require.Len(t, span.Events(), 1)
+	})
+}
+
+func TestDelete(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	orgResources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+	allResources := &annotation_ac.AccessResources{
+		CanAccessOrgAnnotations:  true,
+		CanAccessDashAnnotations: true,
+		Dashboards:               map[string]int64{"dashboard-1": 1},
+	}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, start),
+			genTransition(eval.Alerting, eval.Normal, start.Add(time.Second)),
+		}, map[string]string{}, log.NewNopLogger()),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2", DashboardUID: "dashboard-1", PanelID: 1}, start.Add(2*time.Second)),
+	}
+	get := func() []*annotations.ItemDTO {
+		t.Helper()
+		res, err := store.Get(context.Background(), &annotations.ItemQuery{
+			OrgID: 1,
+			From:  start.UnixMilli(),
+			To:    start.Add(time.Hour).UnixMilli(),
+		}, allResources)
+		require.NoError(t, err)
+		return res
+	}
+
+	items := get()
+	require.Len(t, items, 3)
+	for _, item := range items {
+		require.Equal(t, ComputeAnnotationID(1, item.AlertID, item.Time, item.NewState, historian.LabelFingerprint(map[string]string{"key1": "value1"})), item.ID)
+	}
+
+	t.Run("should get annotations by ID", func(t *testing.T) {
+		for _, item := range items {
+			res, err := store.Get(context.Background(), &annotations.ItemQuery{OrgID: 1, AnnotationID: item.ID}, allResources)
+			require.NoError(t, err)
+			require.Len(t, res, 1)
+			require.Equal(t, item, res[0])
+		}
+	})
+
+	t.Run("should not query loki for the IDs of annotations in the database", func(t *testing.T) {
+		fakeLokiClient.LastQuery = ""
+		_, err := store.Get(context.Background(), &annotations.ItemQuery{OrgID: 1, AnnotationID: 42}, allResources)
+		require.ErrorIs(t, err, ErrAnnotationNotFound)
+		require.Empty(t, fakeLokiClient.LastQuery)
+	})
+
+	t.Run("should hide deleted annotations", func(t *testing.T) {
+		deleted := items[1]
+		require.NoError(t, store.Delete(context.Background(), 1, deleted.ID, orgResources))
+		require.Len(t, fakeLokiClient.Pushed, 1)
+		fakeLokiClient.Response = append(fakeLokiClient.Response, fakeLokiClient.Pushed...)
+
+		remaining := get()
+		require.Len(t, remaining, 2)
+		for _, item := range remaining {
+			require.NotEqual(t, deleted.ID, item.ID)
+		}
+
+		_, err := store.Get(context.Background(), &annotations.ItemQuery{OrgID: 1, AnnotationID: deleted.ID}, allResources)
+		require.ErrorIs(t, err, ErrAnnotationNotFound)
+	})
+
+	t.Run("should not count deleted annotations", func(t *testing.T) {
+		count, err := store.GetCount(context.Background(), &annotations.ItemQuery{
+			OrgID: 1,
+			From:  start.UnixMilli(),
+			To:    start.Add(time.Hour).UnixMilli(),
+		}, allResources)
+		require.NoError(t, err)
+		require.Equal(t, int64(2), count)
+	})
+
+	t.Run("should not delete annotations twice", func(t *testing.T) {
+		fakeLokiClient.Pushed = nil
+		err := store.Delete(context.Background(), 1, items[1].ID, orgResources)
+		require.ErrorIs(t, err, ErrAnnotationNotFound)
+		require.Empty(t, fakeLokiClient.Pushed)
+	})
+
+	t.Run("should deny deleting annotations without access", func(t *testing.T) {
+		fakeLokiClient.Pushed = nil
+		err := store.Delete(context.Background(), 1, items[0].ID, orgResources)
+		require.ErrorIs(t, err, ErrAccessDenied)
+		require.Empty(t, fakeLokiClient.Pushed)
+	})
+
+	t.Run("should fail for unknown annotations", func(t *testing.T) {
+		err := store.Delete(context.Background(), 1, 42, allResources)
+		require.ErrorIs(t, err, ErrAnnotationNotFound)
+
+		err = store.Delete(context.Background(), 2, items[0].ID, allResources)
+		require.ErrorIs(t, err, ErrAnnotationNotFound)
+
+		fakeLokiClient.LastQuery = ""
+		err = store.Delete(context.Background(), 1, 42, allResources)
+		require.ErrorIs(t, err, ErrAnnotationNotFound)
+		require.Empty(t, fakeLokiClient.LastQuery, "annotations stored in the database are not looked up in loki")
+	})
+}
+
+func TestWithoutDeleted(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	streams := []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, start),
+			genTransition(eval.Alerting, eval.Normal, start.Add(time.Second)),
+		}, map[string]string{}, log.NewNopLogger()),
+	}
+	require.Equal(t, streams, withoutDeleted(streams))
+
+	entry := historian.LokiEntry{}
+	require.NoError(t, json.Unmarshal([]byte(streams[0].Values[1].V), &entry))
+	entry.Deleted = true
+	line, err := json.Marshal(entry)
+	require.NoError(t, err)
+	withTombstone := append(slices.Clone(streams), historian.Stream{
+		Stream: streams[0].Stream,
+		Values: []historian.Sample{{T: streams[0].Values[1].T, V: string(line)}},
+	})
+
+	res := withoutDeleted(withTombstone)
+	samples := make([]historian.Sample, 0)
+	for _, stream := range res {
+		samples = append(samples, stream.Values...)
+	}
+	require.Equal(t, streams[0].Values[:1], samples)
+
+	t.Run("latest states should ignore deleted transitions", func(t *testing.T) {
+		store := createTestLokiStore(t, nil, NewFakeLokiClient())
+		latest := store.latestAlertStates(withTombstone)
+		require.Len(t, latest, 1)
+		for _, s := range latest {
+			require.Equal(t, "Alerting", s.State)
+		}
+	})
+}
+
+func TestDeleteInstancesWithSameTransition(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, []state.StateTransition{
+			withInstance(genTransition(eval.Normal, eval.Alerting, start), "a"),
+			withInstance(genTransition(eval.Normal, eval.Alerting, start), "b"),
+		}, map[string]string{}, log.NewNopLogger()),
+	}
+	get := func() []*annotations.ItemDTO {
+		t.Helper()
+		res, err := store.Get(context.Background(), &annotations.ItemQuery{
+			OrgID: 1,
+			From:  start.UnixMilli(),
+			To:    start.Add(time.Hour).UnixMilli(),
+		}, resources)
+		require.NoError(t, err)
+		return res
+	}
+
+	items := get()
+	require.Len(t, items, 2)
+	require.NotEqual(t, items[0].ID, items[1].ID)
+
+	require.NoError(t, store.Delete(context.Background(), 1, items[1].ID, resources))
+	require.Len(t, fakeLokiClient.Pushed, 1)
+	fakeLokiClient.Response = append(fakeLokiClient.Response, fakeLokiClient.Pushed...)
+
+	remaining := get()
+	require.Len(t, remaining, 1)
+	require.Equal(t, items[0].ID, remaining[0].ID)
+}
+
+func TestGetByInstanceLabels(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	transition := func(labels map[string]string, at time.Time) state.StateTransition {
+		tr := genTransition(eval.Normal, eval.Alerting, at)
+		tr.Labels = labels
+		return tr
+	}
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, []state.StateTransition{
+			transition(map[string]string{"team": "a", "instance": "1"}, start),
+			transition(map[string]string{"team": "a", "instance": "2"}, start.Add(time.Second)),
+			transition(map[string]string{"team": "b", "instance": "1"}, start.Add(2*time.Second)),
+		}, map[string]string{}, log.NewNopLogger()),
+	}
+	get := func(labels map[string]string) []int64 {
+		t.Helper()
+		res, err := store.Get(context.Background(), &annotations.ItemQuery{
+			OrgID:          1,
+			From:           start.UnixMilli(),
+			To:             start.Add(time.Hour).UnixMilli(),
+			InstanceLabels: labels,
+		}, resources)
+		require.NoError(t, err)
+		times := make([]int64, 0, len(res))
+		for _, item := range res {
+			times = append(times, item.Time)
+		}
+		return times
+	}
+
+	t.Run("should return instances with the label", func(t *testing.T) {
+		require.Equal(t, []int64{start.Add(time.Second).UnixMilli(), start.UnixMilli()}, get(map[string]string{"team": "a"}))
+		require.Contains(t, fakeLokiClient.LastQuery, `labels_team="a"`)
+	})
+
+	t.Run("should return instances with all of the labels", func(t *testing.T) {
+		require.Equal(t, []int64{start.UnixMilli()}, get(map[string]string{"team": "a", "instance": "1"}))
+		require.Equal(t, []int64{start.Add(2 * time.Second).UnixMilli()}, get(map[string]string{"team": "b", "instance": "1"}))
+		require.Empty(t, get(map[string]string{"team": "b", "instance": "2"}))
+	})
+
+	t.Run("should reject label names that cannot be filtered by", func(t *testing.T) {
+		for _, name := range []string{"", "1team", "app.kubernetes.io/name", `team="a" | json | orgID`} {
+			fakeLokiClient.LastQuery = ""
+
+			_, err := store.Get(context.Background(), &annotations.ItemQuery{
+				OrgID:          1,
+				From:           start.UnixMilli(),
+				To:             start.Add(time.Hour).UnixMilli(),
+				InstanceLabels: map[string]string{name: "a"},
+			}, resources)
+			require.ErrorIs(t, err, ErrLokiStoreBadRequest, name)
+			require.Empty(t, fakeLokiClient.LastQuery)
+		}
+	})
+}
+
+func TestGetDeduplicatesTransitions(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	transitions := make([]state.StateTransition, 0, 12)
+	for i := 0; i < 10; i++ {
+		transitions = append(transitions, genTransition(eval.Normal, eval.NoData, start.Add(time.Duration(i)*time.Minute)))
+	}
+	transitions = append(transitions,
+		genTransition(eval.NoData, eval.Normal, start.Add(10*time.Minute)),
+		genTransition(eval.Normal, eval.NoData, start.Add(11*time.Minute)),
+	)
+	other := genTransition(eval.Normal, eval.NoData, start.Add(time.Minute))
+	other.Labels = map[string]string{"key1": "value2"}
+	transitions = append(transitions, other)
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, transitions, map[string]string{}, log.NewNopLogger()),
+	}
+	query := func(includeDuplicates bool) *annotations.ItemQuery {
+		return &annotations.ItemQuery{
+			OrgID:             1,
+			From:              start.UnixMilli(),
+			To:                start.Add(time.Hour).UnixMilli(),
+			IncludeDuplicates: includeDuplicates,
+		}
+	}
+
+	t.Run("should collapse consecutive identical transitions of an instance", func(t *testing.T) {
+		res, err := store.Get(context.Background(), query(false), resources)
+		require.NoError(t, err)
+		require.Len(t, res, 4)
+
+		times := make([]int64, 0, len(res))
+		for _, item := range res {
+			times = append(times, item.Time)
+		}
+		require.Equal(t, []int64{
+			start.Add(11 * time.Minute).UnixMilli(),
+			start.Add(10 * time.Minute).UnixMilli(),
+			start.Add(time.Minute).UnixMilli(),
+			start.UnixMilli(),
+		}, times)
+	})
+
+	t.Run("should keep duplicates if requested", func(t *testing.T) {
+		res, err := store.Get(context.Background(), query(true), resources)
+		require.NoError(t, err)
+		require.Len(t, res, 13)
+	})
+}
+
+func TestGetTransitionAnnotationsWithErrorDetails(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	queryFailed := genTransition(eval.Normal, eval.Error, start.Add(time.Minute))
+	queryFailed.Error = fmt.Errorf("failed to evaluate: %w", errutil.BadRequest("sse.dataQueryError").Errorf("datasource unavailable"))
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, start),
+			queryFailed,
+			genTransition(eval.Error, eval.Normal, start.Add(2*time.Minute)),
+		}, map[string]string{}, log.NewNopLogger()),
+	}
+
+	query := &annotations.ItemQuery{
+		OrgID: 1,
+		From:  start.UnixMilli(),
+		To:    start.Add(10 * time.Minute).UnixMilli(),
+	}
+	res, err := store.GetTransitionAnnotationsWithErrorDetails(context.Background(), query, resources)
+	require.NoError(t, err)
+	require.Len(t, res, 3)
+
+	require.Empty(t, res[0].ErrorMessage)
+	require.Empty(t, res[0].ErrorType)
+	require.Contains(t, res[1].ErrorMessage, "datasource unavailable")
+	require.Equal(t, "sse.dataQueryError", res[1].ErrorType)
+	require.Empty(t, res[2].ErrorMessage)
+	require.Empty(t, res[2].ErrorType)
+
+	t.Run("should require access resources", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsWithErrorDetails(context.Background(), query, nil)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetTransitionAnnotationsByEvalError(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	queryFailed := genTransition(eval.Normal, eval.Error, start)
+	queryFailed.Error = errutil.BadRequest("sse.dataQueryError").Errorf("datasource unavailable")
+	timedOut := genTransition(eval.Normal, eval.Error, start.Add(time.Minute))
+	timedOut.Error = errutil.Timeout("alerting.evaluationTimeout").Errorf("evaluation timed out")
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, []state.StateTransition{
+			queryFailed,
+			genTransition(eval.Normal, eval.Alerting, start.Add(30*time.Second)),
+		}, map[string]string{}, log.NewNopLogger()),
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2"}, []state.StateTransition{
+			timedOut,
+		}, map[string]string{}, log.NewNopLogger()),
+	}
+	alertIDs := func(items []*annotations.ItemDTO) []int64 {
+		ids := make([]int64, 0, len(items))
+		for _, item := range items {
+			ids = append(ids, item.AlertID)
+		}
+		return ids
+	}
+
+	res, err := store.GetTransitionAnnotationsByEvalError(context.Background(), 1, start, start.Add(10*time.Minute), `sse\..*`, orgAccess)
+	require.NoError(t, err)
+	require.Contains(t, fakeLokiClient.LastQuery, `errorType=~"sse\\..*"`)
+	require.Equal(t, []int64{1}, alertIDs(res))
+
+	res, err = store.GetTransitionAnnotationsByEvalError(context.Background(), 1, start, start.Add(10*time.Minute), `alerting\..*`, orgAccess)
+	require.NoError(t, err)
+	require.Equal(t, []int64{2}, alertIDs(res))
+
+	res, err = store.GetTransitionAnnotationsByEvalError(context.Background(), 1, start, start.Add(10*time.Minute), `.*Error|.*Timeout`, orgAccess)
+	require.NoError(t, err)
+	require.Equal(t, []int64{2, 1}, alertIDs(res))
+
+	t.Run("should require error pattern", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsByEvalError(context.Background(), 1, start, start.Add(10*time.Minute), "", orgAccess)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+
+	t.Run("should reject invalid error pattern", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsByEvalError(context.Background(), 1, start, start.Add(10*time.Minute), "(", orgAccess)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetTransitionAnnotationsWithState(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	errored := genTransition(eval.Alerting, eval.Error, start.Add(time.Minute))
+	errored.State.StateReason = "Alerting"
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Alerting, start),
+			errored,
+		}, map[string]string{}, log.NewNopLogger()),
+	}
+
+	query := &annotations.ItemQuery{
+		OrgID: 1,
+		From:  start.UnixMilli(),
+		To:    start.Add(10 * time.Minute).UnixMilli(),
+	}
+	res, err := store.GetTransitionAnnotationsWithState(context.Background(), query, resources)
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+
+	require.Equal(t, "Error (Alerting)", res[0].NewState)
+	require.NotNil(t, res[0].Transition)
+	require.Equal(t, eval.Error, res[0].Transition.State.State)
+	require.Equal(t, "Alerting", res[0].Transition.State.StateReason)
+	require.Equal(t, eval.Alerting, res[0].Transition.PreviousState)
+
+	require.Equal(t, "Alerting", res[1].NewState)
+	require.NotNil(t, res[1].Transition)
+	require.Equal(t, eval.Alerting, res[1].Transition.State.State)
+	require.Equal(t, eval.Normal, res[1].Transition.PreviousState)
+	require.Equal(t, map[string]float64{"key1": 1.0}, res[1].Transition.State.Values)
+	require.Equal(t, map[string]string{"key1": "value1"}, map[string]string(res[1].Transition.State.Labels))
+
+	t.Run("should require access resources", func(t *testing.T) {
+		_, err := store.GetTransitionAnnotationsWithState(context.Background(), query, nil)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
+
+func TestGetOldestEntry(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+
+	t.Run("should return nil without entries", func(t *testing.T) {
+		res, err := store.GetOldestEntry(context.Background(), 1)
+		require.NoError(t, err)
+		require.Nil(t, res)
+	})
+
+	t.Run("should return time of oldest entry", func(t *testing.T) {
+		start := time.Now().Add(-24 * time.Hour)
+		fakeLokiClient.Response = []historian.Stream{
+			alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, start.Add(time.Hour)),
+			historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2"}, []state.StateTransition{
+				genTransition(eval.Normal, eval.Alerting, start),
+				genTransition(eval.Alerting, eval.Normal, start.Add(2*time.Hour)),
+			}, map[string]string{}, log.NewNopLogger()),
+		}
+
+		res, err := store.GetOldestEntry(context.Background(), 1)
+		require.NoError(t, err)
+		require.NotNil(t, res)
+		require.Equal(t, start.UnixNano(), res.UnixNano())
+	})
+}
+
+func TestGetTransitionsByLabelCardinality(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
 
-		t.Run("should return empty list when no streams", func(t *testing.T) {
-			items := store.annotationsFromStream(historian.Stream{}, annotation_ac.AccessResources{})
-			require.Empty(t, items)
-		})
+	start := time.Now().Add(-time.Hour)
+	instances := func(n int) []state.StateTransition {
+		res := make([]state.StateTransition, 0, n)
+		for i := 0; i < n; i++ {
+			transition := genTransition(eval.Normal, eval.Alerting, start.Add(time.Duration(i)*time.Second))
+			transition.State.Labels = map[string]string{"instance": fmt.Sprint(i)}
+			res = append(res, transition)
+		}
+		return res
+	}
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, instances(5), map[string]string{}, log.NewNopLogger()),
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2"}, instances(3), map[string]string{}, log.NewNopLogger()),
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3"}, instances(1), map[string]string{}, log.NewNopLogger()),
+	}
 
-		t.Run("should return empty list when no entries", func(t *testing.T) {
-			items := store.annotationsFromStream(historian.Stream{
-				Values: []historian.Sample{},
-			}, annotation_ac.AccessResources{})
-			require.Empty(t, items)
-		})
+	res, err := store.GetTransitionsByLabelCardinality(context.Background(), 1, start, start.Add(time.Hour), 3)
+	require.NoError(t, err)
+	require.Equal(t, []CardinalityReport{{RuleUID: "rule-1", UniqueInstanceCount: 5}}, res)
 
-		t.Run("should return one annotation per sample", func(t *testing.T) {
-			rule := dashboardRules[dashboard1.UID][0]
-			start := time.Now()
-			numTransitions := 2
-			transitions := genStateTransitions(t, numTransitions, start)
+	res, err = store.GetTransitionsByLabelCardinality(context.Background(), 1, start, start.Add(time.Hour), 2)
+	require.NoError(t, err)
+	require.Equal(t, []CardinalityReport{
+		{RuleUID: "rule-1", UniqueInstanceCount: 5},
+		{RuleUID: "rule-2", UniqueInstanceCount: 3},
+	}, res)
 
-			stream := historian.StatesToStream(ruleMetaFromRule(t, rule), transitions, map[string]string{}, log.NewNopLogger())
+	res, err = store.GetTransitionsByLabelCardinality(context.Background(), 1, start, start.Add(time.Hour), 5)
+	require.NoError(t, err)
+	require.Empty(t, res)
+}
 
-			items := store.annotationsFromStream(stream, annotation_ac.AccessResources{
-				Dashboards: map[string]int64{
-					dashboard1.UID: dashboard1.ID,
-				},
-				CanAccessDashAnnotations: true,
-			})
-			require.Len(t, items, numTransitions)
+func TestGetLatencyPercentiles(t *testing.T) {
+	store := createTestLokiStore(t, nil, NewFakeLokiClient())
 
-			for i := 0; i < numTransitions; i++ {
-				item := items[i]
-				transition := transitions[i]
+	t.Run("should return zero without queries", func(t *testing.T) {
+		res, err := store.GetLatencyPercentiles(context.Background(), 1)
+		require.NoError(t, err)
+		require.Equal(t, LatencyPercentiles{}, res)
+	})
 
-				expected := &annotations.ItemDTO{
-					AlertID:      rule.ID,
-					DashboardID:  dashboard1.ID,
-					DashboardUID: &dashboard1.UID,
-					PanelID:      *rule.PanelID,
-					Time:         transition.State.LastEvaluationTime.UnixMilli(),
-					NewState:     transition.Formatted(),
-				}
-				if i > 0 {
-					prevTransition := transitions[i-1]
-					expected.PrevState = prevTransition.Formatted()
-				}
+	t.Run("should estimate percentiles from histogram", func(t *testing.T) {
+		histogram := store.metrics.QueryDuration.WithLabelValues("2")
+		for i := 0; i < 90; i++ {
+			histogram.Observe(0.05)
+		}
+		for i := 0; i < 10; i++ {
+			histogram.Observe(2)
+		}
 
-				compareAnnotationItem(t, expected, item)
-			}
-		})
+		res, err := store.GetLatencyPercentiles(context.Background(), 2)
+		require.NoError(t, err)
+		// 90 queries fall in the (0.025, 0.05] bucket and 10 in the (1, 2.5] bucket.
+		require.InDelta(t, (0.025 + 0.025*50/90), res.P50.Seconds(), 1e-6)
+		require.InDelta(t, 1.75, res.P95.Seconds(), 1e-6)
+		require.InDelta(t, 2.35, res.P99.Seconds(), 1e-6)
+	})
 
-		t.Run("should filter out annotations from dashboards not in scope", func(t *testing.T) {
-			start := time.Now()
-			numTransitions := 2
-			transitions := genStateTransitions(t, numTransitions, start)
+	t.Run("should record query durations", func(t *testing.T) {
+		_, err := store.GetTransitionsByNote(context.Background(), 3, "note", time.Now().Add(-time.Minute), time.Now(), orgAccess)
+		require.NoError(t, err)
 
-			rule := dashboardRules[dashboard1.UID][0]
-			stream1 := historian.StatesToStream(ruleMetaFromRule(t, rule), transitions, map[string]string{}, log.NewNopLogger())
+		res, err := store.GetLatencyPercentiles(context.Background(), 3)
+		require.NoError(t, err)
+		require.NotZero(t, res.P50)
+	})
+}
 
-			rule = createAlertRule(t, sql, "Test rule", generator)
-			stream2 := historian.StatesToStream(ruleMetaFromRule(t, rule), transitions, map[string]string{}, log.NewNopLogger())
+func TestGetAnnotationsGroupedByState(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
 
-			stream := historian.Stream{
-				Values: append(stream1.Values, stream2.Values...),
-				Stream: stream1.Stream,
-			}
+	start := time.Now().Truncate(time.Minute)
+	fakeLokiClient.MetricResponse = []historian.MetricSeries{
+		{
+			Metric: map[string]string{"current": "Alerting"},
+			Values: []historian.MetricSample{
+				{T: start.Add(time.Minute), V: 2},
+				{T: start.Add(2 * time.Minute), V: 1},
+			},
+		},
+		{
+			Metric: map[string]string{"current": "Normal"},
+			Values: []historian.MetricSample{
+				{T: start.Add(2 * time.Minute), V: 3},
+				{T: start.Add(3 * time.Minute), V: 1},
+			},
+		},
+		// Tombstones of transitions that were deleted.
+		{
+			Metric: map[string]string{"current": "Alerting", "deleted": "true"},
+			Values: []historian.MetricSample{
+				{T: start.Add(2 * time.Minute), V: 1},
+			},
+		},
+		{
+			Metric: map[string]string{"current": "Normal", "deleted": "true"},
+			Values: []historian.MetricSample{
+				{T: start.Add(2 * time.Minute), V: 1},
+				{T: start.Add(3 * time.Minute), V: 1},
+			},
+		},
+	}
 
-			items := store.annotationsFromStream(stream, annotation_ac.AccessResources{
-				Dashboards: map[string]int64{
-					dashboard1.UID: dashboard1.ID,
-				},
-				CanAccessDashAnnotations: true,
-			})
-			require.Len(t, items, numTransitions)
+	query := &annotations.ItemQuery{
+		OrgID: 1,
+		From:  start.UnixMilli(),
+		To:    start.Add(3 * time.Minute).UnixMilli(),
+	}
+	res, err := store.GetAnnotationsGroupedByState(context.Background(), query, time.Minute)
+	require.NoError(t, err)
+	require.Contains(t, fakeLokiClient.LastQuery, "sum by (current, deleted) (count_over_time(")
+	require.Contains(t, fakeLokiClient.LastQuery, "| json [1m]))")
 
-			for _, item := range items {
-				require.Equal(t, dashboard1.ID, item.DashboardID)
-				require.Equal(t, dashboard1.UID, *item.DashboardUID)
-			}
-		})
+	require.Len(t, res, 2)
+	require.True(t, start.Equal(res[0].BucketStart))
+	require.Equal(t, map[string]int64{"Alerting": 2}, res[0].Counts)
+	require.True(t, start.Add(time.Minute).Equal(res[1].BucketStart))
+	require.Equal(t, map[string]int64{"Normal": 2}, res[1].Counts)
 
-		t.Run("should include only annotations without linked dashboard on org scope", func(t *testing.T) {
-			start := time.Now()
-			numTransitions := 2
-			transitions := genStateTransitions(t, numTransitions, start)
+	t.Run("should fail with invalid bucket size", func(t *testing.T) {
+		_, err := store.GetAnnotationsGroupedByState(context.Background(), query, 0)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
+}
 
-			rule := dashboardRules[dashboard1.UID][0]
-			stream1 := historian.StatesToStream(ruleMetaFromRule(t, rule), transitions, map[string]string{}, log.NewNopLogger())
+func TestGetTransitionHeatmap(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	store := createTestLokiStore(t, nil, fakeLokiClient)
 
-			rule.DashboardUID = nil
-			stream2 := historian.StatesToStream(ruleMetaFromRule(t, rule), transitions, map[string]string{}, log.NewNopLogger())
+	start := time.Now().Truncate(time.Minute)
+	fakeLokiClient.MetricResponse = []historian.MetricSeries{
+		{
+			Metric: map[string]string{"current": "Normal"},
+			Values: []historian.MetricSample{
+				{T: start.Add(3 * time.Minute), V: 3},
+			},
+		},
+		{
+			Metric: map[string]string{"current": "Alerting"},
+			Values: []historian.MetricSample{
+				{T: start.Add(time.Minute), V: 2},
+				{T: start.Add(2 * time.Minute), V: 1},
+			},
+		},
+		// Tombstones of transitions that were deleted.
+		{
+			Metric: map[string]string{"current": "Alerting", "deleted": "true"},
+			Values: []historian.MetricSample{
+				{T: start.Add(time.Minute), V: 1},
+			},
+		},
+		{
+			Metric: map[string]string{"current": "Pending"},
+			Values: []historian.MetricSample{
+				{T: start.Add(2 * time.Minute), V: 1},
+			},
+		},
+		{
+			Metric: map[string]string{"current": "Pending", "deleted": "true"},
+			Values: []historian.MetricSample{
+				{T: start.Add(2 * time.Minute), V: 1},
+			},
+		},
+	}
 
-			stream := historian.Stream{
-				Values: append(stream1.Values, stream2.Values...),
-				Stream: stream1.Stream,
-			}
+	query := &annotations.ItemQuery{
+		OrgID: 1,
+		From:  start.UnixMilli(),
+		To:    start.Add(3 * time.Minute).UnixMilli(),
+	}
+	resources := &annotation_ac.AccessResources{
+		Dashboards:               map[string]int64{"dashboard-uid": 1},
+		CanAccessDashAnnotations: true,
+		CanAccessOrgAnnotations:  true,
+	}
+	res, err := store.GetTransitionHeatmap(context.Background(), query, resources, 3)
+	require.NoError(t, err)
+	require.Contains(t, fakeLokiClient.LastQuery, "sum by (current, deleted) (count_over_time(")
+	require.Contains(t, fakeLokiClient.LastQuery, `| dashboardUID=~"|dashboard-uid" [1m]))`)
 
-			items := store.annotationsFromStream(stream, annotation_ac.AccessResources{
-				Dashboards: map[string]int64{
-					dashboard1.UID: dashboard1.ID,
-				},
-				CanAccessOrgAnnotations: true,
-			})
-			require.Len(t, items, numTransitions)
+	require.Equal(t, []string{"Alerting", "Normal"}, res.States)
+	require.Len(t, res.Timestamps, 3)
+	require.True(t, start.Equal(res.Timestamps[0]))
+	require.Len(t, res.Values, len(res.States))
+	for _, row := range res.Values {
+		require.Len(t, row, 3)
+	}
+	require.Equal(t, [][]int64{{1, 1, 0}, {0, 0, 3}}, res.Values)
 
-			for _, item := range items {
-				require.Zero(t, *item.DashboardUID)
-				require.Zero(t, item.DashboardID)
-			}
-		})
+	t.Run("should not query loki without access", func(t *testing.T) {
+		fakeLokiClient.LastQuery = ""
+		res, err := store.GetTransitionHeatmap(context.Background(), query, &annotation_ac.AccessResources{}, 3)
+		require.NoError(t, err)
+		require.Empty(t, fakeLokiClient.LastQuery)
+		require.Empty(t, res.States)
+		require.Len(t, res.Timestamps, 3)
+	})
+
+	t.Run("should fail with invalid number of buckets", func(t *testing.T) {
+		_, err := store.GetTransitionHeatmap(context.Background(), query, resources, 0)
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
 	})
 }
 
@@ -454,6 +4820,131 @@ func TestBuildHistoryQuery(t *testing.T) {
 		)
 		require.Zero(t, query.DashboardUID)
 	})
+
+	t.Run("should filter by a single state with an exact match", func(t *testing.T) {
+		query := buildHistoryQuery(&annotations.ItemQuery{OrgID: 1, States: []string{"Alerting"}}, nil, "")
+		require.Equal(t, []string{"Alerting"}, query.States)
+
+		logQL, err := historian.BuildLogQuery(query)
+		require.NoError(t, err)
+		require.Equal(t, `{orgID="1",from="state-history"} | json | current="Alerting"`, logQL)
+	})
+
+	t.Run("should filter by multiple states with a regex alternative", func(t *testing.T) {
+		query := buildHistoryQuery(&annotations.ItemQuery{OrgID: 1, States: []string{"Alerting", "Error", "Alerting (NoData)"}}, nil, "")
+
+		logQL, err := historian.BuildLogQuery(query)
+		require.NoError(t, err)
+		require.Equal(t, `{orgID="1",from="state-history"} | json | current=~"Alerting|Error|Alerting \\(NoData\\)"`, logQL)
+	})
+
+	t.Run("should filter by rule name regex", func(t *testing.T) {
+		query := buildHistoryQuery(&annotations.ItemQuery{OrgID: 1, RuleNameRegex: `disk "usage" .*`}, nil, "")
+		require.Equal(t, `disk "usage" .*`, query.TitleRegex)
+
+		logQL, err := historian.BuildLogQuery(query)
+		require.NoError(t, err)
+		require.Equal(t, `{orgID="1",from="state-history"} | json | ruleTitle=~"disk \"usage\" .*"`, logQL)
+	})
+
+	t.Run("should combine rule name regex with rule and dashboard", func(t *testing.T) {
+		query := buildHistoryQuery(&annotations.ItemQuery{OrgID: 1, DashboardID: 1, RuleNameRegex: "disk.*"}, map[string]int64{"dashboard-uid": 1}, "rule-uid")
+
+		logQL, err := historian.BuildLogQuery(query)
+		require.NoError(t, err)
+		require.Equal(t, `{orgID="1",from="state-history"} | json | ruleUID="rule-uid" | dashboardUID="dashboard-uid" | ruleTitle=~"disk.*"`, logQL)
+	})
+}
+
+func TestGetByRuleNameRegex(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	fakeLokiClient.Response = []historian.Stream{
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1", Title: "disk usage high"}, start),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 2, UID: "rule-2", Title: "disk latency high"}, start.Add(time.Second)),
+		alertingStream(historymodel.RuleMeta{OrgID: 1, ID: 3, UID: "rule-3", Title: "cpu usage high"}, start.Add(2*time.Second)),
+	}
+	get := func(regex string) ([]int64, error) {
+		res, err := store.Get(context.Background(), &annotations.ItemQuery{
+			OrgID:         1,
+			From:          start.UnixMilli(),
+			To:            start.Add(time.Hour).UnixMilli(),
+			RuleNameRegex: regex,
+		}, resources)
+		if err != nil {
+			return nil, err
+		}
+		ids := make([]int64, 0, len(res))
+		for _, item := range res {
+			ids = append(ids, item.AlertID)
+		}
+		return ids, nil
+	}
+
+	res, err := get("disk .*")
+	require.NoError(t, err)
+	require.Equal(t, []int64{2, 1}, res)
+
+	res, err = get(".* usage high")
+	require.NoError(t, err)
+	require.Equal(t, []int64{3, 1}, res)
+
+	t.Run("should reject invalid regex", func(t *testing.T) {
+		fakeLokiClient.LastQuery = ""
+		_, err := get("disk (")
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+		require.Empty(t, fakeLokiClient.LastQuery)
+	})
+}
+
+func TestGetByStates(t *testing.T) {
+	fakeLokiClient := NewFakeLokiClient()
+	fakeLokiClient.KeepResponse = true
+	store := createTestLokiStore(t, nil, fakeLokiClient)
+	resources := &annotation_ac.AccessResources{CanAccessOrgAnnotations: true}
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	fakeLokiClient.Response = []historian.Stream{
+		historian.StatesToStream(historymodel.RuleMeta{OrgID: 1, ID: 1, UID: "rule-1"}, []state.StateTransition{
+			genTransition(eval.Normal, eval.Pending, start),
+			genTransition(eval.Pending, eval.Alerting, start.Add(time.Second)),
+			genTransition(eval.Alerting, eval.Error, start.Add(2*time.Second)),
+			genTransition(eval.Error, eval.Normal, start.Add(3*time.Second)),
+		}, map[string]string{}, log.NewNopLogger()),
+	}
+	get := func(states ...string) ([]string, error) {
+		res, err := store.Get(context.Background(), &annotations.ItemQuery{
+			OrgID:  1,
+			From:   start.UnixMilli(),
+			To:     start.Add(time.Hour).UnixMilli(),
+			States: states,
+		}, resources)
+		if err != nil {
+			return nil, err
+		}
+		newStates := make([]string, 0, len(res))
+		for _, item := range res {
+			newStates = append(newStates, item.NewState)
+		}
+		return newStates, nil
+	}
+
+	res, err := get("Alerting")
+	require.NoError(t, err)
+	require.Equal(t, []string{"Alerting"}, res)
+
+	res, err = get("Alerting", "Error")
+	require.NoError(t, err)
+	require.Equal(t, []string{"Error", "Alerting"}, res)
+
+	t.Run("should reject unknown states", func(t *testing.T) {
+		_, err := get("Firing")
+		require.ErrorIs(t, err, ErrLokiStoreBadRequest)
+	})
 }
 
 func TestBuildTransition(t *testing.T) {
@@ -520,13 +5011,15 @@ func TestBuildTransition(t *testing.T) {
 	})
 }
 
-func createTestLokiStore(t *testing.T, sql db.DB, client lokiQueryClient) *LokiHistorianStore {
+func createTestLokiStore(t testing.TB, sql db.DB, client lokiClient) *LokiHistorianStore {
 	t.Helper()
 
 	return &LokiHistorianStore{
-		client: client,
-		db:     sql,
-		log:    log.NewNopLogger(),
+		client:  client,
+		db:      sql,
+		metrics: metrics.NewHistorianMetrics(prometheus.NewRegistry(), subsystem),
+		tracer:  noop.NewTracerProvider().Tracer(tracerName),
+		log:     log.NewNopLogger(),
 	}
 }
 
@@ -682,6 +5175,51 @@ func genStateTransitions(t *testing.T, num int, start time.Time) []state.StateTr
 	return transitions
 }
 
+func genTransition(prev, cur eval.State, at time.Time) state.StateTransition {
+	var err error
+	if cur == eval.Error {
+		err = errors.New("test error")
+	}
+
+	return state.StateTransition{
+		PreviousState: prev,
+		State: &state.State{
+			Error:              err,
+			State:              cur,
+			LastEvaluationTime: at,
+			Values: map[string]float64{
+				"key1": 1.0,
+			},
+			Labels: map[string]string{
+				"key1": "value1",
+			},
+		},
+	}
+}
+
+// alertingStream returns a stream with a single transition of the rule from Normal to Alerting.
+// withInstance sets the labels of a transition to those of the given alert instance.
+func withInstance(tr state.StateTransition, instance string) state.StateTransition {
+	tr.Labels = map[string]string{"instance": instance}
+	return tr
+}
+
+func alertingStream(rule historymodel.RuleMeta, at time.Time) historian.Stream {
+	return historian.StatesToStream(rule, []state.StateTransition{
+		genTransition(eval.Normal, eval.Alerting, at),
+	}, map[string]string{}, log.NewNopLogger())
+}
+
+// notificationStream returns a stream with a notification about the firing alert instance of genTransition.
+func notificationStream(ruleUID, contactPoint string, at time.Time) historian.Stream {
+	return historian.NotificationsToStreams(1, []historymodel.Notification{{
+		RuleUID:      ruleUID,
+		Labels:       map[string]string{"key1": "value1"},
+		ContactPoint: contactPoint,
+		Time:         at,
+	}}, map[string]string{}, "", log.NewNopLogger())[0]
+}
+
 func withDashboardUID(dashboardUID *string) ngmodels.AlertRuleMutator {
 	return func(rule *ngmodels.AlertRule) {
 		rule.DashboardUID = dashboardUID
@@ -721,6 +5259,19 @@ type FakeLokiClient struct {
 	metrics  *metrics.Historian
 	log      log.Logger
 	Response []historian.Stream
+	// KeepResponse makes Response be returned for every range query, instead of only the next one.
+	KeepResponse   bool
+	MetricResponse []historian.MetricSeries
+	// MetricResponses, if set, maps a substring of metric queries to their response, and takes precedence over MetricResponse.
+	MetricResponses map[string][]historian.MetricSeries
+	Pushed          []historian.Stream
+	LastQuery       string
+	// LastLimit is the limit of the last range query.
+	LastLimit int64
+	// PingErr is returned by Ping.
+	PingErr error
+	// QueryErr, if set, is returned by range and metric queries.
+	QueryErr error
 }
 
 func NewFakeLokiClient() *FakeLokiClient {
@@ -740,9 +5291,36 @@ func NewFakeLokiClient() *FakeLokiClient {
 	}
 }
 
-func (c *FakeLokiClient) RangeQuery(_ context.Context, _ string, from, to, _ int64) (historian.QueryRes, error) {
+func (c *FakeLokiClient) Ping(_ context.Context) error {
+	return c.PingErr
+}
+
+func (c *FakeLokiClient) Push(_ context.Context, s []historian.Stream) error {
+	c.Pushed = append(c.Pushed, s...)
+	return nil
+}
+
+func (c *FakeLokiClient) RangeQuery(_ context.Context, logQL string, from, to, limit int64) (historian.QueryRes, error) {
+	return c.rangeQuery(logQL, from, to, limit, false)
+}
+
+func (c *FakeLokiClient) RangeQueryForward(_ context.Context, logQL string, from, to, limit int64) (historian.QueryRes, error) {
+	return c.rangeQuery(logQL, from, to, limit, true)
+}
+
+func (c *FakeLokiClient) rangeQuery(logQL string, from, to, limit int64, forward bool) (historian.QueryRes, error) {
+	c.LastQuery = logQL
+	if c.QueryErr != nil {
+		return historian.QueryRes{}, c.QueryErr
+	}
+	c.LastLimit = limit
 	streams := make([]historian.Stream, len(c.Response))
 
+	type streamSample struct {
+		stream int
+		sample historian.Sample
+	}
+	matching := make([]streamSample, 0)
 	for n, stream := range c.Response {
 		streams[n].Stream = stream.Stream
 		streams[n].Values = []historian.Sample{}
@@ -750,9 +5328,29 @@ func (c *FakeLokiClient) RangeQuery(_ context.Context, _ string, from, to, _ int
 			if sample.T.UnixNano() < from || sample.T.UnixNano() >= to { // matches Loki behavior
 				continue
 			}
-			streams[n].Values = append(streams[n].Values, sample)
+			if !matchesLabelFilters(logQL, sample.V) {
+				continue
+			}
+			matching = append(matching, streamSample{stream: n, sample: sample})
 		}
 	}
+	// Like Loki, only return the most recent samples, or the oldest ones when querying forward,
+	// when there are more than the limit.
+	if limit > 0 && int64(len(matching)) > limit {
+		sort.SliceStable(matching, func(i, j int) bool {
+			if forward {
+				return matching[i].sample.T.Before(matching[j].sample.T)
+			}
+			return matching[i].sample.T.After(matching[j].sample.T)
+		})
+		matching = matching[:limit]
+		sort.SliceStable(matching, func(i, j int) bool {
+			return matching[i].sample.T.Before(matching[j].sample.T)
+		})
+	}
+	for _, m := range matching {
+		streams[m.stream].Values = append(streams[m.stream].Values, m.sample)
+	}
 
 	res := historian.QueryRes{
 		Data: historian.QueryData{
@@ -760,10 +5358,165 @@ func (c *FakeLokiClient) RangeQuery(_ context.Context, _ string, from, to, _ int
 		},
 	}
 	// reset expected streams on read
-	c.Response = []historian.Stream{}
+	if !c.KeepResponse {
+		c.Response = []historian.Stream{}
+	}
 	return res, nil
 }
 
+var labelFilterRegex = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!~|!=|==|>=|<=|=|>|<)\s*(.+)$`)
+
+var lineFilterRegex = regexp.MustCompile(`\|= ("(?:[^"\\]|\\.)*")`)
+
+var countOverTimeRegex = regexp.MustCompile(`^sum(?: by \(([^)]*)\) )?\(count_over_time\((.*) \[[^\]]+\]\)\)$`)
+
+// matchesLabelFilters evaluates the line filters and label filters of a LogQL pipeline against a JSON log line,
+// approximating how Loki filters the output of the json parser. Like in Loki, line filters before the parser are
+// evaluated first, so that lines they drop are not parsed. Other pipeline stages are ignored.
+func matchesLabelFilters(logQL string, line string) bool {
+	stages := strings.Split(logQL, " | ")
+	for _, m := range lineFilterRegex.FindAllStringSubmatch(stages[0], -1) {
+		if contains, err := strconv.Unquote(m[1]); err == nil && !strings.Contains(line, contains) {
+			return false
+		}
+	}
+	if len(stages) < 2 {
+		return true
+	}
+
+	obj := map[string]any{}
+	if err := json.Unmarshal([]byte(line), &obj); err != nil {
+		return false
+	}
+	fields := map[string]string{}
+	flattenJSON("", obj, fields)
+
+	for _, stage := range stages[1:] {
+		m := labelFilterRegex.FindStringSubmatch(stage)
+		if m == nil {
+			continue
+		}
+		key, op, expected := m[1], m[2], m[3]
+		if unquoted, err := strconv.Unquote(expected); err == nil {
+			expected = unquoted
+		}
+		actual := fields[key]
+
+		var ok bool
+		switch op {
+		case "=", "==":
+			ok = actual == expected
+		case "!=":
+			ok = actual != expected
+		case "=~":
+			ok = regexp.MustCompile("^(?:" + expected + ")$").MatchString(actual)
+		case "!~":
+			ok = !regexp.MustCompile("^(?:" + expected + ")$").MatchString(actual)
+		default:
+			a, errA := strconv.ParseFloat(actual, 64)
+			e, errE := strconv.ParseFloat(expected, 64)
+			if errA != nil || errE != nil {
+				return false
+			}
+			switch op {
+			case ">":
+				ok = a > e
+			case ">=":
+				ok = a >= e
+			case "<":
+				ok = a < e
+			case "<=":
+				ok = a <= e
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// flattenJSON flattens nested objects the same way as the Loki json parser, joining keys with underscores.
+func flattenJSON(prefix string, obj map[string]any, fields map[string]string) {
+	for k, v := range obj {
+		key := k
+		if prefix != "" {
+			key = prefix + "_" + k
+		}
+		switch val := v.(type) {
+		case map[string]any:
+			flattenJSON(key, val, fields)
+		case string:
+			fields[key] = val
+		case float64:
+			fields[key] = strconv.FormatFloat(val, 'f', -1, 64)
+		case bool:
+			fields[key] = strconv.FormatBool(val)
+		}
+	}
+}
+
+func (c *FakeLokiClient) MetricsQuery(_ context.Context, logQL string, _, to int64, _ time.Duration) (historian.MetricQueryRes, error) {
+	c.LastQuery = logQL
+	if c.QueryErr != nil {
+		return historian.MetricQueryRes{}, c.QueryErr
+	}
+	result := c.MetricResponse
+	for substr, res := range c.MetricResponses {
+		if strings.Contains(logQL, substr) {
+			result = res
+			break
+		}
+	}
+	// Without a canned response, count the entries of Response that match a sum [by (...)] (count_over_time(...)) query.
+	if result == nil && c.MetricResponses == nil {
+		if m := countOverTimeRegex.FindStringSubmatch(logQL); m != nil {
+			var groupBy []string
+			if m[1] != "" {
+				groupBy = strings.Split(m[1], ", ")
+			}
+			series := make(map[string]*historian.MetricSeries)
+			keys := make([]string, 0)
+			for _, stream := range c.Response {
+				for _, sample := range stream.Values {
+					if !matchesLabelFilters(m[2], sample.V) {
+						continue
+					}
+					obj := map[string]any{}
+					_ = json.Unmarshal([]byte(sample.V), &obj)
+					fields := map[string]string{}
+					flattenJSON("", obj, fields)
+					metric := make(map[string]string)
+					for _, label := range groupBy {
+						if v := fields[label]; v != "" {
+							metric[label] = v
+						}
+					}
+					key := fmt.Sprint(metric)
+					if _, ok := series[key]; !ok {
+						series[key] = &historian.MetricSeries{Metric: metric, Values: []historian.MetricSample{{T: time.Unix(0, to)}}}
+						keys = append(keys, key)
+					}
+					series[key].Values[0].V++
+				}
+			}
+			result = make([]historian.MetricSeries, 0, len(keys))
+			for _, key := range keys {
+				result = append(result, *series[key])
+			}
+			if len(groupBy) == 0 && len(result) == 0 {
+				result = append(result, historian.MetricSeries{Metric: map[string]string{}, Values: []historian.MetricSample{{T: time.Unix(0, to)}}})
+			}
+		}
+	}
+	return historian.MetricQueryRes{
+		Data: historian.MetricQueryData{
+			Result: result,
+		},
+	}, nil
+}
+
 func TestUseStore(t *testing.T) {
 	t.Run("false if state history disabled", func(t *testing.T) {
 		cfg := setting.UnifiedAlertingStateHistorySettings{
@@ -0,0 +1,392 @@
+package loki
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// This file implements a parser for the log pipeline of LogQL queries, the part that follows the stream selector.
+// It follows the grammar of the syntax package of Loki, which is not a dependency of Grafana.
+// Only log queries are accepted: stream selectors, range vectors and metric functions are rejected.
+
+type logQLTokenKind int
+
+const (
+	logQLTokenEOF logQLTokenKind = iota
+	logQLTokenIdent
+	logQLTokenString
+	logQLTokenNumber
+	logQLTokenOp
+	logQLTokenFlag
+)
+
+type logQLToken struct {
+	kind  logQLTokenKind
+	value string
+	pos   int
+}
+
+func (t logQLToken) String() string {
+	if t.kind == logQLTokenEOF {
+		return "end of query"
+	}
+	return strconv.Quote(t.value)
+}
+
+// logQLOperators are the operators of log pipelines, longest first so that they are matched greedily.
+var logQLOperators = []string{"|=", "|~", "|>", "!=", "!~", "!>", "==", "=~", ">=", "<=", "|", "=", ">", "<", "(", ")", ","}
+
+// logQLBytesRegex matches byte sizes, such as 10KB or 1.5MiB.
+var logQLBytesRegex = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?([KMGTPE]i?)?B$`)
+
+// tokenizeLogQL splits a log pipeline into tokens.
+func tokenizeLogQL(s string) ([]logQLToken, error) {
+	var tokens []logQLToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '"' || c == '`':
+			end := i + 1
+			for ; end < len(s) && s[end] != c; end++ {
+				if c == '"' && s[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(s) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			value := s[i+1 : end]
+			if c == '"' {
+				var err error
+				if value, err = strconv.Unquote(s[i : end+1]); err != nil {
+					return nil, fmt.Errorf("invalid string at position %d: %w", i, err)
+				}
+			}
+			tokens = append(tokens, logQLToken{kind: logQLTokenString, value: value, pos: i})
+			i = end + 1
+		case c == '{' || c == '}':
+			return nil, fmt.Errorf("unexpected %q at position %d: stream selectors are not allowed in the pipeline", c, i)
+		case c == '[' || c == ']':
+			return nil, fmt.Errorf("unexpected %q at position %d: metric queries are not allowed", c, i)
+		case c == '-' && strings.HasPrefix(s[i:], "--"):
+			end := i + 2
+			for end < len(s) && (isLogQLIdentChar(s[end], true) || s[end] == '-') {
+				end++
+			}
+			tokens = append(tokens, logQLToken{kind: logQLTokenFlag, value: s[i:end], pos: i})
+			i = end
+		case c == '-' || c >= '0' && c <= '9':
+			end := i + 1
+			for end < len(s) && (isLogQLIdentChar(s[end], true) || s[end] == '.') {
+				end++
+			}
+			value := s[i:end]
+			if !isLogQLNumber(value) {
+				return nil, fmt.Errorf("invalid number %q at position %d", value, i)
+			}
+			tokens = append(tokens, logQLToken{kind: logQLTokenNumber, value: value, pos: i})
+			i = end
+		case isLogQLIdentChar(c, false):
+			end := i + 1
+			for end < len(s) && isLogQLIdentChar(s[end], true) {
+				end++
+			}
+			tokens = append(tokens, logQLToken{kind: logQLTokenIdent, value: s[i:end], pos: i})
+			i = end
+		default:
+			op := ""
+			for _, candidate := range logQLOperators {
+				if strings.HasPrefix(s[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at position %d", c, i)
+			}
+			tokens = append(tokens, logQLToken{kind: logQLTokenOp, value: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, logQLToken{kind: logQLTokenEOF, pos: len(s)}), nil
+}
+
+func isLogQLIdentChar(c byte, digits bool) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || digits && c >= '0' && c <= '9'
+}
+
+// isLogQLNumber reports whether a value can be compared to a label: a number, a duration or a byte size.
+func isLogQLNumber(value string) bool {
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return true
+	}
+	if _, err := time.ParseDuration(value); err == nil {
+		return true
+	}
+	return logQLBytesRegex.MatchString(strings.TrimPrefix(value, "-"))
+}
+
+// logQLPipelineParser is a recursive descent parser of LogQL log pipelines.
+type logQLPipelineParser struct {
+	tokens []logQLToken
+	pos    int
+}
+
+// parseLogPipeline parses the log pipeline of a LogQL query, that is a sequence of line filters, parsers,
+// label filters and formatters that can follow a stream selector. An empty pipeline is valid.
+// It returns an error for anything else, in particular for metric queries and additional stream selectors.
+func parseLogPipeline(pipeline string) error {
+	tokens, err := tokenizeLogQL(pipeline)
+	if err != nil {
+		return err
+	}
+	p := &logQLPipelineParser{tokens: tokens}
+	for p.peek().kind != logQLTokenEOF {
+		if err := p.parseStage(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *logQLPipelineParser) peek() logQLToken {
+	return p.tokens[p.pos]
+}
+
+func (p *logQLPipelineParser) next() logQLToken {
+	t := p.tokens[p.pos]
+	if t.kind != logQLTokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the given operator or keyword.
+func (p *logQLPipelineParser) accept(kind logQLTokenKind, value string) bool {
+	if t := p.peek(); t.kind == kind && t.value == value {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *logQLPipelineParser) expect(kind logQLTokenKind, what string) (logQLToken, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, unexpectedLogQLToken(t, what)
+	}
+	return t, nil
+}
+
+func unexpectedLogQLToken(t logQLToken, what string) error {
+	return fmt.Errorf("unexpected %s at position %d, expected %s", t, t.pos, what)
+}
+
+func (p *logQLPipelineParser) parseStage() error {
+	t := p.next()
+	if t.kind != logQLTokenOp {
+		return unexpectedLogQLToken(t, "a pipeline stage")
+	}
+	switch t.value {
+	case "|=", "|~", "|>", "!=", "!~", "!>":
+		return p.parseLineFilter()
+	case "|":
+	default:
+		return unexpectedLogQLToken(t, "a pipeline stage")
+	}
+
+	t = p.peek()
+	if t.kind == logQLTokenOp && t.value == "(" {
+		return p.parseLabelFilter()
+	}
+	if t.kind != logQLTokenIdent {
+		return unexpectedLogQLToken(t, "a parser, formatter or label filter")
+	}
+	// Label names can shadow keywords, a label filter is recognized by the comparison that follows the name.
+	if p.tokens[p.pos+1].kind == logQLTokenOp && isLogQLComparison(p.tokens[p.pos+1].value) {
+		return p.parseLabelFilter()
+	}
+	p.next()
+	switch t.value {
+	case "json":
+		return p.parseExtractions()
+	case "logfmt":
+		for p.peek().kind == logQLTokenFlag {
+			if flag := p.next(); flag.value != "--strict" && flag.value != "--keep-empty" {
+				return fmt.Errorf("unknown logfmt flag %s at position %d", flag.value, flag.pos)
+			}
+		}
+		return p.parseExtractions()
+	case "regexp", "pattern", "line_format":
+		_, err := p.expect(logQLTokenString, "a string")
+		return err
+	case "unpack", "decolorize":
+		return nil
+	case "label_format":
+		return p.parseLabelFormat()
+	case "drop", "keep":
+		return p.parseLabelList()
+	default:
+		if t.value == "unwrap" || p.accept(logQLTokenOp, "(") || p.peek().kind == logQLTokenIdent && isLogQLGrouping(p.peek().value) {
+			return fmt.Errorf("unexpected function %s at position %d: metric queries are not allowed", t, t.pos)
+		}
+		return unexpectedLogQLToken(t, "a parser, formatter or label filter")
+	}
+}
+
+// parseLineFilter parses the operand of a line filter, with its alternatives and chained filters.
+func (p *logQLPipelineParser) parseLineFilter() error {
+	for {
+		if err := p.parseLineFilterValue(); err != nil {
+			return err
+		}
+		if !p.accept(logQLTokenIdent, "or") {
+			return nil
+		}
+	}
+}
+
+func (p *logQLPipelineParser) parseLineFilterValue() error {
+	if p.accept(logQLTokenIdent, "ip") {
+		return p.parseIPArgument()
+	}
+	_, err := p.expect(logQLTokenString, "a string")
+	return err
+}
+
+func (p *logQLPipelineParser) parseIPArgument() error {
+	if _, err := p.expect(logQLTokenOp, "("); err != nil {
+		return err
+	}
+	if _, err := p.expect(logQLTokenString, "a string"); err != nil {
+		return err
+	}
+	_, err := p.expect(logQLTokenOp, ")")
+	return err
+}
+
+// parseExtractions parses the optional list of labels to extract of the json and logfmt parsers.
+func (p *logQLPipelineParser) parseExtractions() error {
+	if p.peek().kind != logQLTokenIdent {
+		return nil
+	}
+	for {
+		if _, err := p.expect(logQLTokenIdent, "a label name"); err != nil {
+			return err
+		}
+		if p.accept(logQLTokenOp, "=") {
+			if _, err := p.expect(logQLTokenString, "a string"); err != nil {
+				return err
+			}
+		}
+		if !p.accept(logQLTokenOp, ",") {
+			return nil
+		}
+	}
+}
+
+func (p *logQLPipelineParser) parseLabelFormat() error {
+	for {
+		if _, err := p.expect(logQLTokenIdent, "a label name"); err != nil {
+			return err
+		}
+		if _, err := p.expect(logQLTokenOp, "="); err != nil {
+			return err
+		}
+		if t := p.next(); t.kind != logQLTokenString && t.kind != logQLTokenIdent {
+			return unexpectedLogQLToken(t, "a template or a label name")
+		}
+		if !p.accept(logQLTokenOp, ",") {
+			return nil
+		}
+	}
+}
+
+// parseLabelList parses the labels of the drop and keep stages, which are either names or label matchers.
+func (p *logQLPipelineParser) parseLabelList() error {
+	for {
+		if _, err := p.expect(logQLTokenIdent, "a label name"); err != nil {
+			return err
+		}
+		if t := p.peek(); t.kind == logQLTokenOp && isLogQLMatcher(t.value) {
+			p.next()
+			if _, err := p.expect(logQLTokenString, "a string"); err != nil {
+				return err
+			}
+		}
+		if !p.accept(logQLTokenOp, ",") {
+			return nil
+		}
+	}
+}
+
+// parseLabelFilter parses label filters combined with and, or, commas and parentheses.
+func (p *logQLPipelineParser) parseLabelFilter() error {
+	for {
+		if err := p.parseLabelFilterTerm(); err != nil {
+			return err
+		}
+		if !p.accept(logQLTokenIdent, "and") && !p.accept(logQLTokenIdent, "or") && !p.accept(logQLTokenOp, ",") {
+			return nil
+		}
+	}
+}
+
+func (p *logQLPipelineParser) parseLabelFilterTerm() error {
+	if p.accept(logQLTokenOp, "(") {
+		if err := p.parseLabelFilter(); err != nil {
+			return err
+		}
+		_, err := p.expect(logQLTokenOp, ")")
+		return err
+	}
+
+	if _, err := p.expect(logQLTokenIdent, "a label name"); err != nil {
+		return err
+	}
+	op := p.next()
+	if op.kind != logQLTokenOp || !isLogQLComparison(op.value) {
+		return unexpectedLogQLToken(op, "a comparison operator")
+	}
+	value := p.next()
+	switch {
+	case value.kind == logQLTokenString:
+	case value.kind == logQLTokenNumber && !isLogQLMatcherOnly(op.value):
+	case value.kind == logQLTokenIdent && value.value == "ip" && (op.value == "=" || op.value == "!="):
+		return p.parseIPArgument()
+	default:
+		return unexpectedLogQLToken(value, fmt.Sprintf("a value to compare with %s", op.value))
+	}
+	return nil
+}
+
+func isLogQLComparison(op string) bool {
+	switch op {
+	case "=", "!=", "=~", "!~", "==", ">", ">=", "<", "<=":
+		return true
+	}
+	return false
+}
+
+func isLogQLMatcher(op string) bool {
+	switch op {
+	case "=", "!=", "=~", "!~":
+		return true
+	}
+	return false
+}
+
+// isLogQLMatcherOnly reports whether a comparison only applies to strings.
+func isLogQLMatcherOnly(op string) bool {
+	return op == "=~" || op == "!~"
+}
+
+func isLogQLGrouping(keyword string) bool {
+	return keyword == "by" || keyword == "without"
+}
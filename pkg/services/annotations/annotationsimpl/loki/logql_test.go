@@ -0,0 +1,89 @@
+package loki
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLogPipeline(t *testing.T) {
+	t.Run("should accept log pipelines", func(t *testing.T) {
+		pipelines := []string{
+			``,
+			` `,
+			`|= "error"`,
+			`!= "error" != "warn"`,
+			`|~ "err.*" or "warn.*" !~ "debug"`,
+			`|= ip("192.168.0.0/16")`,
+			`| json`,
+			`| json | ruleUID="rule-1"`,
+			`| json uid="ruleUID", title`,
+			`| logfmt --strict --keep-empty`,
+			`| regexp "(?P<method>\\w+)"`,
+			"| pattern `<_> <status>`",
+			`| unpack | decolorize`,
+			`| json | current=~"Alerting.*" and previous!="Normal"`,
+			`| json | (current="Alerting" or current="Pending"), ruleID=1`,
+			`| json | ( ruleID>=1 and ruleID<10 )`,
+			`| json | duration > 1m30s or size <= 1.5KiB`,
+			`| json | value == -1.5`,
+			`| json | addr = ip("10.0.0.1")`,
+			`| json | json="true"`,
+			`| line_format "{{.ruleTitle}}: {{.current}}"`,
+			`| label_format title=ruleTitle, state="{{.current}}"`,
+			`| drop error, __error__="JSONParserErr"`,
+			`| keep ruleUID, current`,
+		}
+		for _, pipeline := range pipelines {
+			require.NoError(t, parseLogPipeline(pipeline), pipeline)
+		}
+	})
+
+	t.Run("should reject stream selectors", func(t *testing.T) {
+		pipelines := []string{
+			`| json or {orgID="2"}`,
+			`{orgID="2"}`,
+			`|= "error" }`,
+		}
+		for _, pipeline := range pipelines {
+			require.ErrorContains(t, parseLogPipeline(pipeline), "stream selectors are not allowed", pipeline)
+		}
+	})
+
+	t.Run("should reject metric queries", func(t *testing.T) {
+		pipelines := []string{
+			`| json [5m]`,
+			`| json | unwrap pendingDurationMs`,
+			`| json | count_over_time(5m)`,
+			`| json | sum by (ruleUID)`,
+		}
+		for _, pipeline := range pipelines {
+			require.ErrorContains(t, parseLogPipeline(pipeline), "metric queries are not allowed", pipeline)
+		}
+	})
+
+	t.Run("should reject invalid pipelines", func(t *testing.T) {
+		pipelines := []string{
+			`json`,
+			`|`,
+			`|= error`,
+			`|= "error" or`,
+			`| json | ruleUID="rule-2`,
+			`| json | ruleUID=`,
+			`| json | ruleUID =~ 5`,
+			`| json | (ruleUID="rule-2"`,
+			`| json | ruleUID="rule-2" and`,
+			`| json | ruleID > 5x`,
+			`| logfmt --lenient`,
+			`| regexp`,
+			`| line_format title`,
+			`| label_format title`,
+			`| drop`,
+			`| unknown`,
+			`| json; drop table`,
+		}
+		for _, pipeline := range pipelines {
+			require.Error(t, parseLogPipeline(pipeline), pipeline)
+		}
+	})
+}
@@ -289,6 +289,13 @@ func (r *xormRepositoryImpl) Get(ctx context.Context, query *annotations.ItemQue
 			params = append(params, query.AlertID)
 		}
 
+		if len(query.AlertIDs) > 0 {
+			sql.WriteString(` AND a.alert_id IN (?` + strings.Repeat(",?", len(query.AlertIDs)-1) + ")")
+			for _, id := range query.AlertIDs {
+				params = append(params, id)
+			}
+		}
+
 		if query.DashboardID != 0 {
 			sql.WriteString(` AND a.dashboard_id = ?`)
 			params = append(params, query.DashboardID)
@@ -11,6 +11,7 @@ type ItemQuery struct {
 	To           int64    `json:"to"`
 	UserID       int64    `json:"userId"`
 	AlertID      int64    `json:"alertId"`
+	AlertIDs     []int64  `json:"alertIds"`
 	DashboardID  int64    `json:"dashboardId"`
 	DashboardUID string   `json:"dashboardUID"`
 	PanelID      int64    `json:"panelId"`
@@ -20,7 +21,50 @@ type ItemQuery struct {
 	MatchAny     bool     `json:"matchAny"`
 	SignedInUser identity.Requester
 
+	// CustomFieldKeys are the custom fields of the alert rule to return along with state history annotations.
+	// It is only supported by the Loki state history store.
+	CustomFieldKeys []string `json:"customFieldKeys"`
+	// SortField is the field that state history annotations are sorted by: time, rule_uid, new_state or prev_state.
+	// SortOrder is either asc or desc. Annotations are sorted by time, most recent first, by default.
+	// They are only supported by the Loki state history store.
+	SortField string `json:"sortField"`
+	SortOrder string `json:"sortOrder"`
+	// TimeZone is the IANA name of the time zone that From and To are given in, such as "America/New_York".
+	// From and To are then read as the wall clock time in that time zone, rather than in UTC, so that queries can
+	// follow local date boundaries. It is only supported by the Loki state history store.
+	TimeZone string `json:"timeZone"`
+	// IncludeDuplicates disables the deduplication of consecutive identical state transitions of an alert instance,
+	// such as the ones recorded on every evaluation of a rule with no data. It is only supported by the Loki state
+	// history store.
+	IncludeDuplicates bool `json:"includeDuplicates"`
+	// InstanceLabels filters state history annotations by the labels of their alert instance. Annotations match if
+	// their alert instance has all of the labels. It is only supported by the Loki state history store.
+	InstanceLabels map[string]string `json:"instanceLabels"`
+	// Severity filters state history annotations by the severity label of their alert instance.
+	// It is only supported by the Loki state history store.
+	Severity string `json:"severity"`
+	// Environment filters state history annotations by the env label of their alert instance, such as prod or
+	// staging. It is only supported by the Loki state history store.
+	Environment string `json:"environment"`
+	// AnnotationFilter filters state history annotations by the free-form annotations of their alert rule, such as
+	// summary or description. Annotations match if their alert rule has all of the annotations. It is only supported
+	// by the Loki state history store.
+	AnnotationFilter map[string]string `json:"annotationFilter"`
+	// States filters state history annotations by the state that their alert instance transitioned into, such as
+	// Alerting or "Alerting (NoData)". It is only supported by the Loki state history store.
+	States []string `json:"states"`
+	// RuleNameRegex filters state history annotations by the name of their alert rule. The regular expression must
+	// match the whole name. It is only supported by the Loki state history store.
+	RuleNameRegex string `json:"ruleNameRegex"`
+
 	Limit int64 `json:"limit"`
+	// Offset is the number of annotations to skip before the ones that are returned, for paging through the results
+	// with Limit. It is only supported by the Loki state history store.
+	Offset int64 `json:"offset"`
+	// PageToken continues a query from the NextPageToken of a previous result, with pages of Limit annotations.
+	// Unlike Offset, it is not affected by annotations that are added between pages. It is only supported by the
+	// Loki state history store.
+	PageToken string `json:"pageToken"`
 }
 
 // TagsQuery is the query for a tags search.
@@ -123,6 +167,8 @@ type ItemDTO struct {
 	Email        string           `json:"email"`
 	AvatarURL    string           `json:"avatarUrl" xorm:"avatar_url"`
 	Data         *simplejson.Json `json:"data"`
+	// TimeZone is the time zone of the query that the annotation was returned for, if any.
+	TimeZone string `json:"timezone,omitempty" xorm:"-"`
 }
 
 type SortedItems []*ItemDTO
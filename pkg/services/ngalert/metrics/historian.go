@@ -13,6 +13,7 @@ type Historian struct {
 	WritesTotal       *prometheus.CounterVec
 	WritesFailed      *prometheus.CounterVec
 	WriteDuration     *instrument.HistogramCollector
+	QueryDuration     *prometheus.HistogramVec
 	BytesWritten      prometheus.Counter
 }
 
@@ -55,6 +56,13 @@ func NewHistorianMetrics(r prometheus.Registerer, subsystem string) *Historian {
 			Help:      "Histogram of request durations to the state history store. Only valid when using external stores.",
 			Buckets:   instrument.DefBuckets,
 		}, instrument.HistogramCollectorBuckets)),
+		QueryDuration: promauto.With(r).NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Subsystem: subsystem,
+			Name:      "state_history_query_duration_seconds",
+			Help:      "Histogram of the duration of queries to the state history store, per org. Only valid when using the Loki store.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"org"}),
 		BytesWritten: promauto.With(r).NewCounter(prometheus.CounterOpts{
 			Namespace: Namespace,
 			Subsystem: subsystem,
@@ -13,6 +13,9 @@ type HistoryQuery struct {
 	DashboardUID string
 	PanelID      int64
 	Labels       map[string]string
+	Annotations  map[string]string
+	States       []string
+	TitleRegex   string
 	From         time.Time
 	To           time.Time
 	Limit        int
@@ -66,7 +66,7 @@ func TestConfigureHistorianBackend(t *testing.T) {
 			Backend: "invalid-backend",
 		}
 
-		_, err := configureHistorianBackend(context.Background(), cfg, nil, nil, nil, met, logger)
+		_, err := configureHistorianBackend(context.Background(), cfg, nil, nil, nil, nil, met, logger)
 
 		require.ErrorContains(t, err, "unrecognized")
 	})
@@ -80,7 +80,7 @@ func TestConfigureHistorianBackend(t *testing.T) {
 			MultiPrimary: "invalid-backend",
 		}
 
-		_, err := configureHistorianBackend(context.Background(), cfg, nil, nil, nil, met, logger)
+		_, err := configureHistorianBackend(context.Background(), cfg, nil, nil, nil, nil, met, logger)
 
 		require.ErrorContains(t, err, "multi-backend target")
 		require.ErrorContains(t, err, "unrecognized")
@@ -96,7 +96,7 @@ func TestConfigureHistorianBackend(t *testing.T) {
 			MultiSecondaries: []string{"annotations", "invalid-backend"},
 		}
 
-		_, err := configureHistorianBackend(context.Background(), cfg, nil, nil, nil, met, logger)
+		_, err := configureHistorianBackend(context.Background(), cfg, nil, nil, nil, nil, met, logger)
 
 		require.ErrorContains(t, err, "multi-backend target")
 		require.ErrorContains(t, err, "unrecognized")
@@ -113,7 +113,7 @@ func TestConfigureHistorianBackend(t *testing.T) {
 			LokiWriteURL: "http://gone.invalid",
 		}
 
-		h, err := configureHistorianBackend(context.Background(), cfg, nil, nil, nil, met, logger)
+		h, err := configureHistorianBackend(context.Background(), cfg, nil, nil, nil, nil, met, logger)
 
 		require.NotNil(t, h)
 		require.NoError(t, err)
@@ -128,7 +128,7 @@ func TestConfigureHistorianBackend(t *testing.T) {
 			Backend: "annotations",
 		}
 
-		h, err := configureHistorianBackend(context.Background(), cfg, nil, nil, nil, met, logger)
+		h, err := configureHistorianBackend(context.Background(), cfg, nil, nil, nil, nil, met, logger)
 
 		require.NotNil(t, h)
 		require.NoError(t, err)
@@ -149,7 +149,7 @@ grafana_alerting_state_history_info{backend="annotations"} 1
 			Enabled: false,
 		}
 
-		h, err := configureHistorianBackend(context.Background(), cfg, nil, nil, nil, met, logger)
+		h, err := configureHistorianBackend(context.Background(), cfg, nil, nil, nil, nil, met, logger)
 
 		require.NotNil(t, h)
 		require.NoError(t, err)
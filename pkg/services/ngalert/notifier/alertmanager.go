@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"strconv"
+	"sync"
 	"time"
 
 	alertingNotify "github.com/grafana/alerting/notify"
@@ -60,6 +61,13 @@ type alertmanager struct {
 	orgID     int64
 
 	withAutogen bool
+
+	// notificationHistorian records the notifications sent to contact points, if set.
+	notificationHistorian NotificationHistorian
+
+	// muteTimings are the notification policies and time intervals of the applied configuration.
+	muteTimings    *muteTimings
+	muteTimingsMtx sync.RWMutex
 }
 
 // maintenanceOptions represent the options for components that need maintenance on a frequency within the Alertmanager.
@@ -349,6 +357,11 @@ func (am *alertmanager) applyConfig(cfg *apimodels.PostableUserConfig) (bool, er
 		return false, err
 	}
 
+	m := newMuteTimings(cfg)
+	am.muteTimingsMtx.Lock()
+	am.muteTimings = m
+	am.muteTimingsMtx.Unlock()
+
 	am.updateConfigMetrics(cfg)
 	return true, nil
 }
@@ -400,6 +413,9 @@ func (am *alertmanager) buildReceiverIntegrations(receiver *alertingNotify.APIRe
 	if err != nil {
 		return nil, err
 	}
+	if am.notificationHistorian != nil {
+		integrations = withNotificationHistory(integrations, am.orgID, receiverCfg.Name, am.notificationHistorian)
+	}
 	return integrations, nil
 }
 
@@ -85,6 +85,8 @@ type MultiOrgAlertmanager struct {
 
 	metrics *metrics.MultiOrgAlertmanager
 	ns      notifications.Service
+
+	notificationHistorian NotificationHistorian
 }
 
 type OrgAlertmanagerFactory func(ctx context.Context, orgID int64) (Alertmanager, error)
@@ -97,6 +99,13 @@ func WithAlertmanagerOverride(f func(OrgAlertmanagerFactory) OrgAlertmanagerFact
 	}
 }
 
+// WithNotificationHistorian records the notifications that the Alertmanagers of all orgs send to contact points.
+func WithNotificationHistorian(h NotificationHistorian) Option {
+	return func(moa *MultiOrgAlertmanager) {
+		moa.notificationHistorian = h
+	}
+}
+
 func NewMultiOrgAlertmanager(
 	cfg *setting.Cfg,
 	configStore AlertingStore,
@@ -135,7 +144,12 @@ func NewMultiOrgAlertmanager(
 	// Set up the default per tenant Alertmanager factory.
 	moa.factory = func(ctx context.Context, orgID int64) (Alertmanager, error) {
 		m := metrics.NewAlertmanagerMetrics(moa.metrics.GetOrCreateOrgRegistry(orgID))
-		return NewAlertmanager(ctx, orgID, moa.settings, moa.configStore, moa.kvStore, moa.peer, moa.decryptFn, moa.ns, m, featureManager.IsEnabled(ctx, featuremgmt.FlagAlertingSimplifiedRouting))
+		am, err := NewAlertmanager(ctx, orgID, moa.settings, moa.configStore, moa.kvStore, moa.peer, moa.decryptFn, moa.ns, m, featureManager.IsEnabled(ctx, featuremgmt.FlagAlertingSimplifiedRouting))
+		if err != nil {
+			return nil, err
+		}
+		am.notificationHistorian = moa.notificationHistorian
+		return am, nil
 	}
 
 	for _, opt := range opts {
@@ -0,0 +1,73 @@
+package notifier
+
+import (
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/prometheus/alertmanager/dispatch"
+	"github.com/prometheus/alertmanager/timeinterval"
+	"github.com/prometheus/common/model"
+
+	apimodels "github.com/grafana/grafana/pkg/services/ngalert/api/tooling/definitions"
+)
+
+// muteTimings are the notification policies and time intervals of an applied configuration.
+type muteTimings struct {
+	route     *dispatch.Route
+	intervals *timeinterval.Intervener
+}
+
+func newMuteTimings(cfg *apimodels.PostableUserConfig) *muteTimings {
+	intervals := make(map[string][]timeinterval.TimeInterval, len(cfg.AlertmanagerConfig.TimeIntervals)+len(cfg.AlertmanagerConfig.MuteTimeIntervals))
+	for _, ti := range cfg.AlertmanagerConfig.TimeIntervals {
+		intervals[ti.Name] = ti.TimeIntervals
+	}
+	for _, ti := range cfg.AlertmanagerConfig.MuteTimeIntervals {
+		intervals[ti.Name] = ti.TimeIntervals
+	}
+	return &muteTimings{
+		route:     dispatch.NewRoute(cfg.AlertmanagerConfig.Route.AsAMRoute(), nil),
+		intervals: timeinterval.NewIntervener(intervals),
+	}
+}
+
+// muted reports whether the notifications of an alert with the given labels are muted at the given time, that is
+// whether every notification policy that routes the alert is in one of its mute timings.
+func (m *muteTimings) muted(labels data.Labels, at time.Time) bool {
+	lset := make(model.LabelSet, len(labels))
+	for k, v := range labels {
+		lset[model.LabelName(k)] = model.LabelValue(v)
+	}
+
+	routes := m.route.Match(lset)
+	if len(routes) == 0 {
+		return false
+	}
+	for _, r := range routes {
+		if muted, err := m.intervals.Mutes(r.RouteOpts.MuteTimeIntervals, at); err != nil || !muted {
+			return false
+		}
+	}
+	return true
+}
+
+// Muted reports whether the notifications of an alert of an org with the given labels are muted at the given time
+// by the configuration of the org's Alertmanager. Alerts of orgs whose Alertmanager is not ready, or does not run in
+// Grafana, are never considered muted.
+func (moa *MultiOrgAlertmanager) Muted(orgID int64, labels data.Labels, at time.Time) bool {
+	orgAM, err := moa.AlertmanagerFor(orgID)
+	if err != nil {
+		return false
+	}
+	am, ok := orgAM.(*alertmanager)
+	if !ok {
+		return false
+	}
+	am.muteTimingsMtx.RLock()
+	m := am.muteTimings
+	am.muteTimingsMtx.RUnlock()
+	if m == nil {
+		return false
+	}
+	return m.muted(labels, at)
+}
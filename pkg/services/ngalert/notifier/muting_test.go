@@ -0,0 +1,50 @@
+package notifier
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/ngalert/api/tooling/definitions"
+)
+
+func TestMuteTimings(t *testing.T) {
+	cfg := &definitions.PostableUserConfig{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"alertmanager_config": {
+			"route": {
+				"receiver": "default",
+				"routes": [
+					{"receiver": "team-a", "object_matchers": [["team", "=", "a"]], "mute_time_intervals": ["weekends"]},
+					{"receiver": "team-b", "object_matchers": [["team", "=", "b"]], "mute_time_intervals": ["weekends"], "continue": true},
+					{"receiver": "default", "object_matchers": [["team", "=", "b"]]}
+				]
+			},
+			"mute_time_intervals": [{"name": "weekends", "time_intervals": [{"weekdays": ["saturday", "sunday"]}]}],
+			"receivers": [{"name": "default"}, {"name": "team-a"}, {"name": "team-b"}]
+		}
+	}`), cfg))
+	saturday := time.Date(2024, time.March, 9, 12, 0, 0, 0, time.UTC)
+	monday := time.Date(2024, time.March, 11, 12, 0, 0, 0, time.UTC)
+
+	m := newMuteTimings(cfg)
+
+	t.Run("alerts routed by a policy in one of its mute timings are muted", func(t *testing.T) {
+		require.True(t, m.muted(data.Labels{"team": "a"}, saturday))
+	})
+
+	t.Run("alerts routed by a policy outside of its mute timings are not muted", func(t *testing.T) {
+		require.False(t, m.muted(data.Labels{"team": "a"}, monday))
+	})
+
+	t.Run("alerts routed by a policy without mute timings are not muted", func(t *testing.T) {
+		require.False(t, m.muted(data.Labels{"team": "c"}, saturday))
+	})
+
+	t.Run("alerts are not muted if any of the policies that route them is not muted", func(t *testing.T) {
+		require.False(t, m.muted(data.Labels{"team": "b"}, saturday))
+	})
+}
@@ -0,0 +1,94 @@
+package notifier
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	alertingModels "github.com/grafana/alerting/models"
+	alertingNotify "github.com/grafana/alerting/notify"
+	"github.com/prometheus/alertmanager/notify"
+	"github.com/prometheus/alertmanager/types"
+
+	history_model "github.com/grafana/grafana/pkg/services/ngalert/state/historian/model"
+)
+
+// NotificationHistorian records the notifications that are sent to contact points.
+type NotificationHistorian interface {
+	// RecordNotifications writes the notifications of an org to its history. It returns a channel that is closed
+	// when writing has completed, with a non-nil error if it failed.
+	RecordNotifications(ctx context.Context, orgID int64, notifications []history_model.Notification) <-chan error
+}
+
+// notificationRecorder is a notifier that records the notifications that an integration of a contact point sent.
+type notificationRecorder struct {
+	integration  *alertingNotify.Integration
+	orgID        int64
+	contactPoint string
+	historian    NotificationHistorian
+}
+
+// withNotificationHistory wraps the integrations of a contact point, so that the notifications about Grafana alerts
+// that they send successfully are recorded.
+func withNotificationHistory(integrations []*alertingNotify.Integration, orgID int64, contactPoint string, historian NotificationHistorian) []*alertingNotify.Integration {
+	res := make([]*alertingNotify.Integration, 0, len(integrations))
+	for _, integration := range integrations {
+		recorder := &notificationRecorder{
+			integration:  integration,
+			orgID:        orgID,
+			contactPoint: contactPoint,
+			historian:    historian,
+		}
+		res = append(res, alertingNotify.NewIntegration(recorder, recorder, integration.Name(), integration.Index(), contactPoint))
+	}
+	return res
+}
+
+func (r *notificationRecorder) Notify(ctx context.Context, alerts ...*types.Alert) (bool, error) {
+	retry, err := r.integration.Notify(ctx, alerts...)
+	if err != nil {
+		return retry, err
+	}
+
+	// The dispatcher puts the key of the aggregation group that is being flushed in the context.
+	groupKey, _ := notify.GroupKey(ctx)
+	notifications := notificationsFromAlerts(alerts, r.contactPoint, groupKey, time.Now())
+	if len(notifications) > 0 {
+		// Recording is best effort and happens in the background, failures are logged by the historian.
+		r.historian.RecordNotifications(ctx, r.orgID, notifications)
+	}
+	return retry, nil
+}
+
+func (r *notificationRecorder) SendResolved() bool {
+	return r.integration.SendResolved()
+}
+
+// notificationsFromAlerts builds the notifications sent to a contact point about the given alerts of an aggregation group.
+// Alerts that do not belong to a Grafana alert rule are left out.
+func notificationsFromAlerts(alerts []*types.Alert, contactPoint, groupKey string, now time.Time) []history_model.Notification {
+	notifications := make([]history_model.Notification, 0, len(alerts))
+	for _, alert := range alerts {
+		ruleUID := string(alert.Labels[alertingModels.RuleUIDLabel])
+		if ruleUID == "" {
+			continue
+		}
+		labels := make(map[string]string, len(alert.Labels))
+		for k, v := range alert.Labels {
+			labels[string(k)] = string(v)
+		}
+		panelID, _ := strconv.ParseInt(string(alert.Annotations[alertingModels.PanelIDAnnotation]), 10, 64)
+		notifications = append(notifications, history_model.Notification{
+			RuleUID:      ruleUID,
+			FolderUID:    string(alert.Labels[alertingModels.NamespaceUIDLabel]),
+			Labels:       labels,
+			DashboardUID: string(alert.Annotations[alertingModels.DashboardUIDAnnotation]),
+			PanelID:      panelID,
+			Resolved:     alert.ResolvedAt(now),
+			ContactPoint: contactPoint,
+			ThrottleKey:  groupKey,
+			Time:         now,
+		})
+	}
+	return notifications
+}
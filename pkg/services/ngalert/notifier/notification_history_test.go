@@ -0,0 +1,119 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	alertingModels "github.com/grafana/alerting/models"
+	alertingNotify "github.com/grafana/alerting/notify"
+	"github.com/prometheus/alertmanager/notify"
+	"github.com/prometheus/alertmanager/types"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	history_model "github.com/grafana/grafana/pkg/services/ngalert/state/historian/model"
+)
+
+func TestNotificationHistory(t *testing.T) {
+	now := time.Now()
+	grafanaAlert := &types.Alert{Alert: model.Alert{
+		Labels: model.LabelSet{
+			alertingModels.RuleUIDLabel:      "rule-1",
+			alertingModels.NamespaceUIDLabel: "folder-1",
+			"team":                           "a-team",
+		},
+		Annotations: model.LabelSet{
+			alertingModels.DashboardUIDAnnotation: "dashboard-1",
+			alertingModels.PanelIDAnnotation:      "3",
+		},
+		StartsAt: now.Add(-time.Minute),
+	}}
+	resolvedAlert := &types.Alert{Alert: model.Alert{
+		Labels:   model.LabelSet{alertingModels.RuleUIDLabel: "rule-2"},
+		StartsAt: now.Add(-time.Hour),
+		EndsAt:   now.Add(-time.Minute),
+	}}
+	externalAlert := &types.Alert{Alert: model.Alert{
+		Labels:   model.LabelSet{"alertname": "external"},
+		StartsAt: now.Add(-time.Minute),
+	}}
+
+	t.Run("records the notifications about Grafana alerts that were sent", func(t *testing.T) {
+		historian := &fakeNotificationHistorian{}
+		integration := alertingNotify.NewIntegration(&fakeNotifier{}, &fakeNotifier{}, "slack", 2, "team-a")
+		integrations := withNotificationHistory([]*alertingNotify.Integration{integration}, 1, "team-a", historian)
+
+		require.Len(t, integrations, 1)
+		require.Equal(t, "slack", integrations[0].Name())
+		require.Equal(t, 2, integrations[0].Index())
+		ctx := notify.WithGroupKey(context.Background(), `{}:{alertname="a"}`)
+		_, err := integrations[0].Notify(ctx, grafanaAlert, resolvedAlert, externalAlert)
+		require.NoError(t, err)
+
+		require.Equal(t, int64(1), historian.orgID)
+		require.Len(t, historian.notifications, 2)
+		firing := historian.notifications[0]
+		require.Equal(t, "rule-1", firing.RuleUID)
+		require.Equal(t, "folder-1", firing.FolderUID)
+		require.Equal(t, "a-team", firing.Labels["team"])
+		require.Equal(t, "dashboard-1", firing.DashboardUID)
+		require.Equal(t, int64(3), firing.PanelID)
+		require.Equal(t, "team-a", firing.ContactPoint)
+		require.Equal(t, `{}:{alertname="a"}`, firing.ThrottleKey)
+		require.False(t, firing.Resolved)
+		resolved := historian.notifications[1]
+		require.Equal(t, "rule-2", resolved.RuleUID)
+		require.True(t, resolved.Resolved)
+	})
+
+	t.Run("does not record notifications that failed", func(t *testing.T) {
+		historian := &fakeNotificationHistorian{}
+		integration := alertingNotify.NewIntegration(&fakeNotifier{err: errors.New("failed")}, &fakeNotifier{}, "slack", 0, "team-a")
+		integrations := withNotificationHistory([]*alertingNotify.Integration{integration}, 1, "team-a", historian)
+
+		_, err := integrations[0].Notify(context.Background(), grafanaAlert)
+		require.Error(t, err)
+
+		require.Empty(t, historian.notifications)
+	})
+
+	t.Run("does not record notifications about alerts of other sources", func(t *testing.T) {
+		historian := &fakeNotificationHistorian{}
+		integration := alertingNotify.NewIntegration(&fakeNotifier{}, &fakeNotifier{}, "slack", 0, "team-a")
+		integrations := withNotificationHistory([]*alertingNotify.Integration{integration}, 1, "team-a", historian)
+
+		_, err := integrations[0].Notify(context.Background(), externalAlert)
+		require.NoError(t, err)
+
+		require.False(t, historian.called)
+	})
+}
+
+type fakeNotifier struct {
+	err error
+}
+
+func (n *fakeNotifier) Notify(context.Context, ...*types.Alert) (bool, error) {
+	return false, n.err
+}
+
+func (n *fakeNotifier) SendResolved() bool {
+	return true
+}
+
+type fakeNotificationHistorian struct {
+	called        bool
+	orgID         int64
+	notifications []history_model.Notification
+}
+
+func (h *fakeNotificationHistorian) RecordNotifications(_ context.Context, orgID int64, notifications []history_model.Notification) <-chan error {
+	h.called = true
+	h.orgID = orgID
+	h.notifications = append(h.notifications, notifications...)
+	errCh := make(chan error)
+	close(errCh)
+	return errCh
+}
@@ -62,8 +62,9 @@ func removePrivateLabels(labels data.Labels) data.Labels {
 	return result
 }
 
-// labelFingerprint calculates a stable Prometheus-style signature for a label set.
-func labelFingerprint(labels data.Labels) string {
+// LabelFingerprint calculates a stable Prometheus-style signature for a label set. It is stored as the
+// fingerprint of the labels of each alert instance in state history.
+func LabelFingerprint(labels data.Labels) string {
 	sig := prometheus.LabelsToSignature(labels)
 	return fmt.Sprintf("%016x", sig)
 }
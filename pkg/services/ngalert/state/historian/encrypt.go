@@ -0,0 +1,93 @@
+package historian
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// encryptedLinePrefix marks log lines that are encrypted at rest.
+// Encrypted lines are formatted as "enc:<key ID>:<base64 of nonce and ciphertext>".
+// The key ID identifies the key that was used to encrypt the line, so that lines written with a previous key
+// can be told apart once keys are rotated.
+const encryptedLinePrefix = "enc:"
+
+// encryptionKeySize is the size of the key for AES-256.
+const encryptionKeySize = 32
+
+// encryptionKeyID derives a short, non-secret identifier from an encryption key.
+func encryptionKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes long, got %d", encryptionKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptLine encrypts a log line with AES-256-GCM.
+func encryptLine(key []byte, line string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(line), nil)
+
+	return encryptedLinePrefix + encryptionKeyID(key) + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// isEncryptedLine returns whether a log line was encrypted with encryptLine.
+func isEncryptedLine(line string) bool {
+	return strings.HasPrefix(line, encryptedLinePrefix)
+}
+
+// decryptLine decrypts a log line that was encrypted with encryptLine.
+func decryptLine(key []byte, line string) (string, error) {
+	if !isEncryptedLine(line) {
+		return "", fmt.Errorf("log line is not encrypted")
+	}
+	keyID, payload, ok := strings.Cut(strings.TrimPrefix(line, encryptedLinePrefix), ":")
+	if !ok {
+		return "", fmt.Errorf("encrypted log line is malformed")
+	}
+	if keyID != encryptionKeyID(key) {
+		return "", fmt.Errorf("log line was encrypted with unknown key %q", keyID)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode encrypted log line: %w", err)
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("encrypted log line is too short")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt log line: %w", err)
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,61 @@
+package historian
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptLine(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, encryptionKeySize)
+	line := `{"schemaVersion":1,"current":"Alerting","labels":{"email":"someone@example.com"}}`
+
+	t.Run("round-trips log lines", func(t *testing.T) {
+		enc, err := encryptLine(key, line)
+		require.NoError(t, err)
+		require.True(t, isEncryptedLine(enc))
+		require.True(t, strings.HasPrefix(enc, encryptedLinePrefix+encryptionKeyID(key)+":"))
+		require.NotContains(t, enc, "someone@example.com")
+
+		dec, err := decryptLine(key, enc)
+		require.NoError(t, err)
+		require.Equal(t, line, dec)
+	})
+
+	t.Run("uses a different nonce every time", func(t *testing.T) {
+		first, err := encryptLine(key, line)
+		require.NoError(t, err)
+		second, err := encryptLine(key, line)
+		require.NoError(t, err)
+		require.NotEqual(t, first, second)
+	})
+
+	t.Run("fails to decrypt with another key", func(t *testing.T) {
+		enc, err := encryptLine(key, line)
+		require.NoError(t, err)
+
+		_, err = decryptLine(bytes.Repeat([]byte{2}, encryptionKeySize), enc)
+		require.ErrorContains(t, err, "unknown key")
+	})
+
+	t.Run("fails to decrypt tampered lines", func(t *testing.T) {
+		enc, err := encryptLine(key, line)
+		require.NoError(t, err)
+		tampered := enc[:len(enc)-4] + "AAA="
+
+		_, err = decryptLine(key, tampered)
+		require.Error(t, err)
+	})
+
+	t.Run("rejects keys of the wrong size", func(t *testing.T) {
+		_, err := encryptLine([]byte("short"), line)
+		require.Error(t, err)
+	})
+
+	t.Run("rejects lines that are not encrypted", func(t *testing.T) {
+		_, err := decryptLine(key, line)
+		require.Error(t, err)
+	})
+}
@@ -3,9 +3,14 @@ package historian
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
+	"regexp"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/benbjohnson/clock"
@@ -20,6 +25,8 @@ import (
 	"github.com/grafana/grafana/pkg/services/ngalert/models"
 	"github.com/grafana/grafana/pkg/services/ngalert/state"
 	history_model "github.com/grafana/grafana/pkg/services/ngalert/state/historian/model"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/util/errutil"
 )
 
 const (
@@ -38,6 +45,32 @@ const (
 	StateHistoryLabelValue = "state-history"
 )
 
+// Sources of the resolution of firing alerts, recorded on transitions from Alerting to Normal.
+const (
+	// ResolutionSourceAuto is the source of resolutions of alerts whose condition no longer holds.
+	ResolutionSourceAuto = "auto"
+	// ResolutionSourceManual is the source of resolutions caused by a user pausing, updating or deleting the rule.
+	ResolutionSourceManual = "manual"
+)
+
+// Types of entries that are not state transitions. State transitions are recorded without a type.
+const (
+	// EntryTypeEvaluationGroup is the type of entries recorded for an evaluation of a rule group.
+	EntryTypeEvaluationGroup = "evaluation_group"
+	// EntryTypeRuleChange is the type of entries recorded for a change to an alert rule.
+	EntryTypeRuleChange = "rule_change"
+	// EntryTypeNotification is the type of entries recorded for a notification about an alert instance that was sent
+	// to a contact point.
+	EntryTypeNotification = "notification"
+)
+
+// DeploymentIDLabel is the label that deployment tooling adds to alert instances to tie them to a deployment.
+const DeploymentIDLabel = "deployment_id"
+
+// MaintenanceWindowLabel is the label that identifies the maintenance window that was active when an alert instance
+// was evaluated. It is expected to be set by the rule, for example with a template over the queried data.
+const MaintenanceWindowLabel = "maintenance_window_id"
+
 const defaultQueryRange = 6 * time.Hour
 
 type remoteLokiClient interface {
@@ -50,6 +83,9 @@ type remoteLokiClient interface {
 type RemoteLokiBackend struct {
 	client         remoteLokiClient
 	externalLabels map[string]string
+	nodeID         string
+	clusterID      string
+	region         string
 	clock          clock.Clock
 	metrics        *metrics.Historian
 	log            log.Logger
@@ -60,6 +96,9 @@ func NewRemoteLokiBackend(cfg LokiConfig, req client.Requester, metrics *metrics
 	return &RemoteLokiBackend{
 		client:         NewLokiClient(cfg, req, metrics, logger),
 		externalLabels: cfg.ExternalLabels,
+		nodeID:         cfg.NodeID,
+		clusterID:      cfg.ClusterName,
+		region:         cfg.Region,
 		clock:          clock.New(),
 		metrics:        metrics,
 		log:            logger,
@@ -73,7 +112,13 @@ func (h *RemoteLokiBackend) TestConnection(ctx context.Context) error {
 // Record writes a number of state transitions for a given rule to an external Loki instance.
 func (h *RemoteLokiBackend) Record(ctx context.Context, rule history_model.RuleMeta, states []state.StateTransition) <-chan error {
 	logger := h.log.FromContext(ctx)
-	logStream := StatesToStream(rule, states, h.externalLabels, logger)
+	if h.clusterID != "" {
+		rule.ClusterID = h.clusterID
+	}
+	if h.region != "" {
+		rule.Region = h.region
+	}
+	logStream := StatesToStreamWithNodeID(rule, states, h.externalLabels, h.nodeID, logger)
 
 	errCh := make(chan error, 1)
 	if len(logStream.Values) == 0 {
@@ -89,6 +134,7 @@ func (h *RemoteLokiBackend) Record(ctx context.Context, rule history_model.RuleM
 	writeCtx := context.Background()
 	writeCtx, cancel := context.WithTimeout(writeCtx, StateHistoryWriteTimeout)
 	writeCtx = history_model.WithRuleData(writeCtx, rule)
+	writeCtx = ContextWithOrgID(writeCtx, rule.OrgID)
 	writeCtx = trace.ContextWithSpan(writeCtx, trace.SpanFromContext(ctx))
 
 	go func(ctx context.Context) {
@@ -110,6 +156,39 @@ func (h *RemoteLokiBackend) Record(ctx context.Context, rule history_model.RuleM
 	return errCh
 }
 
+// RecordNotifications writes an entry for each notification that was sent to a contact point to an external Loki
+// instance. The entries of an org are written to its state history, next to the state transitions of its alerts.
+func (h *RemoteLokiBackend) RecordNotifications(ctx context.Context, orgID int64, notifications []history_model.Notification) <-chan error {
+	logger := h.log.FromContext(ctx)
+	streams := NotificationsToStreams(orgID, notifications, h.externalLabels, h.nodeID, logger)
+
+	errCh := make(chan error, 1)
+	if len(streams) == 0 {
+		close(errCh)
+		return errCh
+	}
+
+	// Like state transitions, notifications are written in the background with a context of their own.
+	writeCtx, cancel := context.WithTimeout(context.Background(), StateHistoryWriteTimeout)
+	writeCtx = ContextWithOrgID(writeCtx, orgID)
+	writeCtx = trace.ContextWithSpan(writeCtx, trace.SpanFromContext(ctx))
+
+	go func(ctx context.Context) {
+		defer cancel()
+		defer close(errCh)
+		logger := h.log.FromContext(ctx)
+
+		org := fmt.Sprint(orgID)
+		h.metrics.WritesTotal.WithLabelValues(org, "loki").Inc()
+		if err := h.recordStreams(ctx, streams, logger); err != nil {
+			logger.Error("Failed to save notification history batch", "error", err)
+			h.metrics.WritesFailed.WithLabelValues(org, "loki").Inc()
+			errCh <- fmt.Errorf("failed to save notification history batch: %w", err)
+		}
+	}(writeCtx)
+	return errCh
+}
+
 // Query retrieves state history entries from an external Loki instance and formats the results into a dataframe.
 func (h *RemoteLokiBackend) Query(ctx context.Context, query models.HistoryQuery) (*data.Frame, error) {
 	logQL, err := BuildLogQuery(query)
@@ -126,7 +205,7 @@ func (h *RemoteLokiBackend) Query(ctx context.Context, query models.HistoryQuery
 	}
 
 	// Timestamps are expected in RFC3339Nano.
-	res, err := h.client.RangeQuery(ctx, logQL, query.From.UnixNano(), query.To.UnixNano(), int64(query.Limit))
+	res, err := h.client.RangeQuery(ContextWithOrgID(ctx, query.OrgID), logQL, query.From.UnixNano(), query.To.UnixNano(), int64(query.Limit))
 	if err != nil {
 		return nil, err
 	}
@@ -154,6 +233,35 @@ func buildSelectors(query models.HistoryQuery) ([]Selector, error) {
 	return selectors, nil
 }
 
+// BuildStreamSelector builds a stream selector for the state history of an org,
+// narrowed down by any additional selectors.
+func BuildStreamSelector(orgID int64, extra ...Selector) (string, error) {
+	selectors, err := buildSelectors(models.HistoryQuery{OrgID: orgID})
+	if err != nil {
+		return "", fmt.Errorf("failed to build the provided selectors: %w", err)
+	}
+
+	return selectorString(append(selectors, extra...)), nil
+}
+
+// BuildMultiOrgStreamSelector builds a stream selector for the state history of several orgs.
+// If no org is given, it selects the state history of all orgs.
+func BuildMultiOrgStreamSelector(orgIDs []int64) string {
+	orgs := ".+"
+	if len(orgIDs) > 0 {
+		ids := make([]string, 0, len(orgIDs))
+		for _, id := range orgIDs {
+			ids = append(ids, strconv.FormatInt(id, 10))
+		}
+		orgs = strings.Join(ids, "|")
+	}
+
+	return selectorString([]Selector{
+		{Label: OrgIDLabel, Op: EqRegEx, Value: orgs},
+		{Label: StateHistoryLabelKey, Op: Eq, Value: StateHistoryLabelValue},
+	})
+}
+
 // merge will put all the results in one array sorted by timestamp.
 func merge(res QueryRes, ruleUID string) (*data.Frame, error) {
 	// Find the total number of elements in all arrays.
@@ -232,6 +340,12 @@ func merge(res QueryRes, ruleUID string) (*data.Frame, error) {
 }
 
 func StatesToStream(rule history_model.RuleMeta, states []state.StateTransition, externalLabels map[string]string, logger log.Logger) Stream {
+	return StatesToStreamWithNodeID(rule, states, externalLabels, "", logger)
+}
+
+// StatesToStreamWithNodeID is like StatesToStream, but also records the ID of the Grafana instance that
+// evaluated the rule in every log line.
+func StatesToStreamWithNodeID(rule history_model.RuleMeta, states []state.StateTransition, externalLabels map[string]string, nodeID string, logger log.Logger) Stream {
 	labels := mergeLabels(make(map[string]string), externalLabels)
 	// System-defined labels take precedence over user-defined external labels.
 	labels[StateHistoryLabelKey] = StateHistoryLabelValue
@@ -247,21 +361,52 @@ func StatesToStream(rule history_model.RuleMeta, states []state.StateTransition,
 
 		sanitizedLabels := removePrivateLabels(state.Labels)
 		entry := LokiEntry{
-			SchemaVersion:  1,
-			Previous:       state.PreviousFormatted(),
-			Current:        state.Formatted(),
-			Values:         valuesAsDataBlob(state.State),
-			Condition:      rule.Condition,
-			DashboardUID:   rule.DashboardUID,
-			PanelID:        rule.PanelID,
-			Fingerprint:    labelFingerprint(sanitizedLabels),
-			RuleTitle:      rule.Title,
-			RuleID:         rule.ID,
-			RuleUID:        rule.UID,
-			InstanceLabels: sanitizedLabels,
+			SchemaVersion:        1,
+			Previous:             state.PreviousFormatted(),
+			Current:              state.Formatted(),
+			Values:               valuesAsDataBlob(state.State),
+			Condition:            rule.Condition,
+			DashboardUID:         rule.DashboardUID,
+			PanelID:              rule.PanelID,
+			Fingerprint:          LabelFingerprint(sanitizedLabels),
+			RuleTitle:            rule.Title,
+			RuleID:               rule.ID,
+			RuleUID:              rule.UID,
+			InstanceLabels:       sanitizedLabels,
+			Note:                 rule.Note,
+			Team:                 rule.Team,
+			Application:          rule.Application,
+			TenantID:             rule.TenantID,
+			ReconciliationID:     rule.ReconciliationID,
+			IncidentID:           rule.IncidentID,
+			ServiceName:          ruleOrLabel(rule.ServiceName, sanitizedLabels, history_model.ServiceAnnotation),
+			Priority:             rule.Priority,
+			K8sNamespace:         ruleOrLabel(rule.K8sNamespace, sanitizedLabels, history_model.NamespaceAnnotation),
+			DeploymentID:         sanitizedLabels[DeploymentIDLabel],
+			FeatureFlag:          rule.FeatureFlag,
+			RunbookURL:           rule.RunbookURL,
+			OnCallPolicy:         rule.OnCallPolicy,
+			MaintenanceWindowID:  sanitizedLabels[MaintenanceWindowLabel],
+			RecordingRuleUID:     rule.RecordingRuleUID,
+			PolicyRoute:          rule.PolicyRoute,
+			EvaluationIntervalMs: rule.EvaluationInterval.Milliseconds(),
+			PendingDurationMs:    rule.PendingPeriod.Milliseconds(),
+			RuleVersion:          rule.Version,
+			CustomFields:         rule.CustomFields,
+			NodeID:               nodeID,
+			ClusterID:            rule.ClusterID,
+			Region:               rule.Region,
+			GroupKey:             groupKey(rule.GroupBy, sanitizedLabels),
+			ResolutionSource:     resolutionSource(state),
+			GrafanaVersion:       setting.BuildVersion,
+			DatasourceUIDs:       strings.Join(rule.DatasourceUIDs, ","),
+			Tags:                 strings.Join(rule.Tags, " "),
+			NoDataBehavior:       rule.NoDataBehavior,
+			Muted:                state.Muted,
 		}
 		if state.State.State == eval.Error {
 			entry.Error = state.Error.Error()
+			entry.ErrorType = errorType(state.Error)
 		}
 
 		jsn, err := json.Marshal(entry)
@@ -283,6 +428,109 @@ func StatesToStream(rule history_model.RuleMeta, states []state.StateTransition,
 	}
 }
 
+// NotificationsToStreams builds the entries recorded for notifications that were sent to contact points, with one
+// stream for each folder, like the state transitions of the rules in the folder.
+func NotificationsToStreams(orgID int64, notifications []history_model.Notification, externalLabels map[string]string, nodeID string, logger log.Logger) []Stream {
+	streams := make([]Stream, 0)
+	byFolder := make(map[string]int)
+	for _, n := range notifications {
+		sanitizedLabels := removePrivateLabels(n.Labels)
+		current := eval.Alerting.String()
+		if n.Resolved {
+			current = eval.Normal.String()
+		}
+		entry := LokiEntry{
+			SchemaVersion:  1,
+			Type:           EntryTypeNotification,
+			Current:        current,
+			DashboardUID:   n.DashboardUID,
+			PanelID:        n.PanelID,
+			Fingerprint:    LabelFingerprint(sanitizedLabels),
+			RuleUID:        n.RuleUID,
+			InstanceLabels: sanitizedLabels,
+			ContactPoint:   n.ContactPoint,
+			ThrottleKey:    n.ThrottleKey,
+			NodeID:         nodeID,
+			GrafanaVersion: setting.BuildVersion,
+		}
+		jsn, err := json.Marshal(entry)
+		if err != nil {
+			logger.Error("Failed to construct history record for notification, skipping", "error", err)
+			continue
+		}
+
+		i, ok := byFolder[n.FolderUID]
+		if !ok {
+			labels := mergeLabels(make(map[string]string), externalLabels)
+			labels[StateHistoryLabelKey] = StateHistoryLabelValue
+			labels[OrgIDLabel] = fmt.Sprint(orgID)
+			labels[FolderUIDLabel] = n.FolderUID
+			i = len(streams)
+			byFolder[n.FolderUID] = i
+			streams = append(streams, Stream{Stream: labels})
+		}
+		streams[i].Values = append(streams[i].Values, Sample{T: n.Time, V: string(jsn)})
+	}
+	return streams
+}
+
+// ruleOrLabel returns the value that the rule sets for a property of its alert instances, such as their service,
+// or the value of the instance label with the given name if the rule does not set one.
+func ruleOrLabel(ruleValue string, labels data.Labels, label string) string {
+	if ruleValue != "" {
+		return ruleValue
+	}
+	return labels[label]
+}
+
+// resolutionSource returns how a firing alert was resolved, or an empty string if the transition is not
+// a resolution.
+func resolutionSource(t state.StateTransition) string {
+	if t.PreviousState != eval.Alerting || t.State.State != eval.Normal {
+		return ""
+	}
+	switch t.StateReason {
+	case models.StateReasonPaused, models.StateReasonUpdated, models.StateReasonRuleDeleted:
+		return ResolutionSourceManual
+	default:
+		return ResolutionSourceAuto
+	}
+}
+
+// groupByAll is the special label that the Alertmanager uses to group alerts by all of their labels.
+const groupByAll = "..."
+
+// groupKey returns the labels of an alert instance that it is grouped by in the Alertmanager, formatted the same
+// way as the Alertmanager formats label sets. Labels that the instance does not have are left out.
+func groupKey(groupBy []string, labels data.Labels) string {
+	if len(groupBy) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if slices.Contains(groupBy, name) || slices.Contains(groupBy, groupByAll) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, labels[name]))
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// errorType returns the message ID of the Grafana error wrapped by err, if any.
+func errorType(err error) string {
+	var gfErr errutil.Error
+	if errors.As(err, &gfErr) {
+		return gfErr.MessageID
+	}
+	return ""
+}
+
 func (h *RemoteLokiBackend) recordStreams(ctx context.Context, streams []Stream, logger log.Logger) error {
 	if err := h.client.Push(ctx, streams); err != nil {
 		return err
@@ -293,21 +541,78 @@ func (h *RemoteLokiBackend) recordStreams(ctx context.Context, streams []Stream,
 }
 
 type LokiEntry struct {
-	SchemaVersion int              `json:"schemaVersion"`
-	Previous      string           `json:"previous"`
-	Current       string           `json:"current"`
-	Error         string           `json:"error,omitempty"`
-	Values        *simplejson.Json `json:"values"`
-	Condition     string           `json:"condition"`
-	DashboardUID  string           `json:"dashboardUID"`
-	PanelID       int64            `json:"panelID"`
-	Fingerprint   string           `json:"fingerprint"`
-	RuleTitle     string           `json:"ruleTitle"`
-	RuleID        int64            `json:"ruleID"`
-	RuleUID       string           `json:"ruleUID"`
+	SchemaVersion int    `json:"schemaVersion"`
+	Type          string `json:"type,omitempty"`
+	Previous      string `json:"previous"`
+	Current       string `json:"current"`
+	Error         string `json:"error,omitempty"`
+	// ErrorType identifies the kind of evaluation error, such as "sse.dataQueryError" for failed data source queries.
+	ErrorType    string           `json:"errorType,omitempty"`
+	Values       *simplejson.Json `json:"values"`
+	Condition    string           `json:"condition"`
+	DashboardUID string           `json:"dashboardUID"`
+	PanelID      int64            `json:"panelID"`
+	Fingerprint  string           `json:"fingerprint"`
+	RuleTitle    string           `json:"ruleTitle"`
+	RuleID       int64            `json:"ruleID"`
+	RuleUID      string           `json:"ruleUID"`
 	// InstanceLabels is exactly the set of labels associated with the alert instance in Alertmanager.
 	// These should not be conflated with labels associated with log streams.
 	InstanceLabels map[string]string `json:"labels"`
+	Note           string            `json:"note,omitempty"`
+	// ContactPoint is the contact point that a notification was sent to. It is only set on entries of type
+	// EntryTypeNotification, as the contact point is only known once the Alertmanager routes the alert.
+	ContactPoint         string            `json:"contactPoint,omitempty"`
+	Team                 string            `json:"team,omitempty"`
+	Application          string            `json:"application,omitempty"`
+	TenantID             string            `json:"tenantID,omitempty"`
+	ReconciliationID     string            `json:"reconciliationID,omitempty"`
+	IncidentID           string            `json:"incidentID,omitempty"`
+	ServiceName          string            `json:"serviceName,omitempty"`
+	Priority             string            `json:"priority,omitempty"`
+	K8sNamespace         string            `json:"namespace,omitempty"`
+	DeploymentID         string            `json:"deploymentID,omitempty"`
+	FeatureFlag          string            `json:"featureFlag,omitempty"`
+	RunbookURL           string            `json:"runbookURL,omitempty"`
+	OnCallPolicy         string            `json:"onCallPolicy,omitempty"`
+	MaintenanceWindowID  string            `json:"maintenanceWindowID,omitempty"`
+	RecordingRuleUID     string            `json:"recordingRuleUID,omitempty"`
+	PolicyRoute          string            `json:"policyRoute,omitempty"`
+	EvaluationIntervalMs int64             `json:"evaluationIntervalMs,omitempty"`
+	PendingDurationMs    int64             `json:"pendingDurationMs,omitempty"`
+	RuleVersion          int64             `json:"ruleVersion,omitempty"`
+	CustomFields         map[string]string `json:"customFields,omitempty"`
+	NodeID               string            `json:"nodeID,omitempty"`
+	ClusterID            string            `json:"clusterID,omitempty"`
+	Region               string            `json:"region,omitempty"`
+	// GroupKey is the set of labels that identifies the Alertmanager group of the alert instance,
+	// formatted like {alertname="a", grafana_folder="b"}. It is only known if the rule sets the labels to group by.
+	GroupKey         string `json:"groupKey,omitempty"`
+	ResolutionSource string `json:"resolutionSource,omitempty"`
+	GrafanaVersion   string `json:"grafanaVersion,omitempty"`
+	// DatasourceUIDs is a comma-separated list of the data sources that the rule queries.
+	// It is not an array, as the Loki json parser does not extract arrays.
+	DatasourceUIDs string `json:"datasourceUIDs,omitempty"`
+	// NoDataBehavior is the state that the rule treats evaluations without data as.
+	NoDataBehavior string `json:"noDataBehavior,omitempty"`
+	// Muted is whether notifications of the alert were muted by the time intervals of its notification policies
+	// when the transition happened.
+	Muted bool `json:"muted,omitempty"`
+	// ThrottleKey is the key of the Alertmanager aggregation group that notifications of the alert are throttled by.
+	// The group depends on the notification policy that the alert is routed by, so it is only set on entries of type
+	// EntryTypeNotification.
+	ThrottleKey string `json:"throttleKey,omitempty"`
+	// Deleted marks a tombstone, which deletes the state transition of the same alert instance, state and time.
+	// Loki is append-only, so deleted transitions are only dropped when they are read.
+	Deleted bool `json:"deleted,omitempty"`
+	// Tags is a space-separated list of the user-defined tags of the rule, like DatasourceUIDs.
+	Tags string `json:"tags,omitempty"`
+
+	// The following fields are only set on entries of type EntryTypeEvaluationGroup.
+	Group      string `json:"group,omitempty"`
+	FolderUID  string `json:"folderUID,omitempty"`
+	RuleCount  int    `json:"ruleCount,omitempty"`
+	DurationMs int64  `json:"durationMs,omitempty"`
 }
 
 func valuesAsDataBlob(state *state.State) *simplejson.Json {
@@ -387,6 +692,18 @@ func BuildLogQuery(query models.HistoryQuery) (string, error) {
 	if query.PanelID != 0 {
 		logQL = fmt.Sprintf("%s | panelID=%d", logQL, query.PanelID)
 	}
+	if query.TitleRegex != "" {
+		logQL = fmt.Sprintf("%s | ruleTitle=~%q", logQL, query.TitleRegex)
+	}
+	if len(query.States) == 1 {
+		logQL = fmt.Sprintf("%s | current=%q", logQL, query.States[0])
+	} else if len(query.States) > 1 {
+		states := make([]string, 0, len(query.States))
+		for _, s := range query.States {
+			states = append(states, regexp.QuoteMeta(s))
+		}
+		logQL = fmt.Sprintf("%s | current=~%q", logQL, strings.Join(states, "|"))
+	}
 
 	labelFilters := ""
 	labelKeys := make([]string, 0, len(query.Labels))
@@ -400,6 +717,16 @@ func BuildLogQuery(query models.HistoryQuery) (string, error) {
 	}
 	logQL += labelFilters
 
+	annotationKeys := make([]string, 0, len(query.Annotations))
+	for k := range query.Annotations {
+		annotationKeys = append(annotationKeys, k)
+	}
+	sort.Strings(annotationKeys)
+	// Free-form annotations of the rule are recorded as custom fields.
+	for _, k := range annotationKeys {
+		logQL += fmt.Sprintf(" | customFields_%s=%q", k, query.Annotations[k])
+	}
+
 	return logQL, nil
 }
 
@@ -407,5 +734,8 @@ func queryHasLogFilters(query models.HistoryQuery) bool {
 	return query.RuleUID != "" ||
 		query.DashboardUID != "" ||
 		query.PanelID != 0 ||
-		len(query.Labels) > 0
+		len(query.Labels) > 0 ||
+		len(query.Annotations) > 0 ||
+		len(query.States) > 0 ||
+		query.TitleRegex != ""
 }
@@ -3,14 +3,22 @@ package historian
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
+	"os"
+	"sort"
 	"strconv"
 	"time"
 
+	"github.com/grafana/grafana/pkg/infra/db"
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/services/ngalert/client"
 	"github.com/grafana/grafana/pkg/services/ngalert/metrics"
@@ -20,10 +28,95 @@ import (
 const defaultPageSize = 1000
 const maximumPageSize = 5000
 
+// pingRange is the time range that labels are looked up in when pinging Loki.
+// It is kept short so that the request is cheap for Loki to serve.
+const pingRange = time.Minute
+
+// ErrLokiUnavailable is returned when Loki responds that it is temporarily unable to serve requests.
+var ErrLokiUnavailable = errors.New("loki is unavailable")
+
+// TenantIDMode determines the Loki tenant that the state history of an org is written to and read from.
+type TenantIDMode string
+
+const (
+	// TenantIDModeFixed uses the configured tenant ID for all orgs.
+	TenantIDModeFixed TenantIDMode = "fixed"
+	// TenantIDModeOrgID uses the ID of the org as tenant ID.
+	TenantIDModeOrgID TenantIDMode = "org_id"
+	// TenantIDModeOrgName uses the name of the org, as returned by the tenant resolver, as tenant ID.
+	TenantIDModeOrgName TenantIDMode = "org_name"
+)
+
+// TenantResolver returns the Loki tenant ID of an org.
+type TenantResolver func(ctx context.Context, orgID int64) (string, error)
+
+// OrgNameTenantResolver returns a TenantResolver that uses the name of an org as its tenant ID.
+func OrgNameTenantResolver(sql db.DB) TenantResolver {
+	return func(ctx context.Context, orgID int64) (string, error) {
+		var name string
+		err := sql.WithDbSession(ctx, func(sess *db.Session) error {
+			exists, err := sess.Table("org").Where("id = ?", orgID).Cols("name").Get(&name)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("org %d does not exist", orgID)
+			}
+			return nil
+		})
+		return name, err
+	}
+}
+
+type orgIDContextKey struct{}
+
+// ContextWithOrgID returns a context for requests to Loki that are made on behalf of an org.
+// Unless the tenant ID mode is fixed, the org determines the tenant of the requests.
+func ContextWithOrgID(ctx context.Context, orgID int64) context.Context {
+	return context.WithValue(ctx, orgIDContextKey{}, orgID)
+}
+
+func orgIDFromContext(ctx context.Context) (int64, bool) {
+	orgID, ok := ctx.Value(orgIDContextKey{}).(int64)
+	return orgID, ok
+}
+
 func NewRequester() client.Requester {
 	return &http.Client{}
 }
 
+// NewLokiRequester returns a requester for the Loki instance of a config. If the config has TLS files, they are loaded
+// into the TLS configuration of its transport.
+func NewLokiRequester(cfg LokiConfig) (client.Requester, error) {
+	if cfg.TLSCertFile == "" && cfg.TLSCAFile == "" {
+		return NewRequester(), nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.TLSCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read loki CA certificate file %q: %w", cfg.TLSCAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in loki CA certificate file %q", cfg.TLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load loki client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
 // encoder serializes log streams to some byte format.
 type encoder interface {
 	// encode serializes a set of log streams to bytes.
@@ -40,6 +133,26 @@ type LokiConfig struct {
 	TenantID          string
 	ExternalLabels    map[string]string
 	Encoder           encoder
+	// NodeID identifies the Grafana instance that writes state history, it is recorded in every log line.
+	NodeID string
+	// ClusterName identifies the cluster of Grafana instances that writes state history, it is recorded in every log line.
+	ClusterName string
+	// Region is the region of the Grafana instance that writes state history, it is recorded in every log line.
+	Region string
+	// EncryptionKey is an AES-256 key. If set, log lines are encrypted before they are pushed to Loki,
+	// and decrypted when they are queried. Loki cannot filter encrypted log lines, so the log pipelines of
+	// queries are evaluated by the client and metric queries are rejected with ErrEncryptedQuery.
+	EncryptionKey []byte
+	// TenantIDMode determines the tenant of requests made on behalf of an org. Requests that are not, such as pings,
+	// use TenantID in every mode.
+	TenantIDMode TenantIDMode
+	// TenantResolver resolves the tenant ID of an org in TenantIDModeOrgName.
+	TenantResolver TenantResolver
+	// TLSCertFile and TLSKeyFile are the client certificate and key presented to Loki, for mutual TLS.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSCAFile is the CA certificate that the certificate of Loki is verified with, instead of the system CAs.
+	TLSCAFile string
 }
 
 func NewLokiConfig(cfg setting.UnifiedAlertingStateHistorySettings) (LokiConfig, error) {
@@ -58,6 +171,31 @@ func NewLokiConfig(cfg setting.UnifiedAlertingStateHistorySettings) (LokiConfig,
 		return LokiConfig{}, fmt.Errorf("either write path URL or remote Loki URL must be provided")
 	}
 
+	mode := TenantIDMode(cfg.LokiTenantIDMode)
+	switch mode {
+	case "":
+		mode = TenantIDModeFixed
+	case TenantIDModeFixed, TenantIDModeOrgID, TenantIDModeOrgName:
+	default:
+		return LokiConfig{}, fmt.Errorf("unknown loki tenant ID mode %q, must be one of %q, %q or %q", mode, TenantIDModeFixed, TenantIDModeOrgID, TenantIDModeOrgName)
+	}
+
+	if (cfg.LokiTLSCertFile == "") != (cfg.LokiTLSKeyFile == "") {
+		return LokiConfig{}, fmt.Errorf("both a client certificate and key file must be provided for TLS to loki")
+	}
+
+	var encryptionKey []byte
+	if cfg.LokiEncryptionKey != "" {
+		key, err := base64.StdEncoding.DecodeString(cfg.LokiEncryptionKey)
+		if err != nil {
+			return LokiConfig{}, fmt.Errorf("failed to decode loki encryption key: %w", err)
+		}
+		if len(key) != encryptionKeySize {
+			return LokiConfig{}, fmt.Errorf("loki encryption key must be %d bytes long, got %d", encryptionKeySize, len(key))
+		}
+		encryptionKey = key
+	}
+
 	readURL, err := url.Parse(read)
 	if err != nil {
 		return LokiConfig{}, fmt.Errorf("failed to parse loki remote read URL: %w", err)
@@ -73,7 +211,15 @@ func NewLokiConfig(cfg setting.UnifiedAlertingStateHistorySettings) (LokiConfig,
 		BasicAuthUser:     cfg.LokiBasicAuthUsername,
 		BasicAuthPassword: cfg.LokiBasicAuthPassword,
 		TenantID:          cfg.LokiTenantID,
+		TenantIDMode:      mode,
+		TLSCertFile:       cfg.LokiTLSCertFile,
+		TLSKeyFile:        cfg.LokiTLSKeyFile,
+		TLSCAFile:         cfg.LokiTLSCAFile,
 		ExternalLabels:    cfg.ExternalLabels,
+		NodeID:            cfg.NodeID,
+		ClusterName:       cfg.ClusterName,
+		Region:            cfg.Region,
+		EncryptionKey:     encryptionKey,
 		// Snappy-compressed protobuf is the default, same goes for Promtail.
 		Encoder: SnappyProtoEncoder{},
 	}, nil
@@ -112,13 +258,21 @@ func NewLokiClient(cfg LokiConfig, req client.Requester, metrics *metrics.Histor
 	}
 }
 
+// Ping checks that Loki can be reached by listing the labels of a short, recent time range.
 func (c *HttpLokiClient) Ping(ctx context.Context) error {
 	uri := c.cfg.ReadPathURL.JoinPath("/loki/api/v1/labels")
+	now := time.Now()
+	values := url.Values{}
+	values.Set("start", fmt.Sprintf("%d", now.Add(-pingRange).UnixNano()))
+	values.Set("end", fmt.Sprintf("%d", now.UnixNano()))
+	uri.RawQuery = values.Encode()
 	req, err := http.NewRequest(http.MethodGet, uri.String(), nil)
 	if err != nil {
 		return fmt.Errorf("error creating request: %w", err)
 	}
-	c.setAuthAndTenantHeaders(req)
+	if err := c.setAuthAndTenantHeaders(ctx, req); err != nil {
+		return err
+	}
 
 	req = req.WithContext(ctx)
 	res, err := c.client.Do(req)
@@ -133,6 +287,9 @@ func (c *HttpLokiClient) Ping(ctx context.Context) error {
 		return fmt.Errorf("error sending request: %w", err)
 	}
 
+	if res.StatusCode == http.StatusServiceUnavailable {
+		return fmt.Errorf("%w: ping request to loki endpoint returned status code %d", ErrLokiUnavailable, res.StatusCode)
+	}
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
 		return fmt.Errorf("ping request to loki endpoint returned a non-200 status code: %d", res.StatusCode)
 	}
@@ -174,6 +331,14 @@ func (r *Sample) UnmarshalJSON(b []byte) error {
 }
 
 func (c *HttpLokiClient) Push(ctx context.Context, s []Stream) error {
+	if len(c.cfg.EncryptionKey) > 0 {
+		var err error
+		s, err = encryptStreams(c.cfg.EncryptionKey, s)
+		if err != nil {
+			return err
+		}
+	}
+
 	enc, err := c.encoder.encode(s)
 	if err != nil {
 		return err
@@ -185,7 +350,9 @@ func (c *HttpLokiClient) Push(ctx context.Context, s []Stream) error {
 		return fmt.Errorf("failed to create Loki request: %w", err)
 	}
 
-	c.setAuthAndTenantHeaders(req)
+	if err := c.setAuthAndTenantHeaders(ctx, req); err != nil {
+		return err
+	}
 	for k, v := range c.encoder.headers() {
 		req.Header.Add(k, v)
 	}
@@ -216,17 +383,53 @@ func (c *HttpLokiClient) Push(ctx context.Context, s []Stream) error {
 	return nil
 }
 
-func (c *HttpLokiClient) setAuthAndTenantHeaders(req *http.Request) {
+func (c *HttpLokiClient) setAuthAndTenantHeaders(ctx context.Context, req *http.Request) error {
 	if c.cfg.BasicAuthUser != "" || c.cfg.BasicAuthPassword != "" {
 		req.SetBasicAuth(c.cfg.BasicAuthUser, c.cfg.BasicAuthPassword)
 	}
 
-	if c.cfg.TenantID != "" {
-		req.Header.Add("X-Scope-OrgID", c.cfg.TenantID)
+	tenantID, err := c.tenantID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to resolve loki tenant: %w", err)
+	}
+	if tenantID != "" {
+		req.Header.Add("X-Scope-OrgID", tenantID)
+	}
+	return nil
+}
+
+// tenantID returns the tenant of a request to Loki, depending on the tenant ID mode and the org of the request.
+func (c *HttpLokiClient) tenantID(ctx context.Context) (string, error) {
+	orgID, ok := orgIDFromContext(ctx)
+	if !ok {
+		return c.cfg.TenantID, nil
+	}
+
+	switch c.cfg.TenantIDMode {
+	case "", TenantIDModeFixed:
+		return c.cfg.TenantID, nil
+	case TenantIDModeOrgID:
+		return strconv.FormatInt(orgID, 10), nil
+	case TenantIDModeOrgName:
+		if c.cfg.TenantResolver == nil {
+			return "", errors.New("no tenant resolver is configured")
+		}
+		return c.cfg.TenantResolver(ctx, orgID)
+	default:
+		return "", fmt.Errorf("unknown tenant ID mode %q", c.cfg.TenantIDMode)
 	}
 }
 
 func (c *HttpLokiClient) RangeQuery(ctx context.Context, logQL string, start, end, limit int64) (QueryRes, error) {
+	return c.rangeQuery(ctx, logQL, start, end, limit, "")
+}
+
+// RangeQueryForward is like RangeQuery, but returns the oldest entries first, instead of the most recent ones.
+func (c *HttpLokiClient) RangeQueryForward(ctx context.Context, logQL string, start, end, limit int64) (QueryRes, error) {
+	return c.rangeQuery(ctx, logQL, start, end, limit, "forward")
+}
+
+func (c *HttpLokiClient) rangeQuery(ctx context.Context, logQL string, start, end, limit int64, direction string) (QueryRes, error) {
 	// Run the pre-flight checks for the query.
 	if start > end {
 		return QueryRes{}, fmt.Errorf("start time cannot be after end time")
@@ -238,28 +441,209 @@ func (c *HttpLokiClient) RangeQuery(ctx context.Context, logQL string, start, en
 		limit = maximumPageSize
 	}
 
-	queryURL := c.cfg.ReadPathURL.JoinPath("/loki/api/v1/query_range")
+	if len(c.cfg.EncryptionKey) > 0 {
+		selector, pipeline, err := splitLogQuery(logQL)
+		if err != nil {
+			return QueryRes{}, err
+		}
+		if len(pipeline) > 0 {
+			return c.filteredRangeQuery(ctx, selector, pipeline, start, end, limit, direction)
+		}
+	}
+
+	return c.doRangeQuery(ctx, logQL, start, end, limit, direction)
+}
+
+// filteredRangeQuery queries the entries of a stream selector page by page, and evaluates a log pipeline on the
+// decrypted log lines, until limit entries pass the pipeline or there are no more entries in the range.
+// The entries that pass are returned in the order of the direction, like Loki does.
+func (c *HttpLokiClient) filteredRangeQuery(ctx context.Context, selector string, pipeline logPipeline, start, end, limit int64, direction string) (QueryRes, error) {
+	type match struct {
+		labels map[string]string
+		sample Sample
+	}
+	var matches []match
+	seen := make(map[string]struct{})
+	for {
+		res, err := c.doRangeQuery(ctx, selector, start, end, maximumPageSize, direction)
+		if err != nil {
+			return QueryRes{}, err
+		}
+
+		entries, fresh := 0, 0
+		// boundary is the oldest timestamp of the page, or the most recent one when querying forward.
+		var boundary int64
+		for _, stream := range res.Data.Result {
+			fingerprint := LabelFingerprint(stream.Stream)
+			for _, sample := range stream.Values {
+				ts := sample.T.UnixNano()
+				if entries == 0 || direction == "" && ts < boundary || direction != "" && ts > boundary {
+					boundary = ts
+				}
+				entries++
+
+				// Pages overlap at their boundary, so that entries with the same timestamp are not skipped.
+				key := fingerprint + "/" + strconv.FormatInt(ts, 10) + "/" + sample.V
+				if _, ok := seen[key]; ok {
+					continue
+				}
+				seen[key] = struct{}{}
+				fresh++
+
+				if pipeline.matches(stream.Stream, sample.V) {
+					matches = append(matches, match{labels: stream.Stream, sample: sample})
+				}
+			}
+		}
+
+		if entries < maximumPageSize || int64(len(matches)) >= limit {
+			break
+		}
+		// A full page of entries that were all seen has a single timestamp, move past it.
+		overlap := int64(1)
+		if fresh == 0 {
+			overlap = 0
+		}
+		if direction == "" {
+			end = boundary + overlap
+		} else {
+			start = boundary + 1 - overlap
+		}
+	}
 
+	// Pages are queried in order, but the entries of a page are grouped by stream.
+	sort.SliceStable(matches, func(i, j int) bool {
+		if direction == "" {
+			return matches[i].sample.T.After(matches[j].sample.T)
+		}
+		return matches[i].sample.T.Before(matches[j].sample.T)
+	})
+	if int64(len(matches)) > limit {
+		matches = matches[:limit]
+	}
+
+	result := QueryRes{}
+	streams := make(map[string]int)
+	for _, m := range matches {
+		fingerprint := LabelFingerprint(m.labels)
+		i, ok := streams[fingerprint]
+		if !ok {
+			i = len(result.Data.Result)
+			streams[fingerprint] = i
+			result.Data.Result = append(result.Data.Result, Stream{Stream: m.labels})
+		}
+		result.Data.Result[i].Values = append(result.Data.Result[i].Values, m.sample)
+	}
+	return result, nil
+}
+
+// doRangeQuery runs a log query and decrypts the log lines of the result.
+func (c *HttpLokiClient) doRangeQuery(ctx context.Context, logQL string, start, end, limit int64, direction string) (QueryRes, error) {
 	values := url.Values{}
 	values.Set("query", logQL)
 	values.Set("start", fmt.Sprintf("%d", start))
 	values.Set("end", fmt.Sprintf("%d", end))
 	values.Set("limit", fmt.Sprintf("%d", limit))
+	// Loki returns the most recent entries first by default.
+	if direction != "" {
+		values.Set("direction", direction)
+	}
+
+	result := QueryRes{}
+	if err := c.queryRange(ctx, values, &result); err != nil {
+		return QueryRes{}, err
+	}
+
+	if err := decryptStreams(c.cfg.EncryptionKey, result.Data.Result); err != nil {
+		return QueryRes{}, err
+	}
+
+	return result, nil
+}
+
+// encryptStreams returns a copy of the streams with all log lines encrypted.
+func encryptStreams(key []byte, streams []Stream) ([]Stream, error) {
+	res := make([]Stream, 0, len(streams))
+	for _, stream := range streams {
+		values := make([]Sample, 0, len(stream.Values))
+		for _, sample := range stream.Values {
+			line, err := encryptLine(key, sample.V)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encrypt log line: %w", err)
+			}
+			values = append(values, Sample{T: sample.T, V: line})
+		}
+		res = append(res, Stream{Stream: stream.Stream, Values: values})
+	}
+	return res, nil
+}
+
+// decryptStreams decrypts the encrypted log lines of the streams in place. Lines that are not encrypted are left as is.
+func decryptStreams(key []byte, streams []Stream) error {
+	for _, stream := range streams {
+		for i, sample := range stream.Values {
+			if !isEncryptedLine(sample.V) {
+				continue
+			}
+			if len(key) == 0 {
+				return fmt.Errorf("log line is encrypted but no encryption key is configured")
+			}
+			line, err := decryptLine(key, sample.V)
+			if err != nil {
+				return err
+			}
+			stream.Values[i].V = line
+		}
+	}
+	return nil
+}
+
+// MetricsQuery runs a LogQL metric query over a range of time, evaluated at every step.
+// Timestamps are in nanoseconds.
+func (c *HttpLokiClient) MetricsQuery(ctx context.Context, logQL string, start, end int64, step time.Duration) (MetricQueryRes, error) {
+	if start > end {
+		return MetricQueryRes{}, fmt.Errorf("start time cannot be after end time")
+	}
+	if step <= 0 {
+		return MetricQueryRes{}, fmt.Errorf("step must be positive")
+	}
+	if len(c.cfg.EncryptionKey) > 0 {
+		return MetricQueryRes{}, fmt.Errorf("%w: metric queries cannot be run on encrypted log lines", ErrEncryptedQuery)
+	}
 
+	values := url.Values{}
+	values.Set("query", logQL)
+	values.Set("start", fmt.Sprintf("%d", start))
+	values.Set("end", fmt.Sprintf("%d", end))
+	values.Set("step", strconv.FormatFloat(step.Seconds(), 'f', -1, 64))
+
+	result := MetricQueryRes{}
+	if err := c.queryRange(ctx, values, &result); err != nil {
+		return MetricQueryRes{}, err
+	}
+
+	return result, nil
+}
+
+// queryRange sends a request to the range query endpoint and decodes the response into result.
+func (c *HttpLokiClient) queryRange(ctx context.Context, values url.Values, result any) error {
+	queryURL := c.cfg.ReadPathURL.JoinPath("/loki/api/v1/query_range")
 	queryURL.RawQuery = values.Encode()
 
 	req, err := http.NewRequest(http.MethodGet,
 		queryURL.String(), nil)
 	if err != nil {
-		return QueryRes{}, fmt.Errorf("error creating request: %w", err)
+		return fmt.Errorf("error creating request: %w", err)
 	}
 
 	req = req.WithContext(ctx)
-	c.setAuthAndTenantHeaders(req)
+	if err := c.setAuthAndTenantHeaders(ctx, req); err != nil {
+		return err
+	}
 
 	res, err := c.client.Do(req)
 	if err != nil {
-		return QueryRes{}, fmt.Errorf("error executing request: %w", err)
+		return fmt.Errorf("error executing request: %w", err)
 	}
 
 	defer func() {
@@ -268,7 +652,7 @@ func (c *HttpLokiClient) RangeQuery(ctx context.Context, logQL string, start, en
 
 	data, err := io.ReadAll(res.Body)
 	if err != nil {
-		return QueryRes{}, fmt.Errorf("error reading request response: %w", err)
+		return fmt.Errorf("error reading request response: %w", err)
 	}
 
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
@@ -277,17 +661,19 @@ func (c *HttpLokiClient) RangeQuery(ctx context.Context, logQL string, start, en
 		} else {
 			c.log.Error("Error response from Loki with an empty body", "status", res.StatusCode)
 		}
-		return QueryRes{}, fmt.Errorf("received a non-200 response from loki, status: %d", res.StatusCode)
+		if res.StatusCode == http.StatusServiceUnavailable {
+			return fmt.Errorf("%w: received status %d", ErrLokiUnavailable, res.StatusCode)
+		}
+		return fmt.Errorf("received a non-200 response from loki, status: %d", res.StatusCode)
 	}
 
-	result := QueryRes{}
-	err = json.Unmarshal(data, &result)
+	err = json.Unmarshal(data, result)
 	if err != nil {
 		fmt.Println(string(data))
-		return QueryRes{}, fmt.Errorf("error parsing request response: %w", err)
+		return fmt.Errorf("error parsing request response: %w", err)
 	}
 
-	return result, nil
+	return nil
 }
 
 type QueryRes struct {
@@ -297,3 +683,47 @@ type QueryRes struct {
 type QueryData struct {
 	Result []Stream `json:"result"`
 }
+
+type MetricQueryRes struct {
+	Data MetricQueryData `json:"data"`
+}
+
+type MetricQueryData struct {
+	Result []MetricSeries `json:"result"`
+}
+
+// MetricSeries is a series of a matrix, the result of a metric query over a range of time.
+type MetricSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values []MetricSample    `json:"values"`
+}
+
+type MetricSample struct {
+	T time.Time
+	V float64
+}
+
+func (r *MetricSample) UnmarshalJSON(b []byte) error {
+	// A Loki matrix sample is formatted like a list with two elements, [At, Val]
+	// At is a number, the timestamp in seconds since the unix epoch.
+	// Val is a string containing the sample value.
+	var tuple [2]json.RawMessage
+	if err := json.Unmarshal(b, &tuple); err != nil {
+		return fmt.Errorf("failed to deserialize sample in Loki response: %w", err)
+	}
+	var sec float64
+	if err := json.Unmarshal(tuple[0], &sec); err != nil {
+		return fmt.Errorf("timestamp in Loki sample not convertible to seconds: %s", tuple[0])
+	}
+	var val string
+	if err := json.Unmarshal(tuple[1], &val); err != nil {
+		return fmt.Errorf("value in Loki sample is not a string: %s", tuple[1])
+	}
+	v, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return fmt.Errorf("value in Loki sample not convertible to float: %v", val)
+	}
+	r.T = time.UnixMilli(int64(math.Round(sec * 1000)))
+	r.V = v
+	return nil
+}
@@ -3,11 +3,16 @@ package historian
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 
@@ -104,6 +109,157 @@ func TestLokiConfig(t *testing.T) {
 		require.NoError(t, err)
 		require.Contains(t, res.ExternalLabels, "a")
 	})
+
+	t.Run("captures node ID", func(t *testing.T) {
+		set := setting.UnifiedAlertingStateHistorySettings{
+			LokiRemoteURL: "http://url.com",
+			NodeID:        "node-1",
+		}
+
+		res, err := NewLokiConfig(set)
+
+		require.NoError(t, err)
+		require.Equal(t, "node-1", res.NodeID)
+	})
+
+	t.Run("captures cluster name", func(t *testing.T) {
+		set := setting.UnifiedAlertingStateHistorySettings{
+			LokiRemoteURL: "http://url.com",
+			ClusterName:   "cluster-1",
+		}
+
+		res, err := NewLokiConfig(set)
+
+		require.NoError(t, err)
+		require.Equal(t, "cluster-1", res.ClusterName)
+	})
+
+	t.Run("captures region", func(t *testing.T) {
+		set := setting.UnifiedAlertingStateHistorySettings{
+			LokiRemoteURL: "http://url.com",
+			Region:        "eu-west-1",
+		}
+
+		res, err := NewLokiConfig(set)
+
+		require.NoError(t, err)
+		require.Equal(t, "eu-west-1", res.Region)
+	})
+
+	t.Run("captures tenant ID mode", func(t *testing.T) {
+		set := setting.UnifiedAlertingStateHistorySettings{
+			LokiRemoteURL:    "http://url.com",
+			LokiTenantIDMode: "org_id",
+		}
+
+		res, err := NewLokiConfig(set)
+
+		require.NoError(t, err)
+		require.Equal(t, TenantIDModeOrgID, res.TenantIDMode)
+	})
+
+	t.Run("defaults to fixed tenant ID mode", func(t *testing.T) {
+		res, err := NewLokiConfig(setting.UnifiedAlertingStateHistorySettings{LokiRemoteURL: "http://url.com"})
+
+		require.NoError(t, err)
+		require.Equal(t, TenantIDModeFixed, res.TenantIDMode)
+	})
+
+	t.Run("rejects unknown tenant ID mode", func(t *testing.T) {
+		set := setting.UnifiedAlertingStateHistorySettings{
+			LokiRemoteURL:    "http://url.com",
+			LokiTenantIDMode: "org_uid",
+		}
+
+		_, err := NewLokiConfig(set)
+
+		require.ErrorContains(t, err, "unknown loki tenant ID mode")
+	})
+
+	t.Run("captures TLS files", func(t *testing.T) {
+		set := setting.UnifiedAlertingStateHistorySettings{
+			LokiRemoteURL:   "http://url.com",
+			LokiTLSCertFile: "client.crt",
+			LokiTLSKeyFile:  "client.key",
+			LokiTLSCAFile:   "ca.crt",
+		}
+
+		res, err := NewLokiConfig(set)
+
+		require.NoError(t, err)
+		require.Equal(t, "client.crt", res.TLSCertFile)
+		require.Equal(t, "client.key", res.TLSKeyFile)
+		require.Equal(t, "ca.crt", res.TLSCAFile)
+	})
+
+	t.Run("decodes encryption key", func(t *testing.T) {
+		key := bytes.Repeat([]byte{1}, encryptionKeySize)
+		set := setting.UnifiedAlertingStateHistorySettings{
+			LokiRemoteURL:     "http://url.com",
+			LokiEncryptionKey: base64.StdEncoding.EncodeToString(key),
+		}
+
+		res, err := NewLokiConfig(set)
+
+		require.NoError(t, err)
+		require.Equal(t, key, res.EncryptionKey)
+	})
+
+	t.Run("rejects invalid encryption keys", func(t *testing.T) {
+		for _, key := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+			set := setting.UnifiedAlertingStateHistorySettings{
+				LokiRemoteURL:     "http://url.com",
+				LokiEncryptionKey: key,
+			}
+
+			_, err := NewLokiConfig(set)
+
+			require.ErrorContains(t, err, "loki encryption key")
+		}
+	})
+
+	t.Run("rejects client certificate without key", func(t *testing.T) {
+		set := setting.UnifiedAlertingStateHistorySettings{
+			LokiRemoteURL:   "http://url.com",
+			LokiTLSCertFile: "client.crt",
+		}
+
+		_, err := NewLokiConfig(set)
+
+		require.ErrorContains(t, err, "both a client certificate and key file must be provided")
+	})
+}
+
+func TestNewLokiRequester(t *testing.T) {
+	t.Run("uses the default requester without TLS files", func(t *testing.T) {
+		req, err := NewLokiRequester(LokiConfig{})
+
+		require.NoError(t, err)
+		require.Equal(t, NewRequester(), req)
+	})
+
+	t.Run("fails if the CA file cannot be read", func(t *testing.T) {
+		_, err := NewLokiRequester(LokiConfig{TLSCAFile: filepath.Join(t.TempDir(), "missing.crt")})
+
+		require.ErrorContains(t, err, "failed to read loki CA certificate file")
+	})
+
+	t.Run("fails if the CA file has no certificates", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "ca.crt")
+		require.NoError(t, os.WriteFile(path, []byte("not a certificate"), 0o600))
+
+		_, err := NewLokiRequester(LokiConfig{TLSCAFile: path})
+
+		require.ErrorContains(t, err, "no certificates found")
+	})
+
+	t.Run("fails if the client certificate cannot be loaded", func(t *testing.T) {
+		dir := t.TempDir()
+
+		_, err := NewLokiRequester(LokiConfig{TLSCertFile: filepath.Join(dir, "client.crt"), TLSKeyFile: filepath.Join(dir, "client.key")})
+
+		require.ErrorContains(t, err, "failed to load loki client certificate")
+	})
 }
 
 func TestLokiHTTPClient(t *testing.T) {
@@ -132,6 +288,84 @@ func TestLokiHTTPClient(t *testing.T) {
 		require.JSONEq(t, exp, sent)
 	})
 
+	t.Run("encrypts pushed lines and decrypts queried lines", func(t *testing.T) {
+		req := NewFakeRequester()
+		client := createTestLokiClient(req)
+		client.cfg.EncryptionKey = bytes.Repeat([]byte{1}, encryptionKeySize)
+		now := time.Now().UTC()
+		data := []Stream{
+			{
+				Stream: map[string]string{},
+				Values: []Sample{{T: now, V: "some line"}},
+			},
+		}
+
+		err := client.Push(context.Background(), data)
+
+		require.NoError(t, err)
+		require.Equal(t, "some line", data[0].Values[0].V, "streams of the caller should not be modified")
+		sent := Stream{}
+		require.NoError(t, json.Unmarshal([]byte(reqBody(t, req.lastRequest)), &struct {
+			Streams []*Stream `json:"streams"`
+		}{Streams: []*Stream{&sent}}))
+		require.Len(t, sent.Values, 1)
+		line := sent.Values[0].V
+		require.True(t, isEncryptedLine(line))
+
+		req.resp = &http.Response{
+			Status:     "200 OK",
+			StatusCode: 200,
+			Body: io.NopCloser(bytes.NewBufferString(fmt.Sprintf(
+				`{"data":{"result":[{"stream":{},"values":[["%d",%q],["%d","plain line"]]}]}}`, now.UnixNano(), line, now.UnixNano()))),
+			ContentLength: int64(0),
+			Header:        make(http.Header, 0),
+		}
+		res, err := client.RangeQuery(context.Background(), `{from="state-history"}`, now.UnixNano()-1, now.UnixNano(), 10)
+
+		require.NoError(t, err)
+		require.Len(t, res.Data.Result, 1)
+		require.Equal(t, "some line", res.Data.Result[0].Values[0].V)
+		require.Equal(t, "plain line", res.Data.Result[0].Values[1].V)
+	})
+
+	t.Run("evaluates the log pipeline of queries on decrypted lines", func(t *testing.T) {
+		req := NewFakeRequester()
+		client := createTestLokiClient(req)
+		client.cfg.EncryptionKey = bytes.Repeat([]byte{1}, encryptionKeySize)
+		now := time.Now().UTC()
+		alerting, err := encryptLine(client.cfg.EncryptionKey, `{"current":"Alerting","ruleUID":"a"}`)
+		require.NoError(t, err)
+		normal, err := encryptLine(client.cfg.EncryptionKey, `{"current":"Normal","ruleUID":"a"}`)
+		require.NoError(t, err)
+		req.resp = &http.Response{
+			Status:     "200 OK",
+			StatusCode: 200,
+			Body: io.NopCloser(bytes.NewBufferString(fmt.Sprintf(
+				`{"data":{"result":[{"stream":{"from":"state-history"},"values":[["%d",%q],["%d",%q]]}]}}`, now.UnixNano(), normal, now.UnixNano()-1, alerting))),
+			ContentLength: int64(0),
+			Header:        make(http.Header, 0),
+		}
+
+		res, err := client.RangeQuery(context.Background(), `{from="state-history"} | json | current="Alerting" | ruleUID=~"a|b"`, now.UnixNano()-10, now.UnixNano(), 10)
+
+		require.NoError(t, err)
+		params := req.lastRequest.URL.Query()
+		require.Equal(t, `{from="state-history"}`, params.Get("query"), "loki cannot filter encrypted lines")
+		require.Equal(t, fmt.Sprint(maximumPageSize), params.Get("limit"))
+		require.Len(t, res.Data.Result, 1)
+		require.Len(t, res.Data.Result[0].Values, 1)
+		require.Equal(t, `{"current":"Alerting","ruleUID":"a"}`, res.Data.Result[0].Values[0].V)
+	})
+
+	t.Run("rejects unsupported pipelines of encrypted queries", func(t *testing.T) {
+		client := createTestLokiClient(NewFakeRequester())
+		client.cfg.EncryptionKey = bytes.Repeat([]byte{1}, encryptionKeySize)
+
+		_, err := client.RangeQuery(context.Background(), `{from="state-history"} | json | line_format "{{.current}}"`, 0, 1, 10)
+
+		require.ErrorIs(t, err, ErrEncryptedQuery)
+	})
+
 	t.Run("range query", func(t *testing.T) {
 		t.Run("passes along page size", func(t *testing.T) {
 			req := NewFakeRequester().WithResponse(&http.Response{
@@ -216,6 +450,223 @@ func TestLokiHTTPClient(t *testing.T) {
 }
 
 // This function can be used for local testing, just remove the skip call.
+func TestLokiHTTPClientRangeQueryForward(t *testing.T) {
+	req := NewFakeRequester().WithResponse(&http.Response{
+		Status:        "200 OK",
+		StatusCode:    200,
+		Body:          io.NopCloser(bytes.NewBufferString(`{}`)),
+		ContentLength: int64(0),
+		Header:        make(http.Header, 0),
+	})
+	client := createTestLokiClient(req)
+
+	_, err := client.RangeQueryForward(context.Background(), `{from="state-history"}`, 0, 100, 1)
+
+	require.NoError(t, err)
+	params := req.lastRequest.URL.Query()
+	require.Equal(t, "forward", params.Get("direction"))
+	require.Equal(t, "1", params.Get("limit"))
+}
+
+func TestLokiHTTPClientRangeQueryErrors(t *testing.T) {
+	t.Run("returns ErrLokiUnavailable on 503", func(t *testing.T) {
+		req := NewFakeRequester().WithResponse(&http.Response{
+			Status:        "503 Service Unavailable",
+			StatusCode:    http.StatusServiceUnavailable,
+			Body:          io.NopCloser(bytes.NewBufferString("")),
+			ContentLength: int64(0),
+			Header:        make(http.Header, 0),
+		})
+		client := createTestLokiClient(req)
+
+		_, err := client.RangeQuery(context.Background(), `{from="state-history"}`, 0, 100, 1)
+
+		require.ErrorIs(t, err, ErrLokiUnavailable)
+	})
+
+	t.Run("fails on other errors", func(t *testing.T) {
+		req := NewFakeRequester().WithResponse(badResponse()) //nolint:bodyclose
+		client := createTestLokiClient(req)
+
+		_, err := client.RangeQuery(context.Background(), `{from="state-history"}`, 0, 100, 1)
+
+		require.Error(t, err)
+		require.NotErrorIs(t, err, ErrLokiUnavailable)
+	})
+}
+
+func TestLokiHTTPClientTenantIDMode(t *testing.T) {
+	createClient := func(req client.Requester, mode TenantIDMode, resolver TenantResolver) *HttpLokiClient {
+		client := createTestLokiClient(req)
+		client.cfg.TenantID = "fixed-tenant"
+		client.cfg.TenantIDMode = mode
+		client.cfg.TenantResolver = resolver
+		return client
+	}
+	resolver := func(_ context.Context, orgID int64) (string, error) {
+		return fmt.Sprintf("org-name-%d", orgID), nil
+	}
+
+	cases := []struct {
+		mode     TenantIDMode
+		expected string
+	}{
+		{mode: TenantIDModeFixed, expected: "fixed-tenant"},
+		{mode: TenantIDModeOrgID, expected: "2"},
+		{mode: TenantIDModeOrgName, expected: "org-name-2"},
+	}
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("%s sets the tenant of the org", tc.mode), func(t *testing.T) {
+			req := NewFakeRequester()
+			client := createClient(req, tc.mode, resolver)
+
+			err := client.Push(ContextWithOrgID(context.Background(), 2), []Stream{})
+
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, req.lastRequest.Header.Get("X-Scope-OrgID"))
+		})
+	}
+
+	t.Run("uses the fixed tenant without an org", func(t *testing.T) {
+		req := NewFakeRequester()
+		client := createClient(req, TenantIDModeOrgID, resolver)
+
+		err := client.Push(context.Background(), []Stream{})
+
+		require.NoError(t, err)
+		require.Equal(t, "fixed-tenant", req.lastRequest.Header.Get("X-Scope-OrgID"))
+	})
+
+	t.Run("fails without a tenant resolver", func(t *testing.T) {
+		req := NewFakeRequester()
+		client := createClient(req, TenantIDModeOrgName, nil)
+
+		err := client.Push(ContextWithOrgID(context.Background(), 2), []Stream{})
+
+		require.ErrorContains(t, err, "no tenant resolver is configured")
+		require.Nil(t, req.lastRequest)
+	})
+
+	t.Run("fails if the tenant cannot be resolved", func(t *testing.T) {
+		req := NewFakeRequester()
+		client := createClient(req, TenantIDModeOrgName, func(context.Context, int64) (string, error) {
+			return "", errors.New("boom")
+		})
+
+		_, err := client.RangeQuery(ContextWithOrgID(context.Background(), 2), `{from="state-history"}`, 0, 100, 1)
+
+		require.ErrorContains(t, err, "boom")
+		require.Nil(t, req.lastRequest)
+	})
+}
+
+func TestLokiHTTPClientPing(t *testing.T) {
+	t.Run("succeeds on 200", func(t *testing.T) {
+		req := NewFakeRequester()
+		client := createTestLokiClient(req)
+
+		err := client.Ping(context.Background())
+
+		require.NoError(t, err)
+		require.Equal(t, "/loki/api/v1/labels", req.lastRequest.URL.Path)
+		params := req.lastRequest.URL.Query()
+		start, err := strconv.ParseInt(params.Get("start"), 10, 64)
+		require.NoError(t, err)
+		end, err := strconv.ParseInt(params.Get("end"), 10, 64)
+		require.NoError(t, err)
+		require.Equal(t, pingRange.Nanoseconds(), end-start)
+		require.Empty(t, params.Get("query"))
+	})
+
+	t.Run("returns ErrLokiUnavailable on 503", func(t *testing.T) {
+		req := NewFakeRequester().WithResponse(&http.Response{
+			Status:        "503 Service Unavailable",
+			StatusCode:    http.StatusServiceUnavailable,
+			Body:          io.NopCloser(bytes.NewBufferString("")),
+			ContentLength: int64(0),
+			Header:        make(http.Header, 0),
+		})
+		client := createTestLokiClient(req)
+
+		err := client.Ping(context.Background())
+
+		require.ErrorIs(t, err, ErrLokiUnavailable)
+	})
+
+	t.Run("fails on other errors", func(t *testing.T) {
+		req := NewFakeRequester().WithResponse(badResponse()) //nolint:bodyclose
+		client := createTestLokiClient(req)
+
+		err := client.Ping(context.Background())
+
+		require.Error(t, err)
+		require.NotErrorIs(t, err, ErrLokiUnavailable)
+	})
+}
+
+func TestLokiHTTPClientMetricsQuery(t *testing.T) {
+	t.Run("passes along step", func(t *testing.T) {
+		req := NewFakeRequester().WithResponse(&http.Response{
+			Status:        "200 OK",
+			StatusCode:    200,
+			Body:          io.NopCloser(bytes.NewBufferString(`{}`)),
+			ContentLength: int64(0),
+			Header:        make(http.Header, 0),
+		})
+		client := createTestLokiClient(req)
+		now := time.Now().UTC().UnixNano()
+		q := `count_over_time({from="state-history"}[1m])`
+
+		_, err := client.MetricsQuery(context.Background(), q, now-100, now, time.Minute)
+
+		require.NoError(t, err)
+		params := req.lastRequest.URL.Query()
+		require.Equal(t, q, params.Get("query"))
+		require.Equal(t, "60", params.Get("step"))
+	})
+
+	t.Run("parses matrix result", func(t *testing.T) {
+		req := NewFakeRequester().WithResponse(&http.Response{
+			Status:     "200 OK",
+			StatusCode: 200,
+			Body: io.NopCloser(bytes.NewBufferString(`{"data":{"resultType":"matrix","result":[` +
+				`{"metric":{"current":"Alerting"},"values":[[1700000000,"2"],[1700000060.5,"3"]]}]}}`)),
+			ContentLength: int64(0),
+			Header:        make(http.Header, 0),
+		})
+		client := createTestLokiClient(req)
+
+		res, err := client.MetricsQuery(context.Background(), `{from="state-history"}`, 0, 1, time.Minute)
+
+		require.NoError(t, err)
+		require.Len(t, res.Data.Result, 1)
+		series := res.Data.Result[0]
+		require.Equal(t, map[string]string{"current": "Alerting"}, series.Metric)
+		require.Len(t, series.Values, 2)
+		require.Equal(t, time.UnixMilli(1700000000000), series.Values[0].T)
+		require.Equal(t, 2.0, series.Values[0].V)
+		require.Equal(t, time.UnixMilli(1700000060500), series.Values[1].T)
+		require.Equal(t, 3.0, series.Values[1].V)
+	})
+
+	t.Run("rejects metric queries on encrypted lines", func(t *testing.T) {
+		client := createTestLokiClient(NewFakeRequester())
+		client.cfg.EncryptionKey = bytes.Repeat([]byte{1}, encryptionKeySize)
+
+		_, err := client.MetricsQuery(context.Background(), `count_over_time({from="state-history"}[1m])`, 0, 1, time.Minute)
+
+		require.ErrorIs(t, err, ErrEncryptedQuery)
+	})
+
+	t.Run("rejects invalid step", func(t *testing.T) {
+		client := createTestLokiClient(NewFakeRequester())
+
+		_, err := client.MetricsQuery(context.Background(), `{from="state-history"}`, 0, 1, 0)
+
+		require.Error(t, err)
+	})
+}
+
 func TestLokiHTTPClient_Manual(t *testing.T) {
 	t.Skip()
 
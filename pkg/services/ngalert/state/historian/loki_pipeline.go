@@ -0,0 +1,326 @@
+package historian
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrEncryptedQuery is returned for queries that cannot be run on encrypted log lines: metric queries,
+// and log queries with pipeline stages that the client does not evaluate.
+var ErrEncryptedQuery = errors.New("query is not supported on encrypted state history")
+
+// Loki cannot filter log lines that are encrypted, so when an encryption key is configured the client only sends the
+// stream selector of a log query to Loki, and evaluates its log pipeline on the decrypted log lines itself.
+// Only the stages that state history queries are built with are supported: line filters, the json parser without
+// parameters and label filters that compare a label to a string or a number.
+
+type logPipelineStage interface {
+	// apply reports whether the log line passes the stage. Stages can add labels.
+	apply(line string, labels map[string]string) bool
+}
+
+type logPipeline []logPipelineStage
+
+// matches reports whether a log line of a stream passes all stages of the pipeline.
+func (p logPipeline) matches(stream map[string]string, line string) bool {
+	labels := make(map[string]string, len(stream))
+	for k, v := range stream {
+		labels[k] = v
+	}
+	for _, stage := range p {
+		if !stage.apply(line, labels) {
+			return false
+		}
+	}
+	return true
+}
+
+type lineFilterStage struct {
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+func (s lineFilterStage) apply(line string, _ map[string]string) bool {
+	switch s.op {
+	case "|=":
+		return strings.Contains(line, s.value)
+	case "!=":
+		return !strings.Contains(line, s.value)
+	case "|~":
+		return s.re.MatchString(line)
+	default:
+		return !s.re.MatchString(line)
+	}
+}
+
+// jsonStage extracts the fields of a JSON log line as labels, like the json parser of Loki: nested objects are
+// flattened by joining their keys with underscores, arrays are skipped, and fields that conflict with stream labels
+// get an _extracted suffix.
+type jsonStage struct{}
+
+func (jsonStage) apply(line string, labels map[string]string) bool {
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.UseNumber()
+	var fields map[string]any
+	if err := dec.Decode(&fields); err != nil {
+		// Loki keeps lines that cannot be parsed, label filters decide whether they match.
+		return true
+	}
+	stream := make(map[string]struct{}, len(labels))
+	for k := range labels {
+		stream[k] = struct{}{}
+	}
+	extractJSONFields("", fields, labels, stream)
+	return true
+}
+
+func extractJSONFields(prefix string, fields map[string]any, labels map[string]string, stream map[string]struct{}) {
+	for k, v := range fields {
+		name := prefix + sanitizeLabelName(k)
+		var value string
+		switch v := v.(type) {
+		case map[string]any:
+			extractJSONFields(name+"_", v, labels, stream)
+			continue
+		case []any:
+			continue
+		case string:
+			value = v
+		case json.Number:
+			value = v.String()
+		case bool:
+			value = strconv.FormatBool(v)
+		case nil:
+			value = ""
+		}
+		if _, ok := stream[name]; ok {
+			name += "_extracted"
+		}
+		labels[name] = value
+	}
+}
+
+// sanitizeLabelName replaces the characters that are not allowed in label names with underscores.
+func sanitizeLabelName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+type labelFilterStage struct {
+	name   string
+	op     string
+	value  string
+	re     *regexp.Regexp
+	number float64
+	// numeric is set when the label is compared to a number rather than a string.
+	numeric bool
+}
+
+func (s labelFilterStage) apply(_ string, labels map[string]string) bool {
+	value := labels[s.name]
+	if !s.numeric {
+		switch s.op {
+		case "=":
+			return value == s.value
+		case "!=":
+			return value != s.value
+		case "=~":
+			return s.re.MatchString(value)
+		default:
+			return !s.re.MatchString(value)
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return false
+	}
+	switch s.op {
+	case "=", "==":
+		return n == s.number
+	case "!=":
+		return n != s.number
+	case ">":
+		return n > s.number
+	case ">=":
+		return n >= s.number
+	case "<":
+		return n < s.number
+	default:
+		return n <= s.number
+	}
+}
+
+// splitLogQuery splits a LogQL log query into its stream selector and its log pipeline.
+func splitLogQuery(logQL string) (string, logPipeline, error) {
+	logQL = strings.TrimSpace(logQL)
+	if !strings.HasPrefix(logQL, "{") {
+		return "", nil, fmt.Errorf("%w: only log queries can be run", ErrEncryptedQuery)
+	}
+	end, err := skipLogQLSelector(logQL)
+	if err != nil {
+		return "", nil, err
+	}
+	pipeline, err := parseClientPipeline(logQL[end:])
+	if err != nil {
+		return "", nil, err
+	}
+	return logQL[:end], pipeline, nil
+}
+
+// skipLogQLSelector returns the position right after the stream selector that a query starts with.
+func skipLogQLSelector(logQL string) (int, error) {
+	for i := 1; i < len(logQL); i++ {
+		switch logQL[i] {
+		case '"', '`':
+			end, err := skipLogQLString(logQL, i)
+			if err != nil {
+				return 0, err
+			}
+			i = end - 1
+		case '}':
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated stream selector in query %q", logQL)
+}
+
+// skipLogQLString returns the position right after the string that starts at position i.
+func skipLogQLString(s string, i int) (int, error) {
+	quote := s[i]
+	for end := i + 1; end < len(s); end++ {
+		if quote == '"' && s[end] == '\\' {
+			end++
+			continue
+		}
+		if s[end] == quote {
+			return end + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated string at position %d", i)
+}
+
+// logQLPipelineOperators are the operators of the supported pipeline stages, longest first.
+var logQLPipelineOperators = []string{"|=", "|~", "!=", "!~", "==", "=~", ">=", "<=", "|", "=", ">", "<"}
+
+// parseClientPipeline parses a log pipeline into stages that the client evaluates.
+func parseClientPipeline(s string) (logPipeline, error) {
+	var pipeline logPipeline
+	rest := strings.TrimSpace(s)
+	for rest != "" {
+		op := logQLPipelineOperator(rest)
+		rest = strings.TrimSpace(rest[len(op):])
+		switch op {
+		case "|=", "!=", "|~", "!~":
+			value, next, err := parseLogQLString(rest)
+			if err != nil {
+				return nil, err
+			}
+			stage := lineFilterStage{op: op, value: value}
+			if op == "|~" || op == "!~" {
+				if stage.re, err = regexp.Compile(value); err != nil {
+					return nil, fmt.Errorf("invalid line filter regex %q: %w", value, err)
+				}
+			}
+			pipeline = append(pipeline, stage)
+			rest = next
+		case "|":
+			name, next := parseLogQLIdent(rest)
+			if name == "" {
+				return nil, fmt.Errorf("%w: unsupported pipeline stage %q", ErrEncryptedQuery, rest)
+			}
+			next = strings.TrimSpace(next)
+			if name == "json" && (next == "" || strings.HasPrefix(next, "|") || strings.HasPrefix(next, "!")) {
+				pipeline = append(pipeline, jsonStage{})
+				rest = next
+				continue
+			}
+			stage, next, err := parseLabelFilter(name, next)
+			if err != nil {
+				return nil, err
+			}
+			pipeline = append(pipeline, stage)
+			rest = next
+		default:
+			return nil, fmt.Errorf("%w: unsupported pipeline stage %q", ErrEncryptedQuery, rest)
+		}
+	}
+	return pipeline, nil
+}
+
+func parseLabelFilter(name, s string) (labelFilterStage, string, error) {
+	op := logQLPipelineOperator(s)
+	rest := strings.TrimSpace(s[len(op):])
+	stage := labelFilterStage{name: name, op: op}
+	switch {
+	case rest != "" && (rest[0] == '"' || rest[0] == '`') && (op == "=" || op == "!=" || op == "=~" || op == "!~"):
+		value, next, err := parseLogQLString(rest)
+		if err != nil {
+			return labelFilterStage{}, "", err
+		}
+		stage.value = value
+		if op == "=~" || op == "!~" {
+			// Label filters match the whole value, unlike line filters.
+			if stage.re, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+				return labelFilterStage{}, "", fmt.Errorf("invalid label filter regex %q: %w", value, err)
+			}
+		}
+		return stage, next, nil
+	case op == "=" || op == "==" || op == "!=" || op == ">" || op == ">=" || op == "<" || op == "<=":
+		end := strings.IndexAny(rest, " |")
+		if end < 0 {
+			end = len(rest)
+		}
+		n, err := strconv.ParseFloat(rest[:end], 64)
+		if err != nil {
+			return labelFilterStage{}, "", fmt.Errorf("%w: unsupported label filter value %q", ErrEncryptedQuery, rest[:end])
+		}
+		stage.number, stage.numeric = n, true
+		return stage, strings.TrimSpace(rest[end:]), nil
+	}
+	return labelFilterStage{}, "", fmt.Errorf("%w: unsupported label filter on %q", ErrEncryptedQuery, name)
+}
+
+func logQLPipelineOperator(s string) string {
+	for _, op := range logQLPipelineOperators {
+		if strings.HasPrefix(s, op) {
+			return op
+		}
+	}
+	return ""
+}
+
+func parseLogQLIdent(s string) (string, string) {
+	end := 0
+	for end < len(s) && (s[end] == '_' || s[end] >= 'a' && s[end] <= 'z' || s[end] >= 'A' && s[end] <= 'Z' || end > 0 && s[end] >= '0' && s[end] <= '9') {
+		end++
+	}
+	return s[:end], s[end:]
+}
+
+// parseLogQLString parses the string that s starts with, and returns its value and what follows it.
+func parseLogQLString(s string) (string, string, error) {
+	if s == "" || s[0] != '"' && s[0] != '`' {
+		return "", "", fmt.Errorf("%w: expected a string in %q", ErrEncryptedQuery, s)
+	}
+	end, err := skipLogQLString(s, 0)
+	if err != nil {
+		return "", "", err
+	}
+	value := s[1 : end-1]
+	if s[0] == '"' {
+		if value, err = strconv.Unquote(s[:end]); err != nil {
+			return "", "", fmt.Errorf("invalid string %s: %w", s[:end], err)
+		}
+	}
+	return value, strings.TrimSpace(s[end:]), nil
+}
@@ -0,0 +1,63 @@
+package historian
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitLogQuery(t *testing.T) {
+	stream := map[string]string{"from": "state-history", "orgID": "1"}
+	line := `{"current":"Alerting","previous":"Normal","ruleUID":"abc","panelID":3,"labels":{"team":"a-team"},"values":[1],"orgID":2}`
+
+	cases := []struct {
+		name    string
+		query   string
+		matches bool
+	}{
+		{name: "selector only", query: `{from="state-history"}`, matches: true},
+		{name: "selector with braces in a value", query: `{from="state-history", folderUID=~"a}b"}`, matches: true},
+		{name: "line filter", query: `{from="state-history"} |= "abc"`, matches: true},
+		{name: "negated line filter", query: `{from="state-history"} != "abc"`, matches: false},
+		{name: "regex line filter", query: "{from=\"state-history\"} |~ `rule.*abc`", matches: true},
+		{name: "string label filter", query: `{from="state-history"} | json | current="Alerting" | previous!="Alerting"`, matches: true},
+		{name: "label filter on a mismatching value", query: `{from="state-history"} | json | current="Normal"`, matches: false},
+		{name: "anchored regex label filter", query: `{from="state-history"} | json | current=~"Alert"`, matches: false},
+		{name: "regex label filter", query: `{from="state-history"} | json | current=~"Alert.*" | ruleUID!~"def|ghi"`, matches: true},
+		{name: "nested field", query: `{from="state-history"} | json | labels_team="a-team"`, matches: true},
+		{name: "missing field", query: `{from="state-history"} | json | type=""`, matches: true},
+		{name: "conflicting field", query: `{from="state-history"} | json | orgID="1" | orgID_extracted="2"`, matches: true},
+		{name: "numeric label filter", query: `{from="state-history"} | json | panelID=3 | panelID>2`, matches: true},
+		{name: "numeric label filter on a mismatching value", query: `{from="state-history"} | json | panelID>=4`, matches: false},
+		{name: "label filter before json", query: `{from="state-history"} | current="Alerting" | json`, matches: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, pipeline, err := splitLogQuery(tc.query)
+
+			require.NoError(t, err)
+			require.Equal(t, tc.matches, pipeline.matches(stream, line))
+		})
+	}
+
+	t.Run("returns the stream selector", func(t *testing.T) {
+		selector, _, err := splitLogQuery(`{from="state-history", folderUID=~"a}b"} | json | current="Alerting"`)
+
+		require.NoError(t, err)
+		require.Equal(t, `{from="state-history", folderUID=~"a}b"}`, selector)
+	})
+
+	t.Run("rejects unsupported queries", func(t *testing.T) {
+		for _, query := range []string{
+			`count_over_time({from="state-history"}[1m])`,
+			`{from="state-history"} | json current="currentState"`,
+			`{from="state-history"} | logfmt | current="Alerting"`,
+			`{from="state-history"} | json | current="Alerting" or current="Normal"`,
+			`{from="state-history"} | json | duration > 1m`,
+		} {
+			_, _, err := splitLogQuery(query)
+
+			require.ErrorIs(t, err, ErrEncryptedQuery, query)
+		}
+	})
+}
@@ -19,6 +19,8 @@ import (
 	"github.com/grafana/grafana/pkg/services/ngalert/models"
 	"github.com/grafana/grafana/pkg/services/ngalert/state"
 	history_model "github.com/grafana/grafana/pkg/services/ngalert/state/historian/model"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/util/errutil"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
@@ -45,6 +47,20 @@ func TestRemoteLokiBackend(t *testing.T) {
 
 			entry := requireSingleEntry(t, res)
 			require.Contains(t, entry.Error, "oh no")
+			require.Empty(t, entry.ErrorType)
+		})
+
+		t.Run("captures type of grafana errors", func(t *testing.T) {
+			rule := createTestRule()
+			l := log.NewNopLogger()
+			err := fmt.Errorf("failed to evaluate: %w", errutil.BadRequest("sse.dataQueryError").Errorf("oh no"))
+			states := singleFromNormal(&state.State{State: eval.Error, Error: err})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Contains(t, entry.Error, "oh no")
+			require.Equal(t, "sse.dataQueryError", entry.ErrorType)
 		})
 
 		t.Run("maps NoData results", func(t *testing.T) {
@@ -171,6 +187,524 @@ func TestRemoteLokiBackend(t *testing.T) {
 			require.Equal(t, rule.Condition, entry.Condition)
 		})
 
+		t.Run("captures team from rule", func(t *testing.T) {
+			rule := createTestRule()
+			rule.Team = "platform"
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "platform", entry.Team)
+		})
+
+		t.Run("captures application from rule", func(t *testing.T) {
+			rule := createTestRule()
+			rule.Application = "checkout"
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "checkout", entry.Application)
+		})
+
+		t.Run("captures tenant from rule", func(t *testing.T) {
+			rule := createTestRule()
+			rule.TenantID = "tenant-a"
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "tenant-a", entry.TenantID)
+		})
+
+		t.Run("captures reconciliation from rule", func(t *testing.T) {
+			rule := createTestRule()
+			rule.ReconciliationID = "run-1"
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "run-1", entry.ReconciliationID)
+		})
+
+		t.Run("captures incident from rule", func(t *testing.T) {
+			rule := createTestRule()
+			rule.IncidentID = "INC-1"
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "INC-1", entry.IncidentID)
+		})
+
+		t.Run("captures service from rule", func(t *testing.T) {
+			rule := createTestRule()
+			rule.ServiceName = "checkout"
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b", "service": "search"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "checkout", entry.ServiceName)
+		})
+
+		t.Run("captures service from instance labels", func(t *testing.T) {
+			rule := createTestRule()
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b", "service": "search"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "search", entry.ServiceName)
+		})
+
+		t.Run("captures priority from rule", func(t *testing.T) {
+			rule := createTestRule()
+			rule.Priority = "P0"
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "P0", entry.Priority)
+		})
+
+		t.Run("captures kubernetes namespace from rule", func(t *testing.T) {
+			rule := createTestRule()
+			rule.K8sNamespace = "monitoring"
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b", "namespace": "default"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "monitoring", entry.K8sNamespace)
+		})
+
+		t.Run("captures kubernetes namespace from instance labels", func(t *testing.T) {
+			rule := createTestRule()
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b", "namespace": "default"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "default", entry.K8sNamespace)
+		})
+
+		t.Run("captures deployment from instance labels", func(t *testing.T) {
+			rule := createTestRule()
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b", DeploymentIDLabel: "deploy-1"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "deploy-1", entry.DeploymentID)
+		})
+
+		t.Run("captures feature flag from rule", func(t *testing.T) {
+			rule := createTestRule()
+			rule.FeatureFlag = "newCheckout"
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "newCheckout", entry.FeatureFlag)
+		})
+
+		t.Run("captures runbook URL from rule", func(t *testing.T) {
+			rule := createTestRule()
+			rule.RunbookURL = "https://runbooks.example.com/db"
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "https://runbooks.example.com/db", entry.RunbookURL)
+		})
+
+		t.Run("captures on-call policy from rule", func(t *testing.T) {
+			rule := createTestRule()
+			rule.OnCallPolicy = "primary-sre"
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "primary-sre", entry.OnCallPolicy)
+		})
+
+		t.Run("captures maintenance window from instance labels", func(t *testing.T) {
+			rule := createTestRule()
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b", MaintenanceWindowLabel: "window-1"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "window-1", entry.MaintenanceWindowID)
+		})
+
+		t.Run("captures recording rule from rule", func(t *testing.T) {
+			rule := createTestRule()
+			rule.RecordingRuleUID = "my-recording-rule"
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, rule.RecordingRuleUID, entry.RecordingRuleUID)
+		})
+
+		t.Run("captures policy route from rule", func(t *testing.T) {
+			rule := createTestRule()
+			rule.PolicyRoute = "abcdef"
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, rule.PolicyRoute, entry.PolicyRoute)
+		})
+
+		t.Run("captures evaluation interval from rule", func(t *testing.T) {
+			rule := createTestRule()
+			rule.EvaluationInterval = 90 * time.Second
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, int64(90000), entry.EvaluationIntervalMs)
+		})
+
+		t.Run("captures pending period from rule", func(t *testing.T) {
+			rule := createTestRule()
+			rule.PendingPeriod = 5 * time.Minute
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, int64(300000), entry.PendingDurationMs)
+		})
+
+		t.Run("captures rule version", func(t *testing.T) {
+			rule := createTestRule()
+			rule.Version = 7
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, int64(7), entry.RuleVersion)
+		})
+
+		t.Run("captures custom fields from rule", func(t *testing.T) {
+			rule := createTestRule()
+			rule.CustomFields = map[string]string{"team": "platform"}
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, map[string]string{"team": "platform"}, entry.CustomFields)
+		})
+
+		t.Run("captures node ID", func(t *testing.T) {
+			rule := createTestRule()
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStreamWithNodeID(rule, states, nil, "node-1", l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "node-1", entry.NodeID)
+
+			res = StatesToStream(rule, states, nil, l)
+
+			entry = requireSingleEntry(t, res)
+			require.Empty(t, entry.NodeID)
+		})
+
+		t.Run("captures group key of instance", func(t *testing.T) {
+			rule := createTestRule()
+			rule.GroupBy = []string{"alertname", "grafana_folder", "team"}
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"alertname": "a", "grafana_folder": "f", "instance": "i", "__private__": "p"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, `{alertname="a", grafana_folder="f"}`, entry.GroupKey)
+		})
+
+		t.Run("captures group key of instance grouped by all labels", func(t *testing.T) {
+			rule := createTestRule()
+			rule.GroupBy = []string{"..."}
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"alertname": "a", "instance": "i", "__private__": "p"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, `{alertname="a", instance="i"}`, entry.GroupKey)
+		})
+
+		t.Run("has no group key without group by", func(t *testing.T) {
+			rule := createTestRule()
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"alertname": "a"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Empty(t, entry.GroupKey)
+		})
+
+		t.Run("captures source of resolutions", func(t *testing.T) {
+			testCases := []struct {
+				name     string
+				previous eval.State
+				current  eval.State
+				reason   string
+				expected string
+			}{
+				{name: "condition no longer holds", previous: eval.Alerting, current: eval.Normal, expected: ResolutionSourceAuto},
+				{name: "series missing", previous: eval.Alerting, current: eval.Normal, reason: models.StateReasonMissingSeries, expected: ResolutionSourceAuto},
+				{name: "rule paused", previous: eval.Alerting, current: eval.Normal, reason: models.StateReasonPaused, expected: ResolutionSourceManual},
+				{name: "rule updated", previous: eval.Alerting, current: eval.Normal, reason: models.StateReasonUpdated, expected: ResolutionSourceManual},
+				{name: "rule deleted", previous: eval.Alerting, current: eval.Normal, reason: models.StateReasonRuleDeleted, expected: ResolutionSourceManual},
+				{name: "not firing before", previous: eval.Pending, current: eval.Normal, expected: ""},
+				{name: "still firing", previous: eval.Normal, current: eval.Alerting, expected: ""},
+			}
+			for _, tc := range testCases {
+				t.Run(tc.name, func(t *testing.T) {
+					rule := createTestRule()
+					l := log.NewNopLogger()
+					states := []state.StateTransition{{
+						PreviousState: tc.previous,
+						State: &state.State{
+							State:       tc.current,
+							StateReason: tc.reason,
+							Labels:      data.Labels{"a": "b"},
+						},
+					}}
+
+					res := StatesToStream(rule, states, nil, l)
+
+					entry := requireSingleEntry(t, res)
+					require.Equal(t, tc.expected, entry.ResolutionSource)
+				})
+			}
+		})
+
+		t.Run("captures cluster from rule", func(t *testing.T) {
+			rule := createTestRule()
+			rule.ClusterID = "cluster-1"
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "cluster-1", entry.ClusterID)
+		})
+
+		t.Run("captures region from rule", func(t *testing.T) {
+			rule := createTestRule()
+			rule.Region = "eu-west-1"
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "eu-west-1", entry.Region)
+		})
+
+		t.Run("captures data sources from rule", func(t *testing.T) {
+			rule := createTestRule()
+			rule.DatasourceUIDs = []string{"loki", "prometheus"}
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "loki,prometheus", entry.DatasourceUIDs)
+		})
+
+		t.Run("captures tags from rule", func(t *testing.T) {
+			rule := createTestRule()
+			rule.Tags = []string{"db", "critical"}
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "db critical", entry.Tags)
+		})
+
+		t.Run("captures no data behavior from rule", func(t *testing.T) {
+			rule := createTestRule()
+			rule.NoDataBehavior = "OK"
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "OK", entry.NoDataBehavior)
+		})
+
+		t.Run("captures whether the alert was muted", func(t *testing.T) {
+			rule := createTestRule()
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+			states[0].Muted = true
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.True(t, entry.Muted)
+		})
+
+		t.Run("captures grafana version", func(t *testing.T) {
+			prev := setting.BuildVersion
+			setting.BuildVersion = "10.1.0"
+			t.Cleanup(func() { setting.BuildVersion = prev })
+			rule := createTestRule()
+			l := log.NewNopLogger()
+			states := singleFromNormal(&state.State{
+				State:  eval.Alerting,
+				Labels: data.Labels{"a": "b"},
+			})
+
+			res := StatesToStream(rule, states, nil, l)
+
+			entry := requireSingleEntry(t, res)
+			require.Equal(t, "10.1.0", entry.GrafanaVersion)
+		})
+
 		t.Run("stores fingerprint of instance labels", func(t *testing.T) {
 			rule := createTestRule()
 			l := log.NewNopLogger()
@@ -186,7 +720,7 @@ func TestRemoteLokiBackend(t *testing.T) {
 			res := StatesToStream(rule, states, nil, l)
 
 			entry := requireSingleEntry(t, res)
-			exp := labelFingerprint(states[0].Labels)
+			exp := LabelFingerprint(states[0].Labels)
 			require.Equal(t, exp, entry.Fingerprint)
 		})
 	})
@@ -203,6 +737,21 @@ func TestRemoteLokiBackend(t *testing.T) {
 		require.Equal(t, expected, result)
 	})
 
+	t.Run("stream selector", func(t *testing.T) {
+		result, err := BuildStreamSelector(1)
+		require.NoError(t, err)
+		require.Equal(t, `{orgID="1",from="state-history"}`, result)
+
+		result, err = BuildStreamSelector(1, Selector{GroupLabel, Eq, "my-group"})
+		require.NoError(t, err)
+		require.Equal(t, `{orgID="1",from="state-history",group="my-group"}`, result)
+	})
+
+	t.Run("multi-org stream selector", func(t *testing.T) {
+		require.Equal(t, `{orgID=~"1|2|3",from="state-history"}`, BuildMultiOrgStreamSelector([]int64{1, 2, 3}))
+		require.Equal(t, `{orgID=~".+",from="state-history"}`, BuildMultiOrgStreamSelector(nil))
+	})
+
 	t.Run("new selector", func(t *testing.T) {
 		selector, err := NewSelector("label", "=", "value")
 		require.NoError(t, err)
@@ -278,6 +827,17 @@ func TestRemoteLokiBackend(t *testing.T) {
 				},
 				exp: `{orgID="123",from="state-history"} | json | ruleUID="rule-uid" | labels_customlabel="customvalue"`,
 			},
+			{
+				name: "filters rule annotations in log line",
+				query: models.HistoryQuery{
+					OrgID: 123,
+					Annotations: map[string]string{
+						"summary": "disk full",
+						"team":    "platform",
+					},
+				},
+				exp: `{orgID="123",from="state-history"} | json | customFields_summary="disk full" | customFields_team="platform"`,
+			},
 		}
 
 		for _, tc := range cases {
@@ -503,6 +1063,137 @@ grafana_alerting_state_history_writes_total{backend="loki",org="1"} 2
 		require.Contains(t, sent, "externalLabelKey")
 		require.Contains(t, sent, "externalLabelValue")
 	})
+
+	t.Run("adds node ID to log lines", func(t *testing.T) {
+		req := NewFakeRequester()
+		loki := createTestLokiBackend(req, metrics.NewHistorianMetrics(prometheus.NewRegistry(), metrics.Subsystem))
+		loki.nodeID = "node-1"
+		rule := createTestRule()
+		states := singleFromNormal(&state.State{
+			State: eval.Alerting,
+		})
+
+		err := <-loki.Record(context.Background(), rule, states)
+
+		require.NoError(t, err)
+		sent := string(readBody(t, req.lastRequest))
+		require.Contains(t, sent, `\"nodeID\":\"node-1\"`)
+	})
+
+	t.Run("adds cluster ID to log lines", func(t *testing.T) {
+		req := NewFakeRequester()
+		loki := createTestLokiBackend(req, metrics.NewHistorianMetrics(prometheus.NewRegistry(), metrics.Subsystem))
+		loki.clusterID = "cluster-1"
+		rule := createTestRule()
+		states := singleFromNormal(&state.State{
+			State: eval.Alerting,
+		})
+
+		err := <-loki.Record(context.Background(), rule, states)
+
+		require.NoError(t, err)
+		sent := string(readBody(t, req.lastRequest))
+		require.Contains(t, sent, `\"clusterID\":\"cluster-1\"`)
+	})
+
+	t.Run("adds region to log lines", func(t *testing.T) {
+		req := NewFakeRequester()
+		loki := createTestLokiBackend(req, metrics.NewHistorianMetrics(prometheus.NewRegistry(), metrics.Subsystem))
+		loki.region = "eu-west-1"
+		rule := createTestRule()
+		states := singleFromNormal(&state.State{
+			State: eval.Alerting,
+		})
+
+		err := <-loki.Record(context.Background(), rule, states)
+
+		require.NoError(t, err)
+		sent := string(readBody(t, req.lastRequest))
+		require.Contains(t, sent, `\"region\":\"eu-west-1\"`)
+	})
+}
+
+func TestRecordNotifications(t *testing.T) {
+	now := time.Now()
+	notifications := []history_model.Notification{
+		{
+			RuleUID:      "rule-uid",
+			FolderUID:    "my-folder",
+			Labels:       map[string]string{"a": "b", "__alert_rule_uid__": "rule-uid"},
+			DashboardUID: "dash-uid",
+			PanelID:      123,
+			ContactPoint: "my-contact-point",
+			ThrottleKey:  `{}:{alertname="a"}`,
+			Time:         now,
+		},
+		{
+			RuleUID:      "rule-uid",
+			FolderUID:    "my-folder",
+			Labels:       map[string]string{"a": "b"},
+			Resolved:     true,
+			ContactPoint: "my-contact-point",
+			Time:         now.Add(time.Minute),
+		},
+		{
+			RuleUID:      "other-rule-uid",
+			FolderUID:    "other-folder",
+			Labels:       map[string]string{"c": "d"},
+			ContactPoint: "other-contact-point",
+			Time:         now,
+		},
+	}
+
+	t.Run("builds a stream for each folder", func(t *testing.T) {
+		res := NotificationsToStreams(1, notifications, map[string]string{"externalLabelKey": "externalLabelValue"}, "node-1", log.NewNopLogger())
+
+		require.Len(t, res, 2)
+		require.Equal(t, map[string]string{
+			StateHistoryLabelKey: StateHistoryLabelValue,
+			OrgIDLabel:           "1",
+			FolderUIDLabel:       "my-folder",
+			"externalLabelKey":   "externalLabelValue",
+		}, res[0].Stream)
+		require.Len(t, res[0].Values, 2)
+		require.Equal(t, "other-folder", res[1].Stream[FolderUIDLabel])
+
+		firing := requireEntry(t, res[0].Values[0])
+		require.Equal(t, EntryTypeNotification, firing.Type)
+		require.Equal(t, "rule-uid", firing.RuleUID)
+		require.Equal(t, "my-contact-point", firing.ContactPoint)
+		require.Equal(t, `{}:{alertname="a"}`, firing.ThrottleKey)
+		require.Equal(t, eval.Alerting.String(), firing.Current)
+		require.Equal(t, "dash-uid", firing.DashboardUID)
+		require.Equal(t, int64(123), firing.PanelID)
+		require.Equal(t, "node-1", firing.NodeID)
+		require.Equal(t, map[string]string{"a": "b"}, firing.InstanceLabels, "private labels should be removed")
+		require.Equal(t, LabelFingerprint(data.Labels{"a": "b"}), firing.Fingerprint, "the fingerprint should be the one of the state transitions")
+
+		resolved := requireEntry(t, res[0].Values[1])
+		require.Equal(t, eval.Normal.String(), resolved.Current)
+		require.Equal(t, now.Add(time.Minute), res[0].Values[1].T)
+	})
+
+	t.Run("writes notifications to loki", func(t *testing.T) {
+		req := NewFakeRequester()
+		loki := createTestLokiBackend(req, metrics.NewHistorianMetrics(prometheus.NewRegistry(), metrics.Subsystem))
+
+		err := <-loki.RecordNotifications(context.Background(), 1, notifications)
+
+		require.NoError(t, err)
+		require.Contains(t, "/loki/api/v1/push", req.lastRequest.URL.Path)
+		sent := string(readBody(t, req.lastRequest))
+		require.Contains(t, sent, `\"contactPoint\":\"other-contact-point\"`)
+	})
+
+	t.Run("elides request if nothing to send", func(t *testing.T) {
+		req := NewFakeRequester()
+		loki := createTestLokiBackend(req, metrics.NewHistorianMetrics(prometheus.NewRegistry(), metrics.Subsystem))
+
+		err := <-loki.RecordNotifications(context.Background(), 1, nil)
+
+		require.NoError(t, err)
+		require.Nil(t, req.lastRequest)
+	})
 }
 
 func createTestLokiBackend(req client.Requester, met *metrics.Historian) *RemoteLokiBackend {
@@ -0,0 +1,21 @@
+package model
+
+import "time"
+
+// Notification is a notification about an alert instance that the Alertmanager sent to a contact point.
+type Notification struct {
+	RuleUID   string
+	FolderUID string
+	// Labels are the labels of the alert instance.
+	Labels       map[string]string
+	DashboardUID string
+	PanelID      int64
+	// Resolved is whether the notification was sent because the alert instance was resolved.
+	Resolved bool
+	// ContactPoint is the name of the contact point, the receiver of the notification policy that matched the alert.
+	ContactPoint string
+	// ThrottleKey is the key of the Alertmanager aggregation group that the notification was sent for. The group
+	// interval and repeat interval of the notification policy throttle the notifications of the group.
+	ThrottleKey string
+	Time        time.Time
+}
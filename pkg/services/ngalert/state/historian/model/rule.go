@@ -2,13 +2,71 @@ package model
 
 import (
 	"context"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/grafana/grafana/pkg/cmd/grafana-cli/logger"
+	"github.com/grafana/grafana/pkg/expr"
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/services/ngalert/models"
 )
 
+// NoteAnnotation is the name of the rule annotation that holds a free-form note about the rule.
+const NoteAnnotation = "note"
+
+// TeamAnnotation is the name of the rule annotation that holds the name of the team that owns the rule.
+const TeamAnnotation = "team"
+
+// ApplicationAnnotation is the name of the rule annotation that holds the name of the application that the rule
+// alerts on.
+const ApplicationAnnotation = "app"
+
+// TenantIDAnnotation is the name of the rule annotation that holds the ID of the tenant that owns the rule, in
+// multi-tenant setups where tenants share an org.
+const TenantIDAnnotation = "tenant_id"
+
+// ReconciliationIDAnnotation is the name of the rule annotation that holds the ID of the reconciliation run of an
+// infrastructure-as-code tool, such as Terraform or Crossplane, that last applied the rule.
+const ReconciliationIDAnnotation = "provisioning_reconciliation_id"
+
+// IncidentIDAnnotation is the name of the rule annotation that holds the ID of the incident that an external
+// incident management system declared for the rule.
+const IncidentIDAnnotation = "incident_id"
+
+// ServiceAnnotation is the name of the rule annotation that holds the name of the service that the rule alerts on.
+// Alert instances can also carry the service in a label of the same name.
+const ServiceAnnotation = "service"
+
+// PriorityAnnotation is the name of the rule annotation that holds the priority of the rule, such as P0.
+const PriorityAnnotation = "priority"
+
+// NamespaceAnnotation is the name of the rule annotation that holds the Kubernetes namespace that the rule alerts on.
+// Alert instances can also carry the namespace in a label of the same name.
+const NamespaceAnnotation = "namespace"
+
+// FeatureFlagAnnotation is the name of the rule annotation that holds the name of the feature flag whose changes
+// the rule is expected to catch.
+const FeatureFlagAnnotation = "grafana_feature_flag"
+
+// RunbookURLAnnotation is the name of the rule annotation that holds the URL of the runbook for the alerts of the rule.
+const RunbookURLAnnotation = "runbook_url"
+
+// OnCallPolicyAnnotation is the name of the rule annotation that holds the on-call policy that the alerts of the rule
+// are escalated to.
+const OnCallPolicyAnnotation = "on_call_policy"
+
+// TagsAnnotation is the name of the rule annotation that holds the user-defined tags of the rule, separated by
+// commas or whitespace.
+const TagsAnnotation = "tags"
+
+// RecordingRuleUIDAnnotation is the name of the rule annotation that holds the UID of the recording rule
+// whose output the rule is evaluated against.
+const RecordingRuleUIDAnnotation = "recording_rule_uid"
+
 // RuleMeta is the metadata about a rule that is needed by state history.
 type RuleMeta struct {
 	ID           int64
@@ -20,6 +78,60 @@ type RuleMeta struct {
 	DashboardUID string
 	PanelID      int64
 	Condition    string
+	Note         string
+	// Team is the name of the team that owns the rule, if any.
+	Team string
+	// Application is the name of the application that the rule alerts on, if any.
+	Application string
+	// TenantID identifies the tenant that owns the rule, if tenants share the org of the rule.
+	TenantID string
+	// ReconciliationID identifies the infrastructure-as-code reconciliation run that last applied the rule, if any.
+	ReconciliationID string
+	// IncidentID identifies the external incident that the rule is attached to, if any.
+	IncidentID string
+	// ServiceName is the name of the service that the rule alerts on, if the rule sets it. Otherwise, the service
+	// of each alert instance is taken from its labels.
+	ServiceName string
+	// Priority is the priority of the rule, such as P0, if any.
+	Priority string
+	// K8sNamespace is the Kubernetes namespace that the rule alerts on, if the rule sets it. Otherwise, the
+	// namespace of each alert instance is taken from its labels. It is unrelated to NamespaceUID.
+	K8sNamespace string
+	// FeatureFlag is the name of the feature flag that the rule is tied to, if any.
+	FeatureFlag string
+	// RunbookURL is the URL of the runbook for the alerts of the rule, if any.
+	RunbookURL string
+	// OnCallPolicy is the on-call policy that the alerts of the rule are escalated to, if any.
+	OnCallPolicy string
+	// RecordingRuleUID is the UID of the recording rule that the rule is evaluated against, if any.
+	RecordingRuleUID string
+	// PolicyRoute identifies the autogenerated notification policy that alerts of the rule are routed by, if the
+	// rule uses simplified routing. It is the fingerprint of the rule's notification settings.
+	PolicyRoute string
+	// EvaluationInterval is how often the rule is evaluated.
+	EvaluationInterval time.Duration
+	// PendingPeriod is how long alerts of the rule are pending before they fire.
+	PendingPeriod time.Duration
+	// Version is the version of the rule that was evaluated.
+	Version int64
+	// CustomFields are the free-form annotations of the rule, without the ones that Grafana reserves for
+	// itself or that are already part of the metadata.
+	CustomFields map[string]string
+	// GroupBy are the labels that alerts of the rule are grouped by in the Alertmanager, if the rule uses
+	// simplified routing and sets them. Otherwise, they are defined by the notification policy tree.
+	GroupBy []string
+	// ClusterID identifies the cluster of Grafana instances that evaluated the rule. NewRuleMeta does not set it,
+	// as it is part of the configuration of the Loki backend, which sets it when recording state history.
+	ClusterID string
+	// Region is the region of the Grafana instance that evaluated the rule. NewRuleMeta does not set it, as it is
+	// part of the configuration of the instance, which the Loki backend sets it from when recording state history.
+	Region string
+	// DatasourceUIDs are the UIDs of the data sources that the rule queries, sorted.
+	DatasourceUIDs []string
+	// NoDataBehavior is the state that the rule treats evaluations without data as: Alerting, NoData or OK.
+	NoDataBehavior string
+	// Tags are the user-defined tags of the rule, in the order that they are given in.
+	Tags []string
 }
 
 func NewRuleMeta(r *models.AlertRule, log log.Logger) RuleMeta {
@@ -36,16 +148,147 @@ func NewRuleMeta(r *models.AlertRule, log log.Logger) RuleMeta {
 		panelID = pid
 	}
 	return RuleMeta{
-		ID:           r.ID,
-		OrgID:        r.OrgID,
-		UID:          r.UID,
-		Title:        r.Title,
-		Group:        r.RuleGroup,
-		NamespaceUID: r.NamespaceUID,
-		DashboardUID: dashUID,
-		PanelID:      panelID,
-		Condition:    r.Condition,
+		ID:                 r.ID,
+		OrgID:              r.OrgID,
+		UID:                r.UID,
+		Title:              r.Title,
+		Group:              r.RuleGroup,
+		NamespaceUID:       r.NamespaceUID,
+		DashboardUID:       dashUID,
+		PanelID:            panelID,
+		Condition:          r.Condition,
+		Note:               r.Annotations[NoteAnnotation],
+		Team:               r.Annotations[TeamAnnotation],
+		Application:        r.Annotations[ApplicationAnnotation],
+		TenantID:           r.Annotations[TenantIDAnnotation],
+		ReconciliationID:   r.Annotations[ReconciliationIDAnnotation],
+		IncidentID:         r.Annotations[IncidentIDAnnotation],
+		ServiceName:        r.Annotations[ServiceAnnotation],
+		Priority:           r.Annotations[PriorityAnnotation],
+		K8sNamespace:       r.Annotations[NamespaceAnnotation],
+		FeatureFlag:        r.Annotations[FeatureFlagAnnotation],
+		RunbookURL:         r.Annotations[RunbookURLAnnotation],
+		OnCallPolicy:       r.Annotations[OnCallPolicyAnnotation],
+		RecordingRuleUID:   r.Annotations[RecordingRuleUIDAnnotation],
+		PolicyRoute:        policyRoute(r),
+		EvaluationInterval: time.Duration(r.IntervalSeconds) * time.Second,
+		PendingPeriod:      r.For,
+		Version:            r.Version,
+		CustomFields:       customFields(r),
+		DatasourceUIDs:     datasourceUIDs(r),
+		GroupBy:            groupBy(r),
+		NoDataBehavior:     string(r.NoDataState),
+		Tags:               tags(r),
+	}
+}
+
+// metaAnnotations are the rule annotations that RuleMeta has dedicated fields for.
+var metaAnnotations = map[string]struct{}{
+	NoteAnnotation:             {},
+	TeamAnnotation:             {},
+	ApplicationAnnotation:      {},
+	TenantIDAnnotation:         {},
+	ReconciliationIDAnnotation: {},
+	IncidentIDAnnotation:       {},
+	ServiceAnnotation:          {},
+	PriorityAnnotation:         {},
+	NamespaceAnnotation:        {},
+	FeatureFlagAnnotation:      {},
+	RunbookURLAnnotation:       {},
+	OnCallPolicyAnnotation:     {},
+	TagsAnnotation:             {},
+	RecordingRuleUIDAnnotation: {},
+}
+
+// maxCustomFields is the maximum number of free-form annotations of a rule that are kept as custom fields. Every
+// state history entry of the rule carries them, so they are capped to keep entries small.
+const maxCustomFields = 20
+
+// maxCustomFieldLength is the maximum length in bytes of the value of a custom field, longer values are truncated.
+const maxCustomFieldLength = 256
+
+// customFields returns the annotations of the rule that are neither reserved by Grafana nor have dedicated fields.
+// At most maxCustomFields annotations are returned, the first ones in alphabetical order of their names.
+func customFields(r *models.AlertRule) map[string]string {
+	keys := make([]string, 0, len(r.Annotations))
+	for k := range r.Annotations {
+		if strings.HasPrefix(k, "__") || strings.HasPrefix(k, models.GrafanaReservedLabelPrefix) {
+			continue
+		}
+		if _, ok := metaAnnotations[k]; ok {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	slices.Sort(keys)
+	if len(keys) > maxCustomFields {
+		keys = keys[:maxCustomFields]
+	}
+
+	fields := make(map[string]string, len(keys))
+	for _, k := range keys {
+		fields[k] = truncate(r.Annotations[k], maxCustomFieldLength)
+	}
+	return fields
+}
+
+// truncate shortens s to at most n bytes, without splitting a multi-byte character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// tags returns the user-defined tags of the rule, without duplicates.
+func tags(r *models.AlertRule) []string {
+	var res []string
+	for _, tag := range strings.FieldsFunc(r.Annotations[TagsAnnotation], func(c rune) bool {
+		return c == ',' || unicode.IsSpace(c)
+	}) {
+		if !slices.Contains(res, tag) {
+			res = append(res, tag)
+		}
+	}
+	return res
+}
+
+// policyRoute returns the fingerprint of the notification settings of the rule, which identifies the
+// autogenerated route that its alerts match, if the rule uses simplified routing.
+func policyRoute(r *models.AlertRule) string {
+	if len(r.NotificationSettings) == 0 {
+		return ""
+	}
+	return r.NotificationSettings[0].Fingerprint().String()
+}
+
+// groupBy returns the labels that alerts of the rule are grouped by, if the rule uses simplified routing.
+func groupBy(r *models.AlertRule) []string {
+	if len(r.NotificationSettings) == 0 {
+		return nil
+	}
+	return r.NotificationSettings[0].GroupBy
+}
+
+// datasourceUIDs returns the UIDs of the data sources that the rule queries, without expressions.
+func datasourceUIDs(r *models.AlertRule) []string {
+	var uids []string
+	for _, q := range r.Data {
+		if expr.NodeTypeFromDatasourceUID(q.DatasourceUID) != expr.TypeDatasourceNode {
+			continue
+		}
+		if !slices.Contains(uids, q.DatasourceUID) {
+			uids = append(uids, q.DatasourceUID)
+		}
 	}
+	slices.Sort(uids)
+	return uids
 }
 
 func WithRuleData(ctx context.Context, rule RuleMeta) context.Context {
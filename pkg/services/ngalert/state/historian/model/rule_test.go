@@ -1,10 +1,14 @@
 package model
 
 import (
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/grafana/grafana/pkg/expr"
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/services/ngalert/models"
 )
@@ -76,3 +80,263 @@ func TestNewRuleMeta(t *testing.T) {
 		})
 	}
 }
+
+func TestNewRuleMetaPolicyRoute(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	t.Run("empty without notification settings", func(t *testing.T) {
+		res := NewRuleMeta(&models.AlertRule{OrgID: 1}, logger)
+		require.Empty(t, res.PolicyRoute)
+	})
+
+	t.Run("fingerprint of notification settings", func(t *testing.T) {
+		settings := models.NotificationSettings{Receiver: "my-contact-point", GroupBy: []string{"alertname"}}
+		res := NewRuleMeta(&models.AlertRule{
+			OrgID:                1,
+			NotificationSettings: []models.NotificationSettings{settings},
+		}, logger)
+		require.Equal(t, settings.Fingerprint().String(), res.PolicyRoute)
+	})
+}
+
+func TestNewRuleMetaRecordingRuleUID(t *testing.T) {
+	res := NewRuleMeta(&models.AlertRule{
+		OrgID: 1,
+		Annotations: map[string]string{
+			RecordingRuleUIDAnnotation: "my-recording-rule",
+		},
+	}, log.NewNopLogger())
+	require.Equal(t, "my-recording-rule", res.RecordingRuleUID)
+}
+
+func TestNewRuleMetaTeam(t *testing.T) {
+	res := NewRuleMeta(&models.AlertRule{
+		OrgID: 1,
+		Annotations: map[string]string{
+			TeamAnnotation: "platform",
+		},
+	}, log.NewNopLogger())
+	require.Equal(t, "platform", res.Team)
+}
+
+func TestNewRuleMetaApplication(t *testing.T) {
+	res := NewRuleMeta(&models.AlertRule{
+		OrgID: 1,
+		Annotations: map[string]string{
+			ApplicationAnnotation: "checkout",
+		},
+	}, log.NewNopLogger())
+	require.Equal(t, "checkout", res.Application)
+}
+
+func TestNewRuleMetaTenantID(t *testing.T) {
+	res := NewRuleMeta(&models.AlertRule{
+		OrgID: 1,
+		Annotations: map[string]string{
+			TenantIDAnnotation: "tenant-a",
+		},
+	}, log.NewNopLogger())
+	require.Equal(t, "tenant-a", res.TenantID)
+}
+
+func TestNewRuleMetaReconciliationID(t *testing.T) {
+	res := NewRuleMeta(&models.AlertRule{
+		OrgID: 1,
+		Annotations: map[string]string{
+			ReconciliationIDAnnotation: "run-1",
+		},
+	}, log.NewNopLogger())
+	require.Equal(t, "run-1", res.ReconciliationID)
+}
+
+func TestNewRuleMetaIncidentID(t *testing.T) {
+	res := NewRuleMeta(&models.AlertRule{
+		OrgID: 1,
+		Annotations: map[string]string{
+			IncidentIDAnnotation: "INC-1",
+		},
+	}, log.NewNopLogger())
+	require.Equal(t, "INC-1", res.IncidentID)
+}
+
+func TestNewRuleMetaServiceName(t *testing.T) {
+	res := NewRuleMeta(&models.AlertRule{
+		OrgID: 1,
+		Annotations: map[string]string{
+			ServiceAnnotation: "checkout",
+		},
+	}, log.NewNopLogger())
+	require.Equal(t, "checkout", res.ServiceName)
+}
+
+func TestNewRuleMetaPriority(t *testing.T) {
+	res := NewRuleMeta(&models.AlertRule{
+		OrgID: 1,
+		Annotations: map[string]string{
+			PriorityAnnotation: "P0",
+		},
+	}, log.NewNopLogger())
+	require.Equal(t, "P0", res.Priority)
+}
+
+func TestNewRuleMetaK8sNamespace(t *testing.T) {
+	res := NewRuleMeta(&models.AlertRule{
+		OrgID: 1,
+		Annotations: map[string]string{
+			NamespaceAnnotation: "monitoring",
+		},
+	}, log.NewNopLogger())
+	require.Equal(t, "monitoring", res.K8sNamespace)
+}
+
+func TestNewRuleMetaFeatureFlag(t *testing.T) {
+	res := NewRuleMeta(&models.AlertRule{
+		OrgID: 1,
+		Annotations: map[string]string{
+			FeatureFlagAnnotation: "newCheckout",
+		},
+	}, log.NewNopLogger())
+	require.Equal(t, "newCheckout", res.FeatureFlag)
+	require.Nil(t, res.CustomFields)
+}
+
+func TestNewRuleMetaRunbookURL(t *testing.T) {
+	res := NewRuleMeta(&models.AlertRule{
+		OrgID: 1,
+		Annotations: map[string]string{
+			RunbookURLAnnotation: "https://runbooks.example.com/db",
+		},
+	}, log.NewNopLogger())
+	require.Equal(t, "https://runbooks.example.com/db", res.RunbookURL)
+	require.Nil(t, res.CustomFields)
+}
+
+func TestNewRuleMetaOnCallPolicy(t *testing.T) {
+	res := NewRuleMeta(&models.AlertRule{
+		OrgID: 1,
+		Annotations: map[string]string{
+			OnCallPolicyAnnotation: "primary-sre",
+		},
+	}, log.NewNopLogger())
+	require.Equal(t, "primary-sre", res.OnCallPolicy)
+}
+
+func TestNewRuleMetaEvaluationInterval(t *testing.T) {
+	res := NewRuleMeta(&models.AlertRule{OrgID: 1, IntervalSeconds: 60}, log.NewNopLogger())
+	require.Equal(t, time.Minute, res.EvaluationInterval)
+}
+
+func TestNewRuleMetaPendingPeriod(t *testing.T) {
+	res := NewRuleMeta(&models.AlertRule{OrgID: 1, For: 5 * time.Minute}, log.NewNopLogger())
+	require.Equal(t, 5*time.Minute, res.PendingPeriod)
+}
+
+func TestNewRuleMetaVersion(t *testing.T) {
+	res := NewRuleMeta(&models.AlertRule{OrgID: 1, Version: 3}, log.NewNopLogger())
+	require.Equal(t, int64(3), res.Version)
+}
+
+func TestNewRuleMetaNoDataBehavior(t *testing.T) {
+	res := NewRuleMeta(&models.AlertRule{OrgID: 1, NoDataState: models.OK}, log.NewNopLogger())
+	require.Equal(t, "OK", res.NoDataBehavior)
+}
+
+func TestNewRuleMetaCustomFields(t *testing.T) {
+	t.Run("captures free-form annotations", func(t *testing.T) {
+		rule := &models.AlertRule{OrgID: 1, Annotations: map[string]string{
+			"summary":                         "disk full",
+			"severity":                        "critical",
+			TeamAnnotation:                    "platform",
+			RunbookURLAnnotation:              "http://runbook",
+			TagsAnnotation:                    "db",
+			NoteAnnotation:                    "a note",
+			RecordingRuleUIDAnnotation:        "recording-rule",
+			models.DashboardUIDAnnotation:     "dashboard",
+			models.PanelIDAnnotation:          "1",
+			models.GrafanaReservedLabelPrefix: "reserved",
+		}}
+
+		res := NewRuleMeta(rule, log.NewNopLogger())
+
+		require.Equal(t, map[string]string{"summary": "disk full", "severity": "critical"}, res.CustomFields)
+	})
+
+	t.Run("keeps at most maxCustomFields annotations", func(t *testing.T) {
+		rule := &models.AlertRule{OrgID: 1, Annotations: map[string]string{}}
+		for i := 0; i < maxCustomFields+5; i++ {
+			rule.Annotations[fmt.Sprintf("field_%02d", i)] = "value"
+		}
+
+		res := NewRuleMeta(rule, log.NewNopLogger())
+
+		require.Len(t, res.CustomFields, maxCustomFields)
+		require.Contains(t, res.CustomFields, "field_00")
+		require.NotContains(t, res.CustomFields, fmt.Sprintf("field_%02d", maxCustomFields))
+	})
+
+	t.Run("truncates long values", func(t *testing.T) {
+		rule := &models.AlertRule{OrgID: 1, Annotations: map[string]string{
+			"description": strings.Repeat("a", maxCustomFieldLength-1) + "é",
+		}}
+
+		res := NewRuleMeta(rule, log.NewNopLogger())
+
+		require.Equal(t, strings.Repeat("a", maxCustomFieldLength-1), res.CustomFields["description"])
+	})
+
+	t.Run("is nil without free-form annotations", func(t *testing.T) {
+		res := NewRuleMeta(&models.AlertRule{OrgID: 1}, log.NewNopLogger())
+
+		require.Nil(t, res.CustomFields)
+	})
+}
+
+func TestNewRuleMetaDatasourceUIDs(t *testing.T) {
+	rule := &models.AlertRule{OrgID: 1, Data: []models.AlertQuery{
+		{RefID: "A", DatasourceUID: "prometheus"},
+		{RefID: "B", DatasourceUID: "loki"},
+		{RefID: "C", DatasourceUID: "prometheus"},
+		{RefID: "D", DatasourceUID: expr.DatasourceUID},
+	}}
+
+	res := NewRuleMeta(rule, log.NewNopLogger())
+
+	require.Equal(t, []string{"loki", "prometheus"}, res.DatasourceUIDs)
+}
+
+func TestNewRuleMetaTags(t *testing.T) {
+	t.Run("splits tags by commas and whitespace", func(t *testing.T) {
+		rule := &models.AlertRule{OrgID: 1, Annotations: map[string]string{
+			TagsAnnotation: "db, critical backend,,db",
+		}}
+
+		res := NewRuleMeta(rule, log.NewNopLogger())
+
+		require.Equal(t, []string{"db", "critical", "backend"}, res.Tags)
+	})
+
+	t.Run("is nil without tags", func(t *testing.T) {
+		res := NewRuleMeta(&models.AlertRule{OrgID: 1}, log.NewNopLogger())
+
+		require.Nil(t, res.Tags)
+	})
+}
+
+func TestNewRuleMetaGroupBy(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	t.Run("empty without notification settings", func(t *testing.T) {
+		res := NewRuleMeta(&models.AlertRule{OrgID: 1}, logger)
+		require.Empty(t, res.GroupBy)
+	})
+
+	t.Run("group by of notification settings", func(t *testing.T) {
+		res := NewRuleMeta(&models.AlertRule{
+			OrgID: 1,
+			NotificationSettings: []models.NotificationSettings{
+				{Receiver: "my-contact-point", GroupBy: []string{"alertname", "grafana_folder", "team"}},
+			},
+		}, logger)
+		require.Equal(t, []string{"alertname", "grafana_folder", "team"}, res.GroupBy)
+	})
+}
@@ -14,6 +14,11 @@ type Backend interface {
 	Query(ctx context.Context, query ngmodels.HistoryQuery) (*data.Frame, error)
 }
 
+// NotificationBackend is a Backend that also records the notifications that are sent to contact points.
+type NotificationBackend interface {
+	RecordNotifications(ctx context.Context, orgID int64, notifications []history_model.Notification) <-chan error
+}
+
 // MultipleBackend is a state.Historian that records history to multiple backends at once.
 // Only one backend is used for reads. The backend selected for read traffic is called the primary and all others are called secondaries.
 type MultipleBackend struct {
@@ -33,6 +38,22 @@ func (h *MultipleBackend) Record(ctx context.Context, rule history_model.RuleMet
 	for _, b := range append([]Backend{h.primary}, h.secondaries...) {
 		jobs = append(jobs, b.Record(ctx, rule, states))
 	}
+	return joinJobs(jobs)
+}
+
+// RecordNotifications records the notifications to all backends that support it.
+func (h *MultipleBackend) RecordNotifications(ctx context.Context, orgID int64, notifications []history_model.Notification) <-chan error {
+	jobs := make([]<-chan error, 0, len(h.secondaries)+1)
+	for _, b := range append([]Backend{h.primary}, h.secondaries...) {
+		if nb, ok := b.(NotificationBackend); ok {
+			jobs = append(jobs, nb.RecordNotifications(ctx, orgID, notifications))
+		}
+	}
+	return joinJobs(jobs)
+}
+
+// joinJobs returns a channel that is closed once all jobs have completed, with the errors of all jobs joined.
+func joinJobs(jobs []<-chan error) <-chan error {
 	errCh := make(chan error, 1)
 	go func() {
 		defer close(errCh)
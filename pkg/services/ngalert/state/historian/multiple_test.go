@@ -41,6 +41,20 @@ func TestMultipleBackend(t *testing.T) {
 		require.NotEmpty(t, three.last)
 	})
 
+	t.Run("notifications dispatch to all backends that record them", func(t *testing.T) {
+		one := &fakeNotificationBackend{}
+		two := &fakeBackend{}
+		three := &fakeNotificationBackend{}
+		fan := NewMultipleBackend(one, two, three)
+		notifications := []history_model.Notification{{RuleUID: "rule-uid"}}
+
+		err := <-fan.RecordNotifications(context.Background(), 1, notifications)
+
+		require.NoError(t, err)
+		require.Equal(t, notifications, one.notifications)
+		require.Equal(t, notifications, three.notifications)
+	})
+
 	t.Run("writes combine errors", func(t *testing.T) {
 		one := &fakeBackend{err: fmt.Errorf("error one")}
 		two := &fakeBackend{err: fmt.Errorf("error two")}
@@ -73,6 +87,18 @@ func (f *fakeBackend) Record(ctx context.Context, rule history_model.RuleMeta, s
 	return ch
 }
 
+type fakeNotificationBackend struct {
+	fakeBackend
+	notifications []history_model.Notification
+}
+
+func (f *fakeNotificationBackend) RecordNotifications(ctx context.Context, orgID int64, notifications []history_model.Notification) <-chan error {
+	ch := make(chan error, 1)
+	f.notifications = notifications
+	close(ch)
+	return ch
+}
+
 func (f *fakeBackend) Query(ctx context.Context, query ngmodels.HistoryQuery) (*data.Frame, error) {
 	return f.resp, f.err
 }
@@ -46,6 +46,7 @@ type Manager struct {
 	instanceStore InstanceStore
 	images        ImageCapturer
 	historian     Historian
+	muteChecker   MuteChecker
 	externalURL   *url.URL
 
 	doNotSaveNormalState           bool
@@ -62,6 +63,8 @@ type ManagerCfg struct {
 	Images        ImageCapturer
 	Clock         clock.Clock
 	Historian     Historian
+	// MuteChecker, if set, is used to record whether the notifications of alerts were muted when their state changed.
+	MuteChecker MuteChecker
 	// DoNotSaveNormalState controls whether eval.Normal state is persisted to the database and returned by get methods
 	DoNotSaveNormalState bool
 	// MaxStateSaveConcurrency controls the number of goroutines (per rule) that can save alert state in parallel.
@@ -90,6 +93,7 @@ func NewManager(cfg ManagerCfg, statePersister StatePersister) *Manager {
 		instanceStore:                  cfg.InstanceStore,
 		images:                         cfg.Images,
 		historian:                      cfg.Historian,
+		muteChecker:                    cfg.MuteChecker,
 		clock:                          cfg.Clock,
 		externalURL:                    cfg.ExternalURL,
 		doNotSaveNormalState:           cfg.DoNotSaveNormalState,
@@ -275,6 +279,7 @@ func (st *Manager) ResetStateByRuleUID(ctx context.Context, rule *ngModels.Alert
 		return transitions
 	}
 
+	st.markMuted(rule.OrgID, transitions, st.clock.Now())
 	ruleMeta := history_model.NewRuleMeta(rule, st.log)
 	errCh := st.historian.Record(ctx, ruleMeta, transitions)
 	go func() {
@@ -310,11 +315,24 @@ func (st *Manager) ProcessEvalResults(ctx context.Context, evaluatedAt time.Time
 
 	allChanges := append(states, staleStates...)
 	if st.historian != nil {
+		st.markMuted(alertRule.OrgID, allChanges, evaluatedAt)
 		st.historian.Record(tracingCtx, history_model.NewRuleMeta(alertRule, logger), allChanges)
 	}
 	return allChanges
 }
 
+// markMuted records whether the notifications of the alerts whose state changed were muted at the given time.
+func (st *Manager) markMuted(orgID int64, transitions []StateTransition, at time.Time) {
+	if st.muteChecker == nil {
+		return
+	}
+	for i := range transitions {
+		if transitions[i].Changed() {
+			transitions[i].Muted = st.muteChecker.Muted(orgID, transitions[i].Labels, at)
+		}
+	}
+}
+
 func (st *Manager) setNextStateForRule(ctx context.Context, alertRule *ngModels.AlertRule, results eval.Results, extraLabels data.Labels, logger log.Logger) []StateTransition {
 	if st.applyNoDataAndErrorToAllStates && results.IsNoData() && (alertRule.NoDataState == ngModels.Alerting || alertRule.NoDataState == ngModels.OK) { // If it is no data, check the mapping and switch all results to the new state
 		// TODO aggregate UID of datasources that returned NoData into one and provide as auxiliary info, probably annotation
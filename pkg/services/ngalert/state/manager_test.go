@@ -1414,6 +1414,61 @@ func printAllAnnotations(annos map[int64]annotations.Item) string {
 	return b.String()
 }
 
+func TestProcessEvalResultsMuted(t *testing.T) {
+	clk := clock.NewMock()
+	historian := &state.FakeHistorian{}
+	muteChecker := &fakeMuteChecker{}
+	cfg := state.ManagerCfg{
+		Metrics:       metrics.NewNGAlert(prometheus.NewPedanticRegistry()).GetStateMetrics(),
+		InstanceStore: &state.FakeInstanceStore{},
+		Images:        &state.NoopImageService{},
+		Clock:         clk,
+		Historian:     historian,
+		MuteChecker:   muteChecker,
+		Tracer:        tracing.InitializeTracerForTest(),
+		Log:           log.New("ngalert.state.manager"),
+	}
+	st := state.NewManager(cfg, state.NewNoopPersister())
+
+	rule := models.AlertRuleGen(models.WithFor(0))()
+	results := eval.Results{
+		eval.ResultGen(eval.WithState(eval.Alerting), eval.WithLabels(data.Labels{"team": "a"}), eval.WithEvaluatedAt(clk.Now()))(),
+		eval.ResultGen(eval.WithState(eval.Alerting), eval.WithLabels(data.Labels{"team": "b"}), eval.WithEvaluatedAt(clk.Now()))(),
+	}
+
+	st.ProcessEvalResults(context.Background(), clk.Now(), rule, results, nil)
+
+	require.Len(t, historian.StateTransitions, 2)
+	for _, transition := range historian.StateTransitions {
+		require.Equal(t, transition.Labels["team"] == "a", transition.Muted, transition.Labels["team"])
+	}
+	require.Equal(t, rule.OrgID, muteChecker.orgID)
+	require.Equal(t, clk.Now(), muteChecker.at)
+
+	t.Run("is not checked for alerts whose state did not change", func(t *testing.T) {
+		historian.StateTransitions = nil
+		muteChecker.calls = 0
+
+		st.ProcessEvalResults(context.Background(), clk.Now(), rule, results, nil)
+
+		require.Len(t, historian.StateTransitions, 2)
+		require.Zero(t, muteChecker.calls)
+	})
+}
+
+type fakeMuteChecker struct {
+	calls int
+	orgID int64
+	at    time.Time
+}
+
+func (c *fakeMuteChecker) Muted(orgID int64, labels data.Labels, at time.Time) bool {
+	c.calls++
+	c.orgID = orgID
+	c.at = at
+	return labels["team"] == "a"
+}
+
 func TestStaleResultsHandler(t *testing.T) {
 	evaluationTime := time.Now()
 	interval := time.Minute
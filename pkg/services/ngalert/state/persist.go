@@ -2,6 +2,9 @@ package state
 
 import (
 	"context"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 
 	"github.com/grafana/grafana/pkg/services/ngalert/models"
 	history_model "github.com/grafana/grafana/pkg/services/ngalert/state/historian/model"
@@ -30,6 +33,13 @@ type Historian interface {
 	Record(ctx context.Context, rule history_model.RuleMeta, states []StateTransition) <-chan error
 }
 
+// MuteChecker tells whether the notifications of alerts are muted by the time intervals of the notification
+// policies that route them.
+type MuteChecker interface {
+	// Muted reports whether the notifications of an alert of an org with the given labels are muted at the given time.
+	Muted(orgID int64, labels data.Labels, at time.Time) bool
+}
+
 // ImageCapturer captures images.
 //
 //go:generate mockgen -destination=image_mock.go -package=state github.com/grafana/grafana/pkg/services/ngalert/state ImageCapturer
@@ -157,6 +157,9 @@ type StateTransition struct {
 	*State
 	PreviousState       eval.State
 	PreviousStateReason string
+	// Muted is whether notifications of the alert were muted by the time intervals of its notification policies
+	// when the transition happened. It is only set if the state manager has a MuteChecker.
+	Muted bool
 }
 
 func (c StateTransition) Formatted() string {
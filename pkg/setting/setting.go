@@ -99,6 +99,7 @@ type Cfg struct {
 	AppURL           string
 	AppSubURL        string
 	InstanceName     string
+	InstanceRegion   string
 	ServeFromSubPath bool
 	StaticRootPath   string
 	Protocol         Scheme
@@ -1070,6 +1071,7 @@ func (cfg *Cfg) parseINIFile(iniFile *ini.File) error {
 	//nolint:staticcheck
 	cfg.ForceMigration = iniFile.Section("").Key("force_migration").MustBool(false)
 	cfg.InstanceName = valueAsString(iniFile.Section(""), "instance_name", "unknown_instance_name")
+	cfg.InstanceRegion = valueAsString(iniFile.Section(""), "instance_region", "")
 	plugins := valueAsString(iniFile.Section("paths"), "plugins", "")
 	cfg.PluginsPath = makeAbsolute(plugins, cfg.HomePath)
 	cfg.BundledPluginsPath = makeAbsolute("plugins-bundled", cfg.HomePath)
@@ -138,6 +138,22 @@ type UnifiedAlertingStateHistorySettings struct {
 	MultiPrimary          string
 	MultiSecondaries      []string
 	ExternalLabels        map[string]string
+	// NodeID identifies the Grafana instance that records state history. It is the instance name.
+	NodeID string
+	// ClusterName identifies the cluster of Grafana instances that records state history, in setups with
+	// multiple clusters writing to the same Loki instance.
+	ClusterName string
+	// Region is the region of the Grafana instance that records state history. It is the instance region.
+	Region string
+	// LokiTenantIDMode determines the Loki tenant of each org, it is one of "fixed", "org_id" or "org_name".
+	LokiTenantIDMode string
+	// LokiTLSCertFile and LokiTLSKeyFile are the client certificate and key presented to Loki, for mutual TLS.
+	LokiTLSCertFile string
+	LokiTLSKeyFile  string
+	// LokiTLSCAFile is the CA certificate that the certificate of Loki is verified with.
+	LokiTLSCAFile string
+	// LokiEncryptionKey is the base64 encoded AES-256 key that log lines are encrypted with before they are pushed to Loki.
+	LokiEncryptionKey string
 }
 
 type UnifiedAlertingUpgradeSettings struct {
@@ -368,9 +384,17 @@ func (cfg *Cfg) ReadUnifiedAlertingSettings(iniFile *ini.File) error {
 		LokiTenantID:          stateHistory.Key("loki_tenant_id").MustString(""),
 		LokiBasicAuthUsername: stateHistory.Key("loki_basic_auth_username").MustString(""),
 		LokiBasicAuthPassword: stateHistory.Key("loki_basic_auth_password").MustString(""),
+		LokiTenantIDMode:      stateHistory.Key("loki_tenant_id_mode").MustString("fixed"),
+		LokiTLSCertFile:       stateHistory.Key("loki_tls_cert_file").MustString(""),
+		LokiTLSKeyFile:        stateHistory.Key("loki_tls_key_file").MustString(""),
+		LokiTLSCAFile:         stateHistory.Key("loki_tls_ca_file").MustString(""),
+		LokiEncryptionKey:     stateHistory.Key("loki_encryption_key").MustString(""),
 		MultiPrimary:          stateHistory.Key("primary").MustString(""),
 		MultiSecondaries:      splitTrim(stateHistory.Key("secondaries").MustString(""), ","),
 		ExternalLabels:        stateHistoryLabels.KeysHash(),
+		NodeID:                cfg.InstanceName,
+		ClusterName:           stateHistory.Key("cluster_name").MustString(""),
+		Region:                cfg.InstanceRegion,
 	}
 	uaCfg.StateHistory = uaCfgStateHistory
 